@@ -0,0 +1,118 @@
+// Package endpoint decides turn-taking for the peer: given a stream of
+// voice activity decisions, one per VAD window, where the caller's
+// utterances start and end. It knows nothing of WebRTC, Opus or the
+// session's buffers, so strategies can be built and exercised on their own.
+package endpoint
+
+// Event is an Endpointer's verdict on one VAD window.
+type Event int
+
+const (
+	// None: the window is outside any utterance, or in a held one's gap,
+	// whose audio isn't kept.
+	None Event = iota
+	// Start: a new utterance begins with this window.
+	Start
+	// Continue: the window belongs to the utterance in progress, resuming
+	// it if it was held.
+	Continue
+	// Hold: the window is the utterance's last for now, but it is held
+	// open rather than ended, in case more speech follows.
+	Hold
+	// End: the utterance is finished and goes to the transcriber; the
+	// window is its last unless the utterance was being held.
+	End
+	// Abort: the utterance in progress is discarded.
+	Abort
+)
+
+func (e Event) String() string {
+	switch e {
+	case Start:
+		return "start"
+	case Continue:
+		return "continue"
+	case Hold:
+		return "hold"
+	case End:
+		return "end"
+	case Abort:
+		return "abort"
+	}
+	return "none"
+}
+
+// Endpointer decides where utterances start and end. Feed is called once
+// per VAD window, in order, from one goroutine, with the smoothed VAD
+// decision; frame is empty, and isSpeech false, for a window whose packet
+// decoded to nothing. Each call has its own. The caller does the rest:
+// buffering, barge-in, the speech timeline and filtering out blips.
+type Endpointer interface {
+	Feed(frame []int16, isSpeech bool) Event
+}
+
+// Resetter is implemented by stateful Endpointers. Reset is called when
+// the caller ends or drops an utterance itself, on a flush, abort or mute,
+// so the next window starts from a clean slate.
+type Resetter interface {
+	Reset()
+}
+
+// Silence is the default Endpointer: an utterance starts on speech and ends
+// after a run of trailing silence. With coalescing, it is held a further
+// while first, and speech resuming in that time carries it on; the gap's
+// audio isn't kept, only the silence that ended it.
+type Silence struct {
+	silenceFrames int // trailing silence that ends an utterance
+	holdFrames    int // silence that ends a held one; 0 when not coalescing
+
+	inSpeech      bool
+	holding       bool
+	silenceStreak int
+}
+
+// NewSilence returns a Silence that ends utterances after silenceMs of
+// silence, holding them a further coalesceMs (none when 0), for VAD windows
+// frameMs long. Durations round up to whole windows.
+func NewSilence(silenceMs, coalesceMs, frameMs int) *Silence {
+	e := &Silence{silenceFrames: (silenceMs + frameMs - 1) / frameMs}
+	if coalesceMs > 0 {
+		e.holdFrames = (silenceMs + coalesceMs + frameMs - 1) / frameMs
+	}
+	return e
+}
+
+func (e *Silence) Feed(_ []int16, isSpeech bool) Event {
+	if isSpeech {
+		e.silenceStreak = 0
+		if e.inSpeech || e.holding {
+			e.inSpeech, e.holding = true, false
+			return Continue
+		}
+		e.inSpeech = true
+		return Start
+	}
+	e.silenceStreak++
+	switch {
+	case e.holding:
+		if e.silenceStreak >= e.holdFrames {
+			e.holding = false
+			return End
+		}
+		return None
+	case !e.inSpeech:
+		return None
+	case e.silenceStreak < e.silenceFrames:
+		return Continue
+	}
+	e.inSpeech = false
+	if e.holdFrames > 0 {
+		e.holding = true
+		return Hold
+	}
+	return End
+}
+
+func (e *Silence) Reset() {
+	e.inSpeech, e.holding, e.silenceStreak = false, false, 0
+}
@@ -0,0 +1,58 @@
+package endpoint
+
+import (
+	"strings"
+	"testing"
+)
+
+// eventCodes abbreviates events in the table below, one letter a window.
+var eventCodes = map[Event]byte{None: 'N', Start: 'S', Continue: 'C', Hold: 'H', End: 'E', Abort: 'A'}
+
+func TestSilence(t *testing.T) {
+	const frameMs = 20
+	for _, tc := range []struct {
+		name                  string
+		silenceMs, coalesceMs int
+		// windows has one character per VAD window: 's' speech, '.'
+		// silence. '|' resets the endpointer, as the session does when
+		// it ends or drops an utterance itself.
+		windows string
+		want    string
+	}{
+		{"silence", 60, 0, "......", "NNNNNN"},
+		// Blips reach End; dropping ones too short to keep is the
+		// caller's job.
+		{"short blip", 60, 0, "s....", "SCCEN"},
+		{"pause inside speech", 60, 0, "ss..ss....", "SCCCCCCCEN"},
+		{"ends after the silence", 60, 0, "ss...ss...", "SCCCESCCCE"},
+		{"silence rounds up to a window", 50, 0, "s...", "SCCE"},
+		{"pause held to coalesce", 60, 40, "ss...ss......", "SCCCHCCCCHNEN"},
+		{"held too long", 60, 40, "s.......s", "SCCHNENNS"},
+		// Speech never ends on its own; a caller cutting off a long
+		// utterance resets, and speech after that is a new utterance.
+		{"max-utterance cutoff", 60, 0, "ssssssss|ss...", "SCCCCCCCSCCCE"},
+		{"trailing flush", 60, 0, "ss.|....s", "SCCNNNNS"},
+		{"flush while held", 60, 40, "s...|......s", "SCCHNNNNNNS"},
+	} {
+		e := NewSilence(tc.silenceMs, tc.coalesceMs, frameMs)
+		var got strings.Builder
+		for _, w := range tc.windows {
+			if w == '|' {
+				e.Reset()
+				continue
+			}
+			got.WriteByte(eventCodes[e.Feed(nil, w == 's')])
+		}
+		if got.String() != tc.want {
+			t.Errorf("%s: %s gave %s, want %s", tc.name, tc.windows, got.String(), tc.want)
+		}
+	}
+}
+
+func TestEventString(t *testing.T) {
+	for ev, want := range map[Event]string{None: "none", Start: "start", Continue: "continue", Hold: "hold", End: "end", Abort: "abort"} {
+		if got := ev.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", ev, got, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+)
+
+// Transcriber converts a finished utterance into text. pcm is the
+// transcriber's own; it may keep it after Transcribe returns.
+type Transcriber interface {
+	Transcribe(ctx context.Context, pcm []int16, sampleRate int, opts TranscribeOptions) (Transcription, error)
+}
+
+// BorrowingTranscriber is implemented by transcribers that are done with
+// pcm once Transcribe returns. When BorrowsPCM reports true, utterances are
+// passed in the peer's pooled buffer, which is recycled for a later
+// utterance after Transcribe returns, rather than copied for each turn.
+type BorrowingTranscriber interface {
+	Transcriber
+	BorrowsPCM() bool
+}
+
+// Transcription is a transcriber's result for one utterance. Only Text is
+// required.
+type Transcription struct {
+	Text string
+	// Language is the BCP 47 tag, such as "fr", of the language the
+	// transcriber detected. Whenever it differs from the one last detected
+	// on the call, the caller is sent a "language_detected" message ahead
+	// of the transcript. Empty if the transcriber doesn't detect it.
+	Language string
+	// Words are the transcriber's word timings, if it times words; they
+	// are relayed with the transcript.
+	Words []WordTiming
+}
+
+// FloatTranscriber is a Transcriber variant for models that take float32
+// PCM normalized to [-1, 1] rather than int16. Wrap one with FloatPCM to
+// use it as the peer's transcriber.
+type FloatTranscriber interface {
+	TranscribeFloat(ctx context.Context, pcm []float32, sampleRate int, opts TranscribeOptions) (Transcription, error)
+}
+
+// FloatPCM adapts t to a Transcriber, converting each utterance with
+// float32PCM on the way in.
+func FloatPCM(t FloatTranscriber) Transcriber {
+	return floatTranscriber{t}
+}
+
+// StreamingTranscriber is implemented by transcribers that can take an
+// utterance as it is spoken. Once an utterance grows past
+// Config.StreamChunkMs, the peer opens a stream and sends it the audio in
+// chunks of that size, so the utterance buffer stays about one chunk long
+// however long the caller talks. Shorter utterances still go to Transcribe
+// whole. Cancelling ctx abandons the utterance, e.g. when it turns out to
+// be too quiet to transcribe; Close is still called.
+type StreamingTranscriber interface {
+	TranscribeStream(ctx context.Context, sampleRate int, opts TranscribeOptions) (TranscribeStream, error)
+}
+
+// TranscribeStream is one utterance being streamed to a transcriber.
+type TranscribeStream interface {
+	// Send adds the next chunk of the utterance's audio.
+	Send(pcm []int16) error
+	// Close ends the utterance and returns its transcription.
+	Close() (Transcription, error)
+}
+
+type floatTranscriber struct{ t FloatTranscriber }
+
+func (f floatTranscriber) Transcribe(ctx context.Context, pcm []int16, sampleRate int, opts TranscribeOptions) (Transcription, error) {
+	return f.t.TranscribeFloat(ctx, float32PCM(pcm), sampleRate, opts)
+}
+
+// BorrowsPCM reports true: the float transcriber gets its own converted
+// copy, so the int16 buffer is free once the conversion is done.
+func (floatTranscriber) BorrowsPCM() bool { return true }
+
+// TranscribeOptions carries per-session hints for the speech-to-text
+// backend. The zero value asks for its defaults.
+type TranscribeOptions struct {
+	// Language is the BCP 47 tag the caller is expected to speak, e.g.
+	// "en-US". Empty means unspecified: let the backend detect it.
+	Language string
+	// Segments marks the utterances in audio batched per
+	// Config.MinTranscribeMs, in order. It is nil for a single utterance.
+	Segments []Segment
+}
+
+// Agent produces the spoken reply to a user's turn.
+type Agent interface {
+	Respond(ctx context.Context, transcript string) (string, error)
+}
+
+// PauseListener is implemented by agents that want to hear about a pause
+// within the caller's utterance: silence of Config.PauseMs that is still
+// too short to end it. The utterance stays open; the agent may use the hint
+// to prompt, or ignore it.
+type PauseListener interface {
+	Paused(ctx context.Context, silence time.Duration)
+}
+
+// CheckpointListener is implemented by agents that want to hear a long
+// turn before it ends: at a pause within it, once Config.CheckpointMs more
+// has been said, the utterance so far is transcribed and handed over. The
+// final transcript still follows, and ctx is cancelled when the utterance
+// ends.
+type CheckpointListener interface {
+	Checkpoint(ctx context.Context, transcript string)
+}
+
+// Transcript is the payload relayed to the remote peer for each final
+// transcription, under the "transcript" key of a signal's data.
+type Transcript struct {
+	Text string `json:"text"`
+	// Partial marks a checkpoint: the utterance so far, at a pause within
+	// it. The final transcript of the whole utterance follows.
+	Partial bool `json:"partial,omitempty"`
+	// Words are the transcriber's word timings, if it reported any in its
+	// Transcription. They are as transcribed, before any
+	// TranscriptProcessor.
+	Words []WordTiming `json:"words,omitempty"`
+}
+
+// WordTiming places one transcribed word in the utterance, in milliseconds
+// from the start of the audio the transcriber was given.
+type WordTiming struct {
+	Word    string `json:"word"`
+	StartMs int    `json:"startMs"`
+	EndMs   int    `json:"endMs"`
+}
+
+// TranscriptSink receives each final transcript as it is relayed, for
+// delivery somewhere other than the caller: a webhook, a queue, a log.
+// Sinks run off the conversational loop, so a slow one doesn't hold up the
+// agent's reply.
+type TranscriptSink interface {
+	Publish(ctx context.Context, ev TranscriptEvent) error
+}
+
+// TranscriptEvent is what a TranscriptSink receives for one transcript.
+type TranscriptEvent struct {
+	PeerID      string    `json:"peerId"` // the caller
+	UtteranceID string    `json:"utteranceId"`
+	Text        string    `json:"text"`
+	DurationMs  int       `json:"durationMs"` // length of the utterance audio
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// TranscriptProcessor rewrites a transcript before it is relayed and handed
+// to the agent: capitalization, a profanity filter, custom vocabulary
+// substitution and so on.
+type TranscriptProcessor func(string) string
+
+// applyProcessors runs text through each processor in order. A transcript
+// one of them empties stays suppressed; the rest don't see it.
+func applyProcessors(text string, processors []TranscriptProcessor) string {
+	for _, process := range processors {
+		if text = process(text); text == "" {
+			break
+		}
+	}
+	return text
+}
@@ -0,0 +1,475 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixedTranscriber transcribes every utterance as result.
+type fixedTranscriber struct{ result Transcription }
+
+func (f fixedTranscriber) Transcribe(context.Context, []int16, int, TranscribeOptions) (Transcription, error) {
+	return f.result, nil
+}
+
+func TestTurnRelaysTranscription(t *testing.T) {
+	words := []WordTiming{{Word: "bonjour", StartMs: 120, EndMs: 480}}
+	p, err := NewPeer(DefaultConfig(), Handlers{
+		Transcriber: fixedTranscriber{Transcription{Text: "bonjour", Language: "fr", Words: words}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newFakeSignaling()
+	p.setConn(ws)
+	s := &Session{RemoteID: "iphone-1", peer: p}
+
+	// The first utterance in a language announces it ahead of the
+	// transcript; a second in the same language doesn't.
+	for range 2 {
+		ctx, cancel := context.WithCancel(withTrace(context.Background(), "call", "call.1"))
+		s.runTurn(ctx, cancel, make([]int16, frameSamples), TranscribeOptions{}, nil)
+		cancel()
+	}
+	var got []SignalMessage
+	for range 3 {
+		got = append(got, ws.next(t, time.Second))
+	}
+
+	if got[0].Type != "language_detected" || got[0].Data.(map[string]interface{})["language"] != "fr" {
+		t.Errorf("first message = %+v, want language_detected fr", got[0])
+	}
+	for _, msg := range got[1:] {
+		var tr struct{ Transcript Transcript }
+		if err := roundTrip(msg.Data, &tr); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "signal" || tr.Transcript.Text != "bonjour" || !reflect.DeepEqual(tr.Transcript.Words, words) {
+			t.Errorf("got %+v, want the transcript with its word timings", msg)
+		}
+	}
+}
+
+// Processors run in the order they were added, on the transcript both the
+// caller and the agent get; one returning "" drops the turn.
+func TestTranscriptProcessors(t *testing.T) {
+	tests := []struct {
+		name       string
+		processors []TranscriptProcessor
+		want       string // "" when nothing is relayed
+	}{
+		{"in order", []TranscriptProcessor{
+			func(s string) string { return strings.TrimPrefix(s, "um ") },
+			func(s string) string { return strings.ToUpper(s[:1]) + s[1:] },
+		}, "Hello there"},
+		{"suppressed", []TranscriptProcessor{
+			func(s string) string { return "" },
+			func(s string) string { return s + "!" },
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := echoAgent{heard: make(chan string, 1)}
+			p, err := NewPeer(DefaultConfig(), Handlers{
+				Transcriber: fixedTranscriber{Transcription{Text: "um hello there"}},
+				Agent:       agent,
+				Synthesizer: countingSynthesizer{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fn := range tt.processors {
+				p.AddTranscriptProcessor(fn)
+			}
+			ws := newFakeSignaling()
+			p.setConn(ws)
+			s := &Session{RemoteID: "iphone-1", peer: p, player: newTestPlayer(t, newRecordingTrack())}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s.runTurn(ctx, cancel, make([]int16, frameSamples), TranscribeOptions{}, nil)
+
+			select {
+			case msg := <-ws.out:
+				var tr struct{ Transcript Transcript }
+				if err := roundTrip(msg.Data, &tr); err != nil {
+					t.Fatal(err)
+				}
+				if tt.want == "" || tr.Transcript.Text != tt.want {
+					t.Errorf("relayed %+v, want transcript %q", msg, tt.want)
+				}
+			default:
+				if tt.want != "" {
+					t.Errorf("nothing relayed, want transcript %q", tt.want)
+				}
+			}
+			select {
+			case heard := <-agent.heard:
+				if heard != tt.want {
+					t.Errorf("agent heard %q, want %q", heard, tt.want)
+				}
+			default:
+				if tt.want != "" {
+					t.Errorf("agent heard nothing, want %q", tt.want)
+				}
+			}
+		})
+	}
+}
+
+// optsTranscriber hands the test the options of every utterance.
+type optsTranscriber struct{ opts chan TranscribeOptions }
+
+func (o optsTranscriber) Transcribe(_ context.Context, _ []int16, _ int, opts TranscribeOptions) (Transcription, error) {
+	o.opts <- opts
+	return Transcription{}, nil
+}
+
+// The language an offer names is the transcriber's hint until a control
+// message changes it; malformed tags are refused either way.
+func TestLanguageHint(t *testing.T) {
+	transcriber := optsTranscriber{opts: make(chan TranscribeOptions, 1)}
+	p, err := NewPeer(DefaultConfig(), Handlers{Transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newFakeSignaling()
+	p.setConn(ws)
+	t.Cleanup(func() { p.shutdown(time.Second) })
+
+	offer := offerMessage("iphone-1", newOffer(t))
+	offer.Data.(map[string]interface{})["language"] = "fr-CA"
+	if err := p.handleOffer(offer); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := p.session("iphone-1")
+	amplitude := int16(4000)
+	hint := func() string {
+		// Each utterance distinct, so none is taken for a repeat.
+		amplitude += 1000
+		s.sayFrame(squareFrame(amplitude), 10)
+		select {
+		case opts := <-transcriber.opts:
+			return opts.Language
+		case <-time.After(time.Second):
+			t.Fatal("utterance never transcribed")
+			return ""
+		}
+	}
+	if got := hint(); got != "fr-CA" {
+		t.Errorf("hint %q, want the offer's fr-CA", got)
+	}
+	control := func(language string) error {
+		return p.handleControl(SignalMessage{Type: "control", From: "iphone-1", Data: map[string]interface{}{"action": "language", "language": language}})
+	}
+	if err := control("de"); err != nil {
+		t.Fatal(err)
+	}
+	if got := hint(); got != "de" {
+		t.Errorf("hint %q after the control message, want de", got)
+	}
+	if err := control("not a tag!"); err == nil {
+		t.Error("control message with a malformed language accepted")
+	}
+	if err := control(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := hint(); got != "" {
+		t.Errorf("hint %q after clearing it, want none", got)
+	}
+
+	bad := offerMessage("iphone-2", newOffer(t))
+	bad.Data.(map[string]interface{})["language"] = "français"
+	var r *offerRejection
+	if err := p.handleOffer(bad); !errors.As(err, &r) || r.reason != rejectInvalidOffer {
+		t.Errorf("offer with a malformed language: %v, want an invalid_offer rejection", err)
+	}
+}
+
+// countingSynthesizer speaks a reply as frames frames of 48 kHz audio,
+// every sample of frame i being i+1. With block set it waits for its
+// context to end instead, as a slow TTS backend would mid-barge-in.
+type countingSynthesizer struct {
+	frames  int
+	block   bool
+	started chan struct{}
+}
+
+func (c countingSynthesizer) Synthesize(ctx context.Context, _ string) ([]int16, int, error) {
+	if c.block {
+		close(c.started)
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+	pcm := make([]int16, 0, c.frames*frameSamples)
+	for i := range c.frames {
+		for range frameSamples {
+			pcm = append(pcm, int16(i+1))
+		}
+	}
+	return pcm, sampleRate, nil
+}
+
+// echoAgent replies to every transcript with it and records what it heard.
+type echoAgent struct{ heard chan string }
+
+func (a echoAgent) Respond(_ context.Context, transcript string) (string, error) {
+	a.heard <- transcript
+	return transcript, nil
+}
+
+// newTurnSession is a session whose audio goes through a default
+// endpointer to p's conversational loop, speaking on track.
+func newTurnSession(t *testing.T, p *Peer, track sampleWriter) *Session {
+	s := &Session{
+		RemoteID: "iphone-1",
+		TraceID:  "call",
+		peer:     p,
+		player:   newTestPlayer(t, track),
+		noise:    newNoiseFloor(p.cfg.NoiseFloorAttack, p.cfg.NoiseFloorDecay),
+		done:     make(chan struct{}),
+	}
+	s.endpointer = p.newEndpointer()
+	// Hangs up ahead of the peer's cleanup waiting for the turn.
+	t.Cleanup(s.stop)
+	return s
+}
+
+// say feeds the session frames of speech followed by enough silence for
+// the endpointer to end the utterance.
+func (s *Session) say(frames int) {
+	s.sayFrame(toneFrame(frameSamples), frames)
+}
+
+// sayFrame is say with every frame of speech being speech.
+func (s *Session) sayFrame(speech []int16, frames int) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	for range frames {
+		s.processFrame(speech, true, 0)
+	}
+	silence := make([]int16, frameSamples)
+	for range s.peer.cfg.SilenceMs/frameDuration + 1 {
+		s.processFrame(silence, false, 0)
+	}
+}
+
+// startSpeaking feeds one frame of speech, starting an utterance.
+func (s *Session) startSpeaking() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.processFrame(toneFrame(frameSamples), true, 0)
+}
+
+// TestFullTurn drives a turn from the caller's speech through the
+// transcriber, agent and synthesizer to the outbound track.
+func TestFullTurn(t *testing.T) {
+	newTurnPeer := func(t *testing.T, synth Synthesizer) (*Peer, echoAgent) {
+		agent := echoAgent{heard: make(chan string, 1)}
+		p, err := NewPeer(DefaultConfig(), Handlers{
+			Transcriber: fixedTranscriber{Transcription{Text: "hello"}},
+			Agent:       agent,
+			Synthesizer: synth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.setConn(newFakeSignaling())
+		t.Cleanup(p.wg.Wait)
+		return p, agent
+	}
+
+	t.Run("reply played in order", func(t *testing.T) {
+		const frames = 10
+		p, agent := newTurnPeer(t, countingSynthesizer{frames: frames})
+		track := newRecordingTrack()
+		s := newTurnSession(t, p, track)
+
+		s.say(10)
+		if got := <-agent.heard; got != "hello" {
+			t.Errorf("agent heard %q, want the transcript", got)
+		}
+		got := track.framesWithin((frames + 5) * frameDuration * time.Millisecond)
+		want := make([]int16, frames)
+		for i := range want {
+			want[i] = int16(i + 1)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("track got frames %v, want %v", got, want)
+		}
+	})
+
+	t.Run("barge-in drops the rest of the reply", func(t *testing.T) {
+		const frames = 100
+		p, agent := newTurnPeer(t, countingSynthesizer{frames: frames})
+		track := newRecordingTrack()
+		s := newTurnSession(t, p, track)
+
+		s.say(10)
+		<-agent.heard
+		for want := int16(1); want <= 3; want++ {
+			select {
+			case got := <-track.frames:
+				if got != want {
+					t.Fatalf("frame %d played as %d", want, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("frame %d never played", want)
+			}
+		}
+		s.startSpeaking()
+		// A frame already being written when the caller spoke may still
+		// go out; nothing after it does.
+		if rest := track.framesWithin(10 * frameDuration * time.Millisecond); len(rest) > 1 {
+			t.Errorf("%d frames played after the barge-in: %v", len(rest), rest)
+		}
+	})
+
+	t.Run("barge-in cancels synthesis", func(t *testing.T) {
+		synth := countingSynthesizer{block: true, started: make(chan struct{})}
+		p, agent := newTurnPeer(t, synth)
+		track := newRecordingTrack()
+		s := newTurnSession(t, p, track)
+
+		s.say(10)
+		<-agent.heard
+		<-synth.started
+		s.startSpeaking()
+		done := make(chan struct{})
+		go func() { p.wg.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("turn still synthesizing after the barge-in")
+		}
+		if got := track.framesWithin(5 * frameDuration * time.Millisecond); len(got) > 0 {
+			t.Errorf("cancelled reply played frames %v", got)
+		}
+	})
+}
+
+// chanSink hands the test every event it is published, and whether its
+// context was still live once release let it finish.
+type chanSink struct {
+	release chan struct{}
+	events  chan TranscriptEvent
+	ctxErrs chan error
+}
+
+func (c chanSink) Publish(ctx context.Context, ev TranscriptEvent) error {
+	<-c.release
+	c.events <- ev
+	c.ctxErrs <- ctx.Err()
+	return nil
+}
+
+// Sinks get the processed transcript of each turn, and a barge-in doesn't
+// cut their delivery short.
+func TestTranscriptSinks(t *testing.T) {
+	sink := chanSink{release: make(chan struct{}), events: make(chan TranscriptEvent, 1), ctxErrs: make(chan error, 1)}
+	p, err := NewPeer(DefaultConfig(), Handlers{
+		Transcriber: fixedTranscriber{Transcription{Text: "hello"}},
+		Sinks:       []TranscriptSink{sink},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AddTranscriptProcessor(strings.ToUpper)
+	p.setConn(newFakeSignaling())
+	s := &Session{RemoteID: "iphone-1", peer: p}
+
+	ctx, cancel := context.WithCancel(withTrace(context.Background(), "call", "call.1"))
+	before := time.Now()
+	s.runTurn(ctx, cancel, make([]int16, 3*frameSamples), TranscribeOptions{}, nil)
+	cancel()
+	close(sink.release)
+	p.wg.Wait()
+
+	ev := <-sink.events
+	if ev.PeerID != "iphone-1" || ev.UtteranceID != "call.1" || ev.Text != "HELLO" || ev.DurationMs != 3*frameDuration || ev.Timestamp.Before(before) {
+		t.Errorf("sink got %+v, want the processed transcript of iphone-1's 60ms utterance call.1", ev)
+	}
+	if err := <-sink.ctxErrs; err != nil {
+		t.Errorf("sink's context ended with the turn: %v", err)
+	}
+}
+
+// floatRecorder is a FloatTranscriber reporting what it was given.
+type floatRecorder struct {
+	pcm        []float32
+	sampleRate int
+	language   string
+}
+
+func (f *floatRecorder) TranscribeFloat(_ context.Context, pcm []float32, sampleRate int, opts TranscribeOptions) (Transcription, error) {
+	f.pcm, f.sampleRate, f.language = pcm, sampleRate, opts.Language
+	return Transcription{Text: "hello"}, nil
+}
+
+// FloatPCM hands a FloatTranscriber the utterance as floats, with the
+// sample rate and options, and relays its transcript.
+func TestFloatPCM(t *testing.T) {
+	rec := &floatRecorder{}
+	got, err := FloatPCM(rec).Transcribe(context.Background(), []int16{-32768, 16384}, sampleRate, TranscribeOptions{Language: "de"})
+	if err != nil || got.Text != "hello" {
+		t.Errorf("Transcribe = %+v, %v; want the float transcriber's", got, err)
+	}
+	if !slices.Equal(rec.pcm, []float32{-1, 0.5}) || rec.sampleRate != sampleRate || rec.language != "de" {
+		t.Errorf("float transcriber got %v at %d Hz, language %q", rec.pcm, rec.sampleRate, rec.language)
+	}
+}
+
+// slowTranscriber takes 50ms over each utterance, recording the most calls
+// it had in flight at once.
+type slowTranscriber struct {
+	mu             sync.Mutex
+	inFlight, peak int
+	done           int
+}
+
+func (s *slowTranscriber) Transcribe(context.Context, []int16, int, TranscribeOptions) (Transcription, error) {
+	s.mu.Lock()
+	s.inFlight++
+	s.peak = max(s.peak, s.inFlight)
+	s.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	s.mu.Lock()
+	s.inFlight--
+	s.done++
+	s.mu.Unlock()
+	return Transcription{}, nil
+}
+
+// max_concurrent_transcriptions caps the Transcribe calls in flight; the
+// rest wait their turn rather than being dropped.
+func TestMaxConcurrentTranscriptions(t *testing.T) {
+	for _, limit := range []int{1, 3, 0} {
+		cfg := DefaultConfig()
+		cfg.MaxConcurrentTranscriptions = limit
+		slow := &slowTranscriber{}
+		p, err := NewPeer(cfg, Handlers{Transcriber: slow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.setConn(newFakeSignaling())
+		s := newTurnSession(t, p, newRecordingTrack())
+		for i := range 20 {
+			s.sayFrame(squareFrame(int16(1000+100*i)), 10)
+		}
+		p.wg.Wait()
+		if slow.done != 20 {
+			t.Errorf("cap %d: %d of 20 utterances transcribed", limit, slow.done)
+		}
+		if limit > 0 && slow.peak != limit {
+			t.Errorf("cap %d: %d transcriptions in flight at once", limit, slow.peak)
+		}
+		if limit == 0 && slow.peak <= 3 {
+			t.Errorf("no cap: at most %d transcriptions in flight at once", slow.peak)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package pipeline
+
+import "math"
+
+// rms returns the root-mean-square level of pcm on the int16 scale.
+func rms(pcm []int16) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+	return math.Sqrt(sumSquares(pcm) / float64(len(pcm)))
+}
+
+// sumSquares is the sum of pcm's squared samples, for an RMS level kept
+// across several slices.
+func sumSquares(pcm []int16) float64 {
+	var sum float64
+	for _, v := range pcm {
+		f := float64(v)
+		sum += f * f
+	}
+	return sum
+}
+
+// float32PCM converts pcm to floats in [-1, 1) by dividing by 32768, the
+// convention of most audio ML tooling: -32768 maps to exactly -1 and 32767
+// to just under 1.
+func float32PCM(pcm []int16) []float32 {
+	out := make([]float32, len(pcm))
+	for i, v := range pcm {
+		out[i] = float32(v) / 32768
+	}
+	return out
+}
+
+// noiseFloor is an exponential moving average of the background level,
+// fed only with frames the VAD classed as silence. Separate coefficients
+// let it rise slowly (a burst of noise shouldn't read as the new floor)
+// and fall quickly once the room gets quieter.
+type noiseFloor struct {
+	attack, decay float64 // EMA weights for rising and falling levels, 0-1
+	level         float64
+	primed        bool
+}
+
+func newNoiseFloor(attack, decay float64) noiseFloor {
+	return noiseFloor{attack: attack, decay: decay}
+}
+
+// update folds the RMS of one silence frame into the estimate.
+func (n *noiseFloor) update(frameRMS float64) {
+	if !n.primed {
+		n.level, n.primed = frameRMS, true
+		return
+	}
+	alpha := n.decay
+	if frameRMS > n.level {
+		alpha = n.attack
+	}
+	n.level += alpha * (frameRMS - n.level)
+}
+
+// value is the current floor estimate on the int16 RMS scale, or 0 before
+// any silence has been seen.
+func (n *noiseFloor) value() float64 {
+	return n.level
+}
+
+// vadSmoother is a median filter over the last few VAD decisions: a frame
+// counts as speech when most of the window does. A lone outlier frame at a
+// speech edge then doesn't flip the state, at the cost of delaying onset
+// and offset by half the window.
+type vadSmoother struct {
+	window []bool
+	next   int
+	voiced int // true entries in window
+}
+
+// newVADSmoother returns a filter over size decisions; size should be odd.
+// A size of 1 passes decisions through unchanged.
+func newVADSmoother(size int) vadSmoother {
+	return vadSmoother{window: make([]bool, size)}
+}
+
+// smooth records the raw decision for the latest frame and returns the
+// filtered one.
+func (v *vadSmoother) smooth(isSpeech bool) bool {
+	if len(v.window) <= 1 {
+		return isSpeech
+	}
+	if v.window[v.next] {
+		v.voiced--
+	}
+	v.window[v.next] = isSpeech
+	if isSpeech {
+		v.voiced++
+	}
+	v.next = (v.next + 1) % len(v.window)
+	return v.voiced*2 > len(v.window)
+}
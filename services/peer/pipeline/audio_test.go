@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// The floor follows silence frames: quickly down when the room gets
+// quieter, slowly up so a burst of noise doesn't become the new floor.
+func TestNoiseFloor(t *testing.T) {
+	n := newNoiseFloor(0.1, 0.5)
+	if n.value() != 0 {
+		t.Errorf("floor %v before any silence, want 0", n.value())
+	}
+	n.update(200)
+	if n.value() != 200 {
+		t.Errorf("floor %v after the first frame, want its 200", n.value())
+	}
+	n.update(100)
+	if n.value() != 150 {
+		t.Errorf("floor %v after a quieter frame, want halfway down at 150", n.value())
+	}
+	n.update(1150)
+	if n.value() != 250 {
+		t.Errorf("floor %v after a loud frame, want a tenth of the way up at 250", n.value())
+	}
+	for range 200 {
+		n.update(600)
+	}
+	if math.Abs(n.value()-600) > 1 {
+		t.Errorf("floor %v after steady noise at 600, want it there", n.value())
+	}
+}
+
+func TestVADSmoother(t *testing.T) {
+	v := newVADSmoother(3)
+	raw := []bool{true, false, true, true, false, true, false, false, true, false}
+	// Speech once two of the last three frames are; the lone dropout at
+	// frame 4 and the lone blip at frame 8 don't flip it.
+	want := []bool{false, false, true, true, true, true, false, false, false, false}
+	for i, isSpeech := range raw {
+		if got := v.smooth(isSpeech); got != want[i] {
+			t.Errorf("frame %d: smoothed %v, want %v", i, got, want[i])
+		}
+	}
+	pass := newVADSmoother(1)
+	for _, isSpeech := range raw {
+		if got := pass.smooth(isSpeech); got != isSpeech {
+			t.Errorf("size 1 smoothed %v to %v", isSpeech, got)
+		}
+	}
+}
+
+// Every int16 maps into [-1, 1) and back; the extremes land on -1 and just
+// under 1.
+func TestFloat32PCM(t *testing.T) {
+	got := float32PCM([]int16{math.MinInt16, 0, math.MaxInt16, 16384})
+	if want := []float32{-1, 0, 32767.0 / 32768, 0.5}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	all := make([]int16, 1<<16)
+	for i := range all {
+		all[i] = int16(i + math.MinInt16)
+	}
+	for i, f := range float32PCM(all) {
+		if f < -1 || f >= 1 || int16(f*32768) != all[i] {
+			t.Fatalf("%d became %v", all[i], f)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"log"
+	"time"
+)
+
+// Segment is one utterance within audio batched for the transcriber; see
+// Config.MinTranscribeMs.
+type Segment struct {
+	UtteranceID string
+	Offset      int // first sample within the batch
+	Samples     int
+}
+
+// queueTurn hands a finished utterance to the conversational loop, batching
+// it with its neighbours until there is Config.MinTranscribeMs of audio.
+// release returns segment's buffer; see bufferPools.handoff. Callers hold
+// stateMu.
+func (s *Session) queueTurn(segment []int16, release func()) {
+	minSamples := s.peer.cfg.MinTranscribeMs * sampleRate / 1000
+	if len(s.batch) == 0 && len(segment) >= minSamples {
+		s.startTurn(segment, nil, release)
+		return
+	}
+	if len(s.batch) == 0 {
+		s.batchSince = time.Now()
+	}
+	s.batchSegments = append(s.batchSegments, Segment{
+		UtteranceID: utteranceID(s.TraceID, s.utterances),
+		Offset:      len(s.batch),
+		Samples:     len(segment),
+	})
+	s.batch = append(s.batch, segment...)
+	release()
+	if len(s.batch) >= minSamples {
+		s.sendBatch()
+	}
+}
+
+// sendBatch starts a turn on the utterances batched so far, if any.
+// Callers hold stateMu.
+func (s *Session) sendBatch() {
+	if len(s.batch) == 0 {
+		return
+	}
+	log.Printf("[%s] 📦 Sending a %d ms batch of %d utterance(s)", s.TraceID, len(s.batch)*1000/sampleRate, len(s.batchSegments))
+	s.startTurn(s.batch, s.batchSegments, nil)
+	s.batch, s.batchSegments = nil, nil
+}
+
+// checkBatch sends a batch that has waited Config.MinTranscribeMs for more
+// utterances, so a caller who goes quiet still gets an answer. The read
+// loop calls it for every packet. Callers hold stateMu.
+func (s *Session) checkBatch() {
+	if len(s.batch) > 0 && time.Since(s.batchSince) >= time.Duration(s.peer.cfg.MinTranscribeMs)*time.Millisecond {
+		s.sendBatch()
+	}
+}
+
+// FlushBatch sends whatever utterances are waiting to be batched, e.g. when
+// the call ends. It is safe to call from any goroutine.
+func (s *Session) FlushBatch() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.sendBatch()
+}
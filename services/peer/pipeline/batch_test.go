@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// batchCall is one Transcribe call as batchTranscriber saw it.
+type batchCall struct {
+	utterance string // the turn's utterance ID
+	samples   int
+	segments  []Segment
+}
+
+// batchTranscriber hands the test every Transcribe call.
+type batchTranscriber struct{ calls chan batchCall }
+
+func (b batchTranscriber) Transcribe(ctx context.Context, pcm []int16, _ int, opts TranscribeOptions) (Transcription, error) {
+	b.calls <- batchCall{UtteranceID(ctx), len(pcm), opts.Segments}
+	return Transcription{}, nil
+}
+
+// nextCall returns the next Transcribe call, or fails t if there is none
+// within a second.
+func (b batchTranscriber) nextCall(t *testing.T) batchCall {
+	t.Helper()
+	select {
+	case c := <-b.calls:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("nothing transcribed")
+		return batchCall{}
+	}
+}
+
+// noCall fails t if anything is transcribed within d.
+func (b batchTranscriber) noCall(t *testing.T, d time.Duration, what string) {
+	t.Helper()
+	select {
+	case c := <-b.calls:
+		t.Errorf("%s: transcribed %+v", what, c)
+	case <-time.After(d):
+	}
+}
+
+func newBatchSession(t *testing.T, minTranscribeMs int) (*Session, batchTranscriber) {
+	cfg := DefaultConfig()
+	cfg.MinTranscribeMs = minTranscribeMs
+	transcriber := batchTranscriber{calls: make(chan batchCall, 16)}
+	p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	s, _ := newReadSession(t, p)
+	return s, transcriber
+}
+
+// Short utterances go to the transcriber together once they add up to
+// min_transcribe_ms, each marked by a segment; a long one with nothing
+// waiting goes alone.
+func TestBatchUtterances(t *testing.T) {
+	s, transcriber := newBatchSession(t, 1000)
+	var lengths []int
+	for i := range 4 {
+		s.sayFrame(squareFrame(int16(1000+100*i)), 5)
+		if i < 3 {
+			transcriber.noCall(t, 20*time.Millisecond, fmt.Sprintf("%d short utterances", i+1))
+		}
+	}
+	batch := transcriber.nextCall(t)
+	if len(batch.segments) != 4 {
+		t.Fatalf("batch of %d samples marks %d utterances, want the 4", batch.samples, len(batch.segments))
+	}
+	offset := 0
+	for i, seg := range batch.segments {
+		if want := utteranceID("call", i+1); seg.UtteranceID != want || seg.Offset != offset {
+			t.Errorf("segment %d is %+v, want %s at %d", i, seg, want, offset)
+		}
+		offset += seg.Samples
+		lengths = append(lengths, seg.Samples)
+	}
+	minSamples := 1000 * sampleRate / 1000
+	if offset != batch.samples || batch.samples < minSamples || batch.samples-lengths[len(lengths)-1] >= minSamples {
+		t.Errorf("batch of %d samples with segments %v, want just past %d", batch.samples, batch.segments, minSamples)
+	}
+	if batch.utterance != batch.segments[0].UtteranceID {
+		t.Errorf("batch transcribed as %s, want its first utterance %s", batch.utterance, batch.segments[0].UtteranceID)
+	}
+
+	s.sayFrame(squareFrame(3000), 100)
+	if long := transcriber.nextCall(t); long.segments != nil || long.samples < minSamples {
+		t.Errorf("long utterance transcribed as %+v, want alone with no segments", long)
+	}
+}
+
+// A batch short of min_transcribe_ms goes once it has waited that long,
+// checked as packets arrive, or on a flush, or when the track ends. With
+// the setting off nothing waits.
+func TestBatchSentEarly(t *testing.T) {
+	s, transcriber := newBatchSession(t, 500)
+	s.sayFrame(squareFrame(1000), 5)
+	s.handleAudio(opusPacket(0).Payload, 0)
+	transcriber.noCall(t, 20*time.Millisecond, "fresh batch")
+	time.Sleep(500 * time.Millisecond)
+	s.handleAudio(opusPacket(1).Payload, frameSamples)
+	if c := transcriber.nextCall(t); len(c.segments) != 1 || c.segments[0].Samples != c.samples {
+		t.Errorf("after waiting got %+v, want the one utterance", c)
+	}
+
+	s, transcriber = newBatchSession(t, 60000)
+	s.sayFrame(squareFrame(1000), 5)
+	s.speakFrames(5)
+	if !s.FlushUtterance("control") {
+		t.Fatal("no utterance to flush")
+	}
+	if c := transcriber.nextCall(t); len(c.segments) != 2 {
+		t.Errorf("flush sent %+v, want the waiting utterance and the flushed one", c)
+	}
+
+	s, transcriber = newBatchSession(t, 60000)
+	s.sayFrame(squareFrame(1000), 5)
+	track := newFakeTrack()
+	done := runReadLoop(s, track)
+	close(track.reads)
+	waitDone(t, done, time.Second, "read loop")
+	if c := transcriber.nextCall(t); len(c.segments) != 1 {
+		t.Errorf("track end sent %+v, want the waiting utterance", c)
+	}
+
+	s, transcriber = newBatchSession(t, 0)
+	s.sayFrame(squareFrame(1000), 5)
+	if c := transcriber.nextCall(t); c.segments != nil {
+		t.Errorf("with batching off got %+v, want no segments", c)
+	}
+}
@@ -0,0 +1,201 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+)
+
+// The benchmarks time the per-packet hot path and the helpers it calls;
+// run them before and after a change to the buffers or the resampler:
+//
+//	go test -run X -bench . -benchmem ./pipeline
+//
+// Except for BenchmarkVAD and BenchmarkOpusDecode, decoding and VAD are
+// stubbed out, so the numbers are the pipeline's own.
+
+// BenchmarkHandleAudio is the read loop's per-packet path, decode through
+// VAD, endpointing and utterance buffering. One op is one packet.
+func BenchmarkHandleAudio(b *testing.B) {
+	// The pipeline logs every speech edge.
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+
+	cfg := DefaultConfig()
+	b.Run("10ms", func(b *testing.B) { benchPackets(b, cfg, frameSamples/2) })
+	b.Run("20ms", func(b *testing.B) { benchPackets(b, cfg, frameSamples) })
+	b.Run("60ms", func(b *testing.B) { benchPackets(b, cfg, 3*frameSamples) })
+	// The decoded audio also streamed to a pcm_sink.
+	b.Run("20ms pcm_sink", func(b *testing.B) {
+		pools := newBufferPools(cfg)
+		ps := &pcmStream{pools: pools, frames: make(chan *[]byte, pcmBacklog)}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for buf := range ps.frames {
+				pools.putPacket(buf)
+			}
+		}()
+		defer func() {
+			ps.close()
+			<-done
+		}()
+		benchPackets(b, cfg, frameSamples, func(s *Session) {
+			s.peer.pools = pools
+			s.pcmOut = ps
+		})
+	})
+}
+
+// BenchmarkHandoff is one 2s utterance buffered and handed to a turn, the
+// buffer coming back from the pool each time. By default the turn gets a
+// copy; a borrowing transcriber's turn takes the pooled buffer itself, so
+// only the release func is allocated.
+func BenchmarkHandoff(b *testing.B) {
+	pools := newBufferPools(DefaultConfig())
+	pcm := toneFrame(2 * sampleRate)
+	for _, borrow := range []bool{false, true} {
+		name := "copy"
+		if borrow {
+			name = "borrow"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buf := pools.getUtterance()
+				*buf = append(*buf, pcm...)
+				_, release := pools.handoff(buf, borrow)
+				release()
+			}
+		})
+	}
+}
+
+// BenchmarkResample converts one 20ms frame each way between the VAD's
+// 16 kHz and the call's rate.
+func BenchmarkResample(b *testing.B) {
+	for _, rates := range [][2]int{{16000, sampleRate}, {sampleRate, 16000}} {
+		from, to := rates[0], rates[1]
+		pcm := toneFrame(from * frameDuration / 1000)
+		b.Run(fmt.Sprintf("%dk-%dk", from/1000, to/1000), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				resample(pcm, from, to)
+			}
+		})
+	}
+}
+
+// BenchmarkVAD is the default VAD judging one 20ms frame.
+func BenchmarkVAD(b *testing.B) {
+	vad, err := newVoiceDetector(DefaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	pcm := toneFrame(frameSamples)
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := vad.IsSpeech(pcm, sampleRate); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkOpusDecode decodes one 20ms CELT fullband packet.
+func BenchmarkOpusDecode(b *testing.B) {
+	dec, err := newOpusDecoder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	packet := []byte{0xf8, 0xff, 0xfe}
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := dec.Decode(packet, frameSamples, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMixPCM mixes two 20ms frames, as the mixer does for every frame
+// of overlapping playback.
+func BenchmarkMixPCM(b *testing.B) {
+	x, y := toneFrame(frameSamples), toneFrame(frameSamples)
+	b.ReportAllocs()
+	for range b.N {
+		mixPCM(x, y)
+	}
+}
+
+// benchOpusTOC are TOC bytes of CELT fullband packets by duration, so
+// handleAudio's size check accepts the stub decoder's output.
+var benchOpusTOC = map[int]byte{
+	frameSamples / 2: 0xf0, // config 30, 10ms
+	frameSamples:     0xf8, // config 31, 20ms
+	3 * frameSamples: 0xfb, // config 31, code 3
+}
+
+// benchPackets feeds packets of n samples through handleAudio, after each
+// of setup has had the session.
+func benchPackets(b *testing.B, cfg Config, n int, setup ...func(*Session)) {
+	payload := []byte{benchOpusTOC[n]}
+	if n == 3*frameSamples {
+		payload = append(payload, 3) // code 3 frame count
+	}
+	peer := &Peer{cfg: cfg, pools: newBufferPools(cfg)}
+	session := &Session{
+		RemoteID: "bench",
+		peer:     peer,
+		dec:      benchDecoder{pcm: toneFrame(n)},
+		vad:      &scriptedVAD{},
+		player:   &player{},
+		smoother: newVADSmoother(cfg.VADSmoothingFrames),
+		noise:    newNoiseFloor(cfg.NoiseFloorAttack, cfg.NoiseFloorDecay),
+	}
+	session.endpointer = peer.newEndpointer()
+	for _, fn := range setup {
+		fn(session)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	var timestamp uint32
+	for range b.N {
+		if !session.handleAudio(payload, timestamp) {
+			b.Fatal("handleAudio rejected the stub decoder's output")
+		}
+		timestamp += uint32(n)
+	}
+}
+
+// benchDecoder stands in for Opus. It returns the same pcm every time, so
+// the allocations reported are the pipeline's alone; nothing downstream
+// keeps or modifies the decoder's output.
+type benchDecoder struct{ pcm []int16 }
+
+func (d benchDecoder) Decode([]byte, int, bool) ([]int16, error) {
+	return d.pcm, nil
+}
+
+// scriptedVAD calls 1.5s of every 2s speech, so the stream keeps starting
+// and ending utterances.
+type scriptedVAD struct{ frame int }
+
+func (v *scriptedVAD) IsSpeech([]int16, int) (bool, error) {
+	v.frame++
+	return v.frame%100 < 75, nil
+}
+
+// toneFrame is n samples of a loud square wave, well over the energy
+// thresholds.
+func toneFrame(n int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		if i/24%2 == 0 {
+			pcm[i] = 8000
+		} else {
+			pcm[i] = -8000
+		}
+	}
+	return pcm
+}
@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"cmp"
+	"log"
+	"slices"
+)
+
+// The audio budget caps the PCM held in utterance buffers across every
+// session, Config.MaxBufferedAudioMB, so many long utterances at once can't
+// run the process out of memory. Each session counts its buffer against
+// Peer.buffered as it grows; when the total goes over, the largest
+// utterances are flushed to the transcriber early until it fits again.
+
+// trackBuffered brings the session's share of the audio budget up to date
+// with its utterance buffer. Callers hold stateMu.
+func (s *Session) trackBuffered() {
+	var n int64
+	if s.utterance != nil {
+		n = int64(2 * len(*s.utterance))
+	}
+	if old := s.buffered.Swap(n); old != n {
+		s.peer.buffered.Add(n - old)
+	}
+}
+
+// audioBudget is the cap on buffered utterance audio, in bytes; zero is
+// unlimited.
+func (p *Peer) audioBudget() int64 {
+	return int64(p.cfg.MaxBufferedAudioMB) << 20
+}
+
+// enforceAudioBudget flushes the largest utterances in progress until the
+// audio buffered across sessions is back under the budget. It is cheap
+// when under it. Callers must not hold any session's stateMu.
+func (p *Peer) enforceAudioBudget() {
+	limit := p.audioBudget()
+	if limit == 0 || p.buffered.Load() <= limit {
+		return
+	}
+	// One enforcer at a time. The rest wait rather than carry on buffering,
+	// which keeps the overshoot to a window per session; most find the
+	// budget met by the time it's their turn.
+	p.budgetMu.Lock()
+	defer p.budgetMu.Unlock()
+	if p.buffered.Load() <= limit {
+		return
+	}
+
+	p.sessionsMu.Lock()
+	sessions := make([]*Session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.sessionsMu.Unlock()
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return cmp.Compare(b.buffered.Load(), a.buffered.Load())
+	})
+	for _, s := range sessions {
+		total := p.buffered.Load()
+		if total <= limit {
+			return
+		}
+		held := s.buffered.Load()
+		if held == 0 {
+			continue
+		}
+		log.Printf("[%s] 🧯 %d MB of audio buffered across calls, over the %d MB cap; flushing %s's %d ms utterance",
+			s.TraceID, total>>20, limit>>20, s.RemoteID, held/2*1000/sampleRate)
+		s.FlushUtterance("buffered audio over the cap")
+	}
+}
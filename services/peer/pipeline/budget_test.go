@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+)
+
+// speechVAD hears speech in everything.
+type speechVAD struct{}
+
+func (speechVAD) IsSpeech([]int16, int) (bool, error) { return true, nil }
+
+// newBudgetPeer is a peer capping buffered audio at mb, with n live calls
+// of endless speech.
+func newBudgetPeer(t *testing.T, mb, n int) (*Peer, []*Session) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.MaxBufferedAudioMB = mb
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make([]*Session, n)
+	for i := range sessions {
+		s, dec := newReadSession(t, p)
+		s.RemoteID = fmt.Sprintf("iphone-%d", i)
+		dec.pcm = toneFrame(frameSamples)
+		s.vad = speechVAD{}
+		p.sessions[s.RemoteID] = s
+		sessions[i] = s
+	}
+	return p, sessions
+}
+
+// Over the cap, the largest utterances are flushed until the audio
+// buffered across calls fits again, and every session's share adds up to
+// the peer's total.
+func TestAudioBudget(t *testing.T) {
+	p, sessions := newBudgetPeer(t, 1, 20)
+	limit := p.audioBudget()
+	for seq := range uint16(60) {
+		for i, s := range sessions {
+			s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+			if total := p.buffered.Load(); total > limit {
+				t.Fatalf("packet %d of call %d: %d bytes buffered, over the %d cap", seq, i, total, limit)
+			}
+		}
+	}
+
+	var sum int64
+	var started uint64
+	for _, s := range sessions {
+		sum += s.buffered.Load()
+		started += s.VAD().UtterancesStarted
+	}
+	if total := p.buffered.Load(); sum != total {
+		t.Errorf("sessions hold %d bytes between them, peer counts %d", sum, total)
+	}
+	// 20 calls of 1.2s each come to 2.2MB, so some must have been flushed.
+	if started <= 20 {
+		t.Errorf("%d utterances for 20 calls, want some flushed early", started)
+	}
+
+	for _, s := range sessions {
+		s.AbortUtterance("test")
+	}
+	if total := p.buffered.Load(); total != 0 {
+		t.Errorf("%d bytes still counted with every utterance discarded", total)
+	}
+}
+
+// A cap of 0 never flushes.
+func TestAudioBudgetUnlimited(t *testing.T) {
+	p, sessions := newBudgetPeer(t, 0, 1)
+	s := sessions[0]
+	// 12s, more than a 1MB cap would allow.
+	for seq := range uint16(600) {
+		s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+	}
+	if got := s.VAD().UtterancesStarted; got != 1 {
+		t.Errorf("%d utterances with no cap, want 1", got)
+	}
+	if got := p.buffered.Load(); got != s.buffered.Load() || got <= 1<<20 {
+		t.Errorf("%d bytes buffered, call holds %d; want the whole 12s", got, s.buffered.Load())
+	}
+}
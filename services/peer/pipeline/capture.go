@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// unsafeFileChars matches what shouldn't go into a recording ID from a
+// peer-chosen ID.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// captureID names the recording of a call with remoteID starting at t.
+func captureID(remoteID string, t time.Time) string {
+	return fmt.Sprintf("%s-%s", unsafeFileChars.ReplaceAllString(remoteID, "_"), t.UTC().Format("20060102T150405Z"))
+}
+
+// openCapture starts recording the session's inbound Opus packets as Ogg
+// to the peer's RecordingStore, if it has one. Captures replay through the
+// vad-sweep command and play in ordinary audio tools.
+func (s *Session) openCapture() {
+	store := s.peer.recordings
+	if store == nil {
+		return
+	}
+	id := captureID(s.RemoteID, time.Now())
+	stream := startRecording(withTrace(context.Background(), s.TraceID, ""), store, id, s.peer.spawn)
+	w, err := oggwriter.NewWith(stream, sampleRate, channels)
+	if err != nil {
+		stream.Close()
+		log.Println("Capture disabled for this call:", err)
+		return
+	}
+	log.Println("Capturing inbound audio as", id)
+	s.capture = w
+}
+
+func (s *Session) closeCapture() {
+	if s.capture == nil {
+		return
+	}
+	if err := s.capture.Close(); err != nil {
+		log.Println("Close capture failed:", err)
+	}
+	s.capture = nil
+}
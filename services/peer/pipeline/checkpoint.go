@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"slices"
+)
+
+// checkpoint transcribes the utterance so far when the caller pauses
+// within it, if Config.CheckpointMs more has been said since the last
+// checkpoint, so the agent can start on a long turn before it ends. A
+// streamed utterance has already been sent on and isn't checkpointed.
+// Callers hold stateMu.
+func (s *Session) checkpoint() {
+	cfg := s.peer.cfg
+	if cfg.CheckpointMs == 0 || s.peer.transcriber == nil || s.stream != nil {
+		return
+	}
+	if len(*s.utterance)-s.checkpointAt < cfg.CheckpointMs*sampleRate/1000 {
+		return
+	}
+	s.checkpointAt = len(*s.utterance)
+	if s.checkpointCtx == nil {
+		id := utteranceID(s.TraceID, s.utterances+1)
+		s.checkpointCtx, s.endCheckpoints = context.WithCancel(withTrace(context.Background(), s.TraceID, id))
+	}
+	ctx := s.checkpointCtx
+	pcm := slices.Clone(*s.utterance)
+	s.mu.Lock()
+	opts := TranscribeOptions{Language: s.language}
+	s.mu.Unlock()
+	s.peer.spawn(func() { s.runCheckpoint(ctx, pcm, opts) })
+}
+
+// stopCheckpoints abandons the checkpoints of the utterance that just
+// ended, so none arrives after its final transcript. Callers hold stateMu.
+func (s *Session) stopCheckpoints() {
+	if s.endCheckpoints != nil {
+		s.endCheckpoints()
+	}
+	s.checkpointCtx, s.endCheckpoints = nil, nil
+	s.checkpointAt = 0
+}
+
+// runCheckpoint transcribes pcm, the utterance so far, and relays the text
+// as a partial transcript, also handing it to a CheckpointListener agent.
+// ctx is cancelled once the utterance ends.
+func (s *Session) runCheckpoint(ctx context.Context, pcm []int16, opts TranscribeOptions) {
+	tag := traceTag(ctx)
+	release := s.peer.acquireTranscription(tag)
+	result, err := s.peer.transcriber.Transcribe(ctx, pcm, sampleRate, opts)
+	release()
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Println(tag+"Checkpoint transcribe error:", err)
+		return
+	}
+	text := applyProcessors(result.Text, s.peer.processors)
+	if text == "" {
+		return
+	}
+	log.Printf("%s🔖 Checkpoint transcript (%d ms): %s", tag, len(pcm)*1000/sampleRate, text)
+	msg := SignalMessage{
+		Type: "signal",
+		To:   s.RemoteID,
+		From: s.peer.cfg.PeerID,
+		Data: map[string]interface{}{"transcript": Transcript{Text: text, Partial: true}},
+	}
+	if err := s.peer.send(msg); err != nil {
+		log.Println(tag+"Send checkpoint transcript failed:", err)
+	}
+	if listener, ok := s.peer.agent.(CheckpointListener); ok {
+		listener.Checkpoint(ctx, text)
+	}
+}
@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// msTranscriber transcribes each clip as its length in ms. While hold is
+// set, it waits for hold to close before answering.
+type msTranscriber struct{ hold chan struct{} }
+
+func (m msTranscriber) Transcribe(_ context.Context, pcm []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	if m.hold != nil {
+		<-m.hold
+	}
+	return Transcription{Text: strconv.Itoa(len(pcm) * 1000 / sampleRate)}, nil
+}
+
+// checkpointAgent hands the test every checkpoint, and has no reply.
+type checkpointAgent struct{ checkpoints chan string }
+
+func (a checkpointAgent) Respond(context.Context, string) (string, error) {
+	return "", errors.New("no reply")
+}
+
+func (a checkpointAgent) Checkpoint(_ context.Context, transcript string) {
+	a.checkpoints <- transcript
+}
+
+// nextTranscript returns the text of the next transcript ws is sent, and
+// whether it is partial.
+func nextTranscript(t *testing.T, ws *fakeSignaling) (text string, partial bool) {
+	t.Helper()
+	msg := ws.nextMessage(t, time.Second)
+	transcript, _ := msg.Data.(map[string]interface{})["transcript"].(map[string]interface{})
+	if transcript == nil {
+		t.Fatalf("sent %+v, want a transcript", msg)
+	}
+	text, _ = transcript["text"].(string)
+	partial, _ = transcript["partial"].(bool)
+	return text, partial
+}
+
+func newCheckpointSession(t *testing.T, transcriber msTranscriber, agent Agent) (*Session, *fakeSignaling) {
+	cfg := DefaultConfig()
+	cfg.PauseMs = 100
+	cfg.CheckpointMs = 1000
+	p, err := NewPeer(cfg, Handlers{Transcriber: transcriber, Agent: agent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newFakeSignaling()
+	p.setConn(ws)
+	return newTurnSession(t, p, newRecordingTrack()), ws
+}
+
+// pause feeds a pause_ms run of silence, short of ending the utterance.
+func (s *Session) pause() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	silence := make([]int16, frameSamples)
+	for range s.peer.cfg.PauseMs / frameDuration {
+		s.processFrame(silence, false, 0)
+	}
+}
+
+// At a pause, once checkpoint_ms more has been said, the utterance so far
+// is relayed as a partial transcript and handed to the agent; the final
+// transcript follows when it ends.
+func TestCheckpoints(t *testing.T) {
+	agent := checkpointAgent{checkpoints: make(chan string, 4)}
+	s, ws := newCheckpointSession(t, msTranscriber{}, agent)
+	var partials []int
+	checkpoint := func(what string) {
+		t.Helper()
+		text, partial := nextTranscript(t, ws)
+		if !partial {
+			t.Fatalf("%s: got final transcript %s, want a checkpoint", what, text)
+		}
+		ms, _ := strconv.Atoi(text)
+		partials = append(partials, ms)
+		select {
+		case heard := <-agent.checkpoints:
+			if heard != text {
+				t.Errorf("%s: agent heard %q, want %q", what, heard, text)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: agent not told", what)
+		}
+	}
+	quiet := func(what string) {
+		t.Helper()
+		select {
+		case msg := <-ws.out:
+			t.Errorf("%s: sent %+v", what, msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	s.speakFrames(75)
+	s.pause()
+	checkpoint("1.5s of speech")
+	s.speakFrames(20)
+	s.pause()
+	quiet("0.5s more")
+	s.speakFrames(40)
+	s.pause()
+	checkpoint("1.4s more")
+	s.sayFrame(toneFrame(frameSamples), 15)
+
+	text, partial := nextTranscript(t, ws)
+	final, _ := strconv.Atoi(text)
+	if partial || final <= partials[1] {
+		t.Errorf("ended with transcript %s (partial %v), want the whole utterance", text, partial)
+	}
+	if partials[0] < 1500 || partials[1]-partials[0] < 1000 {
+		t.Errorf("checkpoints at %v ms, want one past 1500 and one 1000 later", partials)
+	}
+}
+
+// A checkpoint still being transcribed when the utterance ends is dropped,
+// so the final transcript is the last word.
+func TestCheckpointCancelled(t *testing.T) {
+	hold := make(chan struct{})
+	s, ws := newCheckpointSession(t, msTranscriber{hold: hold}, nil)
+	s.speakFrames(75)
+	s.pause()
+	s.sayFrame(toneFrame(frameSamples), 5)
+	close(hold)
+	if text, partial := nextTranscript(t, ws); partial {
+		t.Errorf("got checkpoint %s after the utterance ended", text)
+	}
+	select {
+	case msg := <-ws.out:
+		t.Errorf("after the final transcript sent %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
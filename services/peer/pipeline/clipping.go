@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clipWindowSamples is the span clipping is judged over, one second.
+	clipWindowSamples = sampleRate
+	// clipWarnRatio is the share of a window's samples pinned at full
+	// scale that counts as sustained clipping. Speech that merely peaks
+	// hits the rails for a handful of samples; an overdriven mic does for
+	// whole stretches of every syllable.
+	clipWarnRatio = 0.01
+	// clipWarnInterval spaces out the warnings for a call that keeps
+	// clipping.
+	clipWarnInterval = 30 * time.Second
+)
+
+// clipDetector watches a call's decoded audio for clipping: samples pinned
+// at the int16 rails. The window and warning state are the read loop's;
+// the totals may be read from any goroutine.
+type clipDetector struct {
+	samples atomic.Uint64
+	clipped atomic.Uint64
+
+	windowSamples int
+	windowClipped int
+	lastWarn      time.Time
+}
+
+// observe counts pcm's clipped samples and, when a full window has been
+// clipping, reports its clipped share.
+func (d *clipDetector) observe(pcm []int16) (ratio float64, sustained bool) {
+	n := 0
+	for _, v := range pcm {
+		if v == math.MaxInt16 || v == math.MinInt16 {
+			n++
+		}
+	}
+	d.samples.Add(uint64(len(pcm)))
+	d.clipped.Add(uint64(n))
+	d.windowSamples += len(pcm)
+	d.windowClipped += n
+	if d.windowSamples < clipWindowSamples {
+		return 0, false
+	}
+	ratio = float64(d.windowClipped) / float64(d.windowSamples)
+	d.windowSamples, d.windowClipped = 0, 0
+	return ratio, ratio >= clipWarnRatio
+}
+
+// ratio is the share of all samples so far that were clipped.
+func (d *clipDetector) ratio() float64 {
+	samples := d.samples.Load()
+	if samples == 0 {
+		return 0
+	}
+	return float64(d.clipped.Load()) / float64(samples)
+}
+
+// checkClipping logs a warning when the caller's input has been clipping
+// for a window, at most every clipWarnInterval.
+func (s *Session) checkClipping(pcm []int16) {
+	ratio, sustained := s.clipping.observe(pcm)
+	if !sustained {
+		return
+	}
+	now := time.Now()
+	if !s.clipping.lastWarn.IsZero() && now.Sub(s.clipping.lastWarn) < clipWarnInterval {
+		return
+	}
+	s.clipping.lastWarn = now
+	log.Printf("[%s] ⚠️ Input from %s is clipping: %.1f%% of samples at full scale over the last second (%.2f%% this call); transcription may suffer",
+		s.TraceID, s.RemoteID, ratio*100, s.clipping.ratio()*100)
+}
@@ -0,0 +1,112 @@
+package pipeline
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A window is judged once a second of samples is in: clipped at either
+// rail for 1% of it or more is sustained, less isn't. The call-wide share
+// counts every sample.
+func TestClipDetector(t *testing.T) {
+	window := func(clipped int) []int16 {
+		pcm := make([]int16, clipWindowSamples)
+		for i := range clipped {
+			pcm[i] = math.MaxInt16
+			if i%2 == 1 {
+				pcm[i] = math.MinInt16
+			}
+		}
+		return pcm
+	}
+	var d clipDetector
+	full := window(clipWindowSamples / 100)
+	if _, sustained := d.observe(full[:clipWindowSamples/2]); sustained {
+		t.Error("half a window judged")
+	}
+	if ratio, sustained := d.observe(full[clipWindowSamples/2:]); !sustained || ratio != clipWarnRatio {
+		t.Errorf("window 1%% clipped: ratio %v, sustained %v; want %v, true", ratio, sustained, clipWarnRatio)
+	}
+	if ratio, sustained := d.observe(window(clipWindowSamples/100 - 1)); sustained || ratio >= clipWarnRatio {
+		t.Errorf("window just under 1%% clipped: ratio %v, sustained %v", ratio, sustained)
+	}
+	if ratio, sustained := d.observe(window(0)[:clipWindowSamples-1]); sustained || ratio != 0 {
+		t.Errorf("window one sample short judged: ratio %v, sustained %v", ratio, sustained)
+	}
+	// 480 + 479 clipped of three windows less a sample.
+	if got, want := d.ratio(), 959.0/float64(3*clipWindowSamples-1); got != want {
+		t.Errorf("call-wide ratio %v, want %v", got, want)
+	}
+}
+
+// captureLog collects what the log package writes until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+// A call clipping for seconds on end is warned about once per
+// clipWarnInterval, and /stats carries its clipped share. Clean and muted
+// audio aren't.
+func TestClippingWarnings(t *testing.T) {
+	logged := captureLog(t)
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, dec := newReadSession(t, p)
+	var seq uint16
+	feed := func(d time.Duration) {
+		for range int(d / (frameDuration * time.Millisecond)) {
+			s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+			seq++
+		}
+	}
+	warnings := func() int { return strings.Count(logged.String(), "is clipping") }
+
+	// Half of every frame pinned at full scale.
+	for i := range frameSamples / 2 {
+		dec.pcm[i] = math.MaxInt16
+	}
+	feed(3 * time.Second)
+	if n := warnings(); n != 1 {
+		t.Fatalf("%d warnings over 3s of clipping, want 1:\n%s", n, logged)
+	}
+	if !strings.Contains(logged.String(), "50.0% of samples at full scale") {
+		t.Errorf("warning doesn't give the window's share:\n%s", logged)
+	}
+	if got := s.Stats().ClippingRatio; got != 0.5 {
+		t.Errorf("clippingRatio %v, want 0.5", got)
+	}
+
+	s.clipping.lastWarn = s.clipping.lastWarn.Add(-clipWarnInterval)
+	feed(time.Second)
+	if n := warnings(); n != 2 {
+		t.Errorf("%d warnings once clipWarnInterval passed, want 2", n)
+	}
+
+	s.SetMuted(true)
+	feed(time.Second)
+	s.SetMuted(false)
+	clear(dec.pcm)
+	feed(4 * time.Second)
+	if got := s.Stats().ClippingRatio; got != 0.25 {
+		t.Errorf("clippingRatio %v after 4s clipping, 4s clean and muted audio; want 0.25", got)
+	}
+	s.clipping.lastWarn = s.clipping.lastWarn.Add(-clipWarnInterval)
+	feed(time.Second)
+	if n := warnings(); n != 2 {
+		t.Errorf("%d warnings after clean audio, want still 2", n)
+	}
+}
@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+// comfortNoiseSmoothing is the one-pole low-pass weight shaping the noise.
+// Rolling off the highs makes it a soft hiss rather than harsh white noise.
+const comfortNoiseSmoothing = 0.7
+
+// comfortNoise generates low-level shaped noise for outbound frames that
+// would otherwise be digital silence, so the line sounds live.
+type comfortNoise struct {
+	rms float64 // target level, in sample units
+	lp  float64 // low-pass filter state
+	rng *rand.Rand
+}
+
+// newComfortNoise returns a generator producing frames at an RMS of dbfs,
+// decibels relative to full scale. Useful levels are around -70 to -50.
+func newComfortNoise(dbfs float64) *comfortNoise {
+	return &comfortNoise{
+		rms: math.MaxInt16 * math.Pow(10, dbfs/20),
+		rng: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+	}
+}
+
+// fill overwrites pcm with noise scaled to the target RMS.
+func (c *comfortNoise) fill(pcm []int16) {
+	if len(pcm) == 0 {
+		return
+	}
+	shaped := make([]float64, len(pcm))
+	var sum float64
+	for i := range shaped {
+		c.lp = comfortNoiseSmoothing*c.lp + (1-comfortNoiseSmoothing)*c.rng.NormFloat64()
+		shaped[i] = c.lp
+		sum += c.lp * c.lp
+	}
+	// Normalize each frame so the level holds exactly, whatever the
+	// filter did to the variance.
+	gain := c.rms / math.Sqrt(sum/float64(len(pcm)))
+	for i, v := range shaped {
+		pcm[i] = int16(math.Round(max(min(v*gain, math.MaxInt16), math.MinInt16)))
+	}
+}
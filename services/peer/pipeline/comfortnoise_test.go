@@ -0,0 +1,38 @@
+package pipeline
+
+import (
+	"math"
+	"testing"
+)
+
+// Every frame of comfort noise is at the configured level and shaped, its
+// neighbouring samples alike as white noise's aren't.
+func TestComfortNoiseLevel(t *testing.T) {
+	for _, dbfs := range []float64{-70, -60, -40} {
+		c := newComfortNoise(dbfs)
+		want := math.MaxInt16 * math.Pow(10, dbfs/20)
+		frame := make([]int16, frameSamples)
+		for i := range 5 {
+			c.fill(frame)
+			if got := rms(frame); math.Abs(got-want) > want*0.02 {
+				t.Errorf("%v dBFS frame %d: RMS %.2f, want %.2f", dbfs, i, got, want)
+			}
+			if r := lag1Correlation(frame); r < 0.5 {
+				t.Errorf("%v dBFS frame %d: lag-1 correlation %.2f, want the low-passed 0.7 or so", dbfs, i, r)
+			}
+		}
+	}
+	newComfortNoise(-60).fill(nil)
+}
+
+// lag1Correlation is how alike each sample in pcm is to the one before.
+func lag1Correlation(pcm []int16) float64 {
+	var num, den float64
+	for i, v := range pcm {
+		den += float64(v) * float64(v)
+		if i > 0 {
+			num += float64(v) * float64(pcm[i-1])
+		}
+	}
+	return num / den
+}
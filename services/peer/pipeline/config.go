@@ -0,0 +1,597 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the peer's runtime tunables. Values are resolved in order of
+// increasing precedence: built-in defaults, the -config file, environment
+// variables, then command-line flags.
+type Config struct {
+	SignalingURL string   `json:"signaling_url" yaml:"signaling_url"`
+	PeerID       string   `json:"peer_id" yaml:"peer_id"`
+	ICEServers   []string `json:"ice_servers" yaml:"ice_servers"`
+	// ICEUsername and ICECredential authenticate to the TURN servers among
+	// ICEServers.
+	ICEUsername   string `json:"ice_username" yaml:"ice_username"`
+	ICECredential string `json:"ice_credential" yaml:"ice_credential"`
+	// ICETransportPolicy is "all" (the default) or "relay", which gathers
+	// only TURN candidates so media never leaves through a host or
+	// server-reflexive address.
+	ICETransportPolicy string `json:"ice_transport_policy" yaml:"ice_transport_policy"`
+	// SignalingURLs, when set, replaces SignalingURL with a list of servers
+	// to fail over between: dialing tries each in turn, and a reconnect
+	// starts with the one just lost.
+	SignalingURLs []string `json:"signaling_urls" yaml:"signaling_urls"`
+	// SignalingReconnect redials and rejoins after the signaling connection
+	// drops, keeping live calls up, instead of exiting.
+	SignalingReconnect bool `json:"signaling_reconnect" yaml:"signaling_reconnect"`
+	// TrickleICE relays local candidates as they're gathered. When false the
+	// answer is held until gathering completes and carries every candidate
+	// inline, for clients that can't trickle.
+	TrickleICE bool `json:"trickle_ice" yaml:"trickle_ice"`
+	// SignalingReadBufferSize and SignalingWriteBufferSize size the
+	// signaling WebSocket's I/O buffers, in bytes. The default fits a
+	// typical SDP offer or answer in one frame.
+	SignalingReadBufferSize  int `json:"signaling_read_buffer_size" yaml:"signaling_read_buffer_size"`
+	SignalingWriteBufferSize int `json:"signaling_write_buffer_size" yaml:"signaling_write_buffer_size"`
+	// MaxSessions caps concurrent calls; offers beyond it are rejected
+	// before any PeerConnection is created. Zero means no cap.
+	MaxSessions int `json:"max_sessions" yaml:"max_sessions"`
+	// MaxSDPBytes rejects offers whose SDP is longer, before it is parsed.
+	// Zero means no limit.
+	MaxSDPBytes int `json:"max_sdp_bytes" yaml:"max_sdp_bytes"`
+	// AnswerDelayMs, plus a random share of AnswerJitterMs, is how long an
+	// offer waits before it is answered. Offers are answered one at a time,
+	// off the signaling read loop, so offers that arrive together, such as
+	// every client reconnecting after a signaling restart, get set up one
+	// after another instead of all at once. Both zero answers straight away.
+	AnswerDelayMs  int `json:"answer_delay_ms" yaml:"answer_delay_ms"`
+	AnswerJitterMs int `json:"answer_jitter_ms" yaml:"answer_jitter_ms"`
+	// InactivityTimeoutMs closes a call once no RTP at all has arrived for
+	// this long, e.g. a caller whose app was killed before ICE noticed.
+	// Unlike silence, which still arrives as packets, this is the stream
+	// stopping. Zero disables it.
+	InactivityTimeoutMs int `json:"inactivity_timeout_ms" yaml:"inactivity_timeout_ms"`
+	// RTPReadTimeoutMs hangs up once a single read of the audio track has
+	// waited this long, so a frozen track ends the call from the read loop
+	// itself. Zero disables it, leaving InactivityTimeoutMs to notice.
+	RTPReadTimeoutMs int `json:"rtp_read_timeout_ms" yaml:"rtp_read_timeout_ms"`
+	// CheckPayloadType drops RTP packets whose payload type wasn't
+	// negotiated for the audio track instead of decoding them.
+	CheckPayloadType bool `json:"check_payload_type" yaml:"check_payload_type"`
+	// JitterBufferMaxMs, when set, reorders inbound packets before they are
+	// decoded: on a gap in the sequence, later packets wait for the missing
+	// one up to a delay that follows the measured jitter, between
+	// JitterBufferMinMs and this. Zero decodes packets as they arrive.
+	JitterBufferMaxMs int `json:"jitter_buffer_max_ms" yaml:"jitter_buffer_max_ms"`
+	JitterBufferMinMs int `json:"jitter_buffer_min_ms" yaml:"jitter_buffer_min_ms"`
+
+	// VADMode is the WebRTC VAD aggressiveness, 0 (least) to 3 (most).
+	VADMode int `json:"vad_mode" yaml:"vad_mode"`
+	// VADSmoothingFrames is the odd-sized window of the majority vote over
+	// raw VAD decisions; 1 disables smoothing.
+	VADSmoothingFrames int `json:"vad_smoothing_frames" yaml:"vad_smoothing_frames"`
+	// VADWindowsMs, when set, judges each frame at several VAD window
+	// lengths (10, 20 or 30 ms) and takes a vote over them before
+	// smoothing, e.g. [10, 30]. Unset judges each 20 ms frame whole.
+	VADWindowsMs []int `json:"vad_windows_ms" yaml:"vad_windows_ms"`
+	// VADWarmupMs ignores VAD for this long from the call's first audio,
+	// where connection pops and clicks would otherwise start utterances.
+	// The audio is still decoded.
+	VADWarmupMs int `json:"vad_warmup_ms" yaml:"vad_warmup_ms"`
+	// VADPassthrough skips VAD and hands all decoded audio to the
+	// transcriber in PassthroughChunkMs chunks, for transcribers that do
+	// their own endpointing. There is no barge-in; a reply is interrupted
+	// only by the next chunk that transcribes to text.
+	VADPassthrough     bool `json:"vad_passthrough" yaml:"vad_passthrough"`
+	PassthroughChunkMs int  `json:"passthrough_chunk_ms" yaml:"passthrough_chunk_ms"`
+	// SilenceMs is how much trailing silence ends an utterance.
+	SilenceMs int `json:"silence_ms" yaml:"silence_ms"`
+	// PauseMs, when set, tells a PauseListener agent that the caller has
+	// gone quiet this long mid-utterance. It must be shorter than SilenceMs.
+	PauseMs int `json:"pause_ms" yaml:"pause_ms"`
+	// CheckpointMs, when set, transcribes the utterance so far at such a
+	// pause once this much more has been said since the last checkpoint,
+	// relaying a partial transcript while the turn goes on. Needs PauseMs.
+	CheckpointMs int `json:"checkpoint_ms" yaml:"checkpoint_ms"`
+	// CoalesceMs, when set, holds an ended utterance this long in case the
+	// caller speaks again, and merges what follows into it, so backchannels
+	// and quick bursts reach the transcriber as one segment.
+	CoalesceMs int `json:"coalesce_ms" yaml:"coalesce_ms"`
+	// MinTranscribeMs, when set, batches ended utterances shorter than this
+	// until they add up to it, for STT backends that prefer larger
+	// requests; the transcriber gets each utterance's place in the batch.
+	// A batch waits at most this long for more.
+	MinTranscribeMs int `json:"min_transcribe_ms" yaml:"min_transcribe_ms"`
+	// StreamChunkMs is the chunk size an utterance is streamed in once it
+	// outgrows one, when the transcriber is a StreamingTranscriber. Zero
+	// buffers whole utterances even then; so does MinTranscribeMs.
+	StreamChunkMs int `json:"stream_chunk_ms" yaml:"stream_chunk_ms"`
+	// MinSpeechMs and MinSpeechRMS drop utterances with too little speech
+	// (VAD-positive frames) or too little energy to be worth transcribing.
+	// Zero disables either check.
+	MinSpeechMs  int     `json:"min_speech_ms" yaml:"min_speech_ms"`
+	MinSpeechRMS float64 `json:"min_speech_rms" yaml:"min_speech_rms"`
+	// The adaptive noise floor is an EMA of silence-frame RMS with separate
+	// rise (attack) and fall (decay) weights. Utterances must be at least
+	// NoiseFloorMargin times louder than it; zero disables the adaptive gate.
+	NoiseFloorAttack float64 `json:"noise_floor_attack" yaml:"noise_floor_attack"`
+	NoiseFloorDecay  float64 `json:"noise_floor_decay" yaml:"noise_floor_decay"`
+	NoiseFloorMargin float64 `json:"noise_floor_margin" yaml:"noise_floor_margin"`
+
+	// DTMFFlush ends the current utterance as soon as the caller presses a
+	// key, for IVR-style flows.
+	DTMFFlush bool `json:"dtmf_flush" yaml:"dtmf_flush"`
+
+	// OpusMaxAverageBitrate, when set, advertises maxaveragebitrate (bits/s)
+	// in the answer so the remote caps what it sends. OpusFEC advertises
+	// useinbandfec=1.
+	OpusMaxAverageBitrate int  `json:"opus_max_average_bitrate" yaml:"opus_max_average_bitrate"`
+	OpusFEC               bool `json:"opus_fec" yaml:"opus_fec"`
+	// OpusApplication is the outbound encoder's mode: "voip" (the default,
+	// tuned for speech), "audio" or "lowdelay".
+	OpusApplication string `json:"opus_application" yaml:"opus_application"`
+	// OpusComplexity trades the outbound encoder's CPU use for quality,
+	// from 0 (cheapest) to 10 (best).
+	OpusComplexity int `json:"opus_complexity" yaml:"opus_complexity"`
+	// OpusMaxBandwidth caps the audio band the outbound encoder codes:
+	// "narrowband" (4 kHz, for telephony interop), "mediumband",
+	// "wideband", "superwideband" or "fullband" (the default, 20 kHz).
+	OpusMaxBandwidth string `json:"opus_max_bandwidth" yaml:"opus_max_bandwidth"`
+	// OpusDTX enables discontinuous transmission on the outbound encoder, so
+	// silence within a reply costs a few bytes per frame, and advertises
+	// usedtx=1 in the answer.
+	OpusDTX bool `json:"opus_dtx" yaml:"opus_dtx"`
+	// OpusPacketLossPerc is the loss, in percent, the outbound encoder is
+	// told to expect; the lossier, the more it invests in in-band FEC. The
+	// default, -1, follows the measured loss instead.
+	OpusPacketLossPerc int `json:"opus_packet_loss_perc" yaml:"opus_packet_loss_perc"`
+	// ComfortNoiseDBFS, when set, keeps the outbound track sending shaped
+	// noise at this level (dB relative to full scale, e.g. -60) between
+	// replies instead of nothing, for clients that want a live-sounding
+	// line.
+	ComfortNoiseDBFS float64 `json:"comfort_noise_dbfs" yaml:"comfort_noise_dbfs"`
+
+	// TranscriptWebhookURL, when set, receives every transcript as a JSON
+	// POST; see webhookSink for the retry policy.
+	TranscriptWebhookURL string `json:"transcript_webhook_url" yaml:"transcript_webhook_url"`
+
+	// MaxPooledUtteranceSeconds caps the size of utterance buffers returned to
+	// the pool. Buffers grown past it by a long turn are left to the GC so a
+	// single monologue doesn't pin that memory for the life of the process.
+	MaxPooledUtteranceSeconds int `json:"utterance_pool_max_seconds" yaml:"utterance_pool_max_seconds"`
+	// MaxBufferedAudioMB caps the utterance audio buffered across all calls.
+	// Over it, the largest utterances are flushed to the transcriber early.
+	// 0 is unlimited.
+	MaxBufferedAudioMB int `json:"max_buffered_audio_mb" yaml:"max_buffered_audio_mb"`
+	// MaxConcurrentTranscriptions caps the Transcribe calls in flight
+	// across all calls; utterances beyond it wait their turn. 0 is
+	// unlimited.
+	MaxConcurrentTranscriptions int `json:"max_concurrent_transcriptions" yaml:"max_concurrent_transcriptions"`
+
+	// CaptureDir, when set, records each call's inbound Opus to an Ogg file
+	// there, for offline tuning with the vad-sweep command.
+	CaptureDir string `json:"capture_dir" yaml:"capture_dir"`
+
+	// PCMSink, when set, streams each call's decoded audio to an external
+	// processor at a unix:///path or udp://host:port address; see
+	// pcmStream for the framing.
+	PCMSink string `json:"pcm_sink" yaml:"pcm_sink"`
+
+	// StatsAddr, when set, serves live per-call quality as JSON at /stats
+	// on this address, e.g. ":9090".
+	StatsAddr string `json:"stats_addr" yaml:"stats_addr"`
+}
+
+// DefaultConfig returns the settings LoadConfig starts from; start from it,
+// not the zero Config, when building one in code. Besides tuning values,
+// a few defaults change what the peer does:
+//
+//   - SignalingReconnect is on, so a dropped signaling connection is
+//     redialed and live calls move to the new one.
+//   - TrickleICE is on, so candidates are relayed after the answer.
+//   - MaxSDPBytes is 64 KiB, so larger offers are rejected unparsed.
+//   - StreamChunkMs is 500, so a transcriber that implements
+//     StreamingTranscriber gets long utterances in chunks as they are
+//     spoken.
+//
+// Everything else that filters, drops or hangs up is off until set, e.g.
+// InactivityTimeoutMs, RTPReadTimeoutMs, CheckPayloadType, MinSpeechMs,
+// MinSpeechRMS, NoiseFloorMargin, DTMFFlush, MaxBufferedAudioMB,
+// MaxSessions, the jitter buffer and batching.
+func DefaultConfig() Config {
+	return Config{
+		SignalingURL:              defaultSignalingURL,
+		SignalingReconnect:        true,
+		SignalingReadBufferSize:   defaultSignalingBufferSize,
+		SignalingWriteBufferSize:  defaultSignalingBufferSize,
+		TrickleICE:                true,
+		ICETransportPolicy:        "all",
+		MaxSDPBytes:               64 << 10,
+		PeerID:                    defaultPeerID,
+		VADMode:                   3,
+		VADSmoothingFrames:        3,
+		SilenceMs:                 200,
+		PassthroughChunkMs:        1000,
+		NoiseFloorAttack:          0.02,
+		NoiseFloorDecay:           0.2,
+		OpusApplication:           "voip",
+		OpusComplexity:            5,
+		OpusMaxBandwidth:          "fullband",
+		OpusPacketLossPerc:        -1,
+		MaxPooledUtteranceSeconds: 30,
+		StreamChunkMs:             500,
+	}
+}
+
+// LoadConfig resolves the configuration for the given command-line
+// arguments (without the program name).
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("peer", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a JSON or YAML config file")
+	var flagCfg Config
+	fs.StringVar(&flagCfg.SignalingURL, "signaling-url", "", "signaling server WebSocket URL")
+	fs.StringVar(&flagCfg.PeerID, "peer-id", "", "ID to join the signaling server as")
+	fs.IntVar(&flagCfg.VADMode, "vad-mode", 0, "VAD aggressiveness, 0-3")
+	fs.IntVar(&flagCfg.SilenceMs, "silence-ms", 0, "trailing silence that ends an utterance")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.SignalingURL = envString("SIGNALING_URL", cfg.SignalingURL)
+	if v := envString("SIGNALING_URLS", ""); v != "" {
+		cfg.SignalingURLs = splitList(v)
+	}
+	cfg.SignalingReadBufferSize = envInt("SIGNALING_READ_BUFFER_SIZE", cfg.SignalingReadBufferSize)
+	cfg.SignalingWriteBufferSize = envInt("SIGNALING_WRITE_BUFFER_SIZE", cfg.SignalingWriteBufferSize)
+	cfg.SignalingReconnect = envBool("SIGNALING_RECONNECT", cfg.SignalingReconnect)
+	cfg.PeerID = envString("PEER_ID", cfg.PeerID)
+	if v := envString("ICE_SERVERS", ""); v != "" {
+		cfg.ICEServers = splitList(v)
+	}
+	cfg.ICEUsername = envString("ICE_USERNAME", cfg.ICEUsername)
+	cfg.ICECredential = envString("ICE_CREDENTIAL", cfg.ICECredential)
+	cfg.ICETransportPolicy = envString("ICE_TRANSPORT_POLICY", cfg.ICETransportPolicy)
+	cfg.TrickleICE = envBool("TRICKLE_ICE", cfg.TrickleICE)
+	cfg.MaxSessions = envInt("MAX_SESSIONS", cfg.MaxSessions)
+	cfg.MaxSDPBytes = envInt("MAX_SDP_BYTES", cfg.MaxSDPBytes)
+	cfg.AnswerDelayMs = envInt("ANSWER_DELAY_MS", cfg.AnswerDelayMs)
+	cfg.AnswerJitterMs = envInt("ANSWER_JITTER_MS", cfg.AnswerJitterMs)
+	cfg.InactivityTimeoutMs = envInt("INACTIVITY_TIMEOUT_MS", cfg.InactivityTimeoutMs)
+	cfg.RTPReadTimeoutMs = envInt("RTP_READ_TIMEOUT_MS", cfg.RTPReadTimeoutMs)
+	cfg.CheckPayloadType = envBool("CHECK_PAYLOAD_TYPE", cfg.CheckPayloadType)
+	cfg.JitterBufferMaxMs = envInt("JITTER_BUFFER_MAX_MS", cfg.JitterBufferMaxMs)
+	cfg.JitterBufferMinMs = envInt("JITTER_BUFFER_MIN_MS", cfg.JitterBufferMinMs)
+	cfg.VADMode = envInt("VAD_MODE", cfg.VADMode)
+	cfg.VADSmoothingFrames = envInt("VAD_SMOOTHING_FRAMES", cfg.VADSmoothingFrames)
+	cfg.VADWindowsMs = envInts("VAD_WINDOWS_MS", cfg.VADWindowsMs)
+	cfg.VADWarmupMs = envInt("VAD_WARMUP_MS", cfg.VADWarmupMs)
+	cfg.VADPassthrough = envBool("VAD_PASSTHROUGH", cfg.VADPassthrough)
+	cfg.PassthroughChunkMs = envInt("PASSTHROUGH_CHUNK_MS", cfg.PassthroughChunkMs)
+	cfg.SilenceMs = envInt("SILENCE_MS", cfg.SilenceMs)
+	cfg.PauseMs = envInt("PAUSE_MS", cfg.PauseMs)
+	cfg.CheckpointMs = envInt("CHECKPOINT_MS", cfg.CheckpointMs)
+	cfg.CoalesceMs = envInt("COALESCE_MS", cfg.CoalesceMs)
+	cfg.MinTranscribeMs = envInt("MIN_TRANSCRIBE_MS", cfg.MinTranscribeMs)
+	cfg.StreamChunkMs = envInt("STREAM_CHUNK_MS", cfg.StreamChunkMs)
+	cfg.MinSpeechMs = envInt("MIN_SPEECH_MS", cfg.MinSpeechMs)
+	cfg.MinSpeechRMS = envFloat("MIN_SPEECH_RMS", cfg.MinSpeechRMS)
+	cfg.NoiseFloorAttack = envFloat("NOISE_FLOOR_ATTACK", cfg.NoiseFloorAttack)
+	cfg.NoiseFloorDecay = envFloat("NOISE_FLOOR_DECAY", cfg.NoiseFloorDecay)
+	cfg.NoiseFloorMargin = envFloat("NOISE_FLOOR_MARGIN", cfg.NoiseFloorMargin)
+	cfg.DTMFFlush = envBool("DTMF_FLUSH", cfg.DTMFFlush)
+	cfg.OpusMaxAverageBitrate = envInt("OPUS_MAX_AVERAGE_BITRATE", cfg.OpusMaxAverageBitrate)
+	cfg.OpusFEC = envBool("OPUS_FEC", cfg.OpusFEC)
+	cfg.OpusApplication = envString("OPUS_APPLICATION", cfg.OpusApplication)
+	cfg.OpusComplexity = envInt("OPUS_COMPLEXITY", cfg.OpusComplexity)
+	cfg.OpusMaxBandwidth = envString("OPUS_MAX_BANDWIDTH", cfg.OpusMaxBandwidth)
+	cfg.OpusDTX = envBool("OPUS_DTX", cfg.OpusDTX)
+	cfg.OpusPacketLossPerc = envInt("OPUS_PACKET_LOSS_PERC", cfg.OpusPacketLossPerc)
+	cfg.ComfortNoiseDBFS = envFloat("COMFORT_NOISE_DBFS", cfg.ComfortNoiseDBFS)
+	cfg.TranscriptWebhookURL = envString("TRANSCRIPT_WEBHOOK_URL", cfg.TranscriptWebhookURL)
+	cfg.MaxPooledUtteranceSeconds = envInt("UTTERANCE_POOL_MAX_SECONDS", cfg.MaxPooledUtteranceSeconds)
+	cfg.MaxBufferedAudioMB = envInt("MAX_BUFFERED_AUDIO_MB", cfg.MaxBufferedAudioMB)
+	cfg.MaxConcurrentTranscriptions = envInt("MAX_CONCURRENT_TRANSCRIPTIONS", cfg.MaxConcurrentTranscriptions)
+	cfg.CaptureDir = envString("CAPTURE_DIR", cfg.CaptureDir)
+	cfg.PCMSink = envString("PCM_SINK", cfg.PCMSink)
+	cfg.StatsAddr = envString("STATS_ADDR", cfg.StatsAddr)
+
+	// Only flags given explicitly override, so a flag's zero value never
+	// clobbers the file or environment.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "signaling-url":
+			cfg.SignalingURL = flagCfg.SignalingURL
+			cfg.SignalingURLs = nil
+		case "peer-id":
+			cfg.PeerID = flagCfg.PeerID
+		case "vad-mode":
+			cfg.VADMode = flagCfg.VADMode
+		case "silence-ms":
+			cfg.SilenceMs = flagCfg.SilenceMs
+		}
+	})
+
+	return cfg, cfg.validate()
+}
+
+// loadConfigFile decodes a JSON or YAML file (chosen by extension) over cfg.
+// Unknown keys are an error so typos don't silently fall back to defaults.
+func loadConfigFile(path string, cfg *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config %s: unsupported extension, want .json, .yaml or .yml", path)
+	}
+	return nil
+}
+
+func (c Config) validate() error {
+	var errs []error
+	for _, raw := range c.signalingURLs() {
+		if u, err := url.Parse(raw); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("signaling URL %q is not a valid URL", raw))
+		}
+	}
+	if c.SignalingReadBufferSize <= 0 || c.SignalingWriteBufferSize <= 0 {
+		errs = append(errs, errors.New("signaling_read_buffer_size and signaling_write_buffer_size must be positive"))
+	}
+	if c.PeerID == "" {
+		errs = append(errs, errors.New("peer_id must be set"))
+	}
+	switch c.ICETransportPolicy {
+	case "all":
+	case "relay":
+		if !slices.ContainsFunc(c.ICEServers, isTURNURL) {
+			errs = append(errs, errors.New("ice_transport_policy relay needs a turn: or turns: server in ice_servers"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("ice_transport_policy %q must be all or relay", c.ICETransportPolicy))
+	}
+	if c.MaxSessions < 0 {
+		errs = append(errs, errors.New("max_sessions must not be negative"))
+	}
+	if c.MaxSDPBytes < 0 {
+		errs = append(errs, errors.New("max_sdp_bytes must not be negative"))
+	}
+	if c.AnswerDelayMs < 0 {
+		errs = append(errs, errors.New("answer_delay_ms must not be negative"))
+	}
+	if c.AnswerJitterMs < 0 {
+		errs = append(errs, errors.New("answer_jitter_ms must not be negative"))
+	}
+	if c.InactivityTimeoutMs < 0 {
+		errs = append(errs, errors.New("inactivity_timeout_ms must not be negative"))
+	}
+	if c.RTPReadTimeoutMs < 0 {
+		errs = append(errs, errors.New("rtp_read_timeout_ms must not be negative"))
+	}
+	if c.JitterBufferMinMs < 0 || c.JitterBufferMaxMs < 0 {
+		errs = append(errs, errors.New("jitter_buffer_min_ms and jitter_buffer_max_ms must not be negative"))
+	}
+	if c.JitterBufferMaxMs > 0 && c.JitterBufferMinMs > c.JitterBufferMaxMs {
+		errs = append(errs, errors.New("jitter_buffer_min_ms must not exceed jitter_buffer_max_ms"))
+	}
+	if c.VADMode < 0 || c.VADMode > 3 {
+		errs = append(errs, fmt.Errorf("vad_mode %d out of range 0-3", c.VADMode))
+	}
+	if c.VADSmoothingFrames < 1 || c.VADSmoothingFrames%2 == 0 {
+		errs = append(errs, fmt.Errorf("vad_smoothing_frames %d must be a positive odd number", c.VADSmoothingFrames))
+	}
+	for i, ms := range c.VADWindowsMs {
+		if !slices.Contains(vadWindowSizes, ms) {
+			errs = append(errs, fmt.Errorf("vad_windows_ms: %d ms is not a VAD window length (10, 20 or 30)", ms))
+		} else if slices.Contains(c.VADWindowsMs[:i], ms) {
+			errs = append(errs, fmt.Errorf("vad_windows_ms: %d ms listed twice", ms))
+		}
+	}
+	if c.VADWarmupMs < 0 {
+		errs = append(errs, errors.New("vad_warmup_ms must not be negative"))
+	}
+	if c.VADPassthrough && c.PassthroughChunkMs < frameDuration {
+		errs = append(errs, fmt.Errorf("passthrough_chunk_ms %d shorter than one %dms frame", c.PassthroughChunkMs, frameDuration))
+	}
+	if c.SilenceMs < frameDuration {
+		errs = append(errs, fmt.Errorf("silence_ms %d shorter than one %dms frame", c.SilenceMs, frameDuration))
+	}
+	if c.PauseMs < 0 || (c.PauseMs > 0 && c.PauseMs >= c.SilenceMs) {
+		errs = append(errs, fmt.Errorf("pause_ms %d must be between 0 and silence_ms %d", c.PauseMs, c.SilenceMs))
+	}
+	if c.CheckpointMs < 0 {
+		errs = append(errs, errors.New("checkpoint_ms must not be negative"))
+	} else if c.CheckpointMs > 0 && c.PauseMs == 0 {
+		errs = append(errs, errors.New("checkpoint_ms requires pause_ms"))
+	}
+	if c.CoalesceMs < 0 {
+		errs = append(errs, errors.New("coalesce_ms must not be negative"))
+	}
+	if c.MinTranscribeMs < 0 {
+		errs = append(errs, errors.New("min_transcribe_ms must not be negative"))
+	}
+	if c.StreamChunkMs < 0 {
+		errs = append(errs, errors.New("stream_chunk_ms must not be negative"))
+	}
+	if c.MinSpeechMs < 0 || c.MinSpeechRMS < 0 {
+		errs = append(errs, errors.New("min_speech_ms and min_speech_rms must not be negative"))
+	}
+	for name, w := range map[string]float64{"noise_floor_attack": c.NoiseFloorAttack, "noise_floor_decay": c.NoiseFloorDecay} {
+		if w <= 0 || w > 1 {
+			errs = append(errs, fmt.Errorf("%s %v must be in (0, 1]", name, w))
+		}
+	}
+	if c.NoiseFloorMargin < 0 {
+		errs = append(errs, errors.New("noise_floor_margin must not be negative"))
+	}
+	if c.OpusMaxAverageBitrate != 0 && (c.OpusMaxAverageBitrate < 6000 || c.OpusMaxAverageBitrate > 510000) {
+		errs = append(errs, fmt.Errorf("opus_max_average_bitrate %d outside Opus range 6000-510000", c.OpusMaxAverageBitrate))
+	}
+	if _, ok := opusApplications[c.OpusApplication]; !ok {
+		errs = append(errs, fmt.Errorf("opus_application %q must be voip, audio or lowdelay", c.OpusApplication))
+	}
+	if c.TranscriptWebhookURL != "" {
+		if u, err := url.Parse(c.TranscriptWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("transcript_webhook_url %q is not an http(s) URL", c.TranscriptWebhookURL))
+		}
+	}
+	if c.OpusComplexity < 0 || c.OpusComplexity > 10 {
+		errs = append(errs, fmt.Errorf("opus_complexity %d out of range 0-10", c.OpusComplexity))
+	}
+	if _, ok := opusBandwidths[c.OpusMaxBandwidth]; !ok {
+		errs = append(errs, fmt.Errorf("opus_max_bandwidth %q must be narrowband, mediumband, wideband, superwideband or fullband", c.OpusMaxBandwidth))
+	}
+	if c.OpusPacketLossPerc < -1 || c.OpusPacketLossPerc > 100 {
+		errs = append(errs, fmt.Errorf("opus_packet_loss_perc %d must be -1 (measured) or 0-100", c.OpusPacketLossPerc))
+	}
+	if c.PCMSink != "" {
+		if _, err := parsePCMSink(c.PCMSink); err != nil {
+			errs = append(errs, fmt.Errorf("pcm_sink %q: %w", c.PCMSink, err))
+		}
+	}
+	if c.ComfortNoiseDBFS > 0 || (c.ComfortNoiseDBFS != 0 && c.ComfortNoiseDBFS < -96) {
+		errs = append(errs, fmt.Errorf("comfort_noise_dbfs %v must be between -96 and 0", c.ComfortNoiseDBFS))
+	}
+	if c.MaxPooledUtteranceSeconds < 0 {
+		errs = append(errs, errors.New("utterance_pool_max_seconds must not be negative"))
+	}
+	if c.MaxBufferedAudioMB < 0 {
+		errs = append(errs, errors.New("max_buffered_audio_mb must not be negative"))
+	}
+	if c.MaxConcurrentTranscriptions < 0 {
+		errs = append(errs, errors.New("max_concurrent_transcriptions must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// signalingURLs lists the signaling servers in failover order.
+func (c Config) signalingURLs() []string {
+	if len(c.SignalingURLs) > 0 {
+		return c.SignalingURLs
+	}
+	return []string{c.SignalingURL}
+}
+
+// envString reads a string environment variable, returning def when unset.
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer environment variable, returning def when it is
+// unset or unparsable.
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+// envInts reads a comma-separated list of integers, returning def when it
+// is unset or any entry is unparsable.
+func envInts(key string, def []int) []int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	var out []int
+	for _, s := range splitList(v) {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+			return def
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// envBool reads a boolean environment variable, returning def when it is
+// unset or unparsable.
+func envBool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return b
+}
+
+// envFloat reads a float environment variable, returning def when it is
+// unset or unparsable.
+func envFloat(key string, def float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return f
+}
+
+// isTURNURL reports whether an ice_servers entry names a TURN server.
+func isTURNURL(u string) bool {
+	return strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:")
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,216 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file named name with contents into a
+// directory the test cleans up, returning its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	files := map[string]string{
+		"peer.yaml": "peer_id: from-file\nvad_mode: 1\nsilence_ms: 400\nice_servers: [\"stun:stun.example.com:3478\"]\n",
+		"peer.json": `{"peer_id": "from-file", "vad_mode": 1, "silence_ms": 400, "ice_servers": ["stun:stun.example.com:3478"]}`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, name, contents)
+			cfg, err := LoadConfig([]string{"-config", path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.PeerID != "from-file" || cfg.VADMode != 1 || cfg.SilenceMs != 400 ||
+				len(cfg.ICEServers) != 1 || cfg.ICEServers[0] != "stun:stun.example.com:3478" {
+				t.Errorf("got %+v, want the file's settings", cfg)
+			}
+			// What the file leaves out keeps its default.
+			if cfg.SignalingURL != defaultSignalingURL || cfg.VADSmoothingFrames != 3 {
+				t.Errorf("signaling_url %q, vad_smoothing_frames %d; want the defaults", cfg.SignalingURL, cfg.VADSmoothingFrames)
+			}
+
+			// The environment overrides the file, and flags override both.
+			t.Setenv("PEER_ID", "from-env")
+			t.Setenv("VAD_MODE", "2")
+			cfg, err = LoadConfig([]string{"-config", path, "-vad-mode", "0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.PeerID != "from-env" || cfg.VADMode != 0 || cfg.SilenceMs != 400 {
+				t.Errorf("peer_id %q, vad_mode %d, silence_ms %d; want from-env, the flag's 0 and the file's 400", cfg.PeerID, cfg.VADMode, cfg.SilenceMs)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name, contents string
+		want           string
+	}{
+		{"typo.yaml", "peer_idd: x\n", "peer_idd"},
+		{"typo.json", `{"peer_idd": "x"}`, "peer_idd"},
+		{"bad.json", `{"peer_id": `, "parse"},
+		{"peer.toml", `peer_id = "x"`, "unsupported extension"},
+		{"invalid.yaml", "vad_mode: 7\n", "vad_mode 7 out of range"},
+		{"relay.yaml", "ice_transport_policy: relay\nice_servers: [\"stun:stun.example.com:3478\"]\n", "ice_transport_policy relay needs a turn: or turns: server"},
+		{"passthrough.yaml", "vad_passthrough: true\npassthrough_chunk_ms: 10\n", "passthrough_chunk_ms 10 shorter than one 20ms frame"},
+	}
+	for _, tt := range tests {
+		path := writeConfig(t, tt.name, tt.contents)
+		if _, err := LoadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: LoadConfig = %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("LoadConfig accepted a config file that doesn't exist")
+	}
+	// An empty YAML file is no settings, not an error.
+	if _, err := LoadConfig([]string{"-config", writeConfig(t, "empty.yaml", "")}); err != nil {
+		t.Errorf("empty YAML file: %v", err)
+	}
+}
+
+// Each setting is read from its environment variable and checked.
+func TestLoadConfigEnv(t *testing.T) {
+	tests := []struct {
+		env, value string
+		check      func(Config) bool // the setting took; nil if it's invalid
+		err        string            // part of the error an invalid value gives
+	}{
+		{"MIN_SPEECH_MS", "250", func(c Config) bool { return c.MinSpeechMs == 250 }, ""},
+		{"MIN_SPEECH_MS", "-1", nil, "min_speech_ms and min_speech_rms must not be negative"},
+		{"MIN_SPEECH_RMS", "80.5", func(c Config) bool { return c.MinSpeechRMS == 80.5 }, ""},
+		{"MIN_SPEECH_RMS", "-1", nil, "min_speech_ms and min_speech_rms must not be negative"},
+		{"VAD_SMOOTHING_FRAMES", "5", func(c Config) bool { return c.VADSmoothingFrames == 5 }, ""},
+		{"VAD_SMOOTHING_FRAMES", "4", nil, "vad_smoothing_frames 4 must be a positive odd number"},
+		{"VAD_WINDOWS_MS", "10, 30", func(c Config) bool { return slices.Equal(c.VADWindowsMs, []int{10, 30}) }, ""},
+		{"VAD_WINDOWS_MS", "10,x", func(c Config) bool { return c.VADWindowsMs == nil }, ""},
+		{"VAD_WINDOWS_MS", "10,15", nil, "vad_windows_ms: 15 ms is not a VAD window length (10, 20 or 30)"},
+		{"VAD_WINDOWS_MS", "20,10,20", nil, "vad_windows_ms: 20 ms listed twice"},
+		{"VAD_WARMUP_MS", "300", func(c Config) bool { return c.VADWarmupMs == 300 }, ""},
+		{"VAD_WARMUP_MS", "-1", nil, "vad_warmup_ms must not be negative"},
+		{"VAD_PASSTHROUGH", "true", func(c Config) bool { return c.VADPassthrough && c.PassthroughChunkMs == 1000 }, ""},
+		{"PASSTHROUGH_CHUNK_MS", "500", func(c Config) bool { return c.PassthroughChunkMs == 500 }, ""},
+		{"NOISE_FLOOR_ATTACK", "0.05", func(c Config) bool { return c.NoiseFloorAttack == 0.05 }, ""},
+		{"NOISE_FLOOR_ATTACK", "0", nil, "noise_floor_attack 0 must be in (0, 1]"},
+		{"NOISE_FLOOR_DECAY", "1", func(c Config) bool { return c.NoiseFloorDecay == 1 }, ""},
+		{"NOISE_FLOOR_DECAY", "1.5", nil, "noise_floor_decay 1.5 must be in (0, 1]"},
+		{"NOISE_FLOOR_MARGIN", "3", func(c Config) bool { return c.NoiseFloorMargin == 3 }, ""},
+		{"NOISE_FLOOR_MARGIN", "-1", nil, "noise_floor_margin must not be negative"},
+		{"PAUSE_MS", "100", func(c Config) bool { return c.PauseMs == 100 }, ""},
+		{"PAUSE_MS", "200", nil, "pause_ms 200 must be between 0 and silence_ms 200"},
+		{"CHECKPOINT_MS", "-1", nil, "checkpoint_ms must not be negative"},
+		{"CHECKPOINT_MS", "1000", nil, "checkpoint_ms requires pause_ms"},
+		{"COALESCE_MS", "300", func(c Config) bool { return c.CoalesceMs == 300 }, ""},
+		{"COALESCE_MS", "-20", nil, "coalesce_ms must not be negative"},
+		{"MIN_TRANSCRIBE_MS", "1000", func(c Config) bool { return c.MinTranscribeMs == 1000 }, ""},
+		{"MIN_TRANSCRIBE_MS", "-1", nil, "min_transcribe_ms must not be negative"},
+		{"STREAM_CHUNK_MS", "0", func(c Config) bool { return c.StreamChunkMs == 0 }, ""},
+		{"STREAM_CHUNK_MS", "-1", nil, "stream_chunk_ms must not be negative"},
+		{"DTMF_FLUSH", "true", func(c Config) bool { return c.DTMFFlush }, ""},
+		{"OPUS_COMPLEXITY", "0", func(c Config) bool { return c.OpusComplexity == 0 }, ""},
+		{"OPUS_COMPLEXITY", "11", nil, "opus_complexity 11 out of range 0-10"},
+		{"OPUS_MAX_BANDWIDTH", "wideband", func(c Config) bool { return c.OpusMaxBandwidth == "wideband" }, ""},
+		{"OPUS_MAX_BANDWIDTH", "ultraband", nil, `opus_max_bandwidth "ultraband" must be narrowband, mediumband, wideband, superwideband or fullband`},
+		{"OPUS_DTX", "true", func(c Config) bool { return c.OpusDTX }, ""},
+		{"OPUS_PACKET_LOSS_PERC", "10", func(c Config) bool { return c.OpusPacketLossPerc == 10 }, ""},
+		{"OPUS_PACKET_LOSS_PERC", "101", nil, "opus_packet_loss_perc 101 must be -1 (measured) or 0-100"},
+		{"COMFORT_NOISE_DBFS", "-60", func(c Config) bool { return c.ComfortNoiseDBFS == -60 }, ""},
+		{"COMFORT_NOISE_DBFS", "-100", nil, "comfort_noise_dbfs -100 must be between -96 and 0"},
+		{"COMFORT_NOISE_DBFS", "3", nil, "comfort_noise_dbfs 3 must be between -96 and 0"},
+		{"OPUS_APPLICATION", "lowdelay", func(c Config) bool { return c.OpusApplication == "lowdelay" }, ""},
+		{"OPUS_APPLICATION", "VoIP", nil, `opus_application "VoIP" must be voip, audio or lowdelay`},
+		{"TRANSCRIPT_WEBHOOK_URL", "https://hooks.example/t", func(c Config) bool { return c.TranscriptWebhookURL == "https://hooks.example/t" }, ""},
+		{"TRANSCRIPT_WEBHOOK_URL", "ftp://hooks.example/t", nil, `transcript_webhook_url "ftp://hooks.example/t" is not an http(s) URL`},
+		{"STATS_ADDR", ":9090", func(c Config) bool { return c.StatsAddr == ":9090" }, ""},
+		{"MAX_BUFFERED_AUDIO_MB", "0", func(c Config) bool { return c.MaxBufferedAudioMB == 0 }, ""},
+		{"MAX_BUFFERED_AUDIO_MB", "-1", nil, "max_buffered_audio_mb must not be negative"},
+		{"MAX_CONCURRENT_TRANSCRIPTIONS", "4", func(c Config) bool { return c.MaxConcurrentTranscriptions == 4 }, ""},
+		{"MAX_CONCURRENT_TRANSCRIPTIONS", "-1", nil, "max_concurrent_transcriptions must not be negative"},
+		{"PCM_SINK", "udp://127.0.0.1:7000", func(c Config) bool { return c.PCMSink == "udp://127.0.0.1:7000" }, ""},
+		{"PCM_SINK", "tcp://127.0.0.1:7000", nil, `pcm_sink "tcp://127.0.0.1:7000": want unix:///path or udp://host:port`},
+		{"SIGNALING_URLS", "ws://a.example/ws, ws://b.example/ws", func(c Config) bool {
+			return slices.Equal(c.signalingURLs(), []string{"ws://a.example/ws", "ws://b.example/ws"})
+		}, ""},
+		{"SIGNALING_URLS", "ws://a.example/ws,b.example", nil, `signaling URL "b.example" is not a valid URL`},
+		{"ICE_TRANSPORT_POLICY", "all", func(c Config) bool { return c.ICETransportPolicy == "all" }, ""},
+		{"ICE_TRANSPORT_POLICY", "relay", nil, "ice_transport_policy relay needs a turn: or turns: server in ice_servers"},
+		{"ICE_TRANSPORT_POLICY", "host", nil, `ice_transport_policy "host" must be all or relay`},
+		{"ICE_USERNAME", "agent", func(c Config) bool { return c.ICEUsername == "agent" }, ""},
+		{"ICE_CREDENTIAL", "secret", func(c Config) bool { return c.ICECredential == "secret" }, ""},
+		{"SIGNALING_RECONNECT", "false", func(c Config) bool { return !c.SignalingReconnect }, ""},
+		{"MAX_SDP_BYTES", "0", func(c Config) bool { return c.MaxSDPBytes == 0 }, ""},
+		{"MAX_SDP_BYTES", "-1", nil, "max_sdp_bytes must not be negative"},
+		{"INACTIVITY_TIMEOUT_MS", "0", func(c Config) bool { return c.InactivityTimeoutMs == 0 }, ""},
+		{"INACTIVITY_TIMEOUT_MS", "-1", nil, "inactivity_timeout_ms must not be negative"},
+		{"CHECK_PAYLOAD_TYPE", "false", func(c Config) bool { return !c.CheckPayloadType }, ""},
+		{"RTP_READ_TIMEOUT_MS", "500", func(c Config) bool { return c.RTPReadTimeoutMs == 500 }, ""},
+		{"RTP_READ_TIMEOUT_MS", "-1", nil, "rtp_read_timeout_ms must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			cfg, err := LoadConfig(nil)
+			if tt.check == nil {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("LoadConfig = %v, want an error mentioning %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("%s=%s not applied: %+v", tt.env, tt.value, cfg)
+			}
+		})
+	}
+}
+
+// -signaling-url names the one server to use, over any list.
+func TestSignalingURLFlag(t *testing.T) {
+	t.Setenv("SIGNALING_URLS", "ws://a.example/ws,ws://b.example/ws")
+	cfg, err := LoadConfig([]string{"-signaling-url", "ws://flag.example/ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.signalingURLs(); !slices.Equal(got, []string{"ws://flag.example/ws"}) {
+		t.Errorf("signaling URLs %v, want only the flag's", got)
+	}
+}
+
+// ice_transport_policy relay is accepted once a TURN server is listed.
+func TestRelayPolicyWithTURN(t *testing.T) {
+	for _, server := range []string{"turn:turn.example.com:3478", "turns:turn.example.com:5349"} {
+		path := writeConfig(t, "relay.yaml", "ice_transport_policy: relay\nice_servers: [\"stun:stun.example.com:3478\", \""+server+"\"]\n")
+		cfg, err := LoadConfig([]string{"-config", path})
+		if err != nil {
+			t.Errorf("%s: %v", server, err)
+		} else if cfg.ICETransportPolicy != "relay" {
+			t.Errorf("%s: policy %q, want relay", server, cfg.ICETransportPolicy)
+		}
+	}
+}
+
+// checkpoint_ms is accepted alongside pause_ms.
+func TestCheckpointConfig(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-config", writeConfig(t, "checkpoint.yaml", "pause_ms: 100\ncheckpoint_ms: 1000\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PauseMs != 100 || cfg.CheckpointMs != 1000 {
+		t.Errorf("pause_ms %d, checkpoint_ms %d; want the file's 100 and 1000", cfg.PauseMs, cfg.CheckpointMs)
+	}
+}
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// controlMessage is the data of a "control" message from the caller,
+// steering its live session.
+type controlMessage struct {
+	Action   string `json:"action"`
+	Language string `json:"language,omitempty"` // for "language"
+}
+
+// handleControl applies a caller's control message to its live session.
+func (p *Peer) handleControl(msg SignalMessage) error {
+	var ctl controlMessage
+	if err := decodeData(msg.Data, &ctl); err != nil {
+		return fmt.Errorf("decode control: %w", err)
+	}
+	session, ok := p.session(msg.From)
+	if !ok {
+		return fmt.Errorf("no live session with %s", msg.From)
+	}
+	switch ctl.Action {
+	case "flush":
+		session.FlushUtterance("control message")
+	case "abort":
+		session.AbortUtterance("control message")
+	case "mute", "unmute":
+		session.SetMuted(ctl.Action == "mute")
+	case "language":
+		if err := validateLanguage(ctl.Language); err != nil {
+			return err
+		}
+		session.SetLanguage(ctl.Language)
+	case "test_tone":
+		return session.PlayTestTone()
+	default:
+		return fmt.Errorf("unknown control action %q", ctl.Action)
+	}
+	return nil
+}
+
+// languageTag loosely matches a BCP 47 tag such as "en" or "pt-BR"; the
+// transcriber is the judge of which languages it actually supports.
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// validateLanguage accepts an empty tag, meaning automatic detection, or
+// something shaped like a BCP 47 tag.
+func validateLanguage(tag string) error {
+	if tag != "" && !languageTag.MatchString(tag) {
+		return fmt.Errorf("invalid language tag %q", tag)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// lengthTranscriber hands the test the length of every utterance it's
+// given.
+type lengthTranscriber struct{ lengths chan int }
+
+func (l lengthTranscriber) Transcribe(_ context.Context, pcm []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	l.lengths <- len(pcm)
+	return Transcription{}, nil
+}
+
+// newControlPeer answers a call from iphone-1 on a peer transcribing with
+// transcriber, returning the call's session.
+func newControlPeer(t *testing.T, transcriber Transcriber) (*Peer, *Session) {
+	t.Helper()
+	p, err := NewPeer(DefaultConfig(), Handlers{Transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := p.session("iphone-1")
+	return p, s
+}
+
+// control sends p a control message from iphone-1.
+func control(p *Peer, data map[string]interface{}) error {
+	return p.handleControl(SignalMessage{Type: "control", From: "iphone-1", Data: data})
+}
+
+// An aborted utterance is never transcribed, and none of it carries into
+// the next.
+func TestAbortControl(t *testing.T) {
+	transcriber := lengthTranscriber{lengths: make(chan int, 2)}
+	p, s := newControlPeer(t, transcriber)
+	next := func() int {
+		select {
+		case n := <-transcriber.lengths:
+			return n
+		case <-time.After(time.Second):
+			t.Fatal("utterance never transcribed")
+			return 0
+		}
+	}
+
+	s.sayFrame(squareFrame(4000), 10)
+	want := next()
+
+	s.speakFrames(15)
+	if err := control(p, map[string]interface{}{"action": "abort"}); err != nil {
+		t.Fatal(err)
+	}
+	s.sayFrame(squareFrame(6000), 10)
+	if got := next(); got != want {
+		t.Errorf("utterance after the abort has %d samples, want %d", got, want)
+	}
+	select {
+	case n := <-transcriber.lengths:
+		t.Errorf("%d more samples transcribed after the abort", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if s.AbortUtterance("test") {
+		t.Error("AbortUtterance reported discarding with no utterance in progress")
+	}
+
+	if err := control(p, map[string]interface{}{"action": "rewind"}); err == nil {
+		t.Error("unknown control action accepted")
+	}
+	if err := p.handleControl(SignalMessage{Type: "control", From: "iphone-2", Data: map[string]interface{}{"action": "abort"}}); err == nil {
+		t.Error("control message for no live call accepted")
+	}
+}
+
+// Muting discards the utterance in progress; muted audio is decoded but
+// never judged or transcribed, and speech after unmuting is.
+func TestMuteControl(t *testing.T) {
+	transcriber := lengthTranscriber{lengths: make(chan int, 2)}
+	p, s := newControlPeer(t, transcriber)
+	s.sayFrame(squareFrame(4000), 10)
+	want := <-transcriber.lengths
+
+	s.speakFrames(15)
+	if err := control(p, map[string]interface{}{"action": "mute"}); err != nil {
+		t.Fatal(err)
+	}
+	dec := &countingDecoder{pcm: toneFrame(frameSamples)}
+	vad := &listVAD{decisions: make([]bool, 50)}
+	for i := range vad.decisions {
+		vad.decisions[i] = true
+	}
+	s.dec, s.vad = dec, vad
+	before := s.VAD()
+	for seq := range uint16(50) {
+		s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+	}
+	if n := len(dec.decoded()); n != 50 {
+		t.Errorf("%d of 50 muted packets decoded", n)
+	}
+	if len(vad.decisions) != 50 || s.VAD() != before {
+		t.Errorf("muted audio reached VAD: %d decisions left, counters %+v then %+v", len(vad.decisions), before, s.VAD())
+	}
+
+	if err := control(p, map[string]interface{}{"action": "unmute"}); err != nil {
+		t.Fatal(err)
+	}
+	s.sayFrame(squareFrame(6000), 10)
+	select {
+	case got := <-transcriber.lengths:
+		if got != want {
+			t.Errorf("first utterance after unmuting has %d samples, want %d", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("speech after unmuting never transcribed")
+	}
+	select {
+	case n := <-transcriber.lengths:
+		t.Errorf("%d more samples transcribed", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// dedupWindow is how long a session remembers the utterances it has sent
+// for transcription. Audio replayed after a reconnect arrives again within
+// seconds; a caller repeating themselves never decodes to the same samples.
+const dedupWindow = 10 * time.Second
+
+// utteranceHash fingerprints pcm with 64-bit FNV-1a over its samples, so
+// identical audio always hashes the same.
+func utteranceHash(pcm []int16) uint64 {
+	h := fnv.New64a()
+	hashSamples(h, pcm)
+	return h.Sum64()
+}
+
+// hashSamples feeds pcm to h, so an utterance arriving in pieces hashes
+// the same as utteranceHash of the whole.
+func hashSamples(h hash.Hash64, pcm []int16) {
+	var b [2]byte
+	for _, v := range pcm {
+		binary.LittleEndian.PutUint16(b[:], uint16(v))
+		h.Write(b[:])
+	}
+}
+
+// recentUtterances remembers the fingerprints of a session's utterances
+// for dedupWindow. The zero value is ready to use.
+type recentUtterances struct {
+	seen map[uint64]time.Time
+}
+
+// repeat records h as seen at now and reports whether it was already seen
+// within the window. Expired fingerprints are swept as it goes, so the map
+// holds at most a window's worth.
+func (r *recentUtterances) repeat(h uint64, now time.Time) bool {
+	for k, at := range r.seen {
+		if now.Sub(at) >= dedupWindow {
+			delete(r.seen, k)
+		}
+	}
+	if _, ok := r.seen[h]; ok {
+		return true
+	}
+	if r.seen == nil {
+		r.seen = make(map[uint64]time.Time)
+	}
+	r.seen[h] = now
+	return false
+}
+
+// duplicateUtterance reports whether the utterance of samples hashing to h
+// is audio the session already sent for transcription within dedupWindow,
+// e.g. replayed after a reconnect. Callers hold stateMu.
+func (s *Session) duplicateUtterance(h uint64, samples int) bool {
+	if !s.recent.repeat(h, time.Now()) {
+		return false
+	}
+	s.count(droppedDuplicate)
+	log.Printf("[%s] Skipped utterance (%d ms) identical to one transcribed in the last %v",
+		s.TraceID, samples*1000/sampleRate, dedupWindow)
+	return true
+}
@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"hash/fnv"
+	"testing"
+	"time"
+)
+
+func TestUtteranceHash(t *testing.T) {
+	if got := utteranceHash(nil); got != 0xcbf29ce484222325 {
+		t.Errorf("hash of nothing %#x, want the FNV-1a offset basis", got)
+	}
+	a, b := squareFrame(4000), squareFrame(6000)
+	if utteranceHash(a) == utteranceHash(b) {
+		t.Error("different utterances hash the same")
+	}
+	h := fnv.New64a()
+	hashSamples(h, a[:100])
+	hashSamples(h, a[100:])
+	if h.Sum64() != utteranceHash(a) {
+		t.Error("utterance hashed in pieces differs from the whole")
+	}
+}
+
+// A fingerprint is a repeat within dedupWindow of when it was first seen,
+// and swept once that has passed.
+func TestRecentUtterances(t *testing.T) {
+	var r recentUtterances
+	start := time.Now()
+	steps := []struct {
+		h      uint64
+		after  time.Duration
+		repeat bool
+	}{
+		{1, 0, false},
+		{1, 5 * time.Second, true},
+		{2, 6 * time.Second, false},
+		{1, dedupWindow - time.Millisecond, true},
+		{1, dedupWindow, false}, // first seen a window ago
+		{2, 2 * dedupWindow, false},
+	}
+	for i, step := range steps {
+		if got := r.repeat(step.h, start.Add(step.after)); got != step.repeat {
+			t.Errorf("step %d: repeat(%d) = %v, want %v", i, step.h, got, step.repeat)
+		}
+	}
+	if len(r.seen) != 1 {
+		t.Errorf("%d fingerprints held, want the one within the window", len(r.seen))
+	}
+}
+
+// Of utterances A, A, B, A only the first A and B are transcribed; the
+// repeats are counted as duplicates. Passthrough chunks all go on.
+func TestDuplicateUtterances(t *testing.T) {
+	keeper := &keepingTranscriber{done: make(chan struct{}, 4)}
+	p, err := NewPeer(DefaultConfig(), Handlers{Transcriber: keeper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	s := newTurnSession(t, p, newRecordingTrack())
+	for _, amplitude := range []int16{4000, 4000, 6000, 4000} {
+		s.sayFrame(squareFrame(amplitude), 10)
+	}
+	p.wg.Wait()
+	if n, dups := len(keeper.kept), s.VAD().DroppedDuplicate; n != 2 || dups != 2 {
+		t.Errorf("%d transcribed and %d duplicates, want 2 and 2", n, dups)
+	}
+
+	cfg := DefaultConfig()
+	cfg.VADPassthrough, cfg.PassthroughChunkMs = true, 100
+	keeper = &keepingTranscriber{done: make(chan struct{}, 4)}
+	p, err = NewPeer(cfg, Handlers{Transcriber: keeper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ = newReadSession(t, p)
+	for seq := range uint16(15) {
+		s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+	}
+	p.wg.Wait()
+	if n := len(keeper.kept); n != 3 || s.VAD().DroppedDuplicate != 0 {
+		t.Errorf("%d of 3 identical passthrough chunks transcribed", n)
+	}
+}
@@ -0,0 +1,29 @@
+package pipeline
+
+// dtmfEvent is an RFC 4733 §2.3 telephone-event payload.
+type dtmfEvent struct {
+	event    uint8
+	end      bool
+	volume   uint8
+	duration uint16
+}
+
+const dtmfDigits = "0123456789*#ABCD"
+
+// parseDTMF decodes a telephone-event payload. Only the 16 DTMF events are
+// accepted.
+func parseDTMF(payload []byte) (dtmfEvent, bool) {
+	if len(payload) < 4 || int(payload[0]) >= len(dtmfDigits) {
+		return dtmfEvent{}, false
+	}
+	return dtmfEvent{
+		event:    payload[0],
+		end:      payload[1]&0x80 != 0,
+		volume:   payload[1] & 0x3f,
+		duration: uint16(payload[2])<<8 | uint16(payload[3]),
+	}, true
+}
+
+func (e dtmfEvent) digit() string {
+	return dtmfDigits[e.event : e.event+1]
+}
@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// jitterDelayFactor is how many times the measured jitter the buffer
+	// aims to hold back, enough to absorb most late packets without
+	// tracking every spike.
+	jitterDelayFactor = 3
+	// jitterShrink is the share of the gap to a lower target closed per
+	// packet: the delay grows at once when jitter rises, but only eases
+	// back over a couple of seconds of calm.
+	jitterShrink = 64
+	// jitterSpan is how far a packet's sequence number may stray from the
+	// next one due before it is taken for a restarted stream.
+	jitterSpan = dupWindow
+)
+
+// jitterBuffer holds inbound packets so the ones that arrive out of order
+// are decoded in sequence. The next packet in sequence is released as soon
+// as it arrives; on a gap, what came after it waits up to the target
+// delay for the missing packet before the gap is given up as lost. The
+// target follows the call's measured jitter within [minDelay, maxDelay].
+// It is owned by the read loop.
+type jitterBuffer struct {
+	minDelay, maxDelay time.Duration
+	target             time.Duration
+
+	started bool
+	next    uint16        // sequence number due next
+	held    []heldPacket  // in sequence order, all after next
+	ready   []*rtp.Packet // released but not yet popped
+}
+
+type heldPacket struct {
+	pkt     *rtp.Packet
+	arrival time.Time
+}
+
+func newJitterBuffer(minDelay, maxDelay time.Duration) *jitterBuffer {
+	return &jitterBuffer{minDelay: minDelay, maxDelay: maxDelay, target: minDelay}
+}
+
+// adapt moves the target delay toward jitterDelayFactor times jitterMs,
+// the call's smoothed interarrival jitter.
+func (jb *jitterBuffer) adapt(jitterMs float64) {
+	want := time.Duration(jitterDelayFactor * jitterMs * float64(time.Millisecond))
+	want = max(min(want, jb.maxDelay), jb.minDelay)
+	if want >= jb.target {
+		jb.target = want
+		return
+	}
+	jb.target -= max((jb.target-want)/jitterShrink, time.Microsecond)
+	jb.target = max(jb.target, want)
+}
+
+// push adds pkt, received at now. It reports false for a packet that came
+// after its place in the sequence was given up on, which is dropped.
+func (jb *jitterBuffer) push(pkt *rtp.Packet, now time.Time) bool {
+	seq := pkt.SequenceNumber
+	ahead := seqDiff(seq, jb.next)
+	if !jb.started || ahead >= jitterSpan || ahead <= -jitterSpan {
+		// A new stream: what is held belongs to the old one.
+		jb.flush()
+		jb.started = true
+		jb.next, ahead = seq, 0
+	}
+	if ahead < 0 {
+		return false
+	}
+	i := len(jb.held)
+	for i > 0 && seqNewer(jb.held[i-1].pkt.SequenceNumber, seq) {
+		i--
+	}
+	jb.held = append(jb.held, heldPacket{})
+	copy(jb.held[i+1:], jb.held[i:])
+	jb.held[i] = heldPacket{pkt: pkt, arrival: now}
+	return true
+}
+
+// pop returns the next packet to decode at now, or nil if there is none
+// yet.
+func (jb *jitterBuffer) pop(now time.Time) *rtp.Packet {
+	if len(jb.ready) > 0 {
+		pkt := jb.ready[0]
+		jb.ready = jb.ready[1:]
+		return pkt
+	}
+	if len(jb.held) == 0 {
+		return nil
+	}
+	if jb.held[0].pkt.SequenceNumber != jb.next && now.Before(jb.gapDeadline()) {
+		return nil
+	}
+	pkt := jb.held[0].pkt
+	jb.held = jb.held[1:]
+	jb.next = pkt.SequenceNumber + 1
+	return pkt
+}
+
+// due reports when the gap holding packets back will be given up on, if
+// any are held. Callers pop what is ready first.
+func (jb *jitterBuffer) due() (time.Time, bool) {
+	if len(jb.held) == 0 {
+		return time.Time{}, false
+	}
+	return jb.gapDeadline(), true
+}
+
+// gapDeadline is when the gap before the first held packet is given up
+// on: the target delay after the earliest arrival waiting behind it.
+func (jb *jitterBuffer) gapDeadline() time.Time {
+	first := jb.held[0].arrival
+	for _, h := range jb.held[1:] {
+		if h.arrival.Before(first) {
+			first = h.arrival
+		}
+	}
+	return first.Add(jb.target)
+}
+
+// flush releases everything held, gaps and all, for pop to return in
+// sequence.
+func (jb *jitterBuffer) flush() {
+	for _, h := range jb.held {
+		jb.ready = append(jb.ready, h.pkt)
+	}
+	if len(jb.held) > 0 {
+		jb.next = jb.held[len(jb.held)-1].pkt.SequenceNumber + 1
+	}
+	jb.held = jb.held[:0]
+}
@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func jitterPacket(seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * frameSamples}}
+}
+
+// popAll returns the sequence numbers of the packets jb releases at now.
+func popAll(jb *jitterBuffer, now time.Time) []uint16 {
+	var seqs []uint16
+	for pkt := jb.pop(now); pkt != nil; pkt = jb.pop(now) {
+		seqs = append(seqs, pkt.SequenceNumber)
+	}
+	return seqs
+}
+
+func TestJitterBufferReorders(t *testing.T) {
+	const delay = 60 * time.Millisecond
+	jb := newJitterBuffer(delay, delay)
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	steps := []struct {
+		name string
+		seq  uint16
+		ms   int
+		want []uint16
+	}{
+		{"in order", 65534, 0, []uint16{65534}},
+		{"ahead of a gap", 0, 40, nil},
+		{"filling the gap across the wrap", 65535, 50, []uint16{65535, 0}},
+		{"next in order", 1, 60, []uint16{1}},
+		{"ahead of another gap", 3, 100, nil},
+		{"still waiting", 4, 120, nil},
+	}
+	for _, step := range steps {
+		if !jb.push(jitterPacket(step.seq), at(step.ms)) {
+			t.Fatalf("%s: packet %d refused", step.name, step.seq)
+		}
+		if got := popAll(jb, at(step.ms)); !slices.Equal(got, step.want) {
+			t.Errorf("%s: released %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// The wait for 2 is timed from the arrival of 3.
+	if due, ok := jb.due(); !ok || !due.Equal(at(100).Add(delay)) {
+		t.Errorf("due = %v, %v; want %v", due, ok, at(100).Add(delay))
+	}
+	if got := popAll(jb, at(159)); got != nil {
+		t.Errorf("released %v before the gap was given up on", got)
+	}
+	if got := popAll(jb, at(160)); !slices.Equal(got, []uint16{3, 4}) {
+		t.Errorf("released %v once the gap was given up on, want [3 4]", got)
+	}
+	if jb.push(jitterPacket(2), at(170)) {
+		t.Error("packet 2 accepted after its gap was given up on")
+	}
+	if _, ok := jb.due(); ok {
+		t.Error("due with nothing held")
+	}
+
+	// A jump far ahead is a restarted stream: what was held goes first.
+	jb.push(jitterPacket(7), at(180))
+	jb.push(jitterPacket(30000), at(190))
+	if got := popAll(jb, at(190)); !slices.Equal(got, []uint16{7, 30000}) {
+		t.Errorf("released %v across a restart, want [7 30000]", got)
+	}
+}
+
+// The buffer's depth, its target delay, grows as soon as jitter rises and
+// eases back once the stream is steady again.
+func TestJitterBufferAdapts(t *testing.T) {
+	const minDelay, maxDelay = 20 * time.Millisecond, 200 * time.Millisecond
+	jb := newJitterBuffer(minDelay, maxDelay)
+	var stats streamStats
+	start := time.Now()
+	var seq uint16
+
+	// run sends seconds of 20ms packets, offsetting every other arrival by
+	// lateMs, and returns the target delay after each second.
+	run := func(seconds int, lateMs int) []time.Duration {
+		var targets []time.Duration
+		for range seconds {
+			for range 50 {
+				arrival := start.Add(time.Duration(seq) * frameDuration * time.Millisecond)
+				if seq%2 == 1 {
+					arrival = arrival.Add(time.Duration(lateMs) * time.Millisecond)
+				}
+				pkt := jitterPacket(seq)
+				stats.update(pkt.SequenceNumber, pkt.Timestamp, sampleRate, arrival)
+				jb.push(pkt, arrival)
+				jb.adapt(stats.jitterMs())
+				popAll(jb, arrival)
+				seq++
+			}
+			targets = append(targets, jb.target)
+		}
+		return targets
+	}
+
+	if steady := run(2, 0); steady[1] != minDelay {
+		t.Errorf("target %v on a steady stream, want the minimum %v", steady[1], minDelay)
+	}
+	jittery := run(2, 40)
+	if jittery[0] < 100*time.Millisecond || jittery[0] > maxDelay {
+		t.Errorf("target %v after a second of 40ms jitter, want 100ms-%v", jittery[0], maxDelay)
+	}
+	if got := run(1, 150); got[0] != maxDelay {
+		t.Errorf("target %v under 150ms jitter, want the maximum %v", got[0], maxDelay)
+	}
+	calm := run(6, 0)
+	for i := 1; i < len(calm); i++ {
+		if calm[i] > calm[i-1] {
+			t.Errorf("target grew from %v to %v on a steady stream", calm[i-1], calm[i])
+		}
+	}
+	if calm[0] < 50*time.Millisecond {
+		t.Errorf("target fell to %v within a second of calm, want it to ease back", calm[0])
+	}
+	if last := calm[len(calm)-1]; last > 30*time.Millisecond {
+		t.Errorf("target %v after 6s of calm, want it back near the minimum %v", last, minDelay)
+	}
+}
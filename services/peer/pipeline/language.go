@@ -0,0 +1,36 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+)
+
+// noteLanguage tells the caller about the language the transcriber
+// detected for ctx's utterance, if any and if it changed.
+func (s *Session) noteLanguage(ctx context.Context, tag string) {
+	logTag := traceTag(ctx)
+	if tag == "" {
+		return
+	}
+	if err := validateLanguage(tag); err != nil {
+		log.Println(logTag+"Ignoring detected language:", err)
+		return
+	}
+	s.mu.Lock()
+	changed := tag != s.detectedLanguage
+	s.detectedLanguage = tag
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	log.Println(logTag+"🌐 Detected language:", tag)
+	msg := SignalMessage{
+		Type: "language_detected",
+		To:   s.RemoteID,
+		From: s.peer.cfg.PeerID,
+		Data: map[string]interface{}{"language": tag, "utteranceId": UtteranceID(ctx)},
+	}
+	if err := s.peer.send(msg); err != nil {
+		log.Println(logTag+"Send detected language failed:", err)
+	}
+}
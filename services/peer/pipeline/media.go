@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// MediaConfig is a caller's requested Opus settings for its call, carried as
+// the data of a "media_config" message. Unset fields leave the current
+// setting alone.
+type MediaConfig struct {
+	Bitrate int   `json:"bitrate,omitempty"` // bits/s
+	DTX     *bool `json:"dtx,omitempty"`
+	FEC     *bool `json:"fec,omitempty"`
+}
+
+func (mc MediaConfig) validate() error {
+	if mc.Bitrate != 0 && (mc.Bitrate < 6000 || mc.Bitrate > 510000) {
+		return fmt.Errorf("bitrate %d outside Opus range 6000-510000", mc.Bitrate)
+	}
+	return nil
+}
+
+// mungers returns the answer SDP tweaks asking the caller to send with
+// these settings.
+func (mc MediaConfig) mungers() []SDPMunger {
+	var out []SDPMunger
+	if mc.Bitrate != 0 {
+		out = append(out, MaxAverageBitrate(mc.Bitrate))
+	}
+	if mc.DTX != nil {
+		out = append(out, OpusDTX(*mc.DTX))
+	}
+	if mc.FEC != nil {
+		out = append(out, OpusFEC(*mc.FEC))
+	}
+	return out
+}
+
+// decodeData converts a message's loosely typed data into v.
+func decodeData(data interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// handleMediaConfig applies a caller's requested media settings: straight to
+// the outbound encoder if the call is up, and to the answer of its next
+// offer otherwise.
+func (p *Peer) handleMediaConfig(msg SignalMessage) error {
+	var mc MediaConfig
+	if err := decodeData(msg.Data, &mc); err != nil {
+		return fmt.Errorf("decode media_config: %w", err)
+	}
+	if err := mc.validate(); err != nil {
+		return err
+	}
+
+	if session, ok := p.session(msg.From); ok {
+		if err := session.player.configure(mc); err != nil {
+			return fmt.Errorf("configure encoder: %w", err)
+		}
+		log.Printf("Applied media config from %s to the outbound encoder: %+v", msg.From, mc)
+		return nil
+	}
+
+	if msg.From == "" {
+		return errors.New("no sender ID to keep it for")
+	}
+	p.sessionsMu.Lock()
+	p.mediaPrefs.put(msg.From, mc, time.Now())
+	p.sessionsMu.Unlock()
+	log.Printf("Stored media config from %s for its next offer: %+v", msg.From, mc)
+	return nil
+}
+
+const (
+	// mediaPrefsTTL is how long a media_config waits for its caller's
+	// offer, which normally follows straight after.
+	mediaPrefsTTL = 30 * time.Second
+	// maxMediaPrefs caps how many callers' media configs wait at once;
+	// beyond it the oldest is dropped.
+	maxMediaPrefs = 256
+)
+
+// mediaPrefs holds media configs received before their caller's offer,
+// by the sender ID the signaling server stamped on them. Any joined peer
+// can send one, so entries expire after mediaPrefsTTL and there are at
+// most maxMediaPrefs. The zero value is ready to use.
+type mediaPrefs struct {
+	byPeer map[string]storedMediaConfig
+}
+
+type storedMediaConfig struct {
+	MediaConfig
+	at time.Time
+}
+
+// put keeps mc for remoteID's next offer, sweeping expired entries and,
+// at the cap, dropping the oldest.
+func (m *mediaPrefs) put(remoteID string, mc MediaConfig, now time.Time) {
+	m.sweep(now)
+	if _, ok := m.byPeer[remoteID]; !ok && len(m.byPeer) >= maxMediaPrefs {
+		oldest := ""
+		for id, stored := range m.byPeer {
+			if oldest == "" || stored.at.Before(m.byPeer[oldest].at) {
+				oldest = id
+			}
+		}
+		delete(m.byPeer, oldest)
+	}
+	if m.byPeer == nil {
+		m.byPeer = make(map[string]storedMediaConfig)
+	}
+	m.byPeer[remoteID] = storedMediaConfig{MediaConfig: mc, at: now}
+}
+
+// take removes and returns remoteID's media config, unless it expired.
+func (m *mediaPrefs) take(remoteID string, now time.Time) (MediaConfig, bool) {
+	stored, ok := m.byPeer[remoteID]
+	delete(m.byPeer, remoteID)
+	if !ok || now.Sub(stored.at) >= mediaPrefsTTL {
+		return MediaConfig{}, false
+	}
+	return stored.MediaConfig, true
+}
+
+func (m *mediaPrefs) sweep(now time.Time) {
+	for id, stored := range m.byPeer {
+		if now.Sub(stored.at) >= mediaPrefsTTL {
+			delete(m.byPeer, id)
+		}
+	}
+}
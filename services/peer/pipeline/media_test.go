@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMediaPrefs(t *testing.T) {
+	var prefs mediaPrefs
+	start := time.Now()
+	mc := MediaConfig{Bitrate: 24000}
+
+	prefs.put("iphone-1", mc, start)
+	if got, ok := prefs.take("iphone-1", start.Add(time.Second)); !ok || got != mc {
+		t.Errorf("take = %+v, %v; want %+v", got, ok, mc)
+	}
+	if _, ok := prefs.take("iphone-1", start.Add(time.Second)); ok {
+		t.Error("a media config was taken twice")
+	}
+
+	prefs.put("iphone-1", mc, start)
+	if _, ok := prefs.take("iphone-1", start.Add(mediaPrefsTTL)); ok {
+		t.Error("an expired media config was applied")
+	}
+
+	for i := range maxMediaPrefs + 1 {
+		prefs.put(fmt.Sprint("caller-", i), mc, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	if n := len(prefs.byPeer); n != maxMediaPrefs {
+		t.Errorf("%d media configs kept, want the cap of %d", n, maxMediaPrefs)
+	}
+	if _, ok := prefs.byPeer["caller-0"]; ok {
+		t.Error("the oldest media config survived the cap")
+	}
+
+	// A later put sweeps everything that expired meanwhile.
+	prefs.put("iphone-2", mc, start.Add(time.Hour))
+	if n := len(prefs.byPeer); n != 1 {
+		t.Errorf("%d media configs kept after the rest expired, want 1", n)
+	}
+}
+
+func TestHandleMediaConfigNeedsSender(t *testing.T) {
+	p := &Peer{sessions: make(map[string]*Session)}
+	if err := p.handleMediaConfig(SignalMessage{Type: "media_config", Data: map[string]interface{}{"bitrate": 24000}}); err == nil {
+		t.Error("stored a media config with no sender ID")
+	}
+	if err := p.handleMediaConfig(SignalMessage{Type: "media_config", From: "iphone-1", Data: map[string]interface{}{"bitrate": 24000}}); err != nil {
+		t.Fatal(err)
+	}
+	if mc, ok, err := p.addSession(&Session{RemoteID: "iphone-1"}); !ok || err != nil || mc.Bitrate != 24000 {
+		t.Errorf("offer got %+v, %v, %v; want the stored bitrate", mc, ok, err)
+	}
+}
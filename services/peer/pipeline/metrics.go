@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// vadCounter names one of the speech pipeline's counters.
+type vadCounter int
+
+const (
+	speechFrames vadCounter = iota
+	silenceFrames
+	utterancesStarted
+	utterancesFlushed // handed to the conversational loop
+	droppedTooShort
+	droppedTooQuiet
+	droppedDuplicate // identical to one transcribed moments ago
+	numVADCounters
+)
+
+// vadMetrics counts VAD decisions and utterance outcomes. Sessions keep
+// their own and add to the peer's, which outlives them, so the aggregate
+// covers ended calls too. The zero value is ready to use.
+type vadMetrics [numVADCounters]atomic.Uint64
+
+// VADCounters is a snapshot of vadMetrics, for tuning VAD settings from
+// production traffic.
+type VADCounters struct {
+	SpeechFrames      uint64 `json:"speechFrames"`
+	SilenceFrames     uint64 `json:"silenceFrames"`
+	UtterancesStarted uint64 `json:"utterancesStarted"`
+	UtterancesFlushed uint64 `json:"utterancesFlushed"`
+	DroppedTooShort   uint64 `json:"droppedTooShort"`
+	DroppedTooQuiet   uint64 `json:"droppedTooQuiet"`
+	DroppedDuplicate  uint64 `json:"droppedDuplicate"`
+}
+
+func (m *vadMetrics) snapshot() VADCounters {
+	return VADCounters{
+		SpeechFrames:      m[speechFrames].Load(),
+		SilenceFrames:     m[silenceFrames].Load(),
+		UtterancesStarted: m[utterancesStarted].Load(),
+		UtterancesFlushed: m[utterancesFlushed].Load(),
+		DroppedTooShort:   m[droppedTooShort].Load(),
+		DroppedTooQuiet:   m[droppedTooQuiet].Load(),
+		DroppedDuplicate:  m[droppedDuplicate].Load(),
+	}
+}
+
+// count bumps c for the session and the peer-wide total.
+func (s *Session) count(c vadCounter) {
+	s.metrics[c].Add(1)
+	s.peer.metrics[c].Add(1)
+}
+
+// VAD returns the session's speech pipeline counters. It is safe to call
+// from any goroutine.
+func (s *Session) VAD() VADCounters {
+	return s.metrics.snapshot()
+}
+
+// handleMetrics serves the peer-wide counters, across every call since
+// start, in the Prometheus text format.
+func (p *Peer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	c := p.metrics.snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP peer_vad_frames_total VAD windows processed, by decision.")
+	fmt.Fprintln(w, "# TYPE peer_vad_frames_total counter")
+	fmt.Fprintf(w, "peer_vad_frames_total{decision=\"speech\"} %d\n", c.SpeechFrames)
+	fmt.Fprintf(w, "peer_vad_frames_total{decision=\"silence\"} %d\n", c.SilenceFrames)
+	fmt.Fprintln(w, "# HELP peer_utterances_started_total Utterances opened by speech.")
+	fmt.Fprintln(w, "# TYPE peer_utterances_started_total counter")
+	fmt.Fprintf(w, "peer_utterances_started_total %d\n", c.UtterancesStarted)
+	fmt.Fprintln(w, "# HELP peer_utterances_total Ended utterances, by outcome.")
+	fmt.Fprintln(w, "# TYPE peer_utterances_total counter")
+	fmt.Fprintf(w, "peer_utterances_total{outcome=\"flushed\"} %d\n", c.UtterancesFlushed)
+	fmt.Fprintf(w, "peer_utterances_total{outcome=\"too_short\"} %d\n", c.DroppedTooShort)
+	fmt.Fprintf(w, "peer_utterances_total{outcome=\"too_quiet\"} %d\n", c.DroppedTooQuiet)
+	fmt.Fprintf(w, "peer_utterances_total{outcome=\"duplicate\"} %d\n", c.DroppedDuplicate)
+}
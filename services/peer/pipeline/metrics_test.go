@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// Each call counts its own VAD decisions and utterance outcomes, the peer
+// counts them all, and /metrics serves the peer's.
+func TestVADMetrics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinSpeechMs, cfg.MinSpeechRMS = 100, 100
+	keeper := &keepingTranscriber{done: make(chan struct{}, 2)}
+	p, err := NewPeer(cfg, Handlers{Transcriber: keeper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	first := newTurnSession(t, p, newRecordingTrack())
+	second := newTurnSession(t, p, newRecordingTrack())
+
+	first.sayFrame(squareFrame(8000), 10)
+	first.sayFrame(squareFrame(8000), 10) // the same again
+	first.sayFrame(squareFrame(8000), 4)  // too short
+	second.sayFrame(squareFrame(50), 10)  // too quiet
+	p.wg.Wait()
+
+	silence := uint64(cfg.SilenceMs/frameDuration + 1)
+	wantFirst := VADCounters{
+		SpeechFrames:      24,
+		SilenceFrames:     3 * silence,
+		UtterancesStarted: 3,
+		UtterancesFlushed: 1,
+		DroppedTooShort:   1,
+		DroppedDuplicate:  1,
+	}
+	wantSecond := VADCounters{SpeechFrames: 10, SilenceFrames: silence, UtterancesStarted: 1, DroppedTooQuiet: 1}
+	if got := first.VAD(); got != wantFirst {
+		t.Errorf("first call counted %+v, want %+v", got, wantFirst)
+	}
+	if got := second.VAD(); got != wantSecond {
+		t.Errorf("second call counted %+v, want %+v", got, wantSecond)
+	}
+
+	rec := httptest.NewRecorder()
+	p.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type %q, want the Prometheus text format", ct)
+	}
+	want := fmt.Sprintf(`# HELP peer_vad_frames_total VAD windows processed, by decision.
+# TYPE peer_vad_frames_total counter
+peer_vad_frames_total{decision="speech"} 34
+peer_vad_frames_total{decision="silence"} %d
+# HELP peer_utterances_started_total Utterances opened by speech.
+# TYPE peer_utterances_started_total counter
+peer_utterances_started_total 4
+# HELP peer_utterances_total Ended utterances, by outcome.
+# TYPE peer_utterances_total counter
+peer_utterances_total{outcome="flushed"} 1
+peer_utterances_total{outcome="too_short"} 1
+peer_utterances_total{outcome="too_quiet"} 1
+peer_utterances_total{outcome="duplicate"} 1
+`, 4*silence)
+	if got := rec.Body.String(); got != want {
+		t.Errorf("/metrics served\n%s\nwant\n%s", got, want)
+	}
+}
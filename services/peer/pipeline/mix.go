@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"math"
+	"sync"
+)
+
+// PCMFrame is one decoded packet of a call's inbound audio, tagged with
+// where it came from so streams from several calls can be told apart and
+// combined, e.g. by a Mixer.
+type PCMFrame struct {
+	Source    string // the caller's peer ID
+	TraceID   string
+	Timestamp uint32  // RTP timestamp of the first sample
+	PCM       []int16 // sampleRate mono; listeners must not modify it
+}
+
+// PCMListener receives every call's decoded audio as it arrives, muted
+// audio excepted. It is called on the call's read loop, so it must return
+// quickly; hand the frame off rather than processing it inline.
+type PCMListener func(PCMFrame)
+
+// AddPCMListener registers fn to receive every call's decoded audio.
+// Register listeners before the peer starts answering offers.
+func (p *Peer) AddPCMListener(fn PCMListener) {
+	p.pcmListeners = append(p.pcmListeners, fn)
+}
+
+// emitPCM hands one decoded packet to the PCM listeners.
+func (s *Session) emitPCM(pcm []int16, timestamp uint32) {
+	if len(s.peer.pcmListeners) == 0 {
+		return
+	}
+	f := PCMFrame{Source: s.RemoteID, TraceID: s.TraceID, Timestamp: timestamp, PCM: pcm}
+	for _, fn := range s.peer.pcmListeners {
+		fn(f)
+	}
+}
+
+// mixerBacklog is how many frames a Mixer queues per source, about a
+// second; a source that gets further ahead of the mix loses its oldest.
+const mixerBacklog = 50
+
+// Mixer combines PCMFrames from any number of sources into one stream.
+// Push queues each source's frames as they arrive; every Mix call takes
+// the oldest frame queued from each source and returns their sum, clipped
+// to the int16 range. A source with nothing queued contributes silence,
+// so a late or finished call doesn't hold up the others. Frames should be
+// the same length; the mix is as long as the longest.
+//
+// Mixer is a utility for building conferencing on top of PCM listeners:
+// call Push from one, and Mix on a 20ms ticker.
+type Mixer struct {
+	mu      sync.Mutex
+	pending map[string][][]int16
+}
+
+func NewMixer() *Mixer {
+	return &Mixer{pending: make(map[string][][]int16)}
+}
+
+// Push queues f's audio for its source. The PCM is copied.
+func (m *Mixer) Push(f PCMFrame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.pending[f.Source]
+	if len(q) >= mixerBacklog {
+		q[0] = nil
+		q = q[1:]
+	}
+	m.pending[f.Source] = append(q, append([]int16(nil), f.PCM...))
+}
+
+// Remove forgets source and anything queued from it, e.g. when its call
+// ends.
+func (m *Mixer) Remove(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, source)
+}
+
+// Mix returns the next mixed frame, or nil when nothing is queued.
+func (m *Mixer) Mix() []int16 {
+	m.mu.Lock()
+	var frames [][]int16
+	for src, q := range m.pending {
+		if len(q) == 0 {
+			continue
+		}
+		frames = append(frames, q[0])
+		q[0] = nil
+		m.pending[src] = q[1:]
+	}
+	m.mu.Unlock()
+	if len(frames) == 0 {
+		return nil
+	}
+	return mixPCM(frames...)
+}
+
+// mixPCM sums frames sample by sample, clipping to the int16 range. The
+// result is as long as the longest frame; shorter ones end in silence.
+func mixPCM(frames ...[]int16) []int16 {
+	n := 0
+	for _, f := range frames {
+		n = max(n, len(f))
+	}
+	sum := make([]int32, n)
+	for _, f := range frames {
+		for i, v := range f {
+			sum[i] += int32(v)
+		}
+	}
+	out := make([]int16, n)
+	for i, v := range sum {
+		out[i] = int16(max(min(v, math.MaxInt16), math.MinInt16))
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestMixPCM(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]int16
+		want   []int16
+	}{
+		{"sum", [][]int16{{100, -200, 300}, {1, 2, 3}}, []int16{101, -198, 303}},
+		{"clipped", [][]int16{{math.MaxInt16, math.MinInt16, 20000}, {1, -1, 20000}}, []int16{math.MaxInt16, math.MinInt16, math.MaxInt16}},
+		{"shorter ends in silence", [][]int16{{5, 5, 5}, {1}}, []int16{6, 5, 5}},
+		{"one source", [][]int16{{7, -7}}, []int16{7, -7}},
+	}
+	for _, tt := range tests {
+		if got := mixPCM(tt.frames...); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Each Mix pairs the oldest frame from every source; a source with nothing
+// queued adds silence, and one that runs too far ahead loses its oldest.
+func TestMixer(t *testing.T) {
+	m := NewMixer()
+	if got := m.Mix(); got != nil {
+		t.Errorf("empty mixer mixed %v", got)
+	}
+	pcm := []int16{1, 1}
+	m.Push(PCMFrame{Source: "alice", PCM: pcm})
+	pcm[0] = 99 // Push copied it
+	m.Push(PCMFrame{Source: "alice", PCM: []int16{2, 2}})
+	m.Push(PCMFrame{Source: "bob", PCM: []int16{10, 10}})
+
+	for _, want := range [][]int16{{11, 11}, {2, 2}, nil} {
+		if got := m.Mix(); !slices.Equal(got, want) {
+			t.Errorf("mixed %v, want %v", got, want)
+		}
+	}
+
+	for i := range mixerBacklog + 5 {
+		m.Push(PCMFrame{Source: "alice", PCM: []int16{int16(i)}})
+	}
+	if got := m.Mix(); !slices.Equal(got, []int16{5}) {
+		t.Errorf("after overrunning the backlog mixed %v, want the 6th frame", got)
+	}
+	m.Remove("alice")
+	if got := m.Mix(); got != nil {
+		t.Errorf("removed source still mixed: %v", got)
+	}
+}
+
+// PCM listeners get every decoded packet tagged with its call, and none of
+// the audio heard while muted.
+func TestPCMListener(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []PCMFrame
+	p.AddPCMListener(func(f PCMFrame) { frames = append(frames, f) })
+	s, dec := newReadSession(t, p)
+	s.RemoteID = "alice"
+	dec.pcm = toneFrame(frameSamples)
+
+	s.handleAudio(opusPacket(0).Payload, 1000)
+	s.SetMuted(true)
+	s.handleAudio(opusPacket(1).Payload, 1000+frameSamples)
+	if len(frames) != 1 {
+		t.Fatalf("listener got %d frames, want 1", len(frames))
+	}
+	f := frames[0]
+	if f.Source != "alice" || f.TraceID != s.TraceID || f.Timestamp != 1000 || !slices.Equal(f.PCM, dec.pcm) {
+		t.Errorf("got frame from %q, trace %q at %d with %d samples", f.Source, f.TraceID, f.Timestamp, len(f.PCM))
+	}
+}
@@ -0,0 +1,64 @@
+package pipeline
+
+import "time"
+
+// clock is the time source the outbound pacer runs on, so tests can drive
+// it with simulated time.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// maxPacingLag is how far behind schedule the pacer may fall, e.g. after a
+// stall, before it gives up catching up and starts a fresh schedule. Up to
+// this much is caught up by sending frames back to back; the remote jitter
+// buffer absorbs that better than a permanent delay.
+const maxPacingLag = 5 * frameDuration * time.Millisecond
+
+// framePacer releases one frame per interval against an absolute schedule:
+// frame n is due at start + n*interval however long encoding and writing
+// the earlier ones took, so the per-frame processing time never adds up
+// into drift over a long reply.
+type framePacer struct {
+	clock    clock
+	interval time.Duration
+	next     time.Time // when the next frame is due; zero when idle
+}
+
+func newFramePacer(c clock, interval time.Duration) *framePacer {
+	return &framePacer{clock: c, interval: interval}
+}
+
+// wait blocks until the next frame is due and reports whether it is, or
+// false if done closes first. After idle the first frame is due one
+// interval from now.
+func (p *framePacer) wait(done <-chan struct{}) bool {
+	now := p.clock.Now()
+	if p.next.IsZero() {
+		p.next = now.Add(p.interval)
+	}
+	if lag := now.Sub(p.next); lag > maxPacingLag {
+		p.next = now
+	}
+	if d := p.next.Sub(now); d > 0 {
+		select {
+		case <-done:
+			return false
+		case <-p.clock.After(d):
+		}
+	}
+	p.next = p.next.Add(p.interval)
+	return true
+}
+
+// idle drops the schedule when there is nothing to play, so the next
+// reply starts on its own schedule instead of bursting to catch up the
+// silence.
+func (p *framePacer) idle() {
+	p.next = time.Time{}
+}
@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// fakeClock is simulated time: After returns at once, having advanced the
+// clock by d, so a pacer runs as fast as the test can drive it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.advance(d)
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// slowTrack stands in for the outbound track, taking a random 0-15ms of
+// simulated time to write each frame, and records when each write began.
+type slowTrack struct {
+	clock  *fakeClock
+	rand   *rand.Rand
+	writes []time.Time
+	want   int
+	done   chan struct{}
+}
+
+func (s *slowTrack) WriteSample(media.Sample) error {
+	s.writes = append(s.writes, s.clock.Now())
+	s.clock.advance(time.Duration(s.rand.IntN(15)) * time.Millisecond)
+	if len(s.writes) == s.want {
+		close(s.done)
+	}
+	return nil
+}
+
+// A minute of playback written by a track that takes up to 15ms a frame
+// keeps to the 20ms schedule: processing time never accumulates into
+// drift, and frames never go out in bursts.
+func TestPacedMinute(t *testing.T) {
+	const frames = 60 * 1000 / frameDuration
+	const interval = frameDuration * time.Millisecond
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	track := &slowTrack{clock: clock, rand: rand.New(rand.NewPCG(1, 2)), want: frames, done: make(chan struct{})}
+	p := &player{track: track, clock: clock, enc: &fakeEncoder{}, done: make(chan struct{})}
+	if err := p.enqueue(make([]int16, frames*frameSamples)); err != nil {
+		t.Fatal(err)
+	}
+	start := clock.Now()
+	go p.run()
+	select {
+	case <-track.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%d of %d frames written", len(track.writes), frames)
+	}
+	p.close()
+
+	for i, at := range track.writes {
+		due := start.Add(time.Duration(i+1) * interval)
+		if drift := at.Sub(due); drift < 0 || drift > time.Millisecond {
+			t.Fatalf("frame %d written at %v, %v off its schedule", i, at.Sub(start), drift)
+		}
+		if i > 0 {
+			if gap := at.Sub(track.writes[i-1]); gap < interval {
+				t.Fatalf("frame %d written %v after the one before, want %v", i, gap, interval)
+			}
+		}
+	}
+	if elapsed := track.writes[frames-1].Sub(start); elapsed != time.Minute {
+		t.Errorf("a minute of frames took %v", elapsed)
+	}
+}
+
+// After a stall, the pacer catches up what is within maxPacingLag back to
+// back and drops the rest of the schedule rather than bursting it.
+func TestPacerAfterStall(t *testing.T) {
+	const interval = frameDuration * time.Millisecond
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pacer := newFramePacer(clock, interval)
+	done := make(chan struct{})
+	for range 10 {
+		pacer.wait(done)
+	}
+
+	clock.advance(3 * interval) // a short stall: caught up
+	caughtUp := clock.Now()
+	var burst int
+	for pacer.wait(done) && clock.Now().Equal(caughtUp) {
+		burst++
+	}
+	if burst != 3 {
+		t.Errorf("%d frames caught up back to back after a %v stall, want 3", burst, 3*interval)
+	}
+
+	clock.advance(time.Second) // a long one: schedule restarts
+	restarted := clock.Now()
+	pacer.wait(done)
+	if !clock.Now().Equal(restarted) {
+		t.Errorf("first frame after a long stall waited %v", clock.Now().Sub(restarted))
+	}
+	pacer.wait(done)
+	if got := clock.Now().Sub(restarted); got != interval {
+		t.Errorf("second frame after a long stall %v after the first, want %v", got, interval)
+	}
+}
@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// payloadTypeLogEvery spaces out the log lines for a stream that keeps
+// sending a wrong payload type, about every 5 s at 50 packets a second.
+const payloadTypeLogEvery = 250
+
+// payloadTypeFilter drops RTP packets whose payload type wasn't negotiated
+// for the track, e.g. from a sender that ignores the answer: the decoder
+// would take them for Opus and garble the audio.
+type payloadTypeFilter struct {
+	negotiated []uint8 // nil lets everything through
+	dropped    int
+}
+
+// newPayloadTypeFilter accepts the payload types of codecs, those
+// negotiated for the track's transceiver: Opus and telephone-event.
+func newPayloadTypeFilter(codecs []webrtc.RTPCodecParameters) payloadTypeFilter {
+	f := payloadTypeFilter{negotiated: make([]uint8, 0, len(codecs))}
+	for _, c := range codecs {
+		f.negotiated = append(f.negotiated, uint8(c.PayloadType))
+	}
+	return f
+}
+
+// allowPayloadType reports whether a packet with payload type pt should
+// be decoded, logging the ones that shouldn't now and then.
+func (s *Session) allowPayloadType(pt uint8) bool {
+	f := &s.payloads
+	if f.negotiated == nil || slices.Contains(f.negotiated, pt) {
+		return true
+	}
+	s.droppedPayloadType("payload type " + strconv.Itoa(int(pt)))
+	return false
+}
+
+// droppedPayloadType counts a packet dropped for its payload type, what.
+// pion drops those with no codec negotiated on the connection at all
+// before the read loop sees their payload type.
+func (s *Session) droppedPayloadType(what string) {
+	f := &s.payloads
+	f.dropped++
+	if f.dropped%payloadTypeLogEvery == 1 {
+		log.Printf("[%s] Dropped RTP packet from %s with %s, negotiated %v (%d dropped this call)",
+			s.TraceID, s.RemoteID, what, f.negotiated, f.dropped)
+	}
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Packets of a payload type not negotiated for the track are dropped, as
+// are the ones pion finds no codec for, without the read loop backing
+// off; drops are logged on the first and every payloadTypeLogEvery-th.
+// With check_payload_type off they are decoded.
+func TestPayloadTypeFilter(t *testing.T) {
+	for _, check := range []bool{true, false} {
+		logged := captureLog(t)
+		cfg := DefaultConfig()
+		cfg.CheckPayloadType = check
+		p, err := NewPeer(cfg, Handlers{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, dec := newReadSession(t, p)
+		track := newFakeTrack()
+		last := uint16(310)
+		start := time.Now()
+		done := runReadLoop(s, track)
+		go func() {
+			for seq := range uint16(10) {
+				track.packet(seq)
+			}
+			for seq := range uint16(300) {
+				pkt := opusPacket(10 + seq)
+				pkt.PayloadType = 96
+				track.reads <- trackRead{pkt: pkt}
+			}
+			for range 150 {
+				track.reads <- trackRead{err: webrtc.ErrCodecNotFound}
+			}
+			track.packet(last)
+			close(track.reads)
+		}()
+		waitDone(t, done, 5*time.Second, "read loop")
+
+		want := 11
+		if !check {
+			want = 311
+		}
+		if got := dec.decoded(); len(got) != want || got[len(got)-1] != byte(last) {
+			t.Errorf("check %v: decoded %d packets ending %v, want %d ending with the last packet's", check, len(got), got[len(got)-1:], want)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("check %v: read loop took %v, backing off on codec-not-found reads", check, elapsed)
+		}
+		wantDropped, wantLogged := 450, 2
+		if !check {
+			wantDropped, wantLogged = 150, 1
+		}
+		if s.payloads.dropped != wantDropped {
+			t.Errorf("check %v: %d packets dropped, want %d", check, s.payloads.dropped, wantDropped)
+		}
+		if n := strings.Count(logged.String(), "Dropped RTP packet"); n != wantLogged {
+			t.Errorf("check %v: %d drops logged, want %d:\n%s", check, n, wantLogged, logged)
+		}
+	}
+}
+
+// The filter lets through every codec negotiated for the track, and
+// everything when there is nothing to check against.
+func TestNegotiatedPayloadTypes(t *testing.T) {
+	s := &Session{payloads: newPayloadTypeFilter([]webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, PayloadType: 111},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/telephone-event"}, PayloadType: 101},
+	})}
+	for pt, want := range map[uint8]bool{111: true, 101: true, 0: false, 96: false} {
+		if got := s.allowPayloadType(pt); got != want {
+			t.Errorf("payload type %d allowed %v, want %v", pt, got, want)
+		}
+	}
+	if s := (&Session{}); !s.allowPayloadType(96) {
+		t.Error("payload type dropped with no negotiated codecs to check")
+	}
+}
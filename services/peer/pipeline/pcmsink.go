@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	// pcmBacklog is how many decoded packets (about a second) may queue
+	// for a slow consumer; beyond it packets are dropped, not waited for.
+	pcmBacklog      = 50
+	pcmWriteTimeout = time.Second
+	// pcmRedialDelay spaces out reconnects to a consumer that went away.
+	pcmRedialDelay = time.Second
+)
+
+// pcmSink is where decoded audio is streamed: a Unix domain socket,
+// "unix:///path/to.sock", or a UDP endpoint, "udp://host:port".
+type pcmSink struct {
+	network string
+	addr    string
+}
+
+func parsePCMSink(raw string) (pcmSink, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return pcmSink{}, err
+	}
+	switch {
+	case u.Scheme == "unix" && u.Path != "":
+		return pcmSink{network: "unix", addr: u.Path}, nil
+	case u.Scheme == "udp" && u.Host != "":
+		return pcmSink{network: "udp", addr: u.Host}, nil
+	}
+	return pcmSink{}, errors.New("want unix:///path or udp://host:port")
+}
+
+// pcmHeader opens every connection, so the consumer knows which call the
+// audio that follows belongs to.
+type pcmHeader struct {
+	PeerID     string `json:"peerId"`
+	TraceID    string `json:"traceId"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+}
+
+// pcmStream sends one call's decoded audio to a pcmSink over its own
+// connection (or UDP socket). Every message is a 4-byte big-endian length
+// and then that many bytes: first the JSON pcmHeader, then one message per
+// decoded packet of 16-bit little-endian PCM. A consumer that disconnects
+// is redialed, and sent the header again, as audio keeps coming.
+type pcmStream struct {
+	sink    pcmSink
+	header  []byte
+	pools   *bufferPools
+	frames  chan *[]byte // pooled; see bufferPools.getPacket
+	dropped int          // owned by the read loop
+}
+
+func startPCMStream(sink pcmSink, h pcmHeader, pools *bufferPools, spawn func(func())) *pcmStream {
+	payload, _ := json.Marshal(h)
+	ps := &pcmStream{
+		sink:   sink,
+		header: lengthPrefixed(payload),
+		pools:  pools,
+		frames: make(chan *[]byte, pcmBacklog),
+	}
+	spawn(ps.run)
+	return ps
+}
+
+func lengthPrefixed(payload []byte) []byte {
+	msg := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(msg, uint32(len(payload)))
+	copy(msg[4:], payload)
+	return msg
+}
+
+// write queues pcm without blocking the read loop.
+func (ps *pcmStream) write(pcm []int16) {
+	buf := ps.pools.getPacket()
+	msg := binary.BigEndian.AppendUint32(*buf, uint32(2*len(pcm)))
+	for _, v := range pcm {
+		msg = binary.LittleEndian.AppendUint16(msg, uint16(v))
+	}
+	*buf = msg
+	select {
+	case ps.frames <- buf:
+	default:
+		ps.pools.putPacket(buf)
+		if ps.dropped%pcmBacklog == 0 {
+			log.Printf("PCM consumer at %s is behind; dropping audio (%d packets so far)", ps.sink.addr, ps.dropped+1)
+		}
+		ps.dropped++
+	}
+}
+
+// close ends the stream once the queue drains.
+func (ps *pcmStream) close() {
+	close(ps.frames)
+}
+
+func (ps *pcmStream) run() {
+	var conn net.Conn
+	var retryAt time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for buf := range ps.frames {
+		msg := *buf
+		if conn == nil {
+			// Audio arriving while the consumer is away is dropped.
+			if time.Now().Before(retryAt) {
+				ps.pools.putPacket(buf)
+				continue
+			}
+			c, err := ps.dial()
+			if err != nil {
+				if retryAt.IsZero() {
+					log.Printf("PCM consumer at %s unavailable, retrying every %v: %v", ps.sink.addr, pcmRedialDelay, err)
+				}
+				retryAt = time.Now().Add(pcmRedialDelay)
+				ps.pools.putPacket(buf)
+				continue
+			}
+			conn, retryAt = c, time.Time{}
+		}
+		err := writeWithDeadline(conn, msg)
+		ps.pools.putPacket(buf)
+		if err != nil {
+			log.Printf("PCM consumer at %s disconnected: %v", ps.sink.addr, err)
+			conn.Close()
+			conn = nil
+			retryAt = time.Now().Add(pcmRedialDelay)
+		}
+	}
+}
+
+// dial connects to the sink and sends the header.
+func (ps *pcmStream) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(ps.sink.network, ps.sink.addr, pcmWriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeWithDeadline(conn, ps.header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func writeWithDeadline(conn net.Conn, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(pcmWriteTimeout))
+	_, err := conn.Write(msg)
+	return err
+}
+
+// openPCMOut starts streaming the session's decoded audio to the
+// configured pcm_sink, if any.
+func (s *Session) openPCMOut() {
+	if s.peer.cfg.PCMSink == "" {
+		return
+	}
+	sink, err := parsePCMSink(s.peer.cfg.PCMSink)
+	if err != nil {
+		log.Println("PCM output disabled for this call:", err)
+		return
+	}
+	s.pcmOut = startPCMStream(sink, pcmHeader{
+		PeerID:     s.RemoteID,
+		TraceID:    s.TraceID,
+		SampleRate: sampleRate,
+		Channels:   channels,
+	}, s.peer.pools, s.peer.spawn)
+}
+
+func (s *Session) closePCMOut() {
+	if s.pcmOut != nil {
+		s.pcmOut.close()
+		s.pcmOut = nil
+	}
+}
@@ -0,0 +1,211 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePCMSink(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want pcmSink
+		ok   bool
+	}{
+		{"unix:///run/pcm.sock", pcmSink{"unix", "/run/pcm.sock"}, true},
+		{"udp://127.0.0.1:7000", pcmSink{"udp", "127.0.0.1:7000"}, true},
+		{"unix://", pcmSink{}, false},
+		{"udp:///no-host", pcmSink{}, false},
+		{"tcp://127.0.0.1:7000", pcmSink{}, false},
+		{"/run/pcm.sock", pcmSink{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePCMSink(tt.raw)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parsePCMSink(%q) = %+v, %v; want %+v, ok %v", tt.raw, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// readPCMMessage reads one length-prefixed message from r.
+func readPCMMessage(r io.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(n[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// pcmSamples decodes a PCM message's 16-bit little-endian samples.
+func pcmSamples(msg []byte) []int16 {
+	pcm := make([]int16, len(msg)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(msg[2*i:]))
+	}
+	return pcm
+}
+
+// listenUnix listens on a socket in a directory the test cleans up,
+// returning the listener and its pcm_sink address.
+func listenUnix(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pcm.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, "unix://" + path
+}
+
+// A call's decoded audio reaches the sink after a header naming the call;
+// muted audio doesn't, and the connection closes with the call's output.
+func TestPCMOut(t *testing.T) {
+	ln, addr := listenUnix(t)
+	cfg := DefaultConfig()
+	cfg.PCMSink = addr
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, dec := newReadSession(t, p)
+	dec.pcm = toneFrame(frameSamples)
+	s.openPCMOut()
+
+	s.handleAudio(opusPacket(0).Payload, 0)
+	s.SetMuted(true)
+	s.handleAudio(opusPacket(1).Payload, frameSamples)
+	s.SetMuted(false)
+	s.handleAudio(opusPacket(2).Payload, 2*frameSamples)
+	s.closePCMOut()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := readPCMMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h pcmHeader
+	if err := json.Unmarshal(msg, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := (pcmHeader{PeerID: s.RemoteID, TraceID: s.TraceID, SampleRate: sampleRate, Channels: channels}); h != want {
+		t.Errorf("header %+v, want %+v", h, want)
+	}
+	for range 2 {
+		msg, err := readPCMMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pcmSamples(msg); !slices.Equal(got, dec.pcm) {
+			t.Errorf("got %d samples starting %v, want the decoded packet", len(got), got[:min(4, len(got))])
+		}
+	}
+	if _, err := readPCMMessage(conn); !errors.Is(err, io.EOF) {
+		t.Errorf("after the unmuted packets read %v, want EOF", err)
+	}
+	p.wg.Wait()
+}
+
+// A consumer that goes away is redialed and sent the header again.
+func TestPCMStreamRedial(t *testing.T) {
+	ln, addr := listenUnix(t)
+	sink, _ := parsePCMSink(addr)
+	spawn := func(fn func()) { go fn() }
+	ps := startPCMStream(sink, pcmHeader{PeerID: "iphone-1"}, newBufferPools(DefaultConfig()), spawn)
+	defer ps.close()
+
+	frame := []int16{1, -2, 3}
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	// Keep audio coming, as a call would, until each connection has read
+	// its header and a frame.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(frameDuration * time.Millisecond):
+				ps.write(frame)
+			}
+		}
+	}()
+
+	for i := range 2 {
+		var conn net.Conn
+		select {
+		case conn = <-accepted:
+		case <-time.After(3 * pcmRedialDelay):
+			t.Fatalf("connection %d never dialed", i+1)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		header, err := readPCMMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h pcmHeader
+		if err := json.Unmarshal(header, &h); err != nil || h.PeerID != "iphone-1" {
+			t.Errorf("connection %d opened with %q, want the header", i+1, header)
+		}
+		msg, err := readPCMMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pcmSamples(msg); !slices.Equal(got, frame) {
+			t.Errorf("connection %d got %v, want %v", i+1, got, frame)
+		}
+		conn.Close()
+	}
+}
+
+// Over UDP each message is one datagram.
+func TestPCMStreamUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, _ := parsePCMSink("udp://" + conn.LocalAddr().String())
+	ps := startPCMStream(sink, pcmHeader{PeerID: "iphone-1"}, newBufferPools(DefaultConfig()), func(fn func()) { go fn() })
+	ps.write(toneFrame(frameSamples))
+	ps.close()
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var sizes []int
+	for range 2 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := int(binary.BigEndian.Uint32(buf)); got != n-4 {
+			t.Errorf("datagram of %d bytes claims %d", n, got)
+		}
+		sizes = append(sizes, n)
+	}
+	if sizes[1] != 4+2*frameSamples {
+		t.Errorf("PCM datagram of %d bytes, want %d", sizes[1], 4+2*frameSamples)
+	}
+}
@@ -0,0 +1,755 @@
+// Package pipeline is the backend answerer: it joins the signaling server,
+// answers WebRTC offers, decodes each caller's Opus audio, runs VAD and
+// endpointing on it, and hands finished utterances to the conversational
+// stages and transcript sinks. The peer command is a thin wrapper around
+// it; other programs can embed it with NewPeer and Run.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/MaxwellKendall/voice-agent-service/services/peer/endpoint"
+)
+
+const (
+	defaultSignalingURL = "ws://localhost:8080/ws"
+	defaultPeerID       = "backend-peer-abc"
+	targetID            = "iphone-123"
+	sampleRate          = 48000                             // Hz
+	channels            = 1                                 // mono
+	frameDuration       = 20                                // ms
+	frameSamples        = sampleRate / 1000 * frameDuration // 960 samples for 20ms
+
+	// signalingProtocol is the WebSocket subprotocol naming the signaling
+	// protocol version we speak.
+	signalingProtocol = "voice-agent.v1"
+)
+
+// SignalMessage is a message on the signaling connection. On a relayed
+// message, the server stamps From with the sender's joined ID, so calls,
+// control and media config are keyed on it.
+type SignalMessage struct {
+	Type string      `json:"type"`
+	To   string      `json:"to,omitempty"`
+	From string      `json:"from,omitempty"`
+	ID   string      `json:"id,omitempty"`
+	Role string      `json:"role,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+	// Reason and Message explain a reject: a stable code and a readable
+	// detail.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// iceGatherTimeout bounds how long a non-trickle answer waits for
+// candidate gathering, e.g. on an unreachable STUN server.
+const iceGatherTimeout = 10 * time.Second
+
+// Peer is the backend answerer. It owns the signaling connection and the
+// dependencies shared by every session it answers.
+type Peer struct {
+	cfg   Config
+	api   *rtcAPI
+	pools *bufferPools
+
+	// Conversational stages. A nil transcriber disables the loop; a nil
+	// agent relays transcripts without replying.
+	transcriber Transcriber
+	borrowsPCM  bool // transcriber is a BorrowingTranscriber that borrows
+	agent       Agent
+	synth       Synthesizer
+	// transcribing holds a token per Transcribe call in flight, capped by
+	// Config.MaxConcurrentTranscriptions; nil is unlimited.
+	transcribing chan struct{}
+
+	// processors post-process every transcript, in registration order.
+	processors []TranscriptProcessor
+	// sinks receive every transcript after processing.
+	sinks []TranscriptSink
+	// pcmListeners receive every call's decoded audio, tagged by source.
+	pcmListeners []PCMListener
+	// endpointers makes each session's Endpointer; nil uses
+	// endpoint.Silence.
+	endpointers func() endpoint.Endpointer
+	// mungers rewrite every answer SDP, in registration order.
+	mungers []SDPMunger
+	// recordings receives each call's inbound audio; nil records nothing.
+	recordings RecordingStore
+
+	// dial connects to one signaling server URL.
+	dial func(rawURL string) (SignalConn, error)
+	wsMu sync.Mutex
+	ws   SignalConn
+	// signalURL indexes the current connection's server in
+	// Config.signalingURLs; only the run loop touches it.
+	signalURL int
+
+	// metrics totals every session's speech pipeline counters.
+	metrics vadMetrics
+	// buffered is the utterance audio, in bytes, held across sessions;
+	// see enforceAudioBudget.
+	buffered atomic.Int64
+	budgetMu sync.Mutex
+
+	// wg counts the goroutines calls run; see spawn. closing is closed
+	// when shutdown starts, for goroutines waiting on something else.
+	wg      sync.WaitGroup
+	closing chan struct{}
+
+	offers chan SignalMessage // from the read loop to answerOffers
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*Session // live calls, by remote peer ID
+	mediaPrefs mediaPrefs          // media_config received before the offer
+}
+
+// Handlers are the stages a program embedding the peer plugs in. Every
+// field is optional.
+type Handlers struct {
+	// Transcriber turns utterances into text; nil disables the
+	// conversational loop.
+	Transcriber Transcriber
+	// Agent replies to transcripts; nil relays them without replying.
+	Agent Agent
+	// Synthesizer speaks the agent's replies; nil beeps once per word.
+	Synthesizer Synthesizer
+	// Sinks receive every transcript, after any configured by cfg.
+	Sinks []TranscriptSink
+	// Dial connects to a signaling server URL, e.g. to run over something
+	// other than a WebSocket; nil dials cfg's URLs over WebSocket.
+	Dial func(rawURL string) (SignalConn, error)
+}
+
+// NewPeer makes a peer for cfg, with the Opus SDP mungers, transcript
+// webhook and capture directory it asks for. It doesn't connect until Run.
+// Register further processors, sinks or mungers before calling Run.
+func NewPeer(cfg Config, h Handlers) (*Peer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	api, err := newWebRTCAPI()
+	if err != nil {
+		return nil, fmt.Errorf("WebRTC setup: %w", err)
+	}
+	p := &Peer{
+		cfg:          cfg,
+		api:          api,
+		pools:        newBufferPools(cfg),
+		transcriber:  h.Transcriber,
+		agent:        h.Agent,
+		synth:        h.Synthesizer,
+		transcribing: newTranscribeLimit(cfg.MaxConcurrentTranscriptions),
+		dial:         h.Dial,
+		sessions:     make(map[string]*Session),
+		closing:      make(chan struct{}),
+		offers:       make(chan SignalMessage, maxQueuedOffers),
+	}
+	if b, ok := h.Transcriber.(BorrowingTranscriber); ok {
+		p.borrowsPCM = b.BorrowsPCM()
+	}
+	if p.synth == nil {
+		p.synth = stubSynthesizer{}
+	}
+	if p.dial == nil {
+		p.dial = func(rawURL string) (SignalConn, error) { return dialSignaling(rawURL, cfg) }
+	}
+	if cfg.OpusMaxAverageBitrate > 0 {
+		p.AddSDPMunger(MaxAverageBitrate(cfg.OpusMaxAverageBitrate))
+	}
+	if cfg.OpusFEC {
+		p.AddSDPMunger(OpusFEC(true))
+	}
+	if cfg.OpusDTX {
+		p.AddSDPMunger(OpusDTX(true))
+	}
+	if cfg.TranscriptWebhookURL != "" {
+		p.AddTranscriptSink(newWebhookSink(cfg.TranscriptWebhookURL))
+	}
+	if cfg.CaptureDir != "" {
+		p.SetRecordingStore(dirStore(cfg.CaptureDir))
+	}
+	for _, sink := range h.Sinks {
+		p.AddTranscriptSink(sink)
+	}
+	return p, nil
+}
+
+// Run connects to signaling and answers offers until ctx is cancelled, or
+// until the connection fails without Config.SignalingReconnect. It then
+// leaves signaling, hangs up every call and waits up to ShutdownTimeout
+// for them to wind down. It returns the error that ended the connection,
+// or nil when ctx did. Run a peer once.
+func (p *Peer) Run(ctx context.Context) error {
+	ws, n, err := p.dialFirst(0)
+	if err != nil {
+		return fmt.Errorf("signaling: %w", err)
+	}
+	p.signalURL = n
+	p.setConn(ws)
+
+	p.spawn(p.answerOffers)
+	err = p.run(ctx)
+	p.setConn(nil)
+	log.Printf("Shutting down; hanging up %d calls", p.sessionCount())
+	if !p.shutdown(ShutdownTimeout) {
+		log.Printf("Calls still winding down after %v; exiting anyway", ShutdownTimeout)
+	}
+	return err
+}
+
+// session returns the live call with remoteID, if any.
+func (p *Peer) session(remoteID string) (*Session, bool) {
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+	s, ok := p.sessions[remoteID]
+	return s, ok
+}
+
+// addSession registers s as the live call with its remote peer, returning
+// any media config that peer asked for before offering. A call s replaces
+// is hung up, so a caller that keeps offering holds one connection, not
+// one per offer. Once shutdown has taken its list of calls to hang up, it
+// refuses with errShuttingDown.
+func (p *Peer) addSession(s *Session) (MediaConfig, bool, error) {
+	p.sessionsMu.Lock()
+	select {
+	case <-p.closing:
+		p.sessionsMu.Unlock()
+		return MediaConfig{}, false, errShuttingDown
+	default:
+	}
+	old := p.sessions[s.RemoteID]
+	p.sessions[s.RemoteID] = s
+	mc, ok := p.mediaPrefs.take(s.RemoteID, time.Now())
+	p.sessionsMu.Unlock()
+	if old != nil {
+		// Off the lock: closing the connection reports its state change,
+		// whose handler takes sessionsMu.
+		log.Printf("[%s] %s offered again; hanging up the call it replaces", old.TraceID, s.RemoteID)
+		old.hangUp()
+	}
+	return mc, ok, nil
+}
+
+// sessionCount is the number of live calls.
+func (p *Peer) sessionCount() int {
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+	return len(p.sessions)
+}
+
+// atCapacity reports whether answering remoteID would exceed
+// Config.MaxSessions. A new offer from a peer with a live call replaces
+// that call, so it doesn't count against the cap.
+func (p *Peer) atCapacity(remoteID string) bool {
+	if p.cfg.MaxSessions == 0 {
+		return false
+	}
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+	_, replacing := p.sessions[remoteID]
+	return !replacing && len(p.sessions) >= p.cfg.MaxSessions
+}
+
+// answerDelay is how long to wait before answering an offer: the fixed
+// Config.AnswerDelayMs plus up to Config.AnswerJitterMs at random.
+func (p *Peer) answerDelay() time.Duration {
+	d := time.Duration(p.cfg.AnswerDelayMs) * time.Millisecond
+	if p.cfg.AnswerJitterMs > 0 {
+		d += rand.N(time.Duration(p.cfg.AnswerJitterMs) * time.Millisecond)
+	}
+	return d
+}
+
+// newTranscribeLimit makes Peer.transcribing for a cap of n concurrent
+// transcriptions; 0 is unlimited.
+func newTranscribeLimit(n int) chan struct{} {
+	if n == 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquireTranscription waits for a transcription slot and returns the func
+// that frees it. tag prefixes the log line when it has to wait.
+func (p *Peer) acquireTranscription(tag string) (release func()) {
+	if p.transcribing == nil {
+		return func() {}
+	}
+	select {
+	case p.transcribing <- struct{}{}:
+	default:
+		log.Printf("%sTranscription queued: %d already in flight", tag, cap(p.transcribing))
+		p.transcribing <- struct{}{}
+	}
+	return func() { <-p.transcribing }
+}
+
+// rtcConfiguration is the Configuration every call's PeerConnection is
+// made with.
+func (p *Peer) rtcConfiguration() webrtc.Configuration {
+	config := webrtc.Configuration{
+		ICETransportPolicy: webrtc.NewICETransportPolicy(p.cfg.ICETransportPolicy),
+	}
+	if len(p.cfg.ICEServers) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{
+			URLs:       p.cfg.ICEServers,
+			Username:   p.cfg.ICEUsername,
+			Credential: p.cfg.ICECredential,
+		}}
+	}
+	return config
+}
+
+// removeSession forgets s if it is still the live call with its peer.
+func (p *Peer) removeSession(s *Session) {
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+	if p.sessions[s.RemoteID] == s {
+		delete(p.sessions, s.RemoteID)
+	}
+}
+
+// AddTranscriptProcessor appends fn to the transcript post-processing
+// chain. Register processors before the peer starts answering offers.
+func (p *Peer) AddTranscriptProcessor(fn TranscriptProcessor) {
+	p.processors = append(p.processors, fn)
+}
+
+// AddTranscriptSink registers sink to receive every transcript. Register
+// sinks before the peer starts answering offers.
+func (p *Peer) AddTranscriptSink(sink TranscriptSink) {
+	p.sinks = append(p.sinks, sink)
+}
+
+// SetEndpointer replaces the default silence-based endpointing: each new
+// session gets its own Endpointer from newEndpointer. Set it before the
+// peer starts answering offers.
+func (p *Peer) SetEndpointer(newEndpointer func() endpoint.Endpointer) {
+	p.endpointers = newEndpointer
+}
+
+// newEndpointer returns a session's Endpointer.
+func (p *Peer) newEndpointer() endpoint.Endpointer {
+	if p.endpointers != nil {
+		return p.endpointers()
+	}
+	return endpoint.NewSilence(p.cfg.SilenceMs, p.cfg.CoalesceMs, frameDuration)
+}
+
+// AddSDPMunger appends fn to the answer SDP munging chain. Register mungers
+// before the peer starts answering offers.
+func (p *Peer) AddSDPMunger(fn SDPMunger) {
+	p.mungers = append(p.mungers, fn)
+}
+
+// SetRecordingStore sends each call's inbound audio to store, e.g. object
+// storage in place of the local capture_dir. Set it before the peer starts
+// answering offers.
+func (p *Peer) SetRecordingStore(store RecordingStore) {
+	p.recordings = store
+}
+
+// send writes a message to the signaling server. Sessions answer, relay
+// candidates and emit transcripts from their own goroutines, and the
+// websocket allows only one concurrent writer.
+func (p *Peer) send(msg SignalMessage) error {
+	p.wsMu.Lock()
+	defer p.wsMu.Unlock()
+	if p.ws == nil {
+		return errors.New("signaling not connected")
+	}
+	return p.ws.WriteJSON(msg)
+}
+
+// Reasons an offer is rejected, as a reject message's reason.
+const (
+	rejectBusy             = "busy"              // at Config.MaxSessions
+	rejectInvalidOffer     = "invalid_offer"     // malformed or oversized
+	rejectUnsupportedMedia = "unsupported_media" // no Opus audio
+	rejectInternal         = "internal_error"    // we failed setting up the call
+)
+
+// offerRejection is a handleOffer error the caller is told about, so it
+// can show why and try elsewhere.
+type offerRejection struct {
+	reason string // one of the reject constants
+	detail string // sent to the caller
+	err    error  // logged only; nil when detail says it all
+}
+
+func (r *offerRejection) Error() string {
+	if r.err != nil {
+		return r.reason + ": " + r.detail + ": " + r.err.Error()
+	}
+	return r.reason + ": " + r.detail
+}
+
+func (r *offerRejection) Unwrap() error { return r.err }
+
+// rejectOffer tells the caller its offer won't be answered:
+// {"type":"reject","reason":...,"message":...}.
+func (p *Peer) rejectOffer(to string, r *offerRejection) {
+	msg := SignalMessage{
+		Type:    "reject",
+		To:      to,
+		From:    p.cfg.PeerID,
+		Reason:  r.reason,
+		Message: r.detail,
+	}
+	if err := p.send(msg); err != nil {
+		log.Println("Send offer rejection failed:", err)
+	}
+}
+
+// maxQueuedOffers bounds the offers waiting for answerOffers; beyond it,
+// offers are rejected as busy.
+const maxQueuedOffers = 64
+
+var errShuttingDown = &offerRejection{reason: rejectBusy, detail: "shutting down"}
+
+// queueOffer hands an offer from the read loop to answerOffers. Trickled
+// candidates go the same way, so each is applied after the offer it
+// follows rather than racing its answer.
+func (p *Peer) queueOffer(msg SignalMessage) {
+	select {
+	case p.offers <- msg:
+	default:
+		if isCandidate(msg) {
+			log.Println("Candidate from", msg.From, "dropped:", maxQueuedOffers, "offers already waiting")
+			return
+		}
+		log.Println("Offer from", msg.From, "rejected:", maxQueuedOffers, "offers already waiting")
+		p.rejectOffer(msg.From, &offerRejection{reason: rejectBusy, detail: "too many offers waiting"})
+	}
+}
+
+// answerOffers answers queued offers one at a time until shutdown. The
+// answer delay and call setup happen here rather than on the read loop,
+// so control and media_config for live calls aren't held up behind them.
+func (p *Peer) answerOffers() {
+	for {
+		select {
+		case msg := <-p.offers:
+			if err := p.handleOffer(msg); err != nil {
+				log.Println("Offer from", msg.From, "failed:", err)
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// isCandidate reports whether msg is a trickled ICE candidate rather than
+// an offer: a signal whose data is a candidate and carries no sdp.
+func isCandidate(msg SignalMessage) bool {
+	data, _ := msg.Data.(map[string]interface{})
+	_, candidate := data["candidate"]
+	_, sdp := data["sdp"]
+	return candidate && !sdp
+}
+
+// handleCandidate adds a candidate the caller trickled after its offer to
+// the PeerConnection of its live call.
+func (p *Peer) handleCandidate(msg SignalMessage) error {
+	var c webrtc.ICECandidateInit
+	if err := decodeData(msg.Data, &c); err != nil {
+		return fmt.Errorf("candidate: %w", err)
+	}
+	s, ok := p.session(msg.From)
+	if !ok {
+		return errors.New("candidate for no live call")
+	}
+	if err := s.pc.AddICECandidate(c); err != nil {
+		return fmt.Errorf("add candidate: %w", err)
+	}
+	return nil
+}
+
+// handleOffer answers an SDP offer and starts processing its audio. On any
+// error the partially negotiated PeerConnection is closed before returning.
+// An offer that can't be answered gets a reject message; a signal without
+// an offer just returns an error.
+func (p *Peer) handleOffer(msg SignalMessage) (err error) {
+	defer func() {
+		var r *offerRejection
+		if errors.As(err, &r) {
+			p.rejectOffer(msg.From, r)
+		}
+	}()
+
+	if isCandidate(msg) {
+		return p.handleCandidate(msg)
+	}
+	// Unpack SDP
+	data, _ := msg.Data.(map[string]interface{})
+	sdp, _ := data["sdp"].(string)
+	if sdp == "" {
+		return errors.New("signal carries no sdp")
+	}
+	// Every sdp is taken as an offer: the peer never offers, so there is
+	// no glare to resolve and no Perfect Negotiation rollback. A caller
+	// that offers during a live call is setting up a new call, which
+	// replaces it; see addSession. Tie-breaking is for when the peer
+	// starts sending offers of its own.
+	if limit := p.cfg.MaxSDPBytes; limit > 0 && len(sdp) > limit {
+		return &offerRejection{reason: rejectInvalidOffer, detail: fmt.Sprintf("sdp exceeds %d bytes", limit)}
+	}
+	// Some clients bundle early candidates with the offer.
+	var candidates []webrtc.ICECandidateInit
+	if raw, ok := data["candidates"]; ok {
+		if err := decodeData(raw, &candidates); err != nil {
+			return &offerRejection{reason: rejectInvalidOffer, detail: "candidates: " + err.Error()}
+		}
+	}
+	language, _ := data["language"].(string)
+	if err := validateLanguage(language); err != nil {
+		return &offerRejection{reason: rejectInvalidOffer, detail: err.Error()}
+	}
+	if p.atCapacity(msg.From) {
+		return &offerRejection{reason: rejectBusy, detail: fmt.Sprintf("at capacity (max_sessions %d)", p.cfg.MaxSessions)}
+	}
+	// Media we can't handle is declined in the answer, keeping the audio;
+	// only an offer with no usable audio at all is refused.
+	if ok, err := offersOpus(sdp); err != nil {
+		return &offerRejection{reason: rejectInvalidOffer, detail: err.Error()}
+	} else if !ok {
+		return &offerRejection{reason: rejectUnsupportedMedia, detail: "no Opus audio"}
+	}
+	// Past here the offer is fine; whatever fails is on our side.
+	defer func() {
+		if err != nil && !errors.As(err, new(*offerRejection)) {
+			err = &offerRejection{reason: rejectInternal, detail: "could not set up the call", err: err}
+		}
+	}()
+	// Offers are answered one at a time by answerOffers, so waiting here
+	// spaces out the setup of offers that arrive together.
+	if d := p.answerDelay(); d > 0 {
+		log.Printf("Answering offer from %s in %v", msg.From, d.Round(time.Millisecond))
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-p.closing:
+			return errShuttingDown
+		}
+	}
+
+	// Set up Opus decoder & VAD
+	dec, err := newOpusDecoder()
+	if err != nil {
+		return fmt.Errorf("opus decoder: %w", err)
+	}
+	vad, err := newVoiceDetector(p.cfg)
+	if err != nil {
+		return err
+	}
+
+	// Create PeerConnection
+	peerConnection, bwe, err := p.api.newPeerConnection(p.rtcConfiguration())
+	if err != nil {
+		return fmt.Errorf("create peer connection: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Closing the connection also drops the OnTrack closure, and with it
+		// the last references to the decoder and VAD.
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			log.Println("Close peer connection failed:", closeErr)
+		}
+	}()
+
+	session := &Session{
+		RemoteID: msg.From,
+		TraceID:  newTraceID(),
+		peer:     p,
+		pc:       peerConnection,
+		dec:      dec,
+		vad:      vad,
+		noise:    newNoiseFloor(p.cfg.NoiseFloorAttack, p.cfg.NoiseFloorDecay),
+		smoother: newVADSmoother(p.cfg.VADSmoothingFrames),
+		language: language,
+		done:     make(chan struct{}),
+	}
+	session.endpointer = p.newEndpointer()
+
+	// Handle incoming audio track
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, recv *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			log.Printf("Ignoring %s track (%s): only audio is supported", track.Kind(), track.Codec().MimeType)
+			return
+		}
+		log.Printf("[%s] 🔊 Got track from %s: %s", session.TraceID, session.RemoteID, track.Codec().MimeType)
+		codecs := recv.GetParameters().Codecs
+		p.spawnCallback(func() { session.readLoop(track, codecs) })
+		p.spawnCallback(func() { session.readRTCP(recv) })
+	})
+
+	// Apply remote SDP
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err = peerConnection.SetRemoteDescription(offer); err != nil {
+		return &offerRejection{reason: rejectInvalidOffer, detail: "offer not applicable", err: err}
+	}
+	// Candidates only apply once the offer is in place. One that won't
+	// parse is skipped; the rest, or later ones, may still connect.
+	for _, c := range candidates {
+		if err := peerConnection.AddICECandidate(c); err != nil {
+			log.Printf("[%s] Skipping bundled candidate from %s: %v", session.TraceID, msg.From, err)
+		}
+	}
+
+	// Add the outbound track before answering so the answer is sendrecv
+	if session.player, err = newPlayer(peerConnection, opusApplications[p.cfg.OpusApplication], p.cfg.OpusComplexity, opusBandwidths[p.cfg.OpusMaxBandwidth], session.playbackFailed, session.outboundRTCP, p.spawn); err != nil {
+		return err
+	}
+	if bwe != nil {
+		bwe.OnTargetBitrateChange(session.player.adaptBitrate)
+	}
+	if p.cfg.ComfortNoiseDBFS != 0 {
+		session.player.setComfortNoise(p.cfg.ComfortNoiseDBFS)
+	}
+	if p.cfg.OpusPacketLossPerc >= 0 {
+		session.player.setPacketLoss(p.cfg.OpusPacketLossPerc)
+	}
+	if p.cfg.OpusDTX {
+		dtx := true
+		if err = session.player.configure(MediaConfig{DTX: &dtx}); err != nil {
+			return fmt.Errorf("enable DTX: %w", err)
+		}
+	}
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			p.removeSession(session)
+			session.stop()
+		}
+	})
+
+	// Apply any media settings the caller asked for before offering
+	mungers := p.mungers
+	mc, ok, err := p.addSession(session)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err = session.player.configure(mc); err != nil {
+			return fmt.Errorf("configure encoder: %w", err)
+		}
+		// Last, so the caller's settings win over configured defaults in
+		// the SDP just as they do on the encoder.
+		mungers = slices.Concat(mungers, mc.mungers())
+	}
+	defer func() {
+		if err != nil {
+			p.removeSession(session)
+		}
+	}()
+
+	// Create and set answer
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("create answer: %w", err)
+	}
+	if declined := declinedMedia(answer.SDP); len(declined) > 0 {
+		log.Printf("[%s] Declined unsupported media in offer from %s: %s", session.TraceID, msg.From, strings.Join(declined, ", "))
+	}
+	// The promise has to exist before SetLocalDescription starts gathering.
+	var gathered <-chan struct{}
+	if !p.cfg.TrickleICE {
+		gathered = webrtc.GatheringCompletePromise(peerConnection)
+	}
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("set local description: %w", err)
+	}
+	if gathered != nil {
+		// Gathering can take up to iceGatherTimeout, so the answer waits
+		// for it on its own goroutine rather than holding up the read loop.
+		p.spawn(func() { p.answerWhenGathered(session, gathered, mungers) })
+		return nil
+	}
+	if err = p.sendAnswer(session, answer, mungers); err != nil {
+		return err
+	}
+
+	// Relay ICE candidates as they're gathered
+	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		iceMsg := SignalMessage{
+			Type: "signal",
+			To:   msg.From,
+			From: p.cfg.PeerID,
+			Data: map[string]interface{}{"candidate": c.ToJSON()},
+		}
+		p.send(iceMsg)
+	})
+
+	return nil
+}
+
+// answerWhenGathered sends a non-trickle answer once ICE gathering has
+// finished, or after iceGatherTimeout with the candidates found so far.
+// It gives up if the call ends or the peer shuts down first. A failure
+// hangs up the call, which has been registered by now, and rejects the
+// offer.
+func (p *Peer) answerWhenGathered(s *Session, gathered <-chan struct{}, mungers []SDPMunger) {
+	t := time.NewTimer(iceGatherTimeout)
+	defer t.Stop()
+	select {
+	case <-gathered:
+	case <-t.C:
+		log.Printf("[%s] ICE gathering for %s not complete after %v; answering with what we have", s.TraceID, s.RemoteID, iceGatherTimeout)
+	case <-s.done:
+		return
+	case <-p.closing:
+		return
+	}
+	// The local description now carries the candidates inline.
+	if err := p.sendAnswer(s, *s.pc.LocalDescription(), mungers); err != nil {
+		log.Println("Offer from", s.RemoteID, "failed:", err)
+		p.rejectOffer(s.RemoteID, &offerRejection{reason: rejectInternal, detail: "could not set up the call", err: err})
+		s.hangUp()
+	}
+}
+
+// sendAnswer munges answer and sends it to the caller, then starts the
+// call's watchers.
+func (p *Peer) sendAnswer(s *Session, answer webrtc.SessionDescription, mungers []SDPMunger) error {
+	// pion only accepts the answer exactly as generated, so mungers shape
+	// what the caller sees; fmtp tweaks only steer the remote's sender.
+	answerSDP, err := applyMungers(answer.SDP, mungers)
+	if err != nil {
+		return fmt.Errorf("munge answer: %w", err)
+	}
+
+	// Send answer via signaling
+	answerMsg := SignalMessage{
+		Type: "signal",
+		To:   s.RemoteID,
+		From: p.cfg.PeerID,
+		Data: map[string]string{"sdp": answerSDP},
+	}
+	if err := p.send(answerMsg); err != nil {
+		return fmt.Errorf("send answer: %w", err)
+	}
+	if p.cfg.InactivityTimeoutMs > 0 {
+		p.spawn(func() { s.watchInactivity(time.Duration(p.cfg.InactivityTimeoutMs) * time.Millisecond) })
+	}
+	if p.cfg.OpusPacketLossPerc < 0 {
+		p.spawn(s.trackPacketLoss)
+	}
+	return nil
+}
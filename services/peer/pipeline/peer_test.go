@@ -0,0 +1,845 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/goleak"
+)
+
+// fakeSignaling is a SignalConn that feeds the peer the messages a test
+// queues on in and hands it everything the peer sends on out.
+type fakeSignaling struct {
+	in     chan SignalMessage
+	out    chan SignalMessage
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeSignaling() *fakeSignaling {
+	return &fakeSignaling{
+		in:     make(chan SignalMessage, 16),
+		out:    make(chan SignalMessage, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeSignaling) ReadJSON(v interface{}) error {
+	select {
+	case msg := <-f.in:
+		return roundTrip(msg, v)
+	case <-f.closed:
+		return net.ErrClosed
+	}
+}
+
+func (f *fakeSignaling) WriteJSON(v interface{}) error {
+	var msg SignalMessage
+	if err := roundTrip(v, &msg); err != nil {
+		return err
+	}
+	select {
+	case f.out <- msg:
+		return nil
+	case <-f.closed:
+		return net.ErrClosed
+	}
+}
+
+func (f *fakeSignaling) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+// roundTrip copies from into to through JSON, as the wire would.
+func roundTrip(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// next returns the next message the peer sent, failing the test if none
+// comes within timeout.
+func (f *fakeSignaling) next(t *testing.T, timeout time.Duration) SignalMessage {
+	t.Helper()
+	select {
+	case msg := <-f.out:
+		return msg
+	case <-time.After(timeout):
+		t.Fatalf("peer sent nothing within %v", timeout)
+		return SignalMessage{}
+	}
+}
+
+// nextMessage is next, skipping the ICE candidates a trickling peer sends
+// along the way.
+func (f *fakeSignaling) nextMessage(t *testing.T, timeout time.Duration) SignalMessage {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		msg := f.next(t, time.Until(deadline))
+		if data, ok := msg.Data.(map[string]interface{}); !ok || data["candidate"] == nil {
+			return msg
+		}
+	}
+}
+
+// newTestPeer makes a peer for cfg, signaling through a fake.
+func newTestPeer(t *testing.T, cfg Config) (*Peer, *fakeSignaling) {
+	t.Helper()
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newFakeSignaling()
+	p.setConn(ws)
+	return p, ws
+}
+
+// newOffer returns the SDP of an audio-only offer from a pion peer, as a
+// caller would send it.
+func newOffer(t *testing.T) string {
+	return newOfferOf(t, webrtc.RTPCodecTypeAudio)
+}
+
+// newOfferOf is newOffer with a transceiver of each of kinds.
+func newOfferOf(t *testing.T, kinds ...webrtc.RTPCodecType) string {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	for _, kind := range kinds {
+		if _, err := pc.AddTransceiverFromKind(kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	return offer.SDP
+}
+
+func offerMessage(from, sdp string) SignalMessage {
+	return SignalMessage{Type: "signal", From: from, Data: map[string]interface{}{"sdp": sdp}}
+}
+
+func TestNonTrickleAnswerWaitsOffReadLoop(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TrickleICE = false
+	p, ws := newTestPeer(t, cfg)
+
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	answer := ws.next(t, iceGatherTimeout+time.Second)
+	sdp, _ := answer.Data.(map[string]interface{})["sdp"].(string)
+	if answer.To != "iphone-1" || !strings.Contains(sdp, "a=candidate:") {
+		t.Errorf("want an answer to iphone-1 with its candidates inline, got %+v", answer)
+	}
+	if !p.shutdown(time.Second) {
+		t.Error("call still winding down a second after shutdown")
+	}
+}
+
+func TestShutdownStopsGatherWait(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TrickleICE = false
+	// Nothing answers on TEST-NET-1, so gathering waits on the STUN query.
+	cfg.ICEServers = []string{"stun:192.0.2.1:3478"}
+	p, ws := newTestPeer(t, cfg)
+
+	start := time.Now()
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handleOffer took %v, waiting for ICE gathering on the read loop", elapsed)
+	}
+	if !p.shutdown(time.Second) {
+		t.Error("the answer's gather wait outlived shutdown")
+	}
+	select {
+	case msg := <-ws.out:
+		t.Errorf("sent %+v after shutdown", msg)
+	default:
+	}
+}
+
+func TestAnswerDelayOffReadLoop(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AnswerDelayMs = 2000
+	p, ws := newTestPeer(t, cfg)
+	served := make(chan error, 1)
+	go func() { served <- p.serve() }()
+	if join := ws.next(t, time.Second); join.Type != "join" {
+		t.Fatalf("peer opened with %+v, want a join", join)
+	}
+	p.spawn(p.answerOffers)
+
+	ws.in <- offerMessage("iphone-1", newOffer(t))
+	ws.in <- SignalMessage{Type: "media_config", From: "iphone-2", Data: map[string]interface{}{"bitrate": 24000}}
+	// The read loop handles the media_config while the offer waits.
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.sessionsMu.Lock()
+		_, stored := p.mediaPrefs.byPeer["iphone-2"]
+		p.sessionsMu.Unlock()
+		if stored {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("media_config not handled while an offer waited out its answer delay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Shutting down ends the wait without answering.
+	ws.Close()
+	<-served
+	if !p.shutdown(time.Second) {
+		t.Error("the answer delay outlived shutdown")
+	}
+	if n := p.sessionCount(); n != 0 {
+		t.Errorf("%d calls set up after shutdown", n)
+	}
+}
+
+// remoteCandidateIPs lists the addresses of the remote candidates pc's ICE
+// agent knows.
+func remoteCandidateIPs(pc *webrtc.PeerConnection) []string {
+	var ips []string
+	for _, stat := range pc.GetStats() {
+		if c, ok := stat.(webrtc.ICECandidateStats); ok && c.Type == webrtc.StatsTypeRemoteCandidate {
+			ips = append(ips, c.IP)
+		}
+	}
+	return ips
+}
+
+// A candidate trickled right behind its offer reaches the call that offer
+// set up, rather than being taken for an offer without an sdp.
+func TestTrickledCandidate(t *testing.T) {
+	p, ws := newTestPeer(t, DefaultConfig())
+	served := make(chan error, 1)
+	go func() { served <- p.serve() }()
+	t.Cleanup(func() {
+		ws.Close()
+		<-served
+		p.shutdown(time.Second)
+	})
+	if join := ws.next(t, time.Second); join.Type != "join" {
+		t.Fatalf("peer opened with %+v, want a join", join)
+	}
+	p.spawn(p.answerOffers)
+
+	candidate := func(from, ip string) SignalMessage {
+		return SignalMessage{Type: "signal", From: from, Data: map[string]interface{}{
+			"candidate":     "candidate:1 1 udp 2130706431 " + ip + " 50000 typ host",
+			"sdpMid":        "0",
+			"sdpMLineIndex": 0,
+		}}
+	}
+	ws.in <- offerMessage("iphone-1", newOffer(t))
+	ws.in <- candidate("iphone-1", "192.0.2.1")
+	// No call to add it to: logged and dropped, not rejected as an offer.
+	ws.in <- candidate("iphone-2", "192.0.2.2")
+
+	if answer := ws.nextMessage(t, time.Second); answer.Type != "signal" || answer.To != "iphone-1" {
+		t.Fatalf("got %+v, want the answer to iphone-1", answer)
+	}
+	s, ok := p.session("iphone-1")
+	if !ok {
+		t.Fatal("no live call after answering")
+	}
+	deadline := time.Now().Add(time.Second)
+	for !slices.Contains(remoteCandidateIPs(s.pc), "192.0.2.1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("remote candidates %v, want the trickled 192.0.2.1", remoteCandidateIPs(s.pc))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ips := remoteCandidateIPs(s.pc); slices.Contains(ips, "192.0.2.2") {
+		t.Errorf("iphone-2's candidate added to iphone-1's call: %v", ips)
+	}
+	quiet := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case msg := <-ws.out:
+			if msg.Type == "reject" {
+				t.Errorf("candidate met with %+v", msg)
+			}
+		case <-quiet:
+			return
+		}
+	}
+}
+
+// A browser offering audio and video gets an answer keeping the audio and
+// declining the video; an offer of video alone is refused.
+func TestVideoOffer(t *testing.T) {
+	p, ws := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+
+	if err := p.handleOffer(offerMessage("iphone-1", newOfferOf(t, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo))); err != nil {
+		t.Fatal(err)
+	}
+	answer := ws.nextMessage(t, time.Second)
+	sdp, _ := answer.Data.(map[string]interface{})["sdp"].(string)
+	if got := declinedMedia(sdp); !slices.Equal(got, []string{"video"}) {
+		t.Errorf("answer declines %v, want [video]", got)
+	}
+	if !strings.Contains(sdp, "m=audio 9 ") || !strings.Contains(sdp, "a=sendrecv") {
+		t.Errorf("answer doesn't keep the audio sendrecv:\n%s", sdp)
+	}
+	if _, ok := p.session("iphone-1"); !ok {
+		t.Error("no live call for the audio and video offer")
+	}
+
+	err := p.handleOffer(offerMessage("iphone-2", newOfferOf(t, webrtc.RTPCodecTypeVideo)))
+	var r *offerRejection
+	if !errors.As(err, &r) || r.reason != rejectUnsupportedMedia {
+		t.Errorf("video-only offer: %v, want an unsupported_media rejection", err)
+	}
+}
+
+func TestMaxSessionsRejectsOffer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxSessions = 2
+	p, ws := newTestPeer(t, cfg)
+
+	for _, from := range []string{"iphone-1", "iphone-2"} {
+		if err := p.handleOffer(offerMessage(from, newOffer(t))); err != nil {
+			t.Fatal(err)
+		}
+		if answer := ws.nextMessage(t, time.Second); answer.To != from {
+			t.Fatalf("got %+v, want an answer to %s", answer, from)
+		}
+	}
+	if err := p.handleOffer(offerMessage("iphone-3", newOffer(t))); err == nil {
+		t.Fatal("offer past max_sessions answered")
+	}
+	reject := ws.nextMessage(t, time.Second)
+	if reject.Type != "reject" || reject.To != "iphone-3" || reject.Reason != rejectBusy {
+		t.Errorf("got %+v, want a busy reject to iphone-3", reject)
+	}
+	if n := p.sessionCount(); n != 2 {
+		t.Errorf("%d calls live, want the cap of 2", n)
+	}
+	if !p.shutdown(time.Second) {
+		t.Error("calls still winding down a second after shutdown")
+	}
+}
+
+// An offer that passes the checks but can't be applied is rejected, and
+// the PeerConnection set up for it is closed rather than leaked.
+func TestFailedOfferClosesConnection(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	p, ws := newTestPeer(t, DefaultConfig())
+	var lines []string
+	for _, line := range strings.Split(newOffer(t), "\r\n") {
+		if !strings.HasPrefix(line, "a=ice-ufrag:") {
+			lines = append(lines, line)
+		}
+	}
+	err := p.handleOffer(offerMessage("iphone-1", strings.Join(lines, "\r\n")))
+	var r *offerRejection
+	if !errors.As(err, &r) || r.reason != rejectInvalidOffer {
+		t.Fatalf("handleOffer = %v, want an invalid_offer rejection", err)
+	}
+	if reject := ws.nextMessage(t, time.Second); reject.Type != "reject" || reject.Reason != rejectInvalidOffer {
+		t.Errorf("got %+v, want an invalid_offer reject", reject)
+	}
+	if n := p.sessionCount(); n != 0 {
+		t.Errorf("%d calls live after a failed offer", n)
+	}
+	if !p.shutdown(time.Second) {
+		t.Error("calls still winding down a second after shutdown")
+	}
+}
+
+// A caller that offers again gets a new call in place of its live one. The
+// old call is hung up, so re-offering can't pile up connections past
+// max_sessions.
+func TestReofferReplacesCall(t *testing.T) {
+	// Registered first, so it runs after the cleanups closing the offers.
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	cfg := DefaultConfig()
+	cfg.MaxSessions = 1
+	p, ws := newTestPeer(t, cfg)
+
+	var replaced []*Session
+	for range 3 {
+		if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+			t.Fatal(err)
+		}
+		if answer := ws.nextMessage(t, time.Second); answer.Type != "signal" {
+			t.Fatalf("got %+v, want an answer", answer)
+		}
+		s, ok := p.session("iphone-1")
+		if !ok {
+			t.Fatal("no live call after answering")
+		}
+		replaced = append(replaced, s)
+		if n := p.sessionCount(); n != 1 {
+			t.Errorf("%d calls live after a re-offer, want 1", n)
+		}
+	}
+	for i, s := range replaced[:len(replaced)-1] {
+		if state := s.pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+			t.Errorf("call %d replaced by a re-offer is %s, want closed", i, state)
+		}
+		select {
+		case <-s.done:
+		default:
+			t.Errorf("call %d replaced by a re-offer never stopped", i)
+		}
+	}
+	if live := replaced[len(replaced)-1]; live.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		t.Error("the call answering the last offer is closed")
+	}
+	if !p.shutdown(time.Second) {
+		t.Error("calls still winding down a second after shutdown")
+	}
+}
+
+// The peer is always the answerer: every sdp it sends answers the offer
+// it was given, and a re-offer mid-call is answered too, never met with an
+// offer of ours, so glare can't happen.
+func TestPeerOnlyAnswers(t *testing.T) {
+	p, ws := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	for round := range 2 {
+		caller, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { caller.Close() })
+		if _, err := caller.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+			t.Fatal(err)
+		}
+		offer, err := caller.CreateOffer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := caller.SetLocalDescription(offer); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.handleOffer(offerMessage("iphone-1", offer.SDP)); err != nil {
+			t.Fatal(err)
+		}
+		msg := ws.nextMessage(t, time.Second)
+		sdp, _ := msg.Data.(map[string]interface{})["sdp"].(string)
+		if err := caller.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+			t.Fatalf("round %d: caller can't take what the peer sent as its answer: %v", round, err)
+		}
+		s, _ := p.session("iphone-1")
+		if local := s.pc.LocalDescription(); local == nil || local.Type != webrtc.SDPTypeAnswer {
+			t.Errorf("round %d: peer's local description is %v, want an answer", round, local)
+		}
+		if state := s.pc.SignalingState(); state != webrtc.SignalingStateStable {
+			t.Errorf("round %d: peer's signaling state %s, want stable", round, state)
+		}
+	}
+	deadline := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case msg := <-ws.out:
+			if data, _ := msg.Data.(map[string]interface{}); data["sdp"] != nil {
+				t.Errorf("peer sent an sdp nobody offered for: %+v", msg)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// TestRunThroughDial runs a peer whose signaling is a fake handed over by
+// Handlers.Dial: Run fails over past a server that can't be dialed, joins,
+// answers an offer, and on cancellation closes the connection and returns
+// nil.
+func TestRunThroughDial(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SignalingURLs = []string{"ws://down.example/ws", "ws://up.example/ws"}
+	ws := newFakeSignaling()
+	var dialed []string
+	p, err := NewPeer(cfg, Handlers{Dial: func(rawURL string) (SignalConn, error) {
+		dialed = append(dialed, rawURL)
+		if rawURL == cfg.SignalingURLs[0] {
+			return nil, errors.New("connection refused")
+		}
+		return ws, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+
+	join := ws.next(t, time.Second)
+	if join.Type != "join" || join.ID != cfg.PeerID || join.Role != "backend" {
+		t.Fatalf("peer opened with %+v, want a backend join as %s", join, cfg.PeerID)
+	}
+	if !slices.Equal(dialed, cfg.SignalingURLs) {
+		t.Errorf("dialed %v, want %v", dialed, cfg.SignalingURLs)
+	}
+	ws.in <- offerMessage("iphone-1", newOffer(t))
+	answer := ws.nextMessage(t, 5*time.Second)
+	if sdp, _ := answer.Data.(map[string]interface{})["sdp"].(string); answer.Type != "signal" || answer.To != "iphone-1" || !strings.Contains(sdp, "a=rtpmap:111 opus") {
+		t.Fatalf("got %+v, want an Opus answer to iphone-1", answer)
+	}
+
+	cancel()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Errorf("Run = %v after cancellation, want nil", err)
+		}
+	case <-time.After(ShutdownTimeout + time.Second):
+		t.Fatal("Run didn't return after cancellation")
+	}
+	select {
+	case <-ws.closed:
+	default:
+		t.Error("signaling connection left open")
+	}
+	if n := p.sessionCount(); n != 0 {
+		t.Errorf("%d calls left after Run returned", n)
+	}
+}
+
+// After losing signaling the peer redials, backing off past a failed
+// attempt, and rejoins; the live call carries on over the new connection.
+func TestReconnectKeepsCalls(t *testing.T) {
+	first, second := newFakeSignaling(), newFakeSignaling()
+	var mu sync.Mutex
+	var dials []time.Time
+	p, err := NewPeer(DefaultConfig(), Handlers{
+		Transcriber: fixedTranscriber{Transcription{Text: "still here"}},
+		Dial: func(string) (SignalConn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dials = append(dials, time.Now())
+			switch len(dials) {
+			case 1:
+				return first, nil
+			case 2:
+				return nil, errors.New("connection refused")
+			}
+			return second, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-ran
+	}()
+
+	first.next(t, time.Second) // join
+	first.in <- offerMessage("iphone-1", newOffer(t))
+	first.nextMessage(t, 5*time.Second)
+	first.Close()
+
+	if join := second.next(t, 5*time.Second); join.Type != "join" || join.ID != p.cfg.PeerID {
+		t.Fatalf("peer reopened with %+v, want a join", join)
+	}
+	mu.Lock()
+	if len(dials) != 3 || dials[2].Sub(dials[1]) < reconnectBackoffMin*2 {
+		t.Errorf("%d dials, the retry %v after the failed one; want 3 and a doubled backoff", len(dials), dials[len(dials)-1].Sub(dials[1]))
+	}
+	mu.Unlock()
+	s, ok := p.session("iphone-1")
+	if !ok {
+		t.Fatal("call dropped with the signaling connection")
+	}
+	s.sayFrame(squareFrame(4000), 10)
+	var tr struct{ Transcript Transcript }
+	if msg := second.nextMessage(t, time.Second); msg.To != "iphone-1" || roundTrip(msg.Data, &tr) != nil || tr.Transcript.Text != "still here" {
+		t.Errorf("got %+v on the new connection, want the call's transcript", msg)
+	}
+}
+
+// A reconnect tries the server just lost first, then carries on down the
+// list.
+func TestReconnectStartsWithLostServer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SignalingURLs = []string{"ws://a.example/ws", "ws://b.example/ws", "ws://c.example/ws"}
+	first, second := newFakeSignaling(), newFakeSignaling()
+	var mu sync.Mutex
+	var dialed []string
+	p, err := NewPeer(cfg, Handlers{Dial: func(rawURL string) (SignalConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, rawURL)
+		switch len(dialed) {
+		case 2:
+			return first, nil
+		case 4:
+			return second, nil
+		}
+		return nil, errors.New("connection refused")
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-ran
+	}()
+
+	first.next(t, time.Second)
+	first.Close()
+	second.next(t, 5*time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	urls := cfg.SignalingURLs
+	if want := []string{urls[0], urls[1], urls[1], urls[2]}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
+
+// With signaling_reconnect off, Run returns once the connection drops.
+func TestRunWithoutReconnect(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SignalingReconnect = false
+	ws := newFakeSignaling()
+	p, err := NewPeer(cfg, Handlers{Dial: func(string) (SignalConn, error) { return ws, nil }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(context.Background()) }()
+	ws.next(t, time.Second)
+	ws.Close()
+	select {
+	case err := <-ran:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Run = %v, want the read error", err)
+		}
+	case <-time.After(ShutdownTimeout + time.Second):
+		t.Fatal("Run still going after the connection dropped")
+	}
+}
+
+// Without reconnecting, Run returns the error of a connection it can't
+// make.
+func TestRunReturnsDialError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SignalingReconnect = false
+	refused := errors.New("connection refused")
+	p, err := NewPeer(cfg, Handlers{Dial: func(string) (SignalConn, error) { return nil, refused }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background()); !errors.Is(err, refused) {
+		t.Errorf("Run = %v, want %v", err, refused)
+	}
+}
+
+// Offers that are too long, don't parse or carry no Opus audio are
+// rejected, with no call set up; max_sdp_bytes 0 takes any length.
+func TestInvalidOffers(t *testing.T) {
+	offer := newOffer(t)
+	padded := offer + strings.Repeat("a=x-pad:"+strings.Repeat("x", 1000)+"\r\n", 78)
+	tests := []struct {
+		name, sdp      string
+		reason, detail string
+	}{
+		{"oversized", padded, rejectInvalidOffer, "sdp exceeds 65536 bytes"},
+		{"garbage", "not sdp at all", rejectInvalidOffer, ""},
+		{"truncated", offer[:strings.Index(offer, "m=audio")+4], rejectInvalidOffer, ""},
+		{"video only", newOfferOf(t, webrtc.RTPCodecTypeVideo), rejectUnsupportedMedia, ""},
+	}
+	p, ws := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	for _, tt := range tests {
+		if err := p.handleOffer(offerMessage("iphone-1", tt.sdp)); err == nil {
+			t.Errorf("%s offer answered", tt.name)
+			continue
+		}
+		reject := ws.nextMessage(t, time.Second)
+		if reject.Type != "reject" || reject.To != "iphone-1" || reject.Reason != tt.reason || (tt.detail != "" && reject.Message != tt.detail) {
+			t.Errorf("%s offer: got %+v, want a %s reject %q", tt.name, reject, tt.reason, tt.detail)
+		}
+		if n := p.sessionCount(); n != 0 {
+			t.Errorf("%s offer left %d calls", tt.name, n)
+		}
+	}
+	if err := p.handleOffer(offerMessage("iphone-1", offer)); err != nil {
+		t.Errorf("normal offer: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxSDPBytes = 0
+	unlimited, _ := newTestPeer(t, cfg)
+	t.Cleanup(func() { unlimited.shutdown(time.Second) })
+	if err := unlimited.handleOffer(offerMessage("iphone-1", padded)); err != nil {
+		t.Errorf("padded offer with no limit: %v", err)
+	}
+}
+
+// startTURN runs a TURN server on loopback for the test, accepting
+// username and password, and returns its host:port.
+func startTURN(t *testing.T, username, password string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const realm = "voice-agent"
+	key := turn.GenerateAuthKey(username, realm, password)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: realm,
+		AuthHandler: func(u, _ string, _ net.Addr) ([]byte, bool) {
+			return key, u == username
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return conn.LocalAddr().String()
+}
+
+// Under ice_transport_policy relay a call's PeerConnection gathers only
+// through the TURN server, with its credentials, so no host candidate
+// reaches the caller; under all it does.
+func TestICETransportPolicy(t *testing.T) {
+	for _, policy := range []string{"all", "relay"} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ICEServers = []string{"turn:" + startTURN(t, "agent", "secret")}
+			cfg.ICEUsername, cfg.ICECredential = "agent", "secret"
+			cfg.ICETransportPolicy = policy
+			p, ws := newTestPeer(t, cfg)
+			t.Cleanup(func() { p.shutdown(time.Second) })
+			if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+				t.Fatal(err)
+			}
+			s, _ := p.session("iphone-1")
+			got := s.pc.GetConfiguration()
+			if got.ICETransportPolicy != webrtc.NewICETransportPolicy(policy) {
+				t.Errorf("PeerConnection policy %v, want %s", got.ICETransportPolicy, policy)
+			}
+			if len(got.ICEServers) != 1 || got.ICEServers[0].Username != "agent" || got.ICEServers[0].Credential != "secret" {
+				t.Errorf("ICE servers %+v, want the TURN server with its credentials", got.ICEServers)
+			}
+
+			var host, relay bool
+			quiet := time.After(time.Second)
+		collect:
+			for {
+				select {
+				case msg := <-ws.out:
+					host = host || strings.Contains(fmt.Sprint(msg.Data), "typ host")
+					relay = relay || strings.Contains(fmt.Sprint(msg.Data), "typ relay")
+				case <-quiet:
+					break collect
+				}
+			}
+			if want := policy == "all"; host != want {
+				t.Errorf("host candidate sent %v, want %v", host, want)
+			}
+			if !relay {
+				t.Error("no relay candidate sent")
+			}
+		})
+	}
+}
+
+// Offers failing in each remaining way get a reject naming why; a failure
+// on our side is reported generically, keeping its cause in the log. A
+// signal with no offer in it gets nothing back.
+func TestOfferRejections(t *testing.T) {
+	offer := newOffer(t)
+	var noUfrag []string
+	for _, line := range strings.Split(offer, "\r\n") {
+		if !strings.HasPrefix(line, "a=ice-ufrag:") {
+			noUfrag = append(noUfrag, line)
+		}
+	}
+	tests := []struct {
+		name           string
+		data           map[string]interface{}
+		turn           bool // needs a TURN server configured without credentials
+		reason, detail string
+	}{
+		{"bad candidates", map[string]interface{}{"sdp": offer, "candidates": "candidate:1"}, false, rejectInvalidOffer, ""},
+		{"bad language", map[string]interface{}{"sdp": offer, "language": "not a tag!"}, false, rejectInvalidOffer, `invalid language tag "not a tag!"`},
+		{"not applicable", map[string]interface{}{"sdp": strings.Join(noUfrag, "\r\n")}, false, rejectInvalidOffer, "offer not applicable"},
+		{"setup failure", map[string]interface{}{"sdp": offer}, true, rejectInternal, "could not set up the call"},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		if tt.turn {
+			cfg.ICEServers = []string{"turn:127.0.0.1:3478"}
+		}
+		p, ws := newTestPeer(t, cfg)
+		err := p.handleOffer(SignalMessage{Type: "signal", From: "iphone-1", Data: tt.data})
+		if err == nil {
+			t.Errorf("%s: offer answered", tt.name)
+		} else {
+			reject := ws.nextMessage(t, time.Second)
+			if reject.Type != "reject" || reject.To != "iphone-1" || reject.From != cfg.PeerID ||
+				reject.Reason != tt.reason || (tt.detail != "" && reject.Message != tt.detail) {
+				t.Errorf("%s: got %+v, want a %s reject %q", tt.name, reject, tt.reason, tt.detail)
+			}
+			if tt.reason == rejectInternal && !strings.Contains(err.Error(), "credentials") {
+				t.Errorf("%s: error %q lost the cause", tt.name, err)
+			}
+		}
+		if n := p.sessionCount(); n != 0 {
+			t.Errorf("%s: %d calls left", tt.name, n)
+		}
+		p.shutdown(time.Second)
+	}
+
+	p, ws := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	if err := p.handleOffer(SignalMessage{Type: "signal", From: "iphone-1", Data: map[string]interface{}{"candidate": "candidate:1"}}); err == nil {
+		t.Error("signal without an offer answered")
+	}
+	select {
+	case msg := <-ws.out:
+		t.Errorf("signal without an offer got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
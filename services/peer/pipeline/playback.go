@@ -0,0 +1,328 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// maxOpusPacket is the largest Opus packet for a single frame (RFC 6716 §3.4).
+const maxOpusPacket = 1275
+
+const (
+	// minOpusBitrate is the lowest bitrate Opus accepts, in bits/s.
+	minOpusBitrate = 6000
+	// adaptiveBitrateCeiling is the most bandwidth estimation will raise the
+	// encoder to when the caller hasn't asked for a bitrate; more buys
+	// little for a single voice.
+	adaptiveBitrateCeiling = 32000
+	// bitrateHysteresis is the share, one in this many, by which a new
+	// bandwidth estimate must move the encoder's bitrate before it is
+	// retuned, so a wobbling estimate doesn't change it on every feedback
+	// report. Reaching the floor or the ceiling always applies.
+	bitrateHysteresis = 10
+)
+
+// opusApplications maps Config.OpusApplication values to encoder modes.
+// VoIP favours speech intelligibility, audio favours fidelity, and
+// restricted low-delay trades quality for the lowest algorithmic delay.
+var opusApplications = map[string]opus.Application{
+	"voip":     opus.AppVoIP,
+	"audio":    opus.AppAudio,
+	"lowdelay": opus.AppRestrictedLowdelay,
+}
+
+// opusBandwidths maps Config.OpusMaxBandwidth values to the widest audio
+// band the outbound encoder may code: 4, 6, 8, 12 or 20 kHz.
+var opusBandwidths = map[string]opus.Bandwidth{
+	"narrowband":    opus.Narrowband,
+	"mediumband":    opus.Mediumband,
+	"wideband":      opus.Wideband,
+	"superwideband": opus.SuperWideband,
+	"fullband":      opus.Fullband,
+}
+
+// errPlayerClosed is returned when queueing audio on a player whose track
+// has gone away.
+var errPlayerClosed = errors.New("playback closed")
+
+// sampleWriter is the part of the outbound track the player writes to.
+type sampleWriter interface {
+	WriteSample(media.Sample) error
+}
+
+// frameEncoder is the part of the Opus encoder the player drives once it
+// is set up.
+type frameEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+	SetBitrate(bitrate int) error
+	SetDTX(dtx bool) error
+	SetInBandFEC(fec bool) error
+	SetPacketLossPerc(lossPerc int) error
+}
+
+// player owns a session's outbound audio track. Queued PCM is cut into 20ms
+// frames, encoded to Opus, and written out one frame every 20ms of wall
+// time.
+//
+// With comfort noise set, idle ticks send low-level noise instead of
+// nothing, and frames are padded with it rather than silence.
+//
+// A failed write abandons the rest of the queue and reports the error to
+// onWriteError, so the session can drop the turn that was speaking rather
+// than retrying every tick. Audio queued later is tried again, which lets
+// playback resume if the connection recovers. A write error meaning the
+// track is closed stops the player for good.
+type player struct {
+	track        sampleWriter
+	onWriteError func(error)
+	clock        clock // paces frames; see framePacer
+
+	encMu    sync.Mutex
+	enc      frameEncoder
+	ceiling  int // caller-requested bitrate, or 0 for adaptiveBitrateCeiling
+	estimate int // latest available-bandwidth estimate, 0 until one arrives
+	bitrate  int // bitrate the encoder was last set to, 0 for its default
+	lossPerc int // expected loss the encoder was last told, in percent
+
+	mu    sync.Mutex
+	queue [][]int16
+	noise *comfortNoise // nil sends nothing when idle
+
+	done chan struct{}
+	once sync.Once
+}
+
+// newPlayer adds an outbound Opus track to pc and starts the playback loop.
+// It must be called after the remote offer is applied so the track binds to
+// the offered audio transceiver. onRTCP receives the caller's RTCP about
+// the outbound track, e.g. its receiver reports. The player's goroutines
+// are started with spawn.
+func newPlayer(pc *webrtc.PeerConnection, app opus.Application, complexity int, maxBandwidth opus.Bandwidth, onWriteError func(error), onRTCP func([]rtcp.Packet), spawn func(func())) (*player, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "voice-agent")
+	if err != nil {
+		return nil, fmt.Errorf("create outbound track: %w", err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return nil, fmt.Errorf("add outbound track: %w", err)
+	}
+	enc, err := opus.NewEncoder(sampleRate, channels, app)
+	if err != nil {
+		return nil, fmt.Errorf("opus encoder: %w", err)
+	}
+	if err := enc.SetComplexity(complexity); err != nil {
+		return nil, fmt.Errorf("opus complexity %d: %w", complexity, err)
+	}
+	if err := enc.SetMaxBandwidth(maxBandwidth); err != nil {
+		return nil, fmt.Errorf("opus max bandwidth: %w", err)
+	}
+
+	p := &player{track: track, onWriteError: onWriteError, clock: systemClock{}, enc: enc, done: make(chan struct{})}
+
+	// Drain RTCP for the sender; interceptors only run while it's read.
+	spawn(func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			onRTCP(packets)
+		}
+	})
+	spawn(p.run)
+	return p, nil
+}
+
+// enqueue appends sampleRate PCM to the playback queue, padding the final
+// partial frame with silence or comfort noise.
+func (p *player) enqueue(pcm []int16) error {
+	select {
+	case <-p.done:
+		return errPlayerClosed
+	default:
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(pcm) > 0 {
+		frame := make([]int16, frameSamples)
+		n := copy(frame, pcm)
+		pcm = pcm[n:]
+		if p.noise != nil {
+			p.noise.fill(frame[n:])
+		}
+		p.queue = append(p.queue, frame)
+	}
+	return nil
+}
+
+// flush drops everything queued for playback and reports how many frames
+// were discarded.
+func (p *player) flush() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.queue)
+	p.queue = nil
+	return n
+}
+
+// setComfortNoise turns on comfort noise at dbfs.
+func (p *player) setComfortNoise(dbfs float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.noise = newComfortNoise(dbfs)
+}
+
+// next returns the frame to send: the head of the queue, else comfort
+// noise, else nil.
+func (p *player) next() []int16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		if p.noise == nil {
+			return nil
+		}
+		frame := make([]int16, frameSamples)
+		p.noise.fill(frame)
+		return frame
+	}
+	frame := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return frame
+}
+
+func (p *player) run() {
+	pacer := newFramePacer(p.clock, frameDuration*time.Millisecond)
+	packet := make([]byte, maxOpusPacket)
+	for pacer.wait(p.done) {
+		frame := p.next()
+		if frame == nil {
+			pacer.idle()
+			continue
+		}
+		p.encMu.Lock()
+		n, err := p.enc.Encode(frame, packet)
+		p.encMu.Unlock()
+		if err != nil {
+			log.Println("Opus encode error:", err)
+			continue
+		}
+		sample := media.Sample{Data: packet[:n], Duration: frameDuration * time.Millisecond}
+		if err := p.track.WriteSample(sample); err != nil {
+			dropped := p.flush()
+			log.Printf("Outbound write error, dropped %d ms of playback: %v", dropped*frameDuration, err)
+			if isTrackClosed(err) {
+				p.close()
+			}
+			if p.onWriteError != nil {
+				p.onWriteError(err)
+			}
+		}
+	}
+}
+
+// configure applies a caller's requested settings to the encoder.
+func (p *player) configure(mc MediaConfig) error {
+	p.encMu.Lock()
+	defer p.encMu.Unlock()
+	if mc.Bitrate != 0 {
+		p.ceiling = mc.Bitrate
+		if err := p.setBitrate(p.targetBitrate()); err != nil {
+			return err
+		}
+	}
+	if mc.DTX != nil {
+		if err := p.enc.SetDTX(*mc.DTX); err != nil {
+			return err
+		}
+	}
+	if mc.FEC != nil {
+		if err := p.enc.SetInBandFEC(*mc.FEC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adaptBitrate follows the congestion controller's estimate of available
+// bandwidth, keeping the encoder within Opus's range and the ceiling. It
+// ignores moves smaller than bitrateHysteresis allows.
+func (p *player) adaptBitrate(estimate int) {
+	p.encMu.Lock()
+	defer p.encMu.Unlock()
+	p.estimate = estimate
+	target := p.targetBitrate()
+	if !p.bitrateMoved(target) {
+		return
+	}
+	if err := p.setBitrate(target); err != nil {
+		log.Println("Adapt Opus bitrate failed:", err)
+	}
+}
+
+// bitrateMoved reports whether target is far enough from the encoder's
+// bitrate, or at a bound it isn't at yet, to retune it. Callers hold encMu.
+func (p *player) bitrateMoved(target int) bool {
+	if p.bitrate == 0 {
+		return true
+	}
+	if target == p.bitrate {
+		return false
+	}
+	ceiling := p.ceiling
+	if ceiling == 0 {
+		ceiling = adaptiveBitrateCeiling
+	}
+	diff := max(target-p.bitrate, p.bitrate-target)
+	return diff*bitrateHysteresis >= p.bitrate || target == minOpusBitrate || target == ceiling
+}
+
+// setBitrate sets the encoder's bitrate. Callers hold encMu.
+func (p *player) setBitrate(bitrate int) error {
+	if err := p.enc.SetBitrate(bitrate); err != nil {
+		return err
+	}
+	p.bitrate = bitrate
+	return nil
+}
+
+// setPacketLoss tells the encoder to expect perc percent packet loss, so it
+// puts more of the bitrate into in-band FEC as the path gets lossier.
+func (p *player) setPacketLoss(perc int) {
+	p.encMu.Lock()
+	defer p.encMu.Unlock()
+	if perc == p.lossPerc {
+		return
+	}
+	if err := p.enc.SetPacketLossPerc(perc); err != nil {
+		log.Println("Set Opus packet loss failed:", err)
+		return
+	}
+	p.lossPerc = perc
+}
+
+// targetBitrate is the bitrate to encode at given the ceiling and the
+// latest estimate. Callers hold encMu.
+func (p *player) targetBitrate() int {
+	target := p.ceiling
+	if target == 0 {
+		target = adaptiveBitrateCeiling
+	}
+	if p.estimate > 0 {
+		target = min(target, max(p.estimate, minOpusBitrate))
+	}
+	return target
+}
+
+func (p *player) close() {
+	p.once.Do(func() { close(p.done) })
+}
@@ -0,0 +1,314 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// fakeEncoder "encodes" a frame as its first sample, so a test reading the
+// track can tell frames apart, and records the settings it is given.
+type fakeEncoder struct {
+	mu       sync.Mutex
+	bitrates []int
+	lossPerc []int
+	dtx      []bool
+}
+
+func (e *fakeEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	binary.BigEndian.PutUint16(data, uint16(pcm[0]))
+	return 2, nil
+}
+
+func (e *fakeEncoder) SetBitrate(bitrate int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bitrates = append(e.bitrates, bitrate)
+	return nil
+}
+
+func (e *fakeEncoder) SetPacketLossPerc(perc int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lossPerc = append(e.lossPerc, perc)
+	return nil
+}
+
+func (e *fakeEncoder) SetDTX(dtx bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dtx = append(e.dtx, dtx)
+	return nil
+}
+
+func (e *fakeEncoder) SetInBandFEC(bool) error { return nil }
+
+// recordingTrack hands the test the first sample of every frame the
+// player writes, as fakeEncoder encoded it.
+type recordingTrack struct{ frames chan int16 }
+
+func newRecordingTrack() *recordingTrack {
+	return &recordingTrack{frames: make(chan int16, 1024)}
+}
+
+func (r *recordingTrack) WriteSample(s media.Sample) error {
+	r.frames <- int16(binary.BigEndian.Uint16(s.Data))
+	return nil
+}
+
+// newTestPlayer is a player writing to track through a fakeEncoder, paced
+// by the system clock. It runs until the test ends.
+func newTestPlayer(t *testing.T, track sampleWriter) *player {
+	p := &player{track: track, clock: systemClock{}, enc: &fakeEncoder{}, done: make(chan struct{})}
+	go p.run()
+	t.Cleanup(p.close)
+	return p
+}
+
+// framesWithin returns the frames track receives within d.
+func (r *recordingTrack) framesWithin(d time.Duration) []int16 {
+	var got []int16
+	deadline := time.After(d)
+	for {
+		select {
+		case f := <-r.frames:
+			got = append(got, f)
+		case <-deadline:
+			return got
+		}
+	}
+}
+
+func TestAdaptBitrate(t *testing.T) {
+	steps := []struct {
+		name     string
+		estimate int
+		ceiling  int // a media_config bitrate, applied before the estimate
+		want     int // the encoder's bitrate after the step
+	}{
+		{"first estimate, over the default ceiling", 100000, 0, adaptiveBitrateCeiling},
+		{"drop", 20000, 0, 20000},
+		{"wobble up 2.5%", 20500, 0, 20000},
+		{"wobble down 7.5%", 18500, 0, 20000},
+		{"rise of 15%", 23000, 0, 23000},
+		{"under the Opus minimum", 1000, 0, minOpusBitrate},
+		{"just over the floor", 6300, 0, minOpusBitrate},
+		{"recovery", 30000, 0, 30000},
+		{"back to within 10% of the ceiling", 40000, 0, adaptiveBitrateCeiling},
+		{"a caller's lower ceiling", 40000, 24000, 24000},
+		{"estimate under it", 12000, 0, 12000},
+		{"estimate over it again", 30000, 0, 24000},
+	}
+	enc := &fakeEncoder{}
+	p := &player{enc: enc}
+	for _, step := range steps {
+		if step.ceiling != 0 {
+			if err := p.configure(MediaConfig{Bitrate: step.ceiling}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p.adaptBitrate(step.estimate)
+		if got := enc.bitrates[len(enc.bitrates)-1]; got != step.want {
+			t.Errorf("%s: encoder at %d bps, want %d", step.name, got, step.want)
+		}
+	}
+	// Only real moves reach the encoder: the first estimate, the drop, the
+	// rise, the floor, the recovery, the ceiling, the caller's ceiling, and
+	// the two estimates after it.
+	if len(enc.bitrates) != 9 {
+		t.Errorf("encoder retuned %d times (%v), want 9", len(enc.bitrates), enc.bitrates)
+	}
+}
+
+// failingTrack fails every write with err while it is set, recording the
+// first sample of each frame written.
+type failingTrack struct {
+	mu     sync.Mutex
+	err    error
+	writes int
+	frames chan int16
+}
+
+func (f *failingTrack) WriteSample(s media.Sample) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes++
+	if f.err != nil {
+		return f.err
+	}
+	f.frames <- int16(binary.BigEndian.Uint16(s.Data))
+	return nil
+}
+
+func (f *failingTrack) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// queueFrames queues n frames, frame i's samples all first+i.
+func queueFrames(t *testing.T, p *player, first, n int) {
+	t.Helper()
+	pcm := make([]int16, 0, n*frameSamples)
+	for i := range n {
+		for range frameSamples {
+			pcm = append(pcm, int16(first+i))
+		}
+	}
+	if err := p.enqueue(pcm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A failed write drops the rest of the queue and is reported once; audio
+// queued afterwards plays. A closed track stops the player.
+func TestPlaybackWriteFailure(t *testing.T) {
+	track := &failingTrack{err: errors.New("dtls: write failed"), frames: make(chan int16, 16)}
+	reported := make(chan error, 4)
+	p := newTestPlayer(t, track)
+	p.onWriteError = func(err error) { reported <- err }
+
+	queueFrames(t, p, 1, 5)
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("write failure never reported")
+	}
+	time.Sleep(5 * frameDuration * time.Millisecond)
+	track.mu.Lock()
+	writes := track.writes
+	track.mu.Unlock()
+	if writes != 1 {
+		t.Errorf("%d writes for a queue whose first write failed, want 1", writes)
+	}
+
+	track.setErr(nil)
+	queueFrames(t, p, 10, 2)
+	if got := (&recordingTrack{frames: track.frames}).framesWithin(5 * frameDuration * time.Millisecond); !slices.Equal(got, []int16{10, 11}) {
+		t.Errorf("after recovering played %v, want [10 11]", got)
+	}
+
+	track.setErr(io.ErrClosedPipe)
+	queueFrames(t, p, 20, 1)
+	<-reported
+	select {
+	case <-p.done:
+	case <-time.After(time.Second):
+		t.Fatal("player still running on a closed track")
+	}
+	if err := p.enqueue(make([]int16, frameSamples)); !errors.Is(err, errPlayerClosed) {
+		t.Errorf("enqueue on a closed track = %v, want errPlayerClosed", err)
+	}
+}
+
+// The session cancels the reply being spoken when playback fails.
+func TestPlaybackFailureCancelsTurn(t *testing.T) {
+	s := &Session{}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelTurn = cancel
+	s.playbackFailed(errors.New("dtls: write failed"))
+	if ctx.Err() == nil {
+		t.Error("turn still running after playback failed")
+	}
+}
+
+// Calls are answered whichever encoder mode is configured.
+func TestOpusApplication(t *testing.T) {
+	for app := range opusApplications {
+		cfg := DefaultConfig()
+		cfg.OpusApplication = app
+		p, _ := newTestPeer(t, cfg)
+		if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+			t.Errorf("%s: %v", app, err)
+		} else if s, ok := p.session("iphone-1"); !ok || s.player == nil {
+			t.Errorf("%s: call answered with no outbound player", app)
+		}
+		p.shutdown(time.Second)
+	}
+}
+
+// The configured complexity is set on each call's encoder.
+func TestOpusComplexity(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OpusComplexity = 2
+	p, _ := newTestPeer(t, cfg)
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := p.session("iphone-1")
+	enc, ok := s.player.enc.(*opus.Encoder)
+	if !ok {
+		t.Fatalf("call encodes with %T, want an Opus encoder", s.player.enc)
+	}
+	if got, err := enc.Complexity(); err != nil || got != 2 {
+		t.Errorf("encoder complexity %d, %v; want 2", got, err)
+	}
+}
+
+// With comfort_noise_dbfs set, idle ticks send noise at that level and a
+// short reply is padded with it; without it they send nothing.
+func TestComfortNoise(t *testing.T) {
+	p := &player{}
+	if frame := p.next(); frame != nil {
+		t.Errorf("idle player without comfort noise sent %d samples", len(frame))
+	}
+
+	cfg := DefaultConfig()
+	cfg.ComfortNoiseDBFS = -60
+	peer, _ := newTestPeer(t, cfg)
+	t.Cleanup(func() { peer.shutdown(time.Second) })
+	if err := peer.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := peer.session("iphone-1")
+	p = &player{noise: s.player.noise, done: make(chan struct{})}
+	if p.noise == nil {
+		t.Fatal("call answered without comfort noise")
+	}
+	want := math.MaxInt16 * math.Pow(10, cfg.ComfortNoiseDBFS/20)
+	if got := rms(p.next()); math.Abs(got-want) > want*0.02 {
+		t.Errorf("idle frame at RMS %.2f, want %.2f", got, want)
+	}
+
+	speech := make([]int16, 100)
+	for i := range speech {
+		speech[i] = 1000
+	}
+	if err := p.enqueue(speech); err != nil {
+		t.Fatal(err)
+	}
+	frame := p.next()
+	if !slices.Equal(frame[:100], speech) {
+		t.Error("reply overwritten by padding")
+	}
+	if got := rms(frame[100:]); math.Abs(got-want) > want*0.02 {
+		t.Errorf("padding at RMS %.2f, want %.2f", got, want)
+	}
+}
+
+// The configured bandwidth cap is set on each call's encoder.
+func TestOpusMaxBandwidth(t *testing.T) {
+	for _, name := range []string{"narrowband", "wideband", "fullband"} {
+		cfg := DefaultConfig()
+		cfg.OpusMaxBandwidth = name
+		p, _ := newTestPeer(t, cfg)
+		if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		s, _ := p.session("iphone-1")
+		if got, err := s.player.enc.(*opus.Encoder).MaxBandwidth(); err != nil || got != opusBandwidths[name] {
+			t.Errorf("%s: encoder capped at %v, %v; want %v", name, got, err, opusBandwidths[name])
+		}
+		p.shutdown(time.Second)
+	}
+}
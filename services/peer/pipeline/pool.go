@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"slices"
+	"sync"
+)
+
+// bufferPools recycles the buffers used on the hot path: one growable PCM
+// buffer per utterance, and the per-packet messages streamed to a
+// pcm_sink. Allocating these fresh for every turn or packet of every call
+// is a steady source of garbage.
+//
+// Pooled slices are stored as pointers so Get/Put don't allocate a slice
+// header each time.
+type bufferPools struct {
+	utterances          sync.Pool
+	maxUtteranceSamples int
+	packets             sync.Pool
+}
+
+func newBufferPools(cfg Config) *bufferPools {
+	p := &bufferPools{maxUtteranceSamples: cfg.MaxPooledUtteranceSeconds * sampleRate}
+	p.utterances.New = func() any {
+		// Start with room for ~2s of speech; append grows it as needed.
+		buf := make([]int16, 0, 2*sampleRate)
+		return &buf
+	}
+	p.packets.New = func() any {
+		// Room for Opus's longest packet, 120ms, with its length prefix.
+		buf := make([]byte, 0, 4+2*maxOpusPacketSamples)
+		return &buf
+	}
+	return p
+}
+
+// getUtterance returns an empty buffer to accumulate an utterance into.
+func (p *bufferPools) getUtterance() *[]int16 {
+	buf := p.utterances.Get().(*[]int16)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func (p *bufferPools) putUtterance(buf *[]int16) {
+	if cap(*buf) > p.maxUtteranceSamples {
+		return
+	}
+	p.utterances.Put(buf)
+}
+
+// handoff passes a pooled utterance on to something that outlives the read
+// loop, e.g. an async transcriber. The read loop must drop its reference
+// to buf. pcm is a copy the receiver owns, and buf goes straight back to
+// the pool, unless borrow is set: then pcm is buf itself, and the receiver
+// calls release once, when it has finished reading pcm, and must not touch
+// pcm after that. Either way release must be called.
+func (p *bufferPools) handoff(buf *[]int16, borrow bool) (pcm []int16, release func()) {
+	if borrow {
+		return *buf, func() { p.putUtterance(buf) }
+	}
+	pcm = slices.Clone(*buf)
+	p.putUtterance(buf)
+	return pcm, func() {}
+}
+
+// getPacket returns an empty buffer for one pcm_sink message.
+func (p *bufferPools) getPacket() *[]byte {
+	buf := p.packets.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func (p *bufferPools) putPacket(buf *[]byte) {
+	p.packets.Put(buf)
+}
@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keepingTranscriber keeps every utterance it is given, as a transcriber
+// that batches or uploads asynchronously might.
+type keepingTranscriber struct {
+	mu   sync.Mutex
+	kept [][]int16
+	done chan struct{}
+}
+
+func (k *keepingTranscriber) Transcribe(_ context.Context, pcm []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	k.mu.Lock()
+	k.kept = append(k.kept, pcm)
+	k.mu.Unlock()
+	k.done <- struct{}{}
+	return Transcription{}, nil
+}
+
+// borrowingTranscriber is keepingTranscriber opting in to pooled buffers.
+type borrowingTranscriber struct{ *keepingTranscriber }
+
+func (borrowingTranscriber) BorrowsPCM() bool { return true }
+
+func TestHandoffCopiesUnlessBorrowing(t *testing.T) {
+	pools := newBufferPools(DefaultConfig())
+	for _, borrow := range []bool{false, true} {
+		buf := pools.getUtterance()
+		*buf = append(*buf, 1, 2, 3)
+		pcm, release := pools.handoff(buf, borrow)
+		if !slices.Equal(pcm, []int16{1, 2, 3}) {
+			t.Errorf("borrow=%v: handed off %v", borrow, pcm)
+		}
+		if shared := &pcm[0] == &(*buf)[0]; shared != borrow {
+			t.Errorf("borrow=%v: pcm shares the pooled buffer: %v", borrow, shared)
+		}
+		release()
+	}
+}
+
+// A transcriber that keeps pcm after Transcribe returns still has the
+// utterance it was given once later utterances have reused the pool.
+func TestTranscriberKeepsUtterance(t *testing.T) {
+	tests := []struct {
+		name   string
+		borrow bool
+	}{
+		{"copying", false},
+		{"borrowing", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.VADPassthrough = true
+			keeper := &keepingTranscriber{done: make(chan struct{})}
+			var transcriber Transcriber = keeper
+			if tt.borrow {
+				transcriber = borrowingTranscriber{keeper}
+			}
+			p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.borrowsPCM != tt.borrow {
+				t.Fatalf("borrowsPCM = %v, want %v", p.borrowsPCM, tt.borrow)
+			}
+			p.setConn(newFakeSignaling())
+			s := &Session{RemoteID: "iphone-1", peer: p}
+
+			const utterances = 20
+			for i := range utterances {
+				s.stateMu.Lock()
+				s.utterance = p.pools.getUtterance()
+				for range frameSamples {
+					*s.utterance = append(*s.utterance, int16(i+1))
+				}
+				s.endUtterance()
+				s.stateMu.Unlock()
+				select {
+				case <-keeper.done:
+				case <-time.After(time.Second):
+					t.Fatalf("utterance %d never transcribed", i)
+				}
+			}
+			p.wg.Wait()
+
+			if tt.borrow {
+				// Borrowed buffers are the pool's again; the transcriber
+				// promised not to look.
+				return
+			}
+			for i, pcm := range keeper.kept {
+				if pcm[0] != int16(i+1) || pcm[len(pcm)-1] != int16(i+1) {
+					t.Errorf("utterance %d overwritten: starts %d", i, pcm[0])
+				}
+			}
+		})
+	}
+}
+
+func TestFloatTranscriberBorrows(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{Transcriber: FloatPCM(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.borrowsPCM {
+		t.Error("a FloatPCM transcriber gets copies of utterances it converts anyway")
+	}
+}
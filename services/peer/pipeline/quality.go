@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamStats tracks inbound packet loss and interarrival jitter for one
+// RTP stream, following RFC 3550 §6.4.1 and appendices A.1/A.8.
+type streamStats struct {
+	mu sync.Mutex
+
+	started   bool
+	clockRate float64
+	start     time.Time // arrival of the first packet, the origin for transit times
+
+	baseSeq  uint16
+	maxSeq   uint16
+	cycles   uint32 // sequence number wraparounds seen, RFC 3550 A.1
+	received uint64
+
+	lastTransit float64 // timestamp units
+	jitter      float64 // timestamp units
+	lastArrival time.Time
+
+	// Per-packet distributions behind the smoothed jitter figure.
+	delayVariation Histogram // |D(i-1,i)| from RFC 3550 §6.4.1
+	interarrival   Histogram // wall-clock gap between arrivals
+}
+
+// histogramBoundsMs are the upper bounds of each Histogram bucket; a final
+// bucket counts everything larger.
+var histogramBoundsMs = []float64{1, 2, 5, 10, 20, 40, 80, 160, 320}
+
+// Histogram counts millisecond samples into histogramBoundsMs buckets.
+// Counts has one more entry than BoundsMs, for samples above the last one.
+type Histogram struct {
+	BoundsMs []float64 `json:"boundsMs"`
+	Counts   []uint64  `json:"counts"`
+}
+
+func (h *Histogram) add(ms float64) {
+	if h.Counts == nil {
+		h.BoundsMs = histogramBoundsMs
+		h.Counts = make([]uint64, len(histogramBoundsMs)+1)
+	}
+	i := 0
+	for i < len(h.BoundsMs) && ms > h.BoundsMs[i] {
+		i++
+	}
+	h.Counts[i]++
+}
+
+// String renders the non-empty buckets, e.g. "≤20ms:48 ≤40ms:2".
+func (h Histogram) String() string {
+	var b strings.Builder
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		if i < len(h.BoundsMs) {
+			fmt.Fprintf(&b, "≤%gms:%d", h.BoundsMs[i], n)
+		} else {
+			fmt.Fprintf(&b, ">%gms:%d", h.BoundsMs[i-1], n)
+		}
+	}
+	if b.Len() == 0 {
+		return "none"
+	}
+	return b.String()
+}
+
+func (h Histogram) clone() Histogram {
+	return Histogram{BoundsMs: h.BoundsMs, Counts: append([]uint64(nil), h.Counts...)}
+}
+
+// update records a packet that arrived at arrival.
+func (st *streamStats) update(seq uint16, timestamp uint32, clockRate uint32, arrival time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	arrivalUnits := arrival.Sub(st.start).Seconds() * st.clockRate
+	if !st.started {
+		st.started = true
+		st.clockRate = float64(clockRate)
+		st.start = arrival
+		st.baseSeq, st.maxSeq = seq, seq
+		st.received = 1
+		st.lastTransit = -float64(timestamp)
+		st.lastArrival = arrival
+		return
+	}
+	st.interarrival.add(arrival.Sub(st.lastArrival).Seconds() * 1000)
+	st.lastArrival = arrival
+	st.received++
+	if seqNewer(seq, st.maxSeq) {
+		// Newer yet numerically smaller: the sequence space wrapped.
+		if seq < st.maxSeq {
+			st.cycles++
+		}
+		st.maxSeq = seq
+	}
+
+	// Transit is only meaningful relative to the previous packet, so the
+	// unknown clock offset between sender and receiver cancels out.
+	transit := arrivalUnits - float64(timestamp)
+	d := math.Abs(transit - st.lastTransit)
+	if d > st.clockRate*60 {
+		// Timestamp wrapped relative to lastTransit; fold it back.
+		d = math.Abs(d - math.Exp2(32))
+	}
+	st.lastTransit = transit
+	st.jitter += (d - st.jitter) / 16
+	st.delayVariation.add(d / st.clockRate * 1000)
+}
+
+// packets is how many packets have been recorded.
+func (st *streamStats) packets() uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.received
+}
+
+// lastPacket is when the most recent packet arrived, if any has.
+func (st *streamStats) lastPacket() (time.Time, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.lastArrival, st.started
+}
+
+// lossFraction is the share of expected packets that never arrived.
+func (st *streamStats) lossFraction() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.started {
+		return 0
+	}
+	extMax := uint64(st.cycles)<<16 | uint64(st.maxSeq)
+	expected := extMax - uint64(st.baseSeq) + 1
+	if st.received >= expected {
+		return 0
+	}
+	return float64(expected-st.received) / float64(expected)
+}
+
+// jitterMs is the smoothed interarrival jitter in milliseconds.
+func (st *streamStats) jitterMs() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.clockRate == 0 {
+		return 0
+	}
+	return st.jitter / st.clockRate * 1000
+}
+
+// QualityReport summarizes a session's inbound call quality. One-way
+// latency can't be observed from the receive side alone, so the arrival
+// spacing Histogram stands in for how evenly audio is being delivered.
+type QualityReport struct {
+	LossPercent float64 `json:"lossPercent"`
+	JitterMs    float64 `json:"jitterMs"`
+	MOS         float64 `json:"mos"`
+
+	DelayVariationMs Histogram `json:"delayVariationMs"`
+	InterarrivalMs   Histogram `json:"interarrivalMs"`
+
+	// RTCP is the caller's own reporting, including how our audio reaches it.
+	RTCP RTCPReport `json:"rtcp"`
+}
+
+func (st *streamStats) report() QualityReport {
+	loss := st.lossFraction() * 100
+	jitter := st.jitterMs()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return QualityReport{
+		LossPercent:      loss,
+		JitterMs:         jitter,
+		MOS:              estimateMOS(loss, jitter),
+		DelayVariationMs: st.delayVariation.clone(),
+		InterarrivalMs:   st.interarrival.clone(),
+	}
+}
+
+// estimateMOS approximates a Mean Opinion Score (1–4.5) from packet loss
+// and jitter using the simplified ITU-T G.107 E-model common in VoIP
+// monitoring. One-way latency isn't measured, so only a nominal codec delay
+// and the jitter buffer's cost (twice the jitter) count against R.
+func estimateMOS(lossPercent, jitterMs float64) float64 {
+	effectiveLatency := 2*jitterMs + 10
+	var r float64
+	if effectiveLatency < 160 {
+		r = 93.2 - effectiveLatency/40
+	} else {
+		r = 93.2 - (effectiveLatency-120)/10
+	}
+	r -= 2.5 * lossPercent
+	if r < 0 {
+		r = 0
+	}
+	if r > 100 {
+		r = 100
+	}
+	// The cubic dips just under 1 for R below about 6.5; G.107 has 1 there.
+	return max(1, 1+0.035*r+7e-6*r*(r-60)*(100-r))
+}
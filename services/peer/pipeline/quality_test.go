@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEstimateMOS(t *testing.T) {
+	tests := []struct {
+		name         string
+		loss, jitter float64
+		min, max     float64
+	}{
+		// The E-model tops out near 4.4 for a narrowband-equivalent call.
+		{"clean", 0, 0, 4.39, 4.41},
+		{"light loss and jitter", 1, 10, 4.3, 4.35},
+		{"5% loss", 5, 20, 3.95, 4.05},
+		{"heavy jitter alone", 0, 100, 4.1, 4.2},
+		{"10% loss, 40ms jitter", 10, 40, 3.35, 3.45},
+		{"unusable", 40, 0, 1, 1},
+		{"everything lost", 100, 500, 1, 1},
+	}
+	for _, tt := range tests {
+		if got := estimateMOS(tt.loss, tt.jitter); got < tt.min || got > tt.max {
+			t.Errorf("%s: estimateMOS(%v, %v) = %.3f, want %v-%v", tt.name, tt.loss, tt.jitter, got, tt.min, tt.max)
+		}
+	}
+	// More loss or more jitter never scores better, nor below 1.
+	for loss := 0.0; loss < 50; loss++ {
+		if estimateMOS(loss+1, 20) > estimateMOS(loss, 20) {
+			t.Errorf("MOS rose from %v%% to %v%% loss", loss, loss+1)
+		}
+		if got := estimateMOS(loss, 20); got < 1 {
+			t.Errorf("MOS %v at %v%% loss, under the scale's 1", got, loss)
+		}
+	}
+	for jitter := 0.0; jitter < 300; jitter += 5 {
+		if estimateMOS(2, jitter+5) > estimateMOS(2, jitter) {
+			t.Errorf("MOS rose from %vms to %vms jitter", jitter, jitter+5)
+		}
+	}
+}
+
+func TestQualityReport(t *testing.T) {
+	var st streamStats
+	start := time.Now()
+	// 100 packets 20ms apart with every tenth missing.
+	for seq := range uint16(100) {
+		if seq%10 == 5 {
+			continue
+		}
+		st.update(seq, uint32(seq)*frameSamples, sampleRate, start.Add(time.Duration(seq)*frameDuration*time.Millisecond))
+	}
+	q := st.report()
+	if math.Abs(q.LossPercent-10) > 1e-9 || q.JitterMs > 1e-9 {
+		t.Errorf("loss %v%%, jitter %vms; want 10%% and 0", q.LossPercent, q.JitterMs)
+	}
+	if want := estimateMOS(10, 0); q.MOS != want {
+		t.Errorf("MOS %v, want %v", q.MOS, want)
+	}
+	// Arrivals are 20ms apart, or 40 across a lost packet.
+	var gaps uint64
+	for i, n := range q.InterarrivalMs.Counts {
+		gaps += n
+		if n > 0 && q.InterarrivalMs.BoundsMs[i] != 20 && q.InterarrivalMs.BoundsMs[i] != 40 {
+			t.Errorf("%d arrivals in the ≤%vms bucket", n, q.InterarrivalMs.BoundsMs[i])
+		}
+	}
+	if gaps != 89 {
+		t.Errorf("%d arrival gaps counted, want 89", gaps)
+	}
+}
+
+// Delay variation and arrival spacing land in their buckets, across both
+// sequence number and timestamp wraparound.
+func TestDelayVariation(t *testing.T) {
+	var st streamStats
+	start := time.Now()
+	// 200 packets sent 20ms apart, every other one arriving 4ms late.
+	for i := range 200 {
+		seq := uint16(65500 + i)
+		timestamp := uint32(math.MaxUint32-100*frameSamples+1) + uint32(i*frameSamples)
+		arrival := start.Add(time.Duration(i*frameDuration+i%2*4) * time.Millisecond)
+		st.update(seq, timestamp, sampleRate, arrival)
+	}
+	q := st.report()
+	if q.LossPercent != 0 || math.Abs(q.JitterMs-4) > 0.01 {
+		t.Errorf("loss %v%%, jitter %vms; want none and 4ms", q.LossPercent, q.JitterMs)
+	}
+	if got := q.DelayVariationMs.String(); got != "≤5ms:199" {
+		t.Errorf("delay variation %s, want every packet ≤5ms", got)
+	}
+	if got := q.InterarrivalMs.String(); got != "≤20ms:99 ≤40ms:100" {
+		t.Errorf("interarrival %s, want 99 gaps of 16ms and 100 of 24ms", got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	if got := h.String(); got != "none" {
+		t.Errorf("empty histogram %q, want none", got)
+	}
+	for _, ms := range []float64{0, 1, 1.5, 320, 320.5, 5000} {
+		h.add(ms)
+	}
+	if got, want := h.String(), "≤1ms:2 ≤2ms:1 ≤320ms:1 >320ms:2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	clone := h.clone()
+	h.add(0)
+	if clone.Counts[0] != 2 {
+		t.Error("histogram clone shares its counts")
+	}
+}
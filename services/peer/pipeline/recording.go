@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// RecordingStore persists call recordings. Save reads r, an Ogg Opus
+// stream, until EOF as the call goes on, so implementations can upload in
+// parts (an S3 multipart upload, a GCS resumable write) rather than buffer
+// the whole call. sessionID names the recording and is safe to use as a
+// file name or object key.
+type RecordingStore interface {
+	Save(ctx context.Context, sessionID string, r io.Reader) error
+}
+
+// dirStore is the default RecordingStore: one <sessionID>.ogg file per
+// call in a local directory.
+type dirStore string
+
+func (d dirStore) Save(ctx context.Context, sessionID string, r io.Reader) error {
+	f, err := os.Create(filepath.Join(string(d), sessionID+".ogg"))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordingBacklog is how many Ogg pages (20 ms of audio each) may wait
+// for a slow store before the recording is abandoned. Writes come from the
+// RTP read loop, which must never block on storage.
+const recordingBacklog = 250
+
+var errRecordingBehind = errors.New("recording store fell behind")
+
+// recordingStream feeds what the session writes to a RecordingStore's
+// Save through a bounded queue, and closes the stream when it is closed.
+type recordingStream struct {
+	pages chan []byte
+	done  chan struct{} // closed once Save returns
+	err   error         // Save's result, set before done is closed
+}
+
+// startRecording starts Save on a goroutine, and the queue's writer on
+// another, both with spawn.
+func startRecording(ctx context.Context, store RecordingStore, sessionID string, spawn func(func())) *recordingStream {
+	rs := &recordingStream{
+		pages: make(chan []byte, recordingBacklog),
+		done:  make(chan struct{}),
+	}
+	pr, pw := io.Pipe()
+	spawn(func() {
+		for page := range rs.pages {
+			// After Save returns the pipe fails every write; keep
+			// draining so Close never blocks.
+			pw.Write(page)
+		}
+		pw.Close()
+	})
+	spawn(func() {
+		rs.err = store.Save(ctx, sessionID, pr)
+		pr.CloseWithError(errors.New("recording store stopped reading"))
+		if rs.err != nil {
+			log.Printf("Save recording %s failed: %v", sessionID, rs.err)
+		} else {
+			log.Println("Saved recording", sessionID)
+		}
+		close(rs.done)
+	})
+	return rs
+}
+
+// Write queues a copy of p, failing rather than waiting when the store is
+// behind or has given up.
+func (rs *recordingStream) Write(p []byte) (int, error) {
+	select {
+	case <-rs.done:
+		if rs.err != nil {
+			return 0, fmt.Errorf("recording store: %w", rs.err)
+		}
+		return 0, errors.New("recording store stopped reading")
+	default:
+	}
+	select {
+	case rs.pages <- append([]byte(nil), p...):
+		return len(p), nil
+	default:
+		return 0, errRecordingBehind
+	}
+}
+
+// Close ends the stream; Save sees EOF once the queue drains. It doesn't
+// wait for Save.
+func (rs *recordingStream) Close() error {
+	close(rs.pages)
+	return nil
+}
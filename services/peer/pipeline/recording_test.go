@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// memStore keeps each recording in memory, with the trace ID its Save
+// context carried.
+type memStore struct {
+	mu     sync.Mutex
+	saved  map[string][]byte
+	traces map[string]string
+}
+
+func (m *memStore) Save(ctx context.Context, sessionID string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.saved == nil {
+		m.saved, m.traces = map[string][]byte{}, map[string]string{}
+	}
+	m.saved[sessionID], m.traces[sessionID] = data, SessionID(ctx)
+	return err
+}
+
+// A RecordingStore gets each call's capture under a key safe for storage,
+// with the call's trace ID, as an Ogg stream that reads back.
+func TestRecordingStore(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memStore{}
+	p.SetRecordingStore(store)
+	s, _ := newReadSession(t, p)
+	s.RemoteID = "iphone/1 ../x"
+	s.openCapture()
+	for seq := range uint16(20) {
+		s.decodePacket(opusPacket(seq))
+	}
+	s.closeCapture()
+	p.wg.Wait()
+
+	if len(store.saved) != 1 {
+		t.Fatalf("%d recordings saved, want 1", len(store.saved))
+	}
+	for id, data := range store.saved {
+		if !strings.HasPrefix(id, "iphone_1_.._x-") || strings.ContainsAny(id, "/ ") {
+			t.Errorf("recording saved as %q, want the sanitized caller ID and a time", id)
+		}
+		if store.traces[id] != s.TraceID {
+			t.Errorf("Save ran with trace %q, want the call's %q", store.traces[id], s.TraceID)
+		}
+		r, _, err := oggreader.NewWith(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pages int
+		for {
+			if _, _, err := r.ParseNextPage(); err != nil {
+				break
+			}
+			pages++
+		}
+		// OpusTags, then a page per packet.
+		if pages != 21 {
+			t.Errorf("recording has %d pages after the header, want 21", pages)
+		}
+	}
+}
+
+// stalledStore reads nothing until released, then fails, as a store that
+// hangs and then errors would.
+type stalledStore struct{ release chan struct{} }
+
+var errStoreDown = errors.New("store down")
+
+func (s stalledStore) Save(ctx context.Context, _ string, _ io.Reader) error {
+	<-s.release
+	return errStoreDown
+}
+
+// Writes to a store that has fallen behind fail at once instead of holding
+// up the read loop, and fail with its error once it gives up.
+func TestRecordingStoreBehind(t *testing.T) {
+	store := stalledStore{release: make(chan struct{})}
+	var wg sync.WaitGroup
+	spawn := func(fn func()) { wg.Add(1); go func() { defer wg.Done(); fn() }() }
+	rs := startRecording(context.Background(), store, "call", spawn)
+
+	page := []byte("page")
+	start := time.Now()
+	var behind error
+	for range recordingBacklog + 2 {
+		if _, err := rs.Write(page); err != nil {
+			behind = err
+			break
+		}
+	}
+	if !errors.Is(behind, errRecordingBehind) {
+		t.Errorf("write to a stalled store = %v, want %v", behind, errRecordingBehind)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writes to a stalled store took %v", elapsed)
+	}
+
+	close(store.release)
+	<-rs.done
+	if _, err := rs.Write(page); !errors.Is(err, errStoreDown) {
+		t.Errorf("write after Save failed = %v, want %v", err, errStoreDown)
+	}
+	rs.Close()
+	wg.Wait()
+}
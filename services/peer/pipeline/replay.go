@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// ReadCapture returns the Opus packets of a capture_dir file, one per page
+// as the capture writer produces them.
+func ReadCapture(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, _, err := oggreader.NewWith(f)
+	if err != nil {
+		return nil, err
+	}
+	var packets [][]byte
+	for {
+		page, _, err := r.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			return packets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(string(page), "OpusTags") {
+			continue
+		}
+		packets = append(packets, page)
+	}
+}
+
+// ReplayCapture runs packets through a fresh session's decode, VAD and
+// utterance logic with cfg, returning how many utterances reached the
+// conversational loop and how many were dropped as too short or quiet.
+// The pipeline logs as it goes, as it would on a call.
+func ReplayCapture(packets [][]byte, cfg Config) (utterances, dropped int, err error) {
+	if err := cfg.validate(); err != nil {
+		return 0, 0, err
+	}
+	dec, err := newOpusDecoder()
+	if err != nil {
+		return 0, 0, fmt.Errorf("opus decoder: %w", err)
+	}
+	vad, err := newVoiceDetector(cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+	return newReplaySession(cfg, dec, vad).replay(packets)
+}
+
+// newReplaySession is a session off any call, decoding with dec and judging
+// speech with vad. A peer without a transcriber stops each utterance at the
+// count.
+func newReplaySession(cfg Config, dec frameDecoder, vad VoiceDetector) *Session {
+	peer := &Peer{cfg: cfg, pools: newBufferPools(cfg)}
+	session := &Session{
+		RemoteID: "capture",
+		peer:     peer,
+		dec:      dec,
+		vad:      vad,
+		player:   &player{},
+		smoother: newVADSmoother(cfg.VADSmoothingFrames),
+		noise:    newNoiseFloor(cfg.NoiseFloorAttack, cfg.NoiseFloorDecay),
+	}
+	session.endpointer = peer.newEndpointer()
+	return session
+}
+
+// replay feeds packets through handleAudio and flushes what's left at the
+// end, returning the session's utterance counts.
+func (s *Session) replay(packets [][]byte) (utterances, dropped int, err error) {
+	// ReadCapture keeps no timestamps; replay the packets back to back.
+	var timestamp uint32
+	for _, packet := range packets {
+		if !s.handleAudio(packet, timestamp) {
+			return 0, 0, errors.New("decoder output disagrees with the capture's framing")
+		}
+		n, _ := opusPacketSamples(packet, sampleRate)
+		timestamp += uint32(n)
+	}
+	s.drainVADBuffer()
+	s.FlushUtterance("end of capture")
+	return s.utterances, s.dropped, nil
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// speechPattern is VAD decisions for a long utterance, one too short to
+// keep, and a shorter kept one: two transcribed and one dropped with
+// min_speech_ms 100.
+func speechPattern() []bool {
+	var decisions []bool
+	for _, run := range []struct {
+		frames   int
+		isSpeech bool
+	}{{30, true}, {15, false}, {3, true}, {15, false}, {20, true}} {
+		for range run.frames {
+			decisions = append(decisions, run.isSpeech)
+		}
+	}
+	return decisions
+}
+
+// A call's capture reads back packet for packet, and replaying it counts
+// the utterances the call had.
+func TestCaptureReplay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CaptureDir = t.TempDir()
+	cfg.MinSpeechMs = 100
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions := speechPattern()
+	s := newTurnSession(t, p, newRecordingTrack())
+	s.dec = &countingDecoder{pcm: toneFrame(frameSamples)}
+	s.vad = &listVAD{decisions: slices.Clone(decisions)}
+	s.smoother = newVADSmoother(cfg.VADSmoothingFrames)
+
+	s.openCapture()
+	if s.capture == nil {
+		t.Fatal("capture_dir set but the call isn't captured")
+	}
+	var sent [][]byte
+	for seq := range uint16(len(decisions)) {
+		pkt := opusPacket(seq)
+		sent = append(sent, pkt.Payload)
+		if !s.decodePacket(pkt) {
+			t.Fatalf("packet %d rejected", seq)
+		}
+	}
+	s.drainVADBuffer()
+	s.FlushUtterance("hang up")
+	s.closeCapture()
+	p.wg.Wait()
+	if s.utterances != 2 || s.dropped != 1 {
+		t.Fatalf("call had %d utterances and %d dropped, want 2 and 1", s.utterances, s.dropped)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(cfg.CaptureDir, "iphone-1-*.ogg"))
+	if len(files) != 1 {
+		t.Fatalf("capture files %v, want one for the call", files)
+	}
+	packets, err := ReadCapture(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(packets, sent, bytes.Equal) {
+		t.Fatalf("capture read back %d packets %v, want the %d sent", len(packets), packets, len(sent))
+	}
+
+	replayed := newReplaySession(cfg, &countingDecoder{pcm: toneFrame(frameSamples)}, &listVAD{decisions: decisions})
+	utterances, dropped, err := replayed.replay(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utterances != s.utterances || dropped != s.dropped {
+		t.Errorf("replay counted %d utterances and %d dropped, the call %d and %d", utterances, dropped, s.utterances, s.dropped)
+	}
+}
+
+func TestReplayCaptureErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VADMode = 7
+	if _, _, err := ReplayCapture(nil, cfg); err == nil {
+		t.Error("ReplayCapture accepted an invalid config")
+	}
+	if _, err := ReadCapture(writeConfig(t, "garbage.ogg", "not ogg")); err == nil {
+		t.Error("ReadCapture accepted a file that isn't Ogg")
+	}
+}
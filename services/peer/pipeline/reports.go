@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// RTCPReport is what the caller's RTCP says about the call: its sender
+// reports on the audio it sends us, and its receiver reports on ours. pion's
+// report interceptors send our own sender and receiver reports.
+type RTCPReport struct {
+	// From the latest sender report, as the caller counts its own stream.
+	SenderPackets uint32    `json:"senderPackets"`
+	SenderOctets  uint32    `json:"senderOctets"`
+	SenderReport  time.Time `json:"senderReport,omitzero"` // when it arrived
+
+	// From the latest receiver report on our outbound audio.
+	OutboundLossPercent float64   `json:"outboundLossPercent"` // since the previous report
+	OutboundLost        uint32    `json:"outboundLost"`        // packets, over the call
+	OutboundJitterMs    float64   `json:"outboundJitterMs"`
+	RTTMs               float64   `json:"rttMs"` // zero until a report echoes one of our sender reports
+	ReceiverReport      time.Time `json:"receiverReport,omitzero"`
+}
+
+// rtcpStats collects the caller's reports as they arrive.
+type rtcpStats struct {
+	mu   sync.Mutex
+	last RTCPReport
+}
+
+// record folds packets read at now into the stats.
+func (st *rtcpStats) record(packets []rtcp.Packet, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, pkt := range packets {
+		switch pkt := pkt.(type) {
+		case *rtcp.SenderReport:
+			st.last.SenderPackets = pkt.PacketCount
+			st.last.SenderOctets = pkt.OctetCount
+			st.last.SenderReport = now
+			// A sender report can carry reception blocks for our audio too.
+			st.receptionReports(pkt.Reports, now)
+		case *rtcp.ReceiverReport:
+			st.receptionReports(pkt.Reports, now)
+		}
+	}
+}
+
+// receptionReports records the caller's view of our outbound audio. There
+// is one outbound stream, so any block is about it. Callers hold mu.
+func (st *rtcpStats) receptionReports(blocks []rtcp.ReceptionReport, now time.Time) {
+	for _, rr := range blocks {
+		st.last.OutboundLossPercent = float64(rr.FractionLost) / 256 * 100
+		st.last.OutboundLost = rr.TotalLost
+		st.last.OutboundJitterMs = float64(rr.Jitter) / sampleRate * 1000
+		st.last.ReceiverReport = now
+		// RFC 3550 §6.4.1: RTT is now less when our report left (LSR) and
+		// how long the caller held it (DLSR), in 1/65536 s.
+		if rr.LastSenderReport != 0 {
+			rtt := ntpMiddle(now) - rr.LastSenderReport - rr.Delay
+			st.last.RTTMs = float64(rtt) / 65536 * 1000
+		}
+	}
+}
+
+func (st *rtcpStats) report() RTCPReport {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.last
+}
+
+// ntpMiddle is the middle 32 bits of t as an NTP timestamp, the form sender
+// report times are echoed in.
+func ntpMiddle(t time.Time) uint32 {
+	const ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return uint32((secs<<32 | frac) >> 16)
+}
+
+// lossHintInterval is how often a session re-reads the measured loss for
+// its outbound encoder.
+const lossHintInterval = 2 * time.Second
+
+// trackPacketLoss keeps the outbound encoder's expected loss at the
+// measured loss until the session ends. The caller's receiver reports
+// describe the path our audio takes; until one arrives, the loss on its
+// audio to us stands in.
+func (s *Session) trackPacketLoss() {
+	t := time.NewTicker(lossHintInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		s.player.setPacketLoss(s.measuredLossPerc())
+	}
+}
+
+// measuredLossPerc is the loss on the path our audio takes, rounded up to
+// a whole percent: the caller's latest receiver report, or until one
+// arrives, the loss on its audio to us.
+func (s *Session) measuredLossPerc() int {
+	q := s.Quality()
+	loss := q.RTCP.OutboundLossPercent
+	if q.RTCP.ReceiverReport.IsZero() {
+		loss = s.inbound.lossFraction() * 100
+	}
+	return min(int(math.Ceil(loss)), 100)
+}
+
+// outboundRTCP records the caller's RTCP about our outbound audio.
+func (s *Session) outboundRTCP(packets []rtcp.Packet) {
+	s.rtcp.record(packets, time.Now())
+}
+
+// readRTCP reads the caller's RTCP for its audio track until the receiver
+// closes. Reading also runs it through the interceptors.
+func (s *Session) readRTCP(recv *webrtc.RTPReceiver) {
+	for {
+		packets, _, err := recv.ReadRTCP()
+		if err != nil {
+			if !isTrackClosed(err) {
+				log.Printf("[%s] RTCP read stopped: %v", s.TraceID, err)
+			}
+			return
+		}
+		s.rtcp.record(packets, time.Now())
+	}
+}
@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/rtcp"
+)
+
+func TestNTPMiddle(t *testing.T) {
+	const secs = 2208988800 // 1970 in NTP time
+	tests := []struct {
+		t    time.Time
+		want uint32
+	}{
+		{time.Unix(0, 0), secs & 0xffff << 16},
+		{time.Unix(0, 5e8), secs&0xffff<<16 | 0x8000},
+		{time.Unix(1, 0), (secs + 1) & 0xffff << 16},
+	}
+	for _, tt := range tests {
+		if got := ntpMiddle(tt.t); got != tt.want {
+			t.Errorf("ntpMiddle(%v) = %#x, want %#x", tt.t, got, tt.want)
+		}
+	}
+}
+
+// The caller's sender reports give its own counts; its receiver reports,
+// including those riding on sender reports, give loss, jitter and round
+// trip time on our outbound audio.
+func TestRTCPStats(t *testing.T) {
+	s := &Session{}
+	now := time.Now()
+	s.rtcp.record([]rtcp.Packet{&rtcp.SenderReport{PacketCount: 500, OctetCount: 40000}}, now)
+	if got := s.Quality().RTCP; got.SenderPackets != 500 || got.SenderOctets != 40000 || !got.SenderReport.Equal(now) || !got.ReceiverReport.IsZero() {
+		t.Errorf("after a sender report: %+v", got)
+	}
+
+	// Our report left 150ms ago and the caller held it for 50ms.
+	s.outboundRTCP([]rtcp.Packet{&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{
+		FractionLost:     64,
+		TotalLost:        7,
+		Jitter:           480,
+		LastSenderReport: ntpMiddle(time.Now().Add(-150 * time.Millisecond)),
+		Delay:            50 * 65536 / 1000,
+	}}}})
+	got := s.Quality().RTCP
+	if got.OutboundLossPercent != 25 || got.OutboundLost != 7 || got.OutboundJitterMs != 10 || got.ReceiverReport.IsZero() {
+		t.Errorf("after a receiver report: %+v", got)
+	}
+	if math.Abs(got.RTTMs-100) > 5 {
+		t.Errorf("RTT %.1fms, want about 100ms", got.RTTMs)
+	}
+
+	// A block with no echoed sender report can't give an RTT, so the last
+	// one stands.
+	s.rtcp.record([]rtcp.Packet{&rtcp.SenderReport{PacketCount: 600, Reports: []rtcp.ReceptionReport{{FractionLost: 0, TotalLost: 7}}}}, time.Now())
+	got = s.Quality().RTCP
+	if got.SenderPackets != 600 || got.OutboundLossPercent != 0 || math.Abs(got.RTTMs-100) > 5 {
+		t.Errorf("after a sender report with a reception block: %+v", got)
+	}
+}
+
+// The measured loss comes from the caller's receiver reports once there
+// are any, and from its audio to us before.
+func TestMeasuredLossPerc(t *testing.T) {
+	s := &Session{}
+	if got := s.measuredLossPerc(); got != 0 {
+		t.Errorf("before any audio: %d%%", got)
+	}
+	// 121 of 1000 packets lost.
+	for seq := range uint16(1000) {
+		if seq >= 1 && seq <= 121 {
+			continue
+		}
+		s.inbound.update(seq, uint32(seq)*frameSamples, sampleRate, time.Now())
+	}
+	if got := s.measuredLossPerc(); got != 13 {
+		t.Errorf("12.1%% inbound loss, no reports: %d%%, want 13", got)
+	}
+	s.rtcp.record([]rtcp.Packet{&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{FractionLost: 77}}}}, time.Now())
+	if got := s.measuredLossPerc(); got != 31 {
+		t.Errorf("receiver report of 77/256 lost: %d%%, want 31", got)
+	}
+	s.rtcp.record([]rtcp.Packet{&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{}}}}, time.Now())
+	if got := s.measuredLossPerc(); got != 0 {
+		t.Errorf("clean receiver report: %d%%, want 0", got)
+	}
+}
+
+// The encoder is only retuned when the expected loss changes.
+func TestSetPacketLoss(t *testing.T) {
+	enc := &fakeEncoder{}
+	p := &player{enc: enc}
+	for _, perc := range []int{13, 13, 31, 0, 0} {
+		p.setPacketLoss(perc)
+	}
+	if want := []int{13, 31, 0}; !slices.Equal(enc.lossPerc, want) {
+		t.Errorf("encoder told %v, want %v", enc.lossPerc, want)
+	}
+}
+
+// A fixed opus_packet_loss_perc goes straight to each call's encoder.
+func TestFixedPacketLoss(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OpusPacketLossPerc = 7
+	p, _ := newTestPeer(t, cfg)
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := p.session("iphone-1")
+	if got, err := s.player.enc.(*opus.Encoder).PacketLossPerc(); err != nil || got != 7 {
+		t.Errorf("encoder expects %d%% loss, %v; want 7", got, err)
+	}
+}
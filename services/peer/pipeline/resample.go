@@ -0,0 +1,24 @@
+package pipeline
+
+// resample converts mono PCM between sample rates using linear
+// interpolation. It's cheap and good enough for speech headed into Opus;
+// anything fancier belongs in the synthesizer.
+func resample(in []int16, fromRate, toRate int) []int16 {
+	if fromRate == toRate || len(in) == 0 {
+		return in
+	}
+	outLen := int(int64(len(in)) * int64(toRate) / int64(fromRate))
+	out := make([]int16, outLen)
+	step := float64(fromRate) / float64(toRate)
+	for i := range out {
+		pos := float64(i) * step
+		j := int(pos)
+		if j >= len(in)-1 {
+			out[i] = in[len(in)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = int16(float64(in[j])*(1-frac) + float64(in[j+1])*frac)
+	}
+	return out
+}
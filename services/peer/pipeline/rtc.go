@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+// mimeTypeTelephoneEvent is RFC 4733 DTMF, which pion doesn't register by
+// default.
+const mimeTypeTelephoneEvent = "audio/telephone-event"
+
+// rtcAPI is the pion API every PeerConnection is created from, plus the
+// hook that hands each new connection its bandwidth estimator.
+type rtcAPI struct {
+	*webrtc.API
+
+	// pion builds a connection's interceptors, and so its estimator,
+	// synchronously inside NewPeerConnection; mu makes the hand-off to the
+	// caller unambiguous.
+	mu      sync.Mutex
+	pending cc.BandwidthEstimator
+}
+
+// newPeerConnection creates a PeerConnection along with the send-side
+// bandwidth estimator fed by the remote's transport-wide CC feedback.
+func (a *rtcAPI) newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = nil
+	pc, err := a.NewPeerConnection(config)
+	bwe := a.pending
+	a.pending = nil
+	return pc, bwe, err
+}
+
+// newWebRTCAPI builds the pion API: Opus plus telephone-event at both clock
+// rates browsers offer, the default interceptors, and transport-wide
+// congestion control so outbound speech can follow the available
+// bandwidth.
+//
+// Only codecs the pipeline can decode are registered, so pion answers an
+// offer's video (or any m-line without Opus) with port 0 and keeps the
+// audio path, rather than accepting media that would be thrown away.
+func newWebRTCAPI() (*rtcAPI, error) {
+	m := &webrtc.MediaEngine{}
+	opusCodec := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}
+	if err := m.RegisterCodec(opusCodec, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("register opus: %w", err)
+	}
+	for clockRate, pt := range map[uint32]webrtc.PayloadType{48000: 126, 8000: 101} {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeTelephoneEvent,
+				ClockRate:   clockRate,
+				SDPFmtpLine: "0-15",
+			},
+			PayloadType: pt,
+		}
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("register telephone-event: %w", err)
+		}
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, fmt.Errorf("register interceptors: %w", err)
+	}
+
+	api := &rtcAPI{}
+	estimator, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// Audio is sent as it's produced, never paced.
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(adaptiveBitrateCeiling),
+			gcc.SendSideBWEMinBitrate(minOpusBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth estimator: %w", err)
+	}
+	estimator.OnNewPeerConnection(func(_ string, bwe cc.BandwidthEstimator) {
+		api.pending = bwe
+	})
+	registry.Add(estimator)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, registry); err != nil {
+		return nil, fmt.Errorf("register TWCC: %w", err)
+	}
+
+	api.API = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry))
+	return api, nil
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// SDPMunger rewrites a generated answer SDP before it is sent to the caller,
+// for tweaks pion doesn't expose such as Opus fmtp parameters. pion applies
+// the unmodified answer locally, so mungers can only change what the remote
+// is asked to do, not how this side behaves.
+type SDPMunger func(sdp string) (string, error)
+
+// applyMungers runs raw through each munger in order and checks that the
+// result still parses.
+func applyMungers(raw string, mungers []SDPMunger) (string, error) {
+	if len(mungers) == 0 {
+		return raw, nil
+	}
+	for _, munge := range mungers {
+		var err error
+		if raw, err = munge(raw); err != nil {
+			return "", err
+		}
+	}
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(raw)); err != nil {
+		return "", fmt.Errorf("munged SDP no longer parses: %w", err)
+	}
+	return raw, nil
+}
+
+// offersOpus reports whether an offer has an active audio m-line with Opus
+// among its codecs, the one thing an answer can't do without.
+func offersOpus(offer string) (bool, error) {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(offer)); err != nil {
+		return false, err
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "audio" || md.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, attr := range md.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			if _, codec, ok := strings.Cut(attr.Value, " "); ok && strings.HasPrefix(strings.ToLower(codec), "opus/") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// declinedMedia lists the media types of an answer's rejected (port 0)
+// m-lines.
+func declinedMedia(answer string) []string {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(answer)); err != nil {
+		return nil
+	}
+	var declined []string
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 {
+			declined = append(declined, md.MediaName.Media)
+		}
+	}
+	return declined
+}
+
+// SetOpusFmtp returns a munger that sets the given fmtp parameters on every
+// Opus payload type, adding an a=fmtp line if there is none.
+func SetOpusFmtp(params map[string]string) SDPMunger {
+	return func(raw string) (string, error) {
+		lines := strings.Split(strings.TrimSuffix(raw, "\r\n"), "\r\n")
+		opusPTs := map[string]bool{}
+		for _, line := range lines {
+			if pt, codec, ok := parseRtpmap(line); ok && strings.HasPrefix(strings.ToLower(codec), "opus/") {
+				opusPTs[pt] = true
+			}
+		}
+		if len(opusPTs) == 0 {
+			return raw, nil
+		}
+
+		out := make([]string, 0, len(lines)+len(opusPTs))
+		hasFmtp := map[string]bool{}
+		for _, line := range lines {
+			if strings.HasPrefix(line, "a=fmtp:") {
+				pt, existing, _ := strings.Cut(strings.TrimPrefix(line, "a=fmtp:"), " ")
+				if opusPTs[pt] {
+					hasFmtp[pt] = true
+					line = "a=fmtp:" + pt + " " + mergeFmtp(existing, params)
+				}
+			}
+			out = append(out, line)
+		}
+		// Add fmtp lines for Opus payload types that had none, right after
+		// their rtpmap.
+		if len(hasFmtp) < len(opusPTs) {
+			withAdded := make([]string, 0, len(out)+len(opusPTs))
+			for _, line := range out {
+				withAdded = append(withAdded, line)
+				if pt, _, ok := parseRtpmap(line); ok && opusPTs[pt] && !hasFmtp[pt] {
+					withAdded = append(withAdded, "a=fmtp:"+pt+" "+mergeFmtp("", params))
+				}
+			}
+			out = withAdded
+		}
+		return strings.Join(out, "\r\n") + "\r\n", nil
+	}
+}
+
+// parseRtpmap splits an "a=rtpmap:<pt> <codec>/<rate>" line.
+func parseRtpmap(line string) (pt, codec string, ok bool) {
+	rest, found := strings.CutPrefix(line, "a=rtpmap:")
+	if !found {
+		return "", "", false
+	}
+	return strings.Cut(rest, " ")
+}
+
+// mergeFmtp overlays params onto an existing "k=v;k=v" fmtp parameter list,
+// keeping the original order and appending new keys sorted.
+func mergeFmtp(existing string, params map[string]string) string {
+	var parts []string
+	seen := map[string]bool{}
+	for _, kv := range strings.Split(existing, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, _, _ := strings.Cut(kv, "=")
+		if v, ok := params[k]; ok {
+			kv = k + "=" + v
+			seen[k] = true
+		}
+		parts = append(parts, kv)
+	}
+	var added []string
+	for k := range params {
+		if !seen[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	for _, k := range added {
+		parts = append(parts, k+"="+params[k])
+	}
+	return strings.Join(parts, ";")
+}
+
+// MaxAverageBitrate caps the bitrate the remote may send us, in bits/s.
+func MaxAverageBitrate(bps int) SDPMunger {
+	return SetOpusFmtp(map[string]string{"maxaveragebitrate": strconv.Itoa(bps)})
+}
+
+// OpusFEC asks the remote to enable or disable Opus in-band FEC.
+func OpusFEC(enabled bool) SDPMunger {
+	return SetOpusFmtp(map[string]string{"useinbandfec": boolFmtp(enabled)})
+}
+
+// OpusDTX asks the remote to enable or disable Opus discontinuous
+// transmission.
+func OpusDTX(enabled bool) SDPMunger {
+	return SetOpusFmtp(map[string]string{"usedtx": boolFmtp(enabled)})
+}
+
+func boolFmtp(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetOpusFmtp(t *testing.T) {
+	const header = "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	tests := []struct {
+		name  string
+		media string
+		want  string
+	}{
+		{
+			"merged into the existing fmtp",
+			"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\na=fmtp:111 minptime=10;useinbandfec=0\r\n",
+			"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\na=fmtp:111 minptime=10;useinbandfec=1;maxaveragebitrate=20000\r\n",
+		},
+		{
+			"added after the rtpmap",
+			"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\na=rtpmap:111 OPUS/48000/2\r\na=rtpmap:0 PCMU/8000\r\n",
+			"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\na=rtpmap:111 OPUS/48000/2\r\na=fmtp:111 maxaveragebitrate=20000;useinbandfec=1\r\na=rtpmap:0 PCMU/8000\r\n",
+		},
+		{
+			"no Opus, left alone",
+			"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=rtpmap:0 PCMU/8000\r\na=fmtp:0 foo=1\r\n",
+			"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=rtpmap:0 PCMU/8000\r\na=fmtp:0 foo=1\r\n",
+		},
+	}
+	munge := SetOpusFmtp(map[string]string{"useinbandfec": "1", "maxaveragebitrate": "20000"})
+	for _, tt := range tests {
+		got, err := applyMungers(header+tt.media, []SDPMunger{munge})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != header+tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, header+tt.want)
+		}
+	}
+}
+
+// Mungers shape the answer the caller gets, in the order they were added;
+// the peer keeps the answer pion generated.
+func TestMungersOnlyOnAnswer(t *testing.T) {
+	p, ws := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	p.AddSDPMunger(func(sdp string) (string, error) { return sdp + "a=x-first\r\n", nil })
+	p.AddSDPMunger(func(sdp string) (string, error) { return sdp + "a=x-second\r\n", nil })
+
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	answer := ws.nextMessage(t, time.Second)
+	sdp, _ := answer.Data.(map[string]interface{})["sdp"].(string)
+	if !strings.HasSuffix(sdp, "a=x-first\r\na=x-second\r\n") {
+		t.Errorf("sent answer doesn't end with both mungers' lines, in order:\n%s", sdp)
+	}
+	s, _ := p.session("iphone-1")
+	if local := s.pc.LocalDescription().SDP; strings.Contains(local, "a=x-") {
+		t.Errorf("local answer was munged too:\n%s", local)
+	}
+}
+
+func TestMungerErrors(t *testing.T) {
+	broken := errors.New("munger broke")
+	for name, munge := range map[string]SDPMunger{
+		"error":       func(string) (string, error) { return "", broken },
+		"unparseable": func(string) (string, error) { return "not sdp", nil },
+	} {
+		p, ws := newTestPeer(t, DefaultConfig())
+		p.AddSDPMunger(munge)
+		err := p.handleOffer(offerMessage("iphone-1", newOffer(t)))
+		var r *offerRejection
+		if !errors.As(err, &r) || r.reason != rejectInternal {
+			t.Errorf("%s: handleOffer = %v, want an internal_error rejection", name, err)
+		}
+		if msg := ws.nextMessage(t, time.Second); msg.Type != "reject" {
+			t.Errorf("%s: caller got %+v, want a reject", name, msg)
+		}
+		if n := p.sessionCount(); n != 0 {
+			t.Errorf("%s: %d calls live after the answer failed", name, n)
+		}
+		p.shutdown(time.Second)
+	}
+}
+
+// opus_dtx advertises usedtx=1, unless the caller's media_config asked
+// otherwise; later media_configs reach the encoder.
+func TestOpusDTX(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OpusDTX = true
+	p, ws := newTestPeer(t, cfg)
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	answerFmtp := func(from string) string {
+		t.Helper()
+		if err := p.handleOffer(offerMessage(from, newOffer(t))); err != nil {
+			t.Fatal(err)
+		}
+		sdp, _ := ws.nextMessage(t, time.Second).Data.(map[string]interface{})["sdp"].(string)
+		for _, line := range strings.Split(sdp, "\r\n") {
+			if strings.HasPrefix(line, "a=fmtp:111 ") {
+				return line
+			}
+		}
+		t.Fatalf("answer to %s has no Opus fmtp:\n%s", from, sdp)
+		return ""
+	}
+
+	if fmtp := answerFmtp("iphone-1"); !strings.Contains(fmtp, "usedtx=1") {
+		t.Errorf("answer %q, want usedtx=1", fmtp)
+	}
+	if err := p.handleMediaConfig(SignalMessage{From: "iphone-2", Data: map[string]interface{}{"dtx": false}}); err != nil {
+		t.Fatal(err)
+	}
+	if fmtp := answerFmtp("iphone-2"); !strings.Contains(fmtp, "usedtx=0") || strings.Contains(fmtp, "usedtx=1") {
+		t.Errorf("answer %q, want the caller's usedtx=0", fmtp)
+	}
+
+	s, _ := p.session("iphone-1")
+	enc := &fakeEncoder{}
+	s.player.encMu.Lock()
+	s.player.enc = enc
+	s.player.encMu.Unlock()
+	if err := p.handleMediaConfig(SignalMessage{From: "iphone-1", Data: map[string]interface{}{"dtx": false}}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(enc.dtx, []bool{false}) {
+		t.Errorf("encoder DTX set to %v, want [false]", enc.dtx)
+	}
+}
+
+func TestOffersOpus(t *testing.T) {
+	const header = "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	tests := []struct {
+		name, media string
+		want        bool
+	}{
+		{"Opus audio", "m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\na=rtpmap:111 opus/48000/2\r\na=rtpmap:0 PCMU/8000\r\n", true},
+		{"PCMU only", "m=audio 9 UDP/TLS/RTP/SAVPF 0 8\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\n", false},
+		{"Opus audio disabled", "m=audio 0 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\n", false},
+		{"Opus after a PCMU section", "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=rtpmap:0 PCMU/8000\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 OPUS/48000/2\r\n", true},
+		{"video only", "m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 VP8/90000\r\n", false},
+	}
+	for _, tt := range tests {
+		if got, err := offersOpus(header + tt.media); err != nil || got != tt.want {
+			t.Errorf("%s: offersOpus = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := offersOpus("not sdp"); err == nil {
+		t.Error("offersOpus accepted an unparseable offer")
+	}
+}
+
+// An offer whose only audio is PCMU is refused before any call is set up.
+func TestPCMUOnlyOffer(t *testing.T) {
+	p, ws := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	var lines []string
+	for _, line := range strings.Split(newOffer(t), "\r\n") {
+		if strings.Contains(line, ":111 ") {
+			continue
+		}
+		if strings.HasPrefix(line, "m=audio ") {
+			line = strings.Replace(line, " 111", "", 1)
+		}
+		lines = append(lines, line)
+	}
+	offer := strings.Join(lines, "\r\n")
+	if !strings.Contains(offer, "PCMU/8000") || strings.Contains(strings.ToLower(offer), "opus") {
+		t.Fatalf("offer isn't PCMU without Opus:\n%s", offer)
+	}
+
+	err := p.handleOffer(offerMessage("iphone-1", offer))
+	var r *offerRejection
+	if !errors.As(err, &r) || r.reason != rejectUnsupportedMedia {
+		t.Errorf("handleOffer = %v, want an unsupported_media rejection", err)
+	}
+	if msg := ws.nextMessage(t, time.Second); msg.Type != "reject" {
+		t.Errorf("caller got %+v, want a reject", msg)
+	}
+	if n := p.sessionCount(); n != 0 {
+		t.Errorf("%d calls set up for a PCMU-only offer", n)
+	}
+}
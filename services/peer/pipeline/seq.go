@@ -0,0 +1,102 @@
+package pipeline
+
+import "time"
+
+const (
+	// dupWindow is how many trailing sequence numbers dupFilter remembers.
+	// Must be a multiple of 64 and divide 65536, so the bitmap index stays
+	// continuous across the sequence number wrap.
+	dupWindow = 1024
+	// dupResetGap is the silence after which sequence numbers are forgotten,
+	// so a sender that restarts its stream may reuse them.
+	dupResetGap = 5 * time.Second
+)
+
+// RTP sequence numbers are 16 bits and wrap from 65535 to 0, so they are
+// compared with RFC 1982 serial number arithmetic: a number is newer than
+// another when it is less than half the space ahead of it. Everything that
+// orders sequence numbers goes through seqDiff or seqNewer; comparing them
+// directly breaks at the wrap.
+
+// seqDiff is how far RTP sequence number a is ahead of b, negative when it
+// is behind, in [-32768, 32767]. Numbers exactly half the space apart are
+// undefined in RFC 1982; here a is then behind.
+func seqDiff(a, b uint16) int {
+	return int(int16(a - b))
+}
+
+// seqNewer reports whether RTP sequence number a comes after b.
+func seqNewer(a, b uint16) bool {
+	return seqDiff(a, b) > 0
+}
+
+// dupFilter detects duplicated RTP packets. Decoding the same Opus payload
+// twice corrupts decoder state and double-counts audio, so duplicates are
+// dropped before decode.
+type dupFilter struct {
+	seen     [dupWindow / 64]uint64 // bit per sequence number mod dupWindow
+	highest  uint16
+	lastSeen time.Time
+	started  bool
+}
+
+// duplicate records seq as received at now and reports whether it had
+// already been seen.
+func (f *dupFilter) duplicate(seq uint16, now time.Time) bool {
+	defer func() { f.lastSeen = now }()
+
+	if !f.started || now.Sub(f.lastSeen) > dupResetGap {
+		f.reset(seq)
+		return false
+	}
+
+	if seq == f.highest {
+		return true
+	}
+	if ahead := seqDiff(seq, f.highest); ahead > 0 {
+		if ahead >= dupWindow {
+			f.seen = [dupWindow / 64]uint64{}
+		} else {
+			for s := f.highest + 1; s != seq; s++ {
+				f.clear(s)
+			}
+		}
+		f.highest = seq
+		f.mark(seq)
+		return false
+	}
+
+	if -seqDiff(seq, f.highest) >= dupWindow {
+		// Too far behind to be a late packet: the sender restarted its
+		// sequence space.
+		f.reset(seq)
+		return false
+	}
+	if f.isMarked(seq) {
+		return true
+	}
+	f.mark(seq)
+	return false
+}
+
+func (f *dupFilter) reset(seq uint16) {
+	f.seen = [dupWindow / 64]uint64{}
+	f.highest = seq
+	f.started = true
+	f.mark(seq)
+}
+
+func (f *dupFilter) mark(seq uint16) {
+	i := seq % dupWindow
+	f.seen[i/64] |= 1 << (i % 64)
+}
+
+func (f *dupFilter) clear(seq uint16) {
+	i := seq % dupWindow
+	f.seen[i/64] &^= 1 << (i % 64)
+}
+
+func (f *dupFilter) isMarked(seq uint16) bool {
+	i := seq % dupWindow
+	return f.seen[i/64]&(1<<(i%64)) != 0
+}
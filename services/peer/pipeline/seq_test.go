@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSeqDiff(t *testing.T) {
+	tests := []struct {
+		a, b  uint16
+		diff  int
+		newer bool
+	}{
+		{1, 0, 1, true},
+		{0, 1, -1, false},
+		{5, 5, 0, false},
+		// Across the wrap.
+		{0, 65535, 1, true},
+		{65535, 0, -1, false},
+		{10, 65530, 16, true},
+		{65530, 10, -16, false},
+		// The half-space edge: 32767 ahead is newer, 32768 apart is behind.
+		{32767, 0, 32767, true},
+		{32768, 0, -32768, false},
+		{0, 32768, -32768, false},
+		{32768, 1, 32767, true},
+		{65535, 32768, 32767, true},
+	}
+	for _, tt := range tests {
+		if got := seqDiff(tt.a, tt.b); got != tt.diff {
+			t.Errorf("seqDiff(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.diff)
+		}
+		if got := seqNewer(tt.a, tt.b); got != tt.newer {
+			t.Errorf("seqNewer(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.newer)
+		}
+	}
+}
+
+func TestDupFilterAcrossWrap(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		seq  uint16
+		dup  bool
+	}{
+		{"first", 65533, false},
+		{"next", 65534, false},
+		{"repeat before the wrap", 65534, true},
+		{"skipping 65535", 0, false},
+		{"repeat after the wrap", 0, true},
+		{"late, across the wrap", 65535, false},
+		{"late repeat", 65535, true},
+		{"old one repeated after the wrap", 65533, true},
+		{"next after the wrap", 1, false},
+	}
+	var f dupFilter
+	for i, tt := range tests {
+		if got := f.duplicate(tt.seq, start.Add(time.Duration(i)*20*time.Millisecond)); got != tt.dup {
+			t.Errorf("%s: duplicate(%d) = %v, want %v", tt.name, tt.seq, got, tt.dup)
+		}
+	}
+	// After a long silence the sender may restart and reuse numbers.
+	if f.duplicate(1, start.Add(time.Minute)) {
+		t.Error("a number reused after dupResetGap taken for a duplicate")
+	}
+}
+
+// Within dupWindow a late packet is taken once and its repeat dropped; a
+// jump or fall of more than the window starts over rather than flagging
+// packets it no longer remembers.
+func TestDupFilterWindow(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		seq  uint16
+		dup  bool
+	}{
+		{"first", 2000, false},
+		{"skipping 2001-2004", 2005, false},
+		{"late 2002", 2002, false},
+		{"late 2002 again", 2002, true},
+		{"2005 again", 2005, true},
+		{"oldest remembered", 2005 - dupWindow + 1, false},
+		{"oldest remembered again", 2005 - dupWindow + 1, true},
+		{"jump past the window", 2005 + dupWindow, false},
+		{"2002's slot, cleared by the jump", 2002 + dupWindow, false},
+		{"far behind: a restarted sender", 2005, false},
+		{"restarted stream's next", 2006, false},
+		{"restarted stream's repeat", 2006, true},
+	}
+	var f dupFilter
+	for i, tt := range tests {
+		if got := f.duplicate(tt.seq, start.Add(time.Duration(i)*20*time.Millisecond)); got != tt.dup {
+			t.Errorf("%s: duplicate(%d) = %v, want %v", tt.name, tt.seq, got, tt.dup)
+		}
+	}
+}
+
+func TestStreamStatsAcrossWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		seqs   []uint16
+		cycles uint32
+		loss   float64
+	}{
+		{"no wrap", []uint16{100, 101, 102, 103}, 0, 0},
+		{"wrap, nothing lost", []uint16{65534, 65535, 0, 1}, 1, 0},
+		{"wrap, one lost at it", []uint16{65534, 0, 1, 2}, 1, 0.2},
+		{"late packet from before the wrap", []uint16{65534, 0, 65535, 1}, 1, 0},
+		{"two wraps", twoWraps(), 2, 0},
+	}
+	for _, tt := range tests {
+		var st streamStats
+		start := time.Now()
+		for i, seq := range tt.seqs {
+			st.update(seq, uint32(i)*frameSamples, sampleRate, start.Add(time.Duration(i)*20*time.Millisecond))
+		}
+		if st.cycles != tt.cycles {
+			t.Errorf("%s: %d wraparounds counted, want %d", tt.name, st.cycles, tt.cycles)
+		}
+		if got := st.lossFraction(); got != tt.loss {
+			t.Errorf("%s: loss %v, want %v", tt.name, got, tt.loss)
+		}
+	}
+}
+
+// twoWraps is every sequence number from 65530 on, through two wraps.
+func twoWraps() []uint16 {
+	var seqs []uint16
+	for i := range 2 * 65536 {
+		seqs = append(seqs, uint16(65530+i))
+	}
+	return seqs
+}
+
+func TestJitterBufferOrdersAcrossWrap(t *testing.T) {
+	want := []uint16{65534, 65535, 0, 1}
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 20 {
+		arrivals := slices.Clone(want[1:])
+		r.Shuffle(len(arrivals), func(i, j int) { arrivals[i], arrivals[j] = arrivals[j], arrivals[i] })
+		// The first packet opens the stream; the rest arrive shuffled
+		// within the buffer's wait.
+		arrivals = append([]uint16{want[0]}, arrivals...)
+
+		jb := newJitterBuffer(time.Second, time.Second)
+		start := time.Now()
+		var got []uint16
+		for i, seq := range arrivals {
+			now := start.Add(time.Duration(i) * time.Millisecond)
+			if !jb.push(jitterPacket(seq), now) {
+				t.Fatalf("arrivals %v: packet %d refused", arrivals, seq)
+			}
+			got = append(got, popAll(jb, now)...)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("arrivals %v released as %v, want %v", arrivals, got, want)
+		}
+	}
+}
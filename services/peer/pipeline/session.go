@@ -0,0 +1,956 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/opus"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+
+	"github.com/MaxwellKendall/voice-agent-service/services/peer/endpoint"
+)
+
+// VoiceDetector classifies a PCM frame as speech or not.
+type VoiceDetector interface {
+	IsSpeech(pcm []int16, sampleRate int) (bool, error)
+}
+
+// frameDecoder decodes one Opus payload into PCM.
+type frameDecoder interface {
+	Decode(data []byte, frameSize int, fec bool) ([]int16, error)
+}
+
+// newOpusDecoder returns a decoder that outputs sampleRate PCM. Opus leaves
+// the output rate to the decoder, so this should hold whatever internal
+// rate or bandwidth the remote encoder picks (SILK at 8-16 kHz, a 12 or
+// 24 kHz sprop-maxcapturerate, hybrid or CELT) and may change mid-call: a
+// 20 ms packet decodes to frameSamples. checkDecodedSize checks each
+// packet's output against its TOC and resets a decoder that disagrees.
+func newOpusDecoder() (frameDecoder, error) {
+	dec, err := opus.NewDecoder(sampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	return dec, nil
+}
+
+// codecKey identifies the negotiated codec a decoder was built for.
+type codecKey struct {
+	mimeType  string
+	clockRate uint32
+	channels  uint16
+}
+
+func codecKeyOf(codec webrtc.RTPCodecParameters) codecKey {
+	return codecKey{
+		mimeType:  strings.ToLower(codec.MimeType),
+		clockRate: codec.ClockRate,
+		channels:  codec.Channels,
+	}
+}
+
+// Session is one answered call: the remote peer, its PeerConnection, the
+// inbound speech pipeline and the outbound speech path.
+type Session struct {
+	RemoteID string
+	TraceID  string // correlation ID for logs and stage calls; see trace.go
+
+	peer   *Peer
+	pc     *webrtc.PeerConnection
+	dec    frameDecoder
+	vad    VoiceDetector
+	player *player
+
+	// Read loop state, owned by the read loop goroutine
+	dups     dupFilter
+	payloads payloadTypeFilter
+	jitter   *jitterBuffer // nil unless Config.JitterBufferMaxMs is set
+	decCodec codecKey
+	lastDTMF uint32 // RTP timestamp of the last DTMF event, which repeats per packet
+	seenDTMF bool
+	smoother vadSmoother
+	badSizes int // consecutive frames whose decoded length contradicts their TOC
+	clipping clipDetector
+	capture  *oggwriter.OggWriter
+	pcmOut   *pcmStream
+	// vadBuf holds decoded samples short of a whole VAD window; vadBufTS
+	// is the RTP timestamp of its first sample, and rtpBase that of the
+	// call's first audio, the zero of the speech timeline.
+	vadBuf    []int16
+	vadBufTS  uint32
+	rtpBase   uint32
+	seenAudio bool
+
+	// Speech state, written by the read loop and by control messages
+	stateMu       sync.Mutex
+	inSpeech      bool
+	coalescing    bool // utterance ended but held for Config.CoalesceMs
+	silenceStreak int
+	speechFrames  int // VAD-positive frames in the current utterance
+	utterance     *[]int16
+	dropped       int // utterances discarded as too short or too quiet
+	utterances    int // utterances handed to the conversational loop
+	muted         bool
+	noise         noiseFloor
+	buffered      atomic.Int64 // bytes of utterance counted in Peer.buffered
+	recent        recentUtterances
+	stream        *utteranceStream // the utterance in progress, if streamed; see streamUtterance
+	// checkpointAt is how much of the utterance the last checkpoint
+	// covered; checkpointCtx is cancelled by endCheckpoints when the
+	// utterance ends. See checkpoint.
+	checkpointAt   int
+	checkpointCtx  context.Context
+	endCheckpoints context.CancelFunc
+	// batch collects short utterances up to Config.MinTranscribeMs; see
+	// queueTurn.
+	batch         []int16
+	batchSegments []Segment
+	batchSince    time.Time
+	timeline      speechTimeline
+	endpointer    endpoint.Endpointer // decides where utterances start and end
+
+	inbound streamStats
+	rtcp    rtcpStats
+	metrics vadMetrics
+
+	mu         sync.Mutex
+	cancelTurn context.CancelFunc
+	language   string // transcription hint; empty lets the backend detect it
+	// detectedLanguage is the language the transcriber last reported; see
+	// Transcription.Language.
+	detectedLanguage string
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// rtpTrack is the part of the remote audio track the read loop uses.
+type rtpTrack interface {
+	ReadRTP() (*rtp.Packet, interceptor.Attributes, error)
+	SetReadDeadline(deadline time.Time) error
+	Codec() webrtc.RTPCodecParameters
+}
+
+// readLoop decodes the remote audio track and drives the speech state
+// machine until the track ends. codecs are those negotiated for the track.
+func (s *Session) readLoop(track rtpTrack, codecs []webrtc.RTPCodecParameters) {
+	backoff := readBackoffMin
+	s.decCodec = codecKeyOf(track.Codec())
+	if s.peer.cfg.CheckPayloadType {
+		s.payloads = newPayloadTypeFilter(codecs)
+	}
+	if cfg := s.peer.cfg; cfg.JitterBufferMaxMs > 0 {
+		s.jitter = newJitterBuffer(time.Duration(cfg.JitterBufferMinMs)*time.Millisecond, time.Duration(cfg.JitterBufferMaxMs)*time.Millisecond)
+	}
+	s.openCapture()
+	defer s.closeCapture()
+	s.openPCMOut()
+	defer s.closePCMOut()
+	// Nothing ends an utterance the track leaves open; release its buffer
+	// and its share of the audio budget.
+	defer s.AbortUtterance("track ended")
+	// Utterances waiting on a batch are complete; transcribe them.
+	defer s.FlushBatch()
+	readTimeout := time.Duration(s.peer.cfg.RTPReadTimeoutMs) * time.Millisecond
+	for {
+		// Read RTP packet, waking early if the jitter buffer is holding
+		// packets back for a gap it will give up on.
+		var deadline time.Time
+		if readTimeout > 0 {
+			deadline = time.Now().Add(readTimeout)
+		}
+		gapDue := false
+		if s.jitter != nil {
+			if due, ok := s.jitter.due(); ok && (deadline.IsZero() || due.Before(deadline)) {
+				deadline, gapDue = due, true
+			}
+		}
+		if readTimeout > 0 || s.jitter != nil {
+			track.SetReadDeadline(deadline)
+		}
+		pkt, _, readErr := track.ReadRTP()
+		if readErr != nil {
+			if isTrackClosed(readErr) {
+				log.Println("RTP track ended:", readErr)
+				if s.jitter != nil {
+					s.jitter.flush()
+					s.decodeReady()
+				}
+				return
+			}
+			if isTimeout(readErr) && gapDue {
+				if !s.decodeReady() {
+					return
+				}
+				continue
+			}
+			if isTimeout(readErr) {
+				log.Printf("[%s] 🧊 Audio track from %s frozen, nothing for %v; hanging up", s.TraceID, s.RemoteID, readTimeout)
+				s.hangUp()
+				return
+			}
+			if errors.Is(readErr, webrtc.ErrCodecNotFound) {
+				// The packet is gone but the track is fine; no backoff.
+				s.droppedPayloadType("a payload type no codec was negotiated for")
+				continue
+			}
+			log.Printf("RTP read error, retrying in %v: %v", backoff, readErr)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, readBackoffMax)
+			continue
+		}
+		backoff = readBackoffMin
+		if !s.allowPayloadType(pkt.PayloadType) {
+			continue
+		}
+		if s.dups.duplicate(pkt.SequenceNumber, time.Now()) {
+			log.Println("Dropped duplicate RTP packet", pkt.SequenceNumber)
+			continue
+		}
+		s.inbound.update(pkt.SequenceNumber, pkt.Timestamp, track.Codec().ClockRate, time.Now())
+		if strings.EqualFold(track.Codec().MimeType, mimeTypeTelephoneEvent) {
+			s.handleDTMF(pkt.Timestamp, pkt.Payload)
+			continue
+		}
+		if !s.checkCodec(track.Codec()) {
+			continue
+		}
+
+		if s.jitter == nil {
+			if !s.decodePacket(pkt) {
+				return
+			}
+			continue
+		}
+		if !s.jitter.push(pkt, time.Now()) {
+			log.Println("Dropped RTP packet", pkt.SequenceNumber, "arriving after its gap was given up on")
+			continue
+		}
+		s.jitter.adapt(s.inbound.jitterMs())
+		if !s.decodeReady() {
+			return
+		}
+	}
+}
+
+// decodeReady decodes the packets the jitter buffer has released, in
+// sequence. Like decodePacket, it reports false once the track should be
+// given up on.
+func (s *Session) decodeReady() bool {
+	for pkt := s.jitter.pop(time.Now()); pkt != nil; pkt = s.jitter.pop(time.Now()) {
+		if !s.decodePacket(pkt) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodePacket captures pkt and runs its audio through handleAudio. It
+// reports false once the track should be given up on.
+func (s *Session) decodePacket(pkt *rtp.Packet) bool {
+	if s.capture != nil {
+		if err := s.capture.WriteRTP(pkt); err != nil {
+			log.Println("Capture write failed, stopping capture:", err)
+			s.closeCapture()
+		}
+	}
+	if !s.handleAudio(pkt.Payload, pkt.Timestamp) {
+		log.Printf("Rejecting track from %s: decoder output still disagrees with the packets after a reset", s.RemoteID)
+		return false
+	}
+	return true
+}
+
+// handleAudio decodes one Opus payload, sent with RTP timestamp
+// timestamp, and runs it through VAD and the speech state machine. It
+// reports false once the track should be given up on.
+func (s *Session) handleAudio(payload []byte, timestamp uint32) bool {
+	// Decode Opus → PCM
+	decoded, decodeErr := s.dec.Decode(payload, maxOpusPacketSamples, false)
+	if decodeErr != nil {
+		log.Println("Opus decode error:", decodeErr)
+		return true
+	}
+	if len(decoded) == 0 {
+		// Nothing to judge or buffer (DTX, error recovery), but the
+		// packet's time still passed.
+		s.skipEmptyDecode(payload, timestamp)
+		return true
+	}
+	if !s.checkDecodedSize(payload, len(decoded)) {
+		return s.badSizes < maxBadDecodes
+	}
+
+	// Keep decoding while muted so the decoder's state follows the stream
+	s.stateMu.Lock()
+	muted := s.muted
+	s.stateMu.Unlock()
+	if muted {
+		s.vadBuf = s.vadBuf[:0]
+		return true
+	}
+	if s.pcmOut != nil {
+		s.pcmOut.write(decoded)
+	}
+	s.emitPCM(decoded, timestamp)
+	s.checkClipping(decoded)
+
+	// Packets needn't be one VAD window long: run whole windows as they
+	// fill and carry the rest over to the next packet.
+	if !s.seenAudio {
+		s.seenAudio = true
+		s.rtpBase = timestamp
+	}
+	if len(s.vadBuf) == 0 {
+		s.vadBufTS = timestamp
+	}
+	s.vadBuf = append(s.vadBuf, decoded...)
+	off := 0
+	for ; len(s.vadBuf)-off >= frameSamples; off += frameSamples {
+		pcm := s.vadBuf[off : off+frameSamples]
+		atMs := rtpMs(s.vadBufTS+uint32(off), s.rtpBase)
+		if s.peer.cfg.VADPassthrough {
+			s.stateMu.Lock()
+			s.passthroughFrame(pcm)
+			s.trackBuffered()
+			s.stateMu.Unlock()
+			s.peer.enforceAudioBudget()
+			continue
+		}
+		if atMs < int64(s.peer.cfg.VADWarmupMs) {
+			// Connection pops and clicks; keep them out of the smoother and
+			// the noise floor too.
+			continue
+		}
+		isSpeech, vadErr := s.vad.IsSpeech(pcm, sampleRate)
+		if vadErr != nil {
+			log.Println("VAD error:", vadErr)
+			continue
+		}
+		isSpeech = s.smoother.smooth(isSpeech)
+
+		s.stateMu.Lock()
+		s.processFrame(pcm, isSpeech, atMs)
+		s.trackBuffered()
+		s.stateMu.Unlock()
+		s.peer.enforceAudioBudget()
+	}
+	s.vadBuf = s.vadBuf[:copy(s.vadBuf, s.vadBuf[off:])]
+	s.vadBufTS += uint32(off)
+	if s.peer.cfg.MinTranscribeMs > 0 {
+		s.stateMu.Lock()
+		s.checkBatch()
+		s.stateMu.Unlock()
+	}
+	return true
+}
+
+// skipEmptyDecode accounts for a packet that decoded to no samples as
+// silence for as long as it lasted, by its TOC or else one frame, so a
+// pause still ends the utterance. Nothing reaches VAD or the buffers.
+func (s *Session) skipEmptyDecode(payload []byte, timestamp uint32) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.muted || s.peer.cfg.VADPassthrough {
+		return
+	}
+	if !s.seenAudio {
+		s.seenAudio = true
+		s.rtpBase = timestamp
+	}
+	samples, err := opusPacketSamples(payload, sampleRate)
+	if err != nil || samples == 0 {
+		samples = frameSamples
+	}
+	for off := 0; off < samples; off += frameSamples {
+		atMs := rtpMs(timestamp+uint32(off), s.rtpBase)
+		if atMs < int64(s.peer.cfg.VADWarmupMs) {
+			continue
+		}
+		s.processFrame(nil, false, atMs)
+	}
+}
+
+// drainVADBuffer adds the samples still short of a VAD window to the
+// utterance in progress, if any, for when no more audio will follow.
+func (s *Session) drainVADBuffer() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.inSpeech {
+		*s.utterance = append(*s.utterance, s.vadBuf...)
+		s.trackBuffered()
+	}
+	s.vadBuf = s.vadBuf[:0]
+}
+
+// checkCodec rebuilds the decoder when renegotiation switches the track to a
+// different codec, clock rate or channel count, and reports whether there is
+// a decoder able to take the packet. The speech state machine is untouched,
+// so an utterance spanning the switch carries on.
+func (s *Session) checkCodec(codec webrtc.RTPCodecParameters) bool {
+	key := codecKeyOf(codec)
+	if key == s.decCodec {
+		return s.dec != nil
+	}
+	log.Printf("Track codec changed from %s/%d/%d to %s/%d/%d",
+		s.decCodec.mimeType, s.decCodec.clockRate, s.decCodec.channels,
+		key.mimeType, key.clockRate, key.channels)
+	s.decCodec = key
+	s.dec = nil
+	if key.mimeType != strings.ToLower(webrtc.MimeTypeOpus) {
+		log.Println("Unsupported codec, dropping audio until it changes back:", codec.MimeType)
+		return false
+	}
+	dec, err := newOpusDecoder()
+	if err != nil {
+		log.Println("Opus decoder error, dropping audio until the next codec change:", err)
+		return false
+	}
+	s.dec = dec
+	return true
+}
+
+// maxBadDecodes is how many consecutive mis-sized frames, one second's
+// worth, the read loop tolerates before giving up on a track.
+const maxBadDecodes = 1000 / frameDuration
+
+// checkDecodedSize compares the decoded sample count with what the packet's
+// TOC says it holds. A mismatch means the decoder and stream disagree on
+// sample rate or channels, and the PCM would be garbage: the first one
+// rebuilds the decoder, and the caller gives up after maxBadDecodes.
+func (s *Session) checkDecodedSize(packet []byte, decoded int) bool {
+	want, err := opusPacketSamples(packet, sampleRate)
+	if err != nil || decoded == want {
+		s.badSizes = 0
+		return true
+	}
+	s.badSizes++
+	if s.badSizes == 1 {
+		log.Printf("Decoded %d samples from a %d-sample packet, expected %d Hz/%d ch; resetting decoder",
+			decoded, want, sampleRate, channels)
+		if dec, err := newOpusDecoder(); err == nil {
+			s.dec = dec
+		}
+	}
+	return false
+}
+
+// handleDTMF reacts to the first packet of each RFC 4733 event; senders
+// repeat an event's packets, with the same timestamp, until it ends.
+func (s *Session) handleDTMF(timestamp uint32, payload []byte) {
+	ev, ok := parseDTMF(payload)
+	if !ok || (s.seenDTMF && timestamp == s.lastDTMF) {
+		return
+	}
+	s.seenDTMF, s.lastDTMF = true, timestamp
+	log.Println("☎️ DTMF", ev.digit())
+	if s.peer.cfg.DTMFFlush {
+		s.FlushUtterance("DTMF " + ev.digit())
+	}
+}
+
+// AbortUtterance discards the current utterance without transcribing it,
+// e.g. when the caller says "cancel". Speech that follows starts a new
+// utterance. It reports whether there was an utterance to discard.
+func (s *Session) AbortUtterance(reason string) bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if !s.hasUtterance() {
+		return false
+	}
+	s.discardUtterance(reason)
+	s.resetEndpointer()
+	return true
+}
+
+// discardUtterance drops the utterance in progress. Callers hold stateMu
+// and have checked hasUtterance.
+func (s *Session) discardUtterance(reason string) {
+	log.Printf("🗑 Discarding utterance (%d ms): %s", len(*s.utterance)*1000/sampleRate, reason)
+	s.inSpeech = false
+	s.coalescing = false
+	s.timeline.end()
+	s.silenceStreak = 0
+	s.speechFrames = 0
+	s.peer.pools.putUtterance(s.utterance)
+	s.utterance = nil
+	s.trackBuffered()
+	s.stopCheckpoints()
+	if s.stream != nil {
+		s.stream.abort()
+		s.stream = nil
+	}
+}
+
+// SetMuted pauses or resumes processing of the caller's audio, e.g. while
+// they're on hold. Muted audio is still decoded but never reaches VAD or an
+// utterance, and muting discards any utterance in progress so nothing is
+// transcribed from before the mute either.
+func (s *Session) SetMuted(muted bool) {
+	s.stateMu.Lock()
+	if muted && s.hasUtterance() {
+		s.discardUtterance("muted")
+		s.resetEndpointer()
+	}
+	s.muted = muted
+	s.stateMu.Unlock()
+	log.Printf("[%s] Inbound audio muted: %v", s.TraceID, muted)
+}
+
+// FlushUtterance ends the current utterance now instead of waiting for the
+// silence timeout, sending it on to be transcribed. It reports whether
+// there was an utterance to flush.
+func (s *Session) FlushUtterance(reason string) bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if !s.hasUtterance() {
+		return false
+	}
+	log.Println("⏩ Flushing utterance early:", reason)
+	s.endUtterance()
+	s.sendBatch()
+	s.resetEndpointer()
+	return true
+}
+
+// hasUtterance reports whether there is an utterance in progress, whether
+// the caller is speaking or it is held for coalescing. Callers hold stateMu.
+func (s *Session) hasUtterance() bool {
+	return s.inSpeech || s.coalescing
+}
+
+// processFrame runs one VAD decision through the session's Endpointer,
+// buffering pcm while the user is speaking. atMs is the window's start on
+// the speech timeline. pcm is empty for a frame that decoded to nothing,
+// which counts as silence. Callers hold stateMu.
+func (s *Session) processFrame(pcm []int16, isSpeech bool, atMs int64) {
+	if isSpeech {
+		s.silenceStreak = 0
+		s.count(speechFrames)
+	} else {
+		s.silenceStreak++
+		s.count(silenceFrames)
+		if len(pcm) > 0 {
+			s.noise.update(rms(pcm))
+		}
+	}
+
+	ev := s.endpointer.Feed(pcm, isSpeech)
+	if ev == endpoint.Continue && !s.hasUtterance() {
+		// Nothing to continue, e.g. after a flush; take it as a start.
+		ev = endpoint.Start
+	}
+	switch ev {
+	case endpoint.None:
+		return
+	case endpoint.Abort:
+		if s.hasUtterance() {
+			s.discardUtterance("endpointer aborted it")
+		}
+		return
+	case endpoint.Start:
+		if s.hasUtterance() {
+			// The endpointer moved on without ending the last one.
+			s.endUtterance()
+		}
+		s.inSpeech = true
+		s.speechFrames = 0
+		s.utterance = s.peer.pools.getUtterance()
+		log.Println("▶️ Speech started")
+		s.count(utterancesStarted)
+		s.timeline.start(atMs)
+		s.bargeIn()
+	case endpoint.Continue:
+		if s.coalescing {
+			// Carry on the held utterance rather than starting a new one
+			s.inSpeech = true
+			s.coalescing = false
+			log.Println("▶️ Speech resumed, coalescing with the held utterance")
+			s.timeline.start(atMs)
+			s.bargeIn()
+		}
+	}
+
+	if s.inSpeech {
+		*s.utterance = append(*s.utterance, pcm...)
+		s.streamUtterance()
+		if isSpeech {
+			s.speechFrames++
+			s.timeline.speech(atMs + frameDuration)
+		}
+	}
+	switch ev {
+	case endpoint.End:
+		if s.hasUtterance() {
+			s.endUtterance()
+		}
+		return
+	case endpoint.Hold:
+		if s.inSpeech {
+			// Keep the utterance in case more speech follows, but not the
+			// gap's audio.
+			s.inSpeech = false
+			s.coalescing = true
+			s.timeline.end()
+			log.Printf("⏳ Speech paused (%d ms), holding to coalesce", len(*s.utterance)*1000/sampleRate)
+		}
+		return
+	}
+	if pauseMs := s.peer.cfg.PauseMs; pauseMs > 0 && s.inSpeech && s.silenceStreak == (pauseMs+frameDuration-1)/frameDuration {
+		s.notifyPause(time.Duration(s.silenceStreak*frameDuration) * time.Millisecond)
+		s.checkpoint()
+	}
+}
+
+// resetEndpointer clears the Endpointer's state when the session ends or
+// drops an utterance on its own. Callers hold stateMu.
+func (s *Session) resetEndpointer() {
+	if r, ok := s.endpointer.(endpoint.Resetter); ok {
+		r.Reset()
+	}
+}
+
+// passthroughFrame buffers pcm without VAD, handing the audio on in
+// Config.PassthroughChunkMs chunks. A chunk in progress counts as an
+// utterance, so flushing, aborting and muting work as usual. Callers hold
+// stateMu.
+func (s *Session) passthroughFrame(pcm []int16) {
+	if !s.inSpeech {
+		s.inSpeech = true
+		s.utterance = s.peer.pools.getUtterance()
+	}
+	*s.utterance = append(*s.utterance, pcm...)
+	if len(*s.utterance) >= s.peer.cfg.PassthroughChunkMs*sampleRate/1000 {
+		s.endUtterance()
+	}
+}
+
+// notifyPause tells a PauseListener agent the caller has paused without
+// finishing. It runs off the read loop so a slow agent can't stall audio.
+func (s *Session) notifyPause(silence time.Duration) {
+	listener, ok := s.peer.agent.(PauseListener)
+	if !ok {
+		return
+	}
+	log.Printf("[%s] ⏸ Pause (%v) within utterance", s.TraceID, silence)
+	s.peer.spawn(func() { listener.Paused(withTrace(context.Background(), s.TraceID, ""), silence) })
+}
+
+// endUtterance closes the current utterance and hands it to the
+// conversational loop. Callers hold stateMu.
+func (s *Session) endUtterance() {
+	s.inSpeech = false
+	s.coalescing = false
+	s.timeline.end()
+	s.silenceStreak = 0
+	buf := s.utterance
+	segment := *buf
+	s.utterance = nil
+	s.trackBuffered()
+	s.stopCheckpoints()
+	if s.stream != nil {
+		// The tail is under a chunk; the stream's goroutine gets a copy.
+		s.endStream(slices.Clone(segment))
+		s.peer.pools.putUtterance(buf)
+		return
+	}
+	log.Printf("⏹ Speech ended (%d ms)", len(segment)*1000/sampleRate)
+	// Without VAD there's no speech to measure; every chunk goes on, even
+	// identical runs of silence.
+	if s.peer.cfg.VADPassthrough || (s.worthTranscribing(rms(segment)) && !s.duplicateUtterance(utteranceHash(segment), len(segment))) {
+		s.utterances++
+		s.count(utterancesFlushed)
+		s.queueTurn(s.peer.pools.handoff(buf, s.peer.borrowsPCM))
+		return
+	}
+	s.peer.pools.putUtterance(buf)
+}
+
+// worthTranscribing filters out VAD blips: utterances with too few speech
+// frames, or too little energy over the fixed and adaptive thresholds to
+// contain real speech. level is the utterance's RMS.
+func (s *Session) worthTranscribing(level float64) bool {
+	cfg := s.peer.cfg
+	speechMs := s.speechFrames * frameDuration
+	minLevel := max(cfg.MinSpeechRMS, cfg.NoiseFloorMargin*s.noise.value())
+	if speechMs >= cfg.MinSpeechMs && level >= minLevel {
+		return true
+	}
+	s.dropped++
+	if speechMs < cfg.MinSpeechMs {
+		s.count(droppedTooShort)
+	} else {
+		s.count(droppedTooQuiet)
+	}
+	log.Printf("Skipped utterance with %d ms of speech at RMS %.0f, needed %.0f (%d skipped this call)",
+		speechMs, level, minLevel, s.dropped)
+	return false
+}
+
+// bargeIn interrupts the agent when the user starts talking: any reply still
+// being produced is cancelled and queued playback is dropped.
+func (s *Session) bargeIn() {
+	s.cancelCurrentTurn()
+	if dropped := s.player.flush(); dropped > 0 {
+		log.Printf("✋ Barge-in: dropped %d ms of playback", dropped*frameDuration)
+	}
+}
+
+// cancelCurrentTurn abandons the agent's in-flight reply, if any.
+func (s *Session) cancelCurrentTurn() {
+	s.mu.Lock()
+	if s.cancelTurn != nil {
+		s.cancelTurn()
+		s.cancelTurn = nil
+	}
+	s.mu.Unlock()
+}
+
+// playbackFailed is called by the player when writing to the outbound track
+// fails. The queue is already flushed; cancelling the turn stops the agent
+// from synthesizing more of a reply nobody will hear.
+func (s *Session) playbackFailed(err error) {
+	s.cancelCurrentTurn()
+}
+
+// startTurn hands finished audio to the conversational loop: one utterance,
+// or a batch of them marked by segments. A batch's turn takes its first
+// utterance's ID. release, if not nil, is called once the turn is done
+// with segment; see bufferPools.handoff.
+func (s *Session) startTurn(segment []int16, segments []Segment, release func()) {
+	if s.peer.transcriber == nil {
+		if release != nil {
+			release()
+		}
+		return
+	}
+	id := utteranceID(s.TraceID, s.utterances)
+	if len(segments) > 0 {
+		id = segments[0].UtteranceID
+	}
+	ctx, cancel := context.WithCancel(withTrace(context.Background(), s.TraceID, id))
+	s.mu.Lock()
+	opts := TranscribeOptions{Language: s.language, Segments: segments}
+	s.mu.Unlock()
+	if !s.peer.cfg.VADPassthrough {
+		s.preempt(cancel)
+	}
+	s.peer.spawn(func() { s.runTurn(ctx, cancel, segment, opts, release) })
+}
+
+// preempt makes cancel the in-flight turn's, abandoning the reply of the
+// turn it replaces.
+func (s *Session) preempt(cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelTurn != nil {
+		s.cancelTurn()
+	}
+	s.cancelTurn = cancel
+}
+
+// SetLanguage sets the language hint passed to the transcriber for later
+// utterances. An empty tag goes back to automatic detection.
+func (s *Session) SetLanguage(tag string) {
+	s.mu.Lock()
+	s.language = tag
+	s.mu.Unlock()
+}
+
+// runTurn transcribes an utterance, relays the transcript, and speaks the
+// agent's reply. Transcription isn't tied to ctx so a barge-in never loses
+// what the user already said; only the reply is abandoned. Every stage gets
+// ctx's correlation IDs. release, if not nil, returns segment's buffer once
+// it has been transcribed.
+func (s *Session) runTurn(ctx context.Context, cancel context.CancelFunc, segment []int16, opts TranscribeOptions, release func()) {
+	tag := traceTag(ctx)
+	done := s.peer.acquireTranscription(tag)
+	result, err := s.peer.transcriber.Transcribe(context.WithoutCancel(ctx), segment, sampleRate, opts)
+	done()
+	samples := len(segment)
+	if release != nil {
+		release()
+	}
+	if err != nil {
+		log.Println(tag+"Transcribe error:", err)
+		return
+	}
+	s.noteLanguage(ctx, result.Language)
+	s.finishTurn(ctx, cancel, result.Text, result.Words, samples)
+}
+
+// finishTurn relays the transcript of an utterance of samples, with any
+// word timings, and speaks the agent's reply: the rest of runTurn once
+// transcription is done.
+func (s *Session) finishTurn(ctx context.Context, cancel context.CancelFunc, text string, words []WordTiming, samples int) {
+	tag := traceTag(ctx)
+	text = applyProcessors(text, s.peer.processors)
+	if text == "" {
+		return
+	}
+	// Passthrough chunks run back to back, most of them silence; one only
+	// interrupts the current reply once it turns out to hold words.
+	if s.peer.cfg.VADPassthrough {
+		s.preempt(cancel)
+	}
+	log.Println(tag+"📝 Transcript:", text)
+	s.publishTranscript(ctx, TranscriptEvent{
+		PeerID:      s.RemoteID,
+		UtteranceID: UtteranceID(ctx),
+		Text:        text,
+		DurationMs:  samples * 1000 / sampleRate,
+		Timestamp:   time.Now(),
+	})
+	msg := SignalMessage{
+		Type: "signal",
+		To:   s.RemoteID,
+		From: s.peer.cfg.PeerID,
+		Data: map[string]interface{}{"transcript": Transcript{Text: text, Words: words}},
+	}
+	if err := s.peer.send(msg); err != nil {
+		log.Println(tag+"Send transcript failed:", err)
+	}
+
+	if s.peer.agent == nil {
+		return
+	}
+	reply, err := s.peer.agent.Respond(ctx, text)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println(tag+"Agent error:", err)
+		}
+		return
+	}
+	if err := s.Speak(ctx, reply); err != nil && ctx.Err() == nil {
+		log.Println(tag+"Speak error:", err)
+	}
+}
+
+// publishTranscript hands ev to every transcript sink, each on its own
+// goroutine. Delivery outlives a barge-in, like transcription itself.
+func (s *Session) publishTranscript(ctx context.Context, ev TranscriptEvent) {
+	ctx = context.WithoutCancel(ctx)
+	for _, sink := range s.peer.sinks {
+		s.peer.spawn(func() {
+			if err := sink.Publish(ctx, ev); err != nil {
+				log.Println(traceTag(ctx)+"Publish transcript failed:", err)
+			}
+		})
+	}
+}
+
+// Speak synthesizes text and queues it for playback on the outbound track.
+// It returns once the audio is queued, not once it has finished playing.
+// Nothing is queued if ctx is cancelled while synthesizing.
+func (s *Session) Speak(ctx context.Context, text string) error {
+	pcm, rate, err := s.peer.synth.Synthesize(ctx, text)
+	if err != nil {
+		return fmt.Errorf("synthesize: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.player.enqueue(resample(pcm, rate, sampleRate))
+}
+
+// SpeechTimeline returns the caller's speech intervals so far. It is safe
+// to call from any goroutine.
+func (s *Session) SpeechTimeline() []SpeechInterval {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.timeline.snapshot()
+}
+
+// Quality estimates the inbound call quality so far. It is safe to call from
+// any goroutine.
+func (s *Session) Quality() QualityReport {
+	q := s.inbound.report()
+	q.RTCP = s.rtcp.report()
+	return q
+}
+
+// stop abandons any in-flight turn and shuts down playback once the
+// PeerConnection is gone. It is safe to call more than once.
+func (s *Session) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		q := s.Quality()
+		log.Printf("[%s] 📞 Call with %s ended: loss %.1f%%, jitter %.1f ms, MOS %.2f",
+			s.TraceID, s.RemoteID, q.LossPercent, q.JitterMs, q.MOS)
+		log.Printf("[%s] 📊 Delay variation %v; interarrival %v", s.TraceID, q.DelayVariationMs, q.InterarrivalMs)
+		s.cancelCurrentTurn()
+		s.player.close()
+	})
+}
+
+// watchInactivity closes the PeerConnection once no RTP has arrived for
+// timeout, counting from the call's start until the first packet. It
+// returns when the session stops.
+func (s *Session) watchInactivity(timeout time.Duration) {
+	since := time.Now()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		if last, ok := s.inbound.lastPacket(); ok {
+			since = last
+		}
+		idle := time.Since(since)
+		if idle < timeout {
+			t.Reset(timeout - idle)
+			continue
+		}
+		log.Printf("[%s] ⌛ No RTP from %s for %v; hanging up", s.TraceID, s.RemoteID, idle.Round(time.Millisecond))
+		s.hangUp()
+		return
+	}
+}
+
+// hangUp ends the call from this side: the PeerConnection is closed and
+// the session torn down.
+func (s *Session) hangUp() {
+	if err := s.pc.Close(); err != nil {
+		log.Println("Close peer connection failed:", err)
+	}
+	// Closing normally reports PeerConnectionStateClosed, which does this
+	// too; both are idempotent.
+	s.peer.removeSession(s)
+	s.stop()
+}
+
+const (
+	readBackoffMin = 10 * time.Millisecond
+	readBackoffMax = time.Second
+)
+
+// isTrackClosed reports whether a ReadRTP error means the track is gone for
+// good, as opposed to a bad packet or a hiccup worth retrying.
+func isTrackClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// isTimeout reports whether err is a read deadline expiring.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,1044 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/MaxwellKendall/voice-agent-service/services/peer/endpoint"
+)
+
+// trackRead is what one ReadRTP call on a fakeTrack returns. A codec set
+// renegotiates the track to it as the read returns.
+type trackRead struct {
+	pkt   *rtp.Packet
+	err   error
+	codec *webrtc.RTPCodecParameters
+}
+
+// fakeTrack is a remote Opus track that returns the reads a test queues
+// on reads, io.EOF once reads is closed, and a timeout past its deadline.
+type fakeTrack struct {
+	reads chan trackRead
+	codec webrtc.RTPCodecParameters
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newFakeTrack() *fakeTrack {
+	return &fakeTrack{
+		reads: make(chan trackRead, 64),
+		codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: sampleRate, Channels: 2},
+			PayloadType:        111,
+		},
+	}
+}
+
+func (f *fakeTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	f.mu.Lock()
+	deadline := f.deadline
+	f.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case r, ok := <-f.reads:
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		if r.codec != nil {
+			f.mu.Lock()
+			f.codec = *r.codec
+			f.mu.Unlock()
+		}
+		return r.pkt, nil, r.err
+	case <-expired:
+		return nil, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (f *fakeTrack) SetReadDeadline(deadline time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deadline = deadline
+	return nil
+}
+
+func (f *fakeTrack) Codec() webrtc.RTPCodecParameters {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.codec
+}
+
+// packet queues a 20ms Opus packet with sequence number seq.
+func (f *fakeTrack) packet(seq uint16) {
+	f.reads <- trackRead{pkt: opusPacket(seq)}
+}
+
+func opusPacket(seq uint16) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{PayloadType: 111, SequenceNumber: seq, Timestamp: uint32(seq) * frameSamples},
+		Payload: []byte{benchOpusTOC[frameSamples], byte(seq)},
+	}
+}
+
+// countingDecoder decodes every payload to pcm and records the payloads.
+type countingDecoder struct {
+	pcm []int16
+
+	mu       sync.Mutex
+	payloads [][]byte
+}
+
+func (d *countingDecoder) Decode(data []byte, _ int, _ bool) ([]int16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.payloads = append(d.payloads, slices.Clone(data))
+	return d.pcm, nil
+}
+
+// decoded returns the second byte, the sequence number as fakeTrack.packet
+// wrote it, of every payload decoded so far.
+func (d *countingDecoder) decoded() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var seqs []byte
+	for _, p := range d.payloads {
+		seqs = append(seqs, p[1])
+	}
+	return seqs
+}
+
+// newReadSession is a session for p whose audio is decoded by the
+// returned decoder, as silence.
+func newReadSession(t *testing.T, p *Peer) (*Session, *countingDecoder) {
+	dec := &countingDecoder{pcm: make([]int16, frameSamples)}
+	s := newTurnSession(t, p, newRecordingTrack())
+	s.dec = dec
+	s.vad = &scriptedVAD{}
+	s.smoother = newVADSmoother(p.cfg.VADSmoothingFrames)
+	return s, dec
+}
+
+// runReadLoop runs s.readLoop on track, returning a channel closed when it
+// returns.
+func runReadLoop(s *Session, track rtpTrack) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.readLoop(track, []webrtc.RTPCodecParameters{track.Codec()})
+	}()
+	return done
+}
+
+// waitDone fails t unless done is closed within d.
+func waitDone(t *testing.T, done <-chan struct{}, d time.Duration, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("%s still running after %v", what, d)
+	}
+}
+
+// checkDecodedSize judges the decoder by the packet's own framing: whatever
+// internal rate or mode the remote encoder switches to, a packet's TOC
+// says how many 48 kHz samples it must decode to. That the real decoder
+// delivers them for 12 and 24 kHz streams is not checked here; it needs
+// packets encoded at those rates, which testdata doesn't have.
+func TestCheckDecodedSizeAcrossConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		// 20ms configurations (RFC 6716 §3.1).
+		{"SILK NB 8k", []byte{1 << 3}, frameSamples},
+		{"SILK MB 12k", []byte{5 << 3}, frameSamples},
+		{"SILK WB 16k", []byte{9 << 3}, frameSamples},
+		{"hybrid SWB 24k", []byte{13 << 3}, frameSamples},
+		{"hybrid FB", []byte{15 << 3}, frameSamples},
+		{"CELT NB", []byte{19 << 3}, frameSamples},
+		{"CELT FB", []byte{31 << 3}, frameSamples},
+		// Other durations, and packets of several frames.
+		{"SILK NB 40ms", []byte{2 << 3}, 2 * frameSamples},
+		{"SILK WB 60ms", []byte{11 << 3}, 3 * frameSamples},
+		{"CELT FB 2.5ms", []byte{28 << 3}, frameSamples / 8},
+		{"CELT FB 2x20ms", []byte{31<<3 | 1}, 2 * frameSamples},
+		{"CELT FB 3x20ms", []byte{31<<3 | 3, 3}, 3 * frameSamples},
+	}
+	for _, tt := range tests {
+		if got, err := opusPacketSamples(tt.packet, sampleRate); err != nil || got != tt.want {
+			t.Errorf("%s: opusPacketSamples = %d, %v; want %d", tt.name, got, err, tt.want)
+		}
+		stale := benchDecoder{}
+		s := &Session{dec: stale}
+		if !s.checkDecodedSize(tt.packet, tt.want) {
+			t.Errorf("%s: checkDecodedSize rejected %d samples", tt.name, tt.want)
+		}
+		// A decoder stuck at the internal rate, e.g. 12 or 24 kHz output for
+		// a 48 kHz call, is caught and replaced.
+		for _, rate := range []int{12000, 24000} {
+			if s.checkDecodedSize(tt.packet, tt.want*rate/sampleRate) {
+				t.Errorf("%s: checkDecodedSize accepted output at %d Hz", tt.name, rate)
+			}
+		}
+		if _, reset := s.dec.(benchDecoder); reset {
+			t.Errorf("%s: decoder not replaced after a wrong size", tt.name)
+		}
+		if s.badSizes != 2 {
+			t.Errorf("%s: %d bad sizes counted, want 2", tt.name, s.badSizes)
+		}
+	}
+
+	s := &Session{dec: benchDecoder{}}
+	for _, packet := range [][]byte{{}, {31<<3 | 3}, {31<<3 | 3, 0}} {
+		// Malformed framing is the decoder's to reject, not a size mismatch.
+		if !s.checkDecodedSize(packet, 0) {
+			t.Errorf("checkDecodedSize(%#x) rejected a packet it can't size", packet)
+		}
+	}
+}
+
+// windowCounter is a custom Endpointer that ignores silence: an utterance
+// starts on speech and ends after exactly n windows, however the caller
+// sounds.
+type windowCounter struct{ n, fed int }
+
+func (w *windowCounter) Feed(_ []int16, isSpeech bool) endpoint.Event {
+	if w.fed == 0 && !isSpeech {
+		return endpoint.None
+	}
+	w.fed++
+	switch w.fed {
+	case w.n:
+		w.fed = 0
+		return endpoint.End
+	case 1:
+		return endpoint.Start
+	}
+	return endpoint.Continue
+}
+
+// A custom Endpointer set with SetEndpointer decides where turns end: here
+// sooner than the silence default would, in the middle of speech, and later,
+// past the silence that would have ended it.
+func TestCustomEndpointer(t *testing.T) {
+	tests := []struct {
+		name           string
+		n              int
+		speech, silent int   // windows fed, speech first
+		want           []int // windows in each utterance transcribed
+	}{
+		{"early, mid-speech", 5, 20, 0, []int{5, 5, 5, 5}},
+		{"late, past the silence timeout", 25, 5, 30, []int{25}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keeper := &keepingTranscriber{done: make(chan struct{})}
+			p, err := NewPeer(DefaultConfig(), Handlers{Transcriber: keeper})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetEndpointer(func() endpoint.Endpointer { return &windowCounter{n: tt.n} })
+			p.setConn(newFakeSignaling())
+			s := newTurnSession(t, p, newRecordingTrack())
+
+			go func() {
+				s.stateMu.Lock()
+				defer s.stateMu.Unlock()
+				for i := range tt.speech + tt.silent {
+					// Each window distinct, so none is taken for a repeat.
+					frame := make([]int16, frameSamples)
+					for j := range frame {
+						frame[j] = int16(i + 1)
+					}
+					s.processFrame(frame, i < tt.speech, 0)
+				}
+			}()
+			for range tt.want {
+				select {
+				case <-keeper.done:
+				case <-time.After(time.Second):
+					t.Fatalf("%d of %d utterances transcribed", len(keeper.kept), len(tt.want))
+				}
+			}
+			p.wg.Wait()
+			var got []int
+			for _, pcm := range keeper.kept {
+				got = append(got, len(pcm)/frameSamples)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("utterances of %v windows, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A read error that isn't the track closing is retried, and the packets
+// after it are decoded; the loop ends with the track.
+func TestReadLoopRetries(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, dec := newReadSession(t, p)
+	track := newFakeTrack()
+	hiccup := errors.New("srtp: bad auth tag")
+	for range 3 {
+		track.reads <- trackRead{err: hiccup}
+	}
+	track.packet(1)
+	track.reads <- trackRead{err: hiccup}
+	track.packet(2)
+	close(track.reads)
+
+	waitDone(t, runReadLoop(s, track), time.Second, "read loop on a closed track")
+	if got := dec.decoded(); !slices.Equal(got, []byte{1, 2}) {
+		t.Errorf("decoded packets %v, want [1 2]", got)
+	}
+}
+
+// Hanging up ends the wait between retries.
+func TestReadLoopStopsDuringBackoff(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newReadSession(t, p)
+	track := newFakeTrack()
+	// 10ms doubling to 1s: well over a second of backoff in all.
+	for range 8 {
+		track.reads <- trackRead{err: errors.New("srtp: bad auth tag")}
+	}
+	done := runReadLoop(s, track)
+	time.Sleep(50 * time.Millisecond)
+	s.stop()
+	waitDone(t, done, 200*time.Millisecond, "read loop backing off after hang-up")
+}
+
+// A renegotiated codec gets a fresh decoder; one that isn't Opus has its
+// packets dropped, without ending the call, until Opus comes back.
+func TestCodecChange(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, dec := newReadSession(t, p)
+	track := newFakeTrack()
+	stereo := track.Codec()
+	mono := stereo
+	mono.Channels = 1
+	pcmu := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0}
+
+	track.packet(1)
+	track.reads <- trackRead{pkt: opusPacket(2), codec: &mono}
+	track.reads <- trackRead{pkt: opusPacket(3), codec: &pcmu}
+	track.packet(4)
+	track.reads <- trackRead{pkt: opusPacket(5), codec: &stereo}
+	close(track.reads)
+	waitDone(t, runReadLoop(s, track), time.Second, "read loop on a closed track")
+
+	// Only the first packet reached the original decoder.
+	if got := dec.decoded(); !slices.Equal(got, []byte{1}) {
+		t.Errorf("original decoder decoded %v, want [1]", got)
+	}
+	if _, reused := s.dec.(*countingDecoder); reused || s.dec == nil {
+		t.Errorf("decoder after switching back to Opus is %T, want a fresh one", s.dec)
+	}
+	if want := codecKeyOf(stereo); s.decCodec != want {
+		t.Errorf("decoder built for %+v, want %+v", s.decCodec, want)
+	}
+	// Packets 1, 2 and 5 were decoded and judged; 3 and 4 dropped.
+	if m := s.metrics.snapshot(); m.SpeechFrames+m.SilenceFrames != 3 {
+		t.Errorf("%d frames judged, want 3", m.SpeechFrames+m.SilenceFrames)
+	}
+}
+
+// squareFrame is a frame of square wave at amplitude, its RMS.
+func squareFrame(amplitude int16) []int16 {
+	pcm := make([]int16, frameSamples)
+	for i := range pcm {
+		if i/24%2 == 0 {
+			pcm[i] = amplitude
+		} else {
+			pcm[i] = -amplitude
+		}
+	}
+	return pcm
+}
+
+// Utterances with too little speech, or too quiet, are counted and not
+// transcribed; a threshold of 0 lets them through.
+func TestSkipsEmptyUtterances(t *testing.T) {
+	tests := []struct {
+		name            string
+		minMs           int
+		minRMS          float64
+		amplitude       int16
+		frames          int
+		short, quiet    uint64
+		wantTranscribed bool
+	}{
+		{"speech", 100, 100, 8000, 10, 0, 0, true},
+		{"too short", 100, 100, 8000, 4, 1, 0, false},
+		{"too quiet", 100, 100, 50, 10, 0, 1, false},
+		{"short and quiet, checks off", 0, 0, 50, 1, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.MinSpeechMs, cfg.MinSpeechRMS = tt.minMs, tt.minRMS
+			keeper := &keepingTranscriber{done: make(chan struct{}, 1)}
+			p, err := NewPeer(cfg, Handlers{Transcriber: keeper})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.setConn(newFakeSignaling())
+			s := newTurnSession(t, p, newRecordingTrack())
+			s.sayFrame(squareFrame(tt.amplitude), tt.frames)
+			p.wg.Wait()
+
+			if got := len(keeper.kept) == 1; got != tt.wantTranscribed {
+				t.Errorf("transcribed: %v, want %v", got, tt.wantTranscribed)
+			}
+			m := s.metrics.snapshot()
+			if m.DroppedTooShort != tt.short || m.DroppedTooQuiet != tt.quiet {
+				t.Errorf("dropped %d too short, %d too quiet; want %d, %d", m.DroppedTooShort, m.DroppedTooQuiet, tt.short, tt.quiet)
+			}
+		})
+	}
+}
+
+// With noise_floor_margin set, an utterance must stand out from the room's
+// background by that factor, whatever min_speech_rms allows.
+func TestNoiseFloorThreshold(t *testing.T) {
+	tests := []struct {
+		name            string
+		margin          float64
+		speech          int16
+		wantTranscribed bool
+	}{
+		{"barely over the noise", 2, 1500, false},
+		{"well over the noise", 2, 8000, true},
+		{"no margin", 0, 1500, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.NoiseFloorMargin = tt.margin
+			keeper := &keepingTranscriber{done: make(chan struct{}, 1)}
+			p, err := NewPeer(cfg, Handlers{Transcriber: keeper})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.setConn(newFakeSignaling())
+			s := newTurnSession(t, p, newRecordingTrack())
+
+			noise := squareFrame(1000)
+			s.stateMu.Lock()
+			for range 50 {
+				s.processFrame(noise, false, 0)
+			}
+			for range 10 {
+				s.processFrame(squareFrame(tt.speech), true, 0)
+			}
+			for range cfg.SilenceMs/frameDuration + 1 {
+				s.processFrame(noise, false, 0)
+			}
+			s.stateMu.Unlock()
+			p.wg.Wait()
+
+			if got := len(keeper.kept) == 1; got != tt.wantTranscribed {
+				t.Errorf("transcribed: %v, want %v (noise floor %.0f)", got, tt.wantTranscribed, s.noise.value())
+			}
+		})
+	}
+}
+
+// speakFrames feeds s frames of speech without the silence that would end
+// the utterance.
+func (s *Session) speakFrames(frames int) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	for range frames {
+		s.processFrame(toneFrame(frameSamples), true, 0)
+	}
+}
+
+// With dtmf_flush a key press ends the utterance in progress, once per
+// event however many packets repeat it.
+func TestDTMFFlush(t *testing.T) {
+	for _, flush := range []bool{true, false} {
+		cfg := DefaultConfig()
+		cfg.DTMFFlush = flush
+		keeper := &keepingTranscriber{done: make(chan struct{}, 4)}
+		p, err := NewPeer(cfg, Handlers{Transcriber: keeper})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.setConn(newFakeSignaling())
+		s := newTurnSession(t, p, newRecordingTrack())
+
+		digit5 := []byte{5, 10, 0, 160}
+		digit5End := []byte{5, 0x80 | 10, 1, 64}
+		s.speakFrames(10)
+		s.handleDTMF(8000, digit5)
+		s.handleDTMF(8000, digit5)
+		s.speakFrames(5)
+		s.handleDTMF(8000, digit5End) // the same press, ending
+		s.handleDTMF(9600, digit5)    // a second press
+		s.speakFrames(3)
+		s.handleDTMF(9600, []byte{99, 0, 0, 0}) // not a DTMF event
+		p.wg.Wait()
+
+		var got []int
+		for _, pcm := range keeper.kept {
+			got = append(got, len(pcm)/frameSamples)
+		}
+		var want []int
+		if flush {
+			want = []int{10, 5}
+		}
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("dtmf_flush %v: utterances of %v frames transcribed, want %v", flush, got, want)
+		}
+	}
+}
+
+// pauseAgent hands the test each pause it is told about.
+type pauseAgent struct{ pauses chan time.Duration }
+
+func (pauseAgent) Respond(context.Context, string) (string, error) { return "", nil }
+
+func (a pauseAgent) Paused(_ context.Context, silence time.Duration) {
+	a.pauses <- silence
+}
+
+// A pause of pause_ms mid-utterance is reported to a PauseListener agent,
+// once per silence, while the utterance stays open; the silence_ms timeout
+// still ends it.
+func TestPauseBeforeFlush(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PauseMs, cfg.SilenceMs = 100, 400
+	agent := pauseAgent{pauses: make(chan time.Duration, 4)}
+	keeper := &keepingTranscriber{done: make(chan struct{}, 1)}
+	p, err := NewPeer(cfg, Handlers{Transcriber: keeper, Agent: agent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	s := newTurnSession(t, p, newRecordingTrack())
+	silence := func(frames int) {
+		s.stateMu.Lock()
+		defer s.stateMu.Unlock()
+		for range frames {
+			s.processFrame(make([]int16, frameSamples), false, 0)
+		}
+	}
+	nextPause := func() time.Duration {
+		select {
+		case d := <-agent.pauses:
+			return d
+		case <-time.After(time.Second):
+			t.Fatal("no pause reported")
+			return 0
+		}
+	}
+
+	s.speakFrames(10)
+	silence(6)
+	if d := nextPause(); d != 100*time.Millisecond {
+		t.Errorf("pause of %v reported, want 100ms", d)
+	}
+	silence(3)
+	s.stateMu.Lock()
+	open := s.hasUtterance()
+	s.stateMu.Unlock()
+	if !open || len(keeper.kept) != 0 {
+		t.Fatal("the pause ended the utterance")
+	}
+
+	s.speakFrames(5)
+	silence(cfg.SilenceMs / frameDuration)
+	nextPause()
+	<-keeper.done
+	if got, want := len(keeper.kept[0])/frameSamples, 10+9+5+cfg.SilenceMs/frameDuration; got != want {
+		t.Errorf("utterance of %d frames, want all %d", got, want)
+	}
+	select {
+	case d := <-agent.pauses:
+		t.Errorf("extra pause of %v reported", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// listVAD gives the decisions in order, then silence.
+type listVAD struct{ decisions []bool }
+
+func (v *listVAD) IsSpeech([]int16, int) (bool, error) {
+	if len(v.decisions) == 0 {
+		return false, nil
+	}
+	isSpeech := v.decisions[0]
+	v.decisions = v.decisions[1:]
+	return isSpeech, nil
+}
+
+// Smoothing keeps single-frame VAD dropouts from ending an utterance that
+// one frame of silence would otherwise end.
+func TestVADSmoothingFlicker(t *testing.T) {
+	for _, tt := range []struct {
+		frames     int
+		utterances uint64
+	}{{1, 5}, {3, 1}} {
+		cfg := DefaultConfig()
+		cfg.SilenceMs = frameDuration
+		cfg.VADSmoothingFrames = tt.frames
+		p, err := NewPeer(cfg, Handlers{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := newReadSession(t, p)
+		var decisions []bool
+		for range 5 {
+			decisions = append(decisions, true, true, true, false)
+		}
+		s.vad = &listVAD{decisions: decisions}
+		for i := range len(decisions) + tt.frames {
+			s.handleAudio([]byte{benchOpusTOC[frameSamples]}, uint32(i*frameSamples))
+		}
+		if got := s.metrics.snapshot().UtterancesStarted; got != tt.utterances {
+			t.Errorf("vad_smoothing_frames %d: %d utterances, want %d", tt.frames, got, tt.utterances)
+		}
+	}
+}
+
+// A decoder whose output contradicts the packets is replaced; the track is
+// given up on only after a second of mismatches in a row.
+func TestDecodedSizeMismatch(t *testing.T) {
+	p, err := NewPeer(DefaultConfig(), Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte{benchOpusTOC[frameSamples]}
+	// A decoder stuck at 12 kHz output for 48 kHz packets.
+	stuck := &countingDecoder{pcm: make([]int16, frameSamples/4)}
+
+	s, _ := newReadSession(t, p)
+	s.dec = stuck
+	if !s.handleAudio(payload, 0) {
+		t.Fatal("track given up on after one mismatch")
+	}
+	if s.dec == stuck {
+		t.Fatal("decoder not replaced after a mismatch")
+	}
+	// The fresh decoder agrees with the packets, and its frames go on.
+	if !s.handleAudio(payload, frameSamples) || s.badSizes != 0 {
+		t.Errorf("after the reset: %d bad sizes, want 0", s.badSizes)
+	}
+	if m := s.metrics.snapshot(); m.SpeechFrames+m.SilenceFrames != 1 {
+		t.Errorf("%d frames judged, want only the good one", m.SpeechFrames+m.SilenceFrames)
+	}
+
+	s, _ = newReadSession(t, p)
+	for i := 1; i <= maxBadDecodes; i++ {
+		// However often it is reset, the stream still disagrees.
+		s.dec = stuck
+		if ok := s.handleAudio(payload, uint32(i*frameSamples)); ok != (i < maxBadDecodes) {
+			t.Fatalf("mismatch %d of %d: handleAudio = %v", i, maxBadDecodes, ok)
+		}
+	}
+}
+
+// rampDecoder decodes each packet to as many samples as its TOC says,
+// numbering samples across packets so their order can be checked.
+type rampDecoder struct{ next int }
+
+func (d *rampDecoder) Decode(data []byte, _ int, _ bool) ([]int16, error) {
+	n, err := opusPacketSamples(data, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = rampSample(d.next)
+		d.next++
+	}
+	return pcm, nil
+}
+
+// rampSample is sample i of rampDecoder's output, loud enough to keep.
+func rampSample(i int) int16 { return int16(2000 + i%20000) }
+
+// pcmTranscriber hands the test a copy of every utterance.
+type pcmTranscriber struct{ pcm chan []int16 }
+
+func (p pcmTranscriber) Transcribe(_ context.Context, pcm []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	p.pcm <- slices.Clone(pcm)
+	return Transcription{}, nil
+}
+
+// Packets of any Opus duration are cut into 20ms VAD windows, the part
+// window carried into the next packet, and every sample reaches the
+// utterance in order, the last part window included.
+func TestMixedPacketDurations(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VADSmoothingFrames = 1
+	transcriber := pcmTranscriber{pcm: make(chan []int16, 1)}
+	p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	t.Cleanup(p.wg.Wait)
+	s := newTurnSession(t, p, newRecordingTrack())
+	s.dec = &rampDecoder{}
+	s.vad = &listVAD{decisions: slices.Repeat([]bool{true}, 100)}
+	s.smoother = newVADSmoother(1)
+
+	packets := map[int][]byte{
+		10: {0xf0},    // config 30, one 10ms frame
+		20: {0xf8},    // config 31, one 20ms frame
+		40: {0xf9},    // config 31, two equal frames
+		60: {0xfb, 3}, // config 31, code 3, three frames
+	}
+	var timestamp uint32
+	var total int
+	for _, ms := range []int{10, 20, 40, 60, 10, 10, 20, 60, 40, 10, 10} {
+		if !s.handleAudio(packets[ms], timestamp) {
+			t.Fatalf("%dms packet rejected", ms)
+		}
+		timestamp += uint32(ms * sampleRate / 1000)
+		total += ms * sampleRate / 1000
+	}
+	if judged := s.VAD().SpeechFrames; judged != uint64(total/frameSamples) {
+		t.Errorf("%d windows judged, want %d", judged, total/frameSamples)
+	}
+	s.drainVADBuffer()
+	s.FlushUtterance("end of test")
+
+	select {
+	case pcm := <-transcriber.pcm:
+		want := make([]int16, total)
+		for i := range want {
+			want[i] = rampSample(i)
+		}
+		if !slices.Equal(pcm, want) {
+			t.Errorf("utterance of %d samples isn't the %d decoded, in order", len(pcm), total)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("utterance never transcribed")
+	}
+}
+
+// With coalesce_ms, speech resuming while an ended utterance is held joins
+// it, without the gap; a gap of silence_ms plus coalesce_ms or more
+// doesn't.
+func TestCoalesce(t *testing.T) {
+	// Three 200ms bursts 300ms apart, then 1.2s of silence and another.
+	type run struct{ speech, silence int }
+	pattern := []run{{10, 15}, {10, 15}, {10, 60}, {10, 30}}
+	const burst = 20 * frameSamples // its speech and the silence that ended it
+	for _, tt := range []struct {
+		coalesceMs int
+		want       []int // sorted utterance lengths
+	}{
+		{0, []int{burst, burst, burst, burst}},
+		{200, []int{burst, 3 * burst}},
+		{100, []int{burst, burst, burst, burst}},
+	} {
+		cfg := DefaultConfig()
+		cfg.CoalesceMs = tt.coalesceMs
+		transcriber := pcmTranscriber{pcm: make(chan []int16, len(pattern))}
+		p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.setConn(newFakeSignaling())
+		s := newTurnSession(t, p, newRecordingTrack())
+		s.stateMu.Lock()
+		for i, r := range pattern {
+			// Each burst distinct, so none is taken for a repeat.
+			speech := squareFrame(int16(4000 + 1000*i))
+			for range r.speech {
+				s.processFrame(speech, true, 0)
+			}
+			for range r.silence {
+				s.processFrame(make([]int16, frameSamples), false, 0)
+			}
+		}
+		s.stateMu.Unlock()
+		p.wg.Wait()
+
+		var got []int
+		for len(transcriber.pcm) > 0 {
+			got = append(got, len(<-transcriber.pcm))
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("coalesce_ms %d: utterances of %v samples, want %v", tt.coalesceMs, got, tt.want)
+		}
+	}
+}
+
+// A call is hung up once its RTP stops, and not while it keeps arriving.
+func TestInactivityHangUp(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.InactivityTimeoutMs = 150
+	p, _ := newTestPeer(t, cfg)
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := p.session("iphone-1")
+
+	for seq := range uint16(20) {
+		s.inbound.update(seq, uint32(seq)*frameSamples, sampleRate, time.Now())
+		time.Sleep(frameDuration * time.Millisecond)
+	}
+	if _, ok := p.session("iphone-1"); !ok {
+		t.Fatal("call hung up while its RTP was arriving")
+	}
+
+	waitDone(t, s.done, time.Second, "call with no RTP for the timeout hung up")
+	if _, ok := p.session("iphone-1"); ok {
+		t.Error("hung-up call still registered")
+	}
+}
+
+// For vad_warmup_ms of media time from the call's first audio, windows are
+// decoded but never judged; the first window after it can start speech.
+func TestVADWarmup(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VADWarmupMs = 300
+	cfg.VADSmoothingFrames = 1
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, dec := newReadSession(t, p)
+	vad := &listVAD{decisions: []bool{true}}
+	s.vad = vad
+	// Starting off zero, as RTP timestamps do.
+	const base = 123456
+	for i := range 15 {
+		s.handleAudio(opusPacket(uint16(i)).Payload, base+uint32(i*frameSamples))
+	}
+	if n := len(dec.decoded()); n != 15 {
+		t.Errorf("%d of 15 warm-up packets decoded", n)
+	}
+	if len(vad.decisions) != 1 || s.VAD() != (VADCounters{}) {
+		t.Fatalf("warm-up audio reached VAD: counters %+v", s.VAD())
+	}
+
+	s.handleAudio(opusPacket(15).Payload, base+15*frameSamples)
+	if got := s.VAD().UtterancesStarted; got != 1 {
+		t.Fatalf("%d utterances started after the warm-up, want 1", got)
+	}
+	s.stateMu.Lock()
+	timeline := s.timeline.snapshot()
+	s.stateMu.Unlock()
+	if len(timeline) != 1 || timeline[0].StartMs != 300 {
+		t.Errorf("timeline %v, want speech starting at 300ms", timeline)
+	}
+}
+
+// With vad_passthrough, all decoded audio goes to the transcriber in
+// passthrough_chunk_ms chunks without VAD; a flush sends the rest.
+func TestVADPassthrough(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VADPassthrough = true
+	transcriber := lengthTranscriber{lengths: make(chan int, 2)}
+	p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newReadSession(t, p)
+	vad := &listVAD{decisions: []bool{true}}
+	s.vad = vad
+	for seq := range uint16(60) {
+		s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+	}
+	if !s.FlushUtterance("test") {
+		t.Error("no chunk in progress to flush")
+	}
+	p.wg.Wait()
+	close(transcriber.lengths)
+
+	var got []int
+	for n := range transcriber.lengths {
+		got = append(got, n)
+	}
+	slices.Sort(got)
+	if want := []int{9600, 48000}; !slices.Equal(got, want) {
+		t.Errorf("transcribed chunks of %v samples, want %v", got, want)
+	}
+	if len(vad.decisions) != 1 {
+		t.Error("VAD consulted in passthrough")
+	}
+}
+
+// loudTranscriber hears words only in audio that isn't silent.
+type loudTranscriber struct{}
+
+func (loudTranscriber) Transcribe(_ context.Context, pcm []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	if rms(pcm) == 0 {
+		return Transcription{}, nil
+	}
+	return Transcription{Text: "hello"}, nil
+}
+
+// A passthrough chunk interrupts the reply being spoken only once it
+// transcribes to text.
+func TestVADPassthroughPreempts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VADPassthrough = true
+	cfg.PassthroughChunkMs = 100
+	p, err := NewPeer(cfg, Handlers{Transcriber: loudTranscriber{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	s, dec := newReadSession(t, p)
+	reply, cancel := context.WithCancel(context.Background())
+	s.cancelTurn = cancel
+
+	for seq := range uint16(5) {
+		s.handleAudio(opusPacket(seq).Payload, uint32(seq)*frameSamples)
+	}
+	p.wg.Wait()
+	if reply.Err() != nil {
+		t.Fatal("a silent chunk interrupted the reply")
+	}
+
+	dec.pcm = toneFrame(frameSamples)
+	for seq := range uint16(5) {
+		s.handleAudio(opusPacket(5+seq).Payload, uint32(5+seq)*frameSamples)
+	}
+	p.wg.Wait()
+	if reply.Err() == nil {
+		t.Error("a chunk with words left the reply running")
+	}
+}
+
+// With rtp_read_timeout_ms, a track that stops delivering hangs the call
+// up from the read loop; one that keeps delivering doesn't.
+func TestFrozenTrackHangUp(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RTPReadTimeoutMs = 100
+	cfg.InactivityTimeoutMs = 0
+	p, _ := newTestPeer(t, cfg)
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	if err := p.handleOffer(offerMessage("iphone-1", newOffer(t))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := p.session("iphone-1")
+	track := newFakeTrack()
+	done := runReadLoop(s, track)
+
+	for seq := range uint16(15) {
+		track.packet(seq)
+		time.Sleep(frameDuration * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("read loop ended while audio was arriving")
+	default:
+	}
+	if _, ok := p.session("iphone-1"); !ok {
+		t.Fatal("call hung up while audio was arriving")
+	}
+
+	waitDone(t, done, time.Second, "read loop on a frozen track")
+	waitDone(t, s.done, time.Second, "call on a frozen track hung up")
+	if _, ok := p.session("iphone-1"); ok {
+		t.Error("hung-up call still registered")
+	}
+	if state := s.pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("peer connection %s, want closed", state)
+	}
+}
+
+// A packet decoding to no samples counts as silence for as long as it
+// lasts, by its TOC or else one frame, so the caller's pause still ends
+// the utterance on time; nothing of it is buffered, and it isn't a bad
+// decode. Muted, it counts for nothing.
+func TestEmptyDecode(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		samples uint32 // the time it takes
+		ending  int    // packets of it ending the utterance
+	}{
+		{"20ms", []byte{benchOpusTOC[frameSamples], 0}, frameSamples, 10},
+		{"60ms", []byte{benchOpusTOC[3*frameSamples], 3}, 3 * frameSamples, 4},
+		{"no TOC", []byte{}, frameSamples, 10},
+	} {
+		cfg := DefaultConfig()
+		cfg.VADSmoothingFrames = 1
+		transcriber := lengthTranscriber{lengths: make(chan int, 1)}
+		p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.setConn(newFakeSignaling())
+		s, dec := newReadSession(t, p)
+		s.vad = &listVAD{decisions: slices.Repeat([]bool{true}, 30)}
+		dec.pcm = nil
+		s.SetMuted(true)
+		for range 20 {
+			s.handleAudio(tt.payload, 0)
+		}
+		s.SetMuted(false)
+		if got := s.VAD(); got != (VADCounters{}) {
+			t.Errorf("%s: muted empty packets counted: %+v", tt.name, got)
+		}
+
+		dec.pcm = toneFrame(frameSamples)
+		ts := uint32(0)
+		for seq := range uint16(30) {
+			s.handleAudio(opusPacket(seq).Payload, ts)
+			ts += frameSamples
+		}
+		dec.pcm = nil
+		for range tt.ending - 1 {
+			s.handleAudio(tt.payload, ts)
+			ts += tt.samples
+		}
+		select {
+		case n := <-transcriber.lengths:
+			t.Fatalf("%s: utterance of %d samples ended a packet early", tt.name, n)
+		case <-time.After(20 * time.Millisecond):
+		}
+		s.handleAudio(tt.payload, ts)
+		select {
+		case n := <-transcriber.lengths:
+			if n != 30*frameSamples {
+				t.Errorf("%s: %d samples transcribed, want the 600ms of speech alone", tt.name, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: utterance didn't end after %d empty packets", tt.name, tt.ending)
+		}
+		if s.badSizes != 0 {
+			t.Errorf("%s: empty decodes counted as %d bad sizes", tt.name, s.badSizes)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"time"
+)
+
+// ShutdownTimeout bounds how long Run waits, once its context is done, for
+// calls to wind down: transcripts in flight to be relayed, recordings
+// saved.
+const ShutdownTimeout = 10 * time.Second
+
+// spawn runs fn on a goroutine that shutdown waits for. Every goroutine a
+// call runs is started this way. It must be called from the run loop or
+// from a goroutine already spawned, so the count can't restart from zero
+// while shutdown is waiting; pion's callbacks use spawnCallback instead.
+func (p *Peer) spawn(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		fn()
+	}()
+}
+
+// spawnCallback is spawn for pion's callbacks, such as OnTrack, which run
+// on pion's goroutines and can fire at any time, including while shutdown
+// is waiting. Once shutdown has started it drops fn, as the call is being
+// hung up anyway. Checking under sessionsMu, which shutdown holds to close
+// p.closing, orders every Add it makes before shutdown's Wait.
+func (p *Peer) spawnCallback(fn func()) {
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+	select {
+	case <-p.closing:
+		return
+	default:
+	}
+	p.spawn(fn)
+}
+
+// shutdown hangs up every live call and waits up to timeout for the
+// goroutines calls started to exit, reporting whether they all did. Call
+// it once run has returned, so no new calls arrive.
+func (p *Peer) shutdown(timeout time.Duration) bool {
+	p.sessionsMu.Lock()
+	// Closed under the lock, so addSession can't register a call after
+	// the list below is taken.
+	close(p.closing)
+	sessions := make([]*Session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.sessionsMu.Unlock()
+	for _, s := range sessions {
+		s.hangUp()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
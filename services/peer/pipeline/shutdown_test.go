@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"go.uber.org/goleak"
+)
+
+// TestShutdownLeavesNoGoroutines runs a peer with a live call from a pion
+// caller on loopback, cancels it and checks that every goroutine the peer
+// and the call started has exited.
+func TestShutdownLeavesNoGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	cfg := DefaultConfig()
+	cfg.TrickleICE = false
+	ws := newFakeSignaling()
+	p, err := NewPeer(cfg, Handlers{Dial: func(string) (SignalConn, error) { return ws, nil }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+	if join := ws.next(t, time.Second); join.Type != "join" {
+		t.Fatalf("peer opened with %+v, want a join", join)
+	}
+
+	caller, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "caller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := caller.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	caller.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	offer, err := caller.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(caller)
+	if err := caller.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	ws.in <- offerMessage("iphone-1", caller.LocalDescription().SDP)
+
+	answer := ws.next(t, iceGatherTimeout+time.Second)
+	sdp, _ := answer.Data.(map[string]interface{})["sdp"].(string)
+	if err := caller.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("caller never connected")
+	}
+	// A 20ms CELT frame of silence, for long enough that the peer's
+	// OnTrack fires and the call's read loops start.
+	frame := []byte{0xf8, 0xff, 0xfe}
+	for range 25 {
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: frameDuration * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(frameDuration * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Errorf("Run = %v, want nil after cancelling", err)
+		}
+	case <-time.After(ShutdownTimeout + time.Second):
+		t.Fatal("Run didn't return after cancelling")
+	}
+	caller.Close()
+}
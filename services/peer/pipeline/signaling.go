@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	reconnectBackoffMin = 500 * time.Millisecond
+	reconnectBackoffMax = 30 * time.Second
+	// signalingDialTimeout bounds one dial, so an unreachable server
+	// doesn't hold up failing over to the next.
+	signalingDialTimeout = 10 * time.Second
+	// defaultSignalingBufferSize holds a browser's audio offer, usually
+	// 3-6 KB with its candidates, in one read; gorilla's default is 4 KB.
+	defaultSignalingBufferSize = 8 << 10
+)
+
+// SignalConn is the part of a WebSocket connection the peer uses, so a fake
+// can stand in for *websocket.Conn in tests; see Handlers.Dial.
+type SignalConn interface {
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+// dialSignaling connects to the signaling server, asking for the protocol
+// version we speak.
+func dialSignaling(rawURL string, cfg Config) (SignalConn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{signalingProtocol}
+	dialer.HandshakeTimeout = signalingDialTimeout
+	dialer.ReadBufferSize = cfg.SignalingReadBufferSize
+	dialer.WriteBufferSize = cfg.SignalingWriteBufferSize
+	ws, _, err := dialer.Dial(rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != signalingProtocol {
+		log.Printf("Signaling server didn't negotiate %s; assuming it is compatible", signalingProtocol)
+	}
+	return ws, nil
+}
+
+// dialFirst tries each of the signaling URLs once, starting at index start
+// and wrapping around, and returns the first connection made with the
+// index of its URL.
+func (p *Peer) dialFirst(start int) (SignalConn, int, error) {
+	urls := p.cfg.signalingURLs()
+	var errs []error
+	for i := range urls {
+		n := (start + i) % len(urls)
+		ws, err := p.dial(urls[n])
+		if err == nil {
+			return ws, n, nil
+		}
+		if len(urls) > 1 {
+			log.Printf("Signaling server %s unreachable: %v", urls[n], err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", urls[n], err))
+	}
+	return nil, start, errors.Join(errs...)
+}
+
+// setConn makes ws the signaling connection every session sends through,
+// closing the one it replaces.
+func (p *Peer) setConn(ws SignalConn) {
+	p.wsMu.Lock()
+	old := p.ws
+	p.ws = ws
+	p.wsMu.Unlock()
+	if old != nil && old != ws {
+		old.Close()
+	}
+}
+
+// run joins the signaling server and dispatches messages until the
+// connection fails. With Config.SignalingReconnect it then redials and
+// rejoins, backing off between attempts, and carries on. Live sessions
+// keep their PeerConnections throughout and send through the new
+// connection once it is up, so trickle ICE and transcripts resume.
+//
+// Cancelling ctx closes the connection and run returns nil, leaving the
+// live sessions for shutdown.
+func (p *Peer) run(ctx context.Context) error {
+	defer context.AfterFunc(ctx, func() { p.setConn(nil) })()
+	for {
+		err := p.serve()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !p.cfg.SignalingReconnect {
+			return err
+		}
+		log.Println("Signaling connection lost, reconnecting:", err)
+		p.reconnect(ctx)
+		if ctx.Err() != nil {
+			// A connection made as ctx was cancelled is ours to close.
+			p.setConn(nil)
+			return nil
+		}
+	}
+}
+
+// reconnect dials until a signaling server answers again. Each attempt
+// starts with the server we lost and fails over through the rest of
+// Config.SignalingURLs. It gives up when ctx is cancelled.
+func (p *Peer) reconnect(ctx context.Context) {
+	backoff := reconnectBackoffMin
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		ws, n, err := p.dialFirst(p.signalURL)
+		if err == nil {
+			p.signalURL = n
+			p.setConn(ws)
+			log.Printf("Reconnected to signaling at %s; live sessions: %d", p.cfg.signalingURLs()[n], p.sessionCount())
+			return
+		}
+		log.Printf("Signaling reconnect failed, retrying in %v: %v", backoff, err)
+		backoff = min(backoff*2, reconnectBackoffMax)
+	}
+}
+
+// serve joins as a backend with our peer ID on the current signaling
+// connection and handles incoming messages until reading fails.
+func (p *Peer) serve() error {
+	if err := p.send(SignalMessage{Type: "join", ID: p.cfg.PeerID, Role: "backend"}); err != nil {
+		return fmt.Errorf("join: %w", err)
+	}
+	p.wsMu.Lock()
+	ws := p.ws
+	p.wsMu.Unlock()
+	if ws == nil {
+		return errors.New("no signaling connection")
+	}
+
+	for {
+		var msg SignalMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("read signal: %w", err)
+		}
+		switch msg.Type {
+		case "signal":
+			p.queueOffer(msg)
+		case "control":
+			if err := p.handleControl(msg); err != nil {
+				log.Println("Control from", msg.From, "rejected:", err)
+			}
+		case "media_config":
+			if err := p.handleMediaConfig(msg); err != nil {
+				log.Println("Media config from", msg.From, "rejected:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBacklog is how many transcripts may queue for one slow SSE
+	// client; beyond it its events are dropped rather than waited for.
+	eventBacklog = 32
+	// eventKeepalive spaces comment lines on an idle stream, so proxies
+	// keep it open and a vanished client is noticed.
+	eventKeepalive = 15 * time.Second
+)
+
+// eventStream is a TranscriptSink that serves transcripts as Server-Sent
+// Events at /events/{peerId}, for browsers that would rather not open a
+// second WebSocket. Each connected client gets the transcripts of the call
+// it names, from when it connected; nothing is replayed.
+type eventStream struct {
+	mu      sync.Mutex
+	clients map[string]map[*eventClient]struct{} // by caller peer ID
+}
+
+// eventClient is one SSE connection's queue.
+type eventClient struct {
+	events  chan TranscriptEvent
+	dropped int // guarded by eventStream.mu
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{clients: make(map[string]map[*eventClient]struct{})}
+}
+
+// Publish queues ev for every client watching its caller, without blocking
+// on any of them.
+func (es *eventStream) Publish(_ context.Context, ev TranscriptEvent) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for c := range es.clients[ev.PeerID] {
+		select {
+		case c.events <- ev:
+		default:
+			if c.dropped%eventBacklog == 0 {
+				log.Printf("SSE client for %s is behind; dropping transcripts (%d so far)", ev.PeerID, c.dropped+1)
+			}
+			c.dropped++
+		}
+	}
+	return nil
+}
+
+func (es *eventStream) subscribe(peerID string) *eventClient {
+	c := &eventClient{events: make(chan TranscriptEvent, eventBacklog)}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.clients[peerID] == nil {
+		es.clients[peerID] = make(map[*eventClient]struct{})
+	}
+	es.clients[peerID][c] = struct{}{}
+	return c
+}
+
+func (es *eventStream) unsubscribe(peerID string, c *eventClient) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	delete(es.clients[peerID], c)
+	if len(es.clients[peerID]) == 0 {
+		delete(es.clients, peerID)
+	}
+}
+
+// ServeHTTP streams transcripts for the {peerId} in the path, one
+// "transcript" event of TranscriptEvent JSON each, until the client goes
+// away.
+func (es *eventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("peerId")
+	if peerID == "" {
+		http.Error(w, "missing peer ID", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c := es.subscribe(peerID)
+	defer es.unsubscribe(peerID, c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev := <-c.events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Println("Encode SSE transcript failed:", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: transcript\nid: %s\ndata: %s\n\n", ev.UtteranceID, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribers is how many clients are watching peerID.
+func (es *eventStream) subscribers(peerID string) int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return len(es.clients[peerID])
+}
+
+// waitSubscribers fails t unless peerID has n subscribers within a second.
+func waitSubscribers(t *testing.T, es *eventStream, peerID string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); es.subscribers(peerID) != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d subscribers, want %d", peerID, es.subscribers(peerID), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A client of /events/{peerId} gets that caller's transcripts in order as
+// SSE transcript events, and no other caller's.
+func TestEventStream(t *testing.T) {
+	es := newEventStream()
+	mux := http.NewServeMux()
+	mux.Handle("GET /events/{peerId}", es)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events/alice", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q, want text/event-stream", ct)
+	}
+	waitSubscribers(t, es, "alice", 1)
+
+	for _, ev := range []TranscriptEvent{
+		{PeerID: "alice", UtteranceID: "a.1", Text: "hello"},
+		{PeerID: "bob", UtteranceID: "b.1", Text: "not yours"},
+		{PeerID: "alice", UtteranceID: "a.2", Text: "goodbye"},
+	} {
+		es.Publish(context.Background(), ev)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for _, want := range []TranscriptEvent{{UtteranceID: "a.1", Text: "hello"}, {UtteranceID: "a.2", Text: "goodbye"}} {
+		var event []string
+		for lines.Scan() && lines.Text() != "" {
+			event = append(event, lines.Text())
+		}
+		if len(event) != 3 || event[0] != "event: transcript" || event[1] != "id: "+want.UtteranceID || !strings.HasPrefix(event[2], "data: ") {
+			t.Fatalf("got event %q, want transcript %s", event, want.UtteranceID)
+		}
+		var got TranscriptEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event[2], "data: ")), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.PeerID != "alice" || got.UtteranceID != want.UtteranceID || got.Text != want.Text {
+			t.Errorf("got %+v, want alice's %+v", got, want)
+		}
+	}
+
+	cancel()
+	waitSubscribers(t, es, "alice", 0)
+
+	resp, err = http.Get(srv.URL + "/events/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/events/ with no peer ID: %s, want 404", resp.Status)
+	}
+}
+
+// A stream ends when its request's context does.
+func TestEventStreamEndsOnCancel(t *testing.T) {
+	es := newEventStream()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequestWithContext(ctx, "GET", "/events/alice", nil)
+	req.SetPathValue("peerId", "alice")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		es.ServeHTTP(rec, req)
+	}()
+	waitSubscribers(t, es, "alice", 1)
+	cancel()
+	waitDone(t, done, time.Second, "stream ended with its request")
+	if es.subscribers("alice") != 0 {
+		t.Error("ended stream still subscribed")
+	}
+
+	rec = httptest.NewRecorder()
+	es.ServeHTTP(rec, httptest.NewRequest("GET", "/events/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("no peer ID: %d, want 400", rec.Code)
+	}
+}
+
+// Publishing never waits on a client that isn't reading; what doesn't fit
+// in its queue is dropped.
+func TestEventStreamSlowClient(t *testing.T) {
+	es := newEventStream()
+	c := es.subscribe("alice")
+	for range 100 {
+		es.Publish(context.Background(), TranscriptEvent{PeerID: "alice"})
+	}
+	if len(c.events) != eventBacklog || c.dropped != 100-eventBacklog {
+		t.Errorf("%d queued and %d dropped, want %d and %d", len(c.events), c.dropped, eventBacklog, 100-eventBacklog)
+	}
+	es.unsubscribe("alice", c)
+	if _, ok := es.clients["alice"]; ok {
+		t.Error("caller with no subscribers left listed")
+	}
+}
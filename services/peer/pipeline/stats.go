@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// SessionStats is a snapshot of one call's metrics, as listed by /stats.
+type SessionStats struct {
+	RemoteID string `json:"remoteId"`
+	TraceID  string `json:"traceId"`
+	// Packets counts the inbound RTP packets received, duplicates aside.
+	Packets uint64        `json:"packets"`
+	Quality QualityReport `json:"quality"`
+	VAD     VADCounters   `json:"vad"`
+	// SpeechRatio is the share of VAD windows judged speech, 0 before any.
+	SpeechRatio float64 `json:"speechRatio"`
+	// Timeline is the caller's speech so far; see SpeechInterval.
+	Timeline []SpeechInterval `json:"timeline"`
+	// ClippingRatio is the share of decoded samples pinned at full scale,
+	// a sign of an overdriven mic.
+	ClippingRatio float64 `json:"clippingRatio"`
+}
+
+// Stats returns a copy of the call's current metrics. It is safe to call
+// from any goroutine.
+func (s *Session) Stats() SessionStats {
+	vad := s.VAD()
+	var ratio float64
+	if frames := vad.SpeechFrames + vad.SilenceFrames; frames > 0 {
+		ratio = float64(vad.SpeechFrames) / float64(frames)
+	}
+	stats := SessionStats{
+		RemoteID:    s.RemoteID,
+		TraceID:     s.TraceID,
+		Packets:     s.inbound.packets(),
+		Quality:     s.Quality(),
+		VAD:         vad,
+		SpeechRatio: ratio,
+		Timeline:    s.SpeechTimeline(),
+	}
+	stats.ClippingRatio = s.clipping.ratio()
+	return stats
+}
+
+// StatsHandler serves /stats, /metrics and the transcript event streams at
+// /events/{peerId}. The event streams are a transcript sink, so get the
+// handler before calling Run.
+func (p *Peer) StatsHandler() http.Handler {
+	events := newEventStream()
+	p.AddTranscriptSink(events)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", p.handleStats)
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.Handle("GET /events/{peerId}", events)
+	return mux
+}
+
+// handleStats serves the inbound quality of every live call as JSON,
+// sorted by remote peer ID.
+func (p *Peer) handleStats(w http.ResponseWriter, r *http.Request) {
+	p.sessionsMu.Lock()
+	sessions := make([]*Session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.sessionsMu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].RemoteID < sessions[j].RemoteID })
+
+	list := make([]SessionStats, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s.Stats())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// /stats lists every live call, sorted by caller, with its inbound quality.
+func TestHandleStats(t *testing.T) {
+	p, _ := newTestPeer(t, DefaultConfig())
+	t.Cleanup(func() { p.shutdown(time.Second) })
+	for _, id := range []string{"iphone-2", "iphone-1"} {
+		if err := p.handleOffer(offerMessage(id, newOffer(t))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, _ := p.session("iphone-1")
+	start := time.Now()
+	for seq := range uint16(10) {
+		s.inbound.update(seq, uint32(seq)*frameSamples, sampleRate, start.Add(time.Duration(seq)*frameDuration*time.Millisecond))
+	}
+
+	s.stateMu.Lock()
+	s.timeline.start(100)
+	s.timeline.speech(400)
+	s.stateMu.Unlock()
+
+	rec := httptest.NewRecorder()
+	p.handleStats(rec, httptest.NewRequest("GET", "/stats", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var list []SessionStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].RemoteID != "iphone-1" || list[1].RemoteID != "iphone-2" {
+		t.Fatalf("got %+v, want iphone-1 then iphone-2", list)
+	}
+	if list[0].TraceID != s.TraceID || list[0].Packets != 10 || list[1].Packets != 0 {
+		t.Errorf("trace %q and %d, %d packets; want %q and 10, 0", list[0].TraceID, list[0].Packets, list[1].Packets, s.TraceID)
+	}
+	if got := list[0].Quality.InterarrivalMs.String(); got != "≤20ms:9" {
+		t.Errorf("iphone-1 interarrival %s, want 9 gaps of 20ms", got)
+	}
+	if got := list[0].Timeline; len(got) != 1 || got[0] != (SpeechInterval{StartMs: 100, EndMs: 400}) {
+		t.Errorf("iphone-1 timeline %v, want [{100 400}]", got)
+	}
+}
+
+// Stats can be read while the read loop runs, and adds up what it did.
+func TestSessionStats(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VADSmoothingFrames = 1
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newReadSession(t, p)
+	if got := s.Stats(); got.Packets != 0 || got.SpeechRatio != 0 {
+		t.Errorf("before any audio: %d packets, speech ratio %v", got.Packets, got.SpeechRatio)
+	}
+	vad := &listVAD{}
+	for i := range 400 {
+		vad.decisions = append(vad.decisions, i%2 == 0)
+	}
+	s.vad = vad
+
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		start := time.Now()
+		for seq := range uint16(400) {
+			ts := uint32(seq) * frameSamples
+			s.inbound.update(seq, ts, sampleRate, start.Add(time.Duration(seq)*frameDuration*time.Millisecond))
+			s.handleAudio(opusPacket(seq).Payload, ts)
+		}
+	}()
+	for polling := true; polling; {
+		select {
+		case <-fed:
+			polling = false
+		default:
+			s.Stats()
+		}
+	}
+
+	got := s.Stats()
+	if got.RemoteID != s.RemoteID || got.TraceID != s.TraceID || got.Packets != 400 {
+		t.Errorf("stats for %q, %q with %d packets; want %q, %q with 400", got.RemoteID, got.TraceID, got.Packets, s.RemoteID, s.TraceID)
+	}
+	if windows := got.VAD.SpeechFrames + got.VAD.SilenceFrames; windows != 400 || got.SpeechRatio != 0.5 {
+		t.Errorf("%d VAD windows, speech ratio %v; want 400 and 0.5", windows, got.SpeechRatio)
+	}
+}
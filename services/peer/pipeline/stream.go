@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"context"
+	"hash"
+	"hash/fnv"
+	"log"
+	"math"
+	"slices"
+)
+
+// streamQueueChunks is how many chunks can wait for a slow streaming
+// transcriber. Beyond that the utterance buffers as usual until it catches
+// up, so the read loop never blocks on it.
+const streamQueueChunks = 8
+
+// utteranceStream is an utterance being streamed to a StreamingTranscriber
+// while the caller is still speaking. The read loop sends it chunks; its
+// turn's goroutine feeds them to the transcriber.
+type utteranceStream struct {
+	ctx    context.Context // the turn's
+	cancel context.CancelFunc
+	// abandon cancels the transcriber's context, for an utterance that
+	// won't be transcribed after all.
+	transcribeCtx context.Context
+	abandon       context.CancelFunc
+
+	chunks chan []int16
+	tail   []int16 // the rest of the utterance, set before chunks is closed
+
+	// Totals over the audio sent so far, for the checks a buffered
+	// utterance gets when it ends; guarded by the session's stateMu.
+	samples    int
+	sumSquares float64
+	hash       hash.Hash64
+}
+
+// send queues pcm for the transcriber, reporting whether there was room.
+func (us *utteranceStream) send(pcm []int16) bool {
+	select {
+	case us.chunks <- pcm:
+		us.add(pcm)
+		return true
+	default:
+		return false
+	}
+}
+
+// add counts pcm into the utterance's totals.
+func (us *utteranceStream) add(pcm []int16) {
+	us.samples += len(pcm)
+	us.sumSquares += sumSquares(pcm)
+	hashSamples(us.hash, pcm)
+}
+
+// finish sends tail, the end of the utterance, and closes the stream.
+func (us *utteranceStream) finish(tail []int16) {
+	us.tail = tail
+	close(us.chunks)
+}
+
+// abort abandons the utterance, cancelling its transcription and turn.
+func (us *utteranceStream) abort() {
+	us.abandon()
+	us.cancel()
+	close(us.chunks)
+}
+
+// streams reports whether long utterances are streamed to the transcriber.
+// Passthrough chunks are short already, and batching needs whole
+// utterances.
+func (s *Session) streams() bool {
+	_, ok := s.peer.transcriber.(StreamingTranscriber)
+	cfg := s.peer.cfg
+	return ok && cfg.StreamChunkMs > 0 && !cfg.VADPassthrough && cfg.MinTranscribeMs == 0
+}
+
+// streamUtterance moves the utterance in progress on to a streaming
+// transcriber in chunks of Config.StreamChunkMs, opening the stream once
+// there is a whole chunk. Callers hold stateMu.
+func (s *Session) streamUtterance() {
+	chunk := s.peer.cfg.StreamChunkMs * sampleRate / 1000
+	buf := *s.utterance
+	if len(buf) < chunk || !s.streams() {
+		return
+	}
+	if s.stream == nil {
+		s.openStream()
+	}
+	off := 0
+	for ; len(buf)-off >= chunk; off += chunk {
+		if !s.stream.send(slices.Clone(buf[off : off+chunk])) {
+			break
+		}
+	}
+	*s.utterance = buf[:copy(buf, buf[off:])]
+}
+
+// openStream starts the turn for the utterance in progress, streaming it.
+// Callers hold stateMu.
+func (s *Session) openStream() {
+	id := utteranceID(s.TraceID, s.utterances+1)
+	ctx, cancel := context.WithCancel(withTrace(context.Background(), s.TraceID, id))
+	// Like a buffered utterance's, transcription outlives a barge-in.
+	transcribeCtx, abandon := context.WithCancel(context.WithoutCancel(ctx))
+	us := &utteranceStream{
+		ctx:           ctx,
+		cancel:        cancel,
+		transcribeCtx: transcribeCtx,
+		abandon:       abandon,
+		chunks:        make(chan []int16, streamQueueChunks),
+		hash:          fnv.New64a(),
+	}
+	s.mu.Lock()
+	opts := TranscribeOptions{Language: s.language}
+	s.mu.Unlock()
+	s.stream = us
+	log.Printf("%s🌊 Streaming utterance to the transcriber", traceTag(ctx))
+	s.peer.spawn(func() { s.runStreamTurn(us, opts) })
+}
+
+// endStream ends the streamed utterance with tail, its last samples. An
+// utterance that fails the checks a buffered one gets is abandoned instead.
+// Callers hold stateMu.
+func (s *Session) endStream(tail []int16) {
+	us := s.stream
+	s.stream = nil
+	us.add(tail)
+	log.Printf("⏹ Speech ended (%d ms, streamed)", us.samples*1000/sampleRate)
+	level := math.Sqrt(us.sumSquares / float64(us.samples))
+	if !s.worthTranscribing(level) || s.duplicateUtterance(us.hash.Sum64(), us.samples) {
+		us.abort()
+		return
+	}
+	s.utterances++
+	s.count(utterancesFlushed)
+	s.preempt(us.cancel)
+	us.finish(tail)
+}
+
+// runStreamTurn is runTurn for a streamed utterance: it feeds the chunks
+// to the transcriber as they come, then carries on with the transcript.
+func (s *Session) runStreamTurn(us *utteranceStream, opts TranscribeOptions) {
+	tag := traceTag(us.ctx)
+	release := s.peer.acquireTranscription(tag)
+	result, samples, err := s.transcribeStream(us, opts)
+	release()
+	if us.transcribeCtx.Err() != nil {
+		return // abandoned
+	}
+	if err != nil {
+		log.Println(tag+"Transcribe error:", err)
+		return
+	}
+	s.noteLanguage(us.ctx, result.Language)
+	s.finishTurn(us.ctx, us.cancel, result.Text, result.Words, samples)
+}
+
+// transcribeStream streams us to the transcriber until it ends, returning
+// the transcription and the utterance's length.
+func (s *Session) transcribeStream(us *utteranceStream, opts TranscribeOptions) (result Transcription, samples int, err error) {
+	st, err := s.peer.transcriber.(StreamingTranscriber).TranscribeStream(us.transcribeCtx, sampleRate, opts)
+	if err != nil {
+		return Transcription{}, 0, err
+	}
+	for pcm := range us.chunks {
+		samples += len(pcm)
+		if err == nil {
+			err = st.Send(pcm)
+		}
+	}
+	// What was left buffered goes in the same chunks.
+	chunk := s.peer.cfg.StreamChunkMs * sampleRate / 1000
+	for pcm := range slices.Chunk(us.tail, chunk) {
+		samples += len(pcm)
+		if err == nil {
+			err = st.Send(pcm)
+		}
+	}
+	result, closeErr := st.Close()
+	if err != nil {
+		return Transcription{}, samples, err
+	}
+	return result, samples, closeErr
+}
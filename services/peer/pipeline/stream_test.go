@@ -0,0 +1,219 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// streamTranscriber streams utterances into fakeStreams, handing the test
+// each one as it opens, and the length of any utterance sent whole. With
+// opening set, a stream doesn't open until it is closed.
+type streamTranscriber struct {
+	streams chan *fakeStream
+	whole   chan int
+	opening chan struct{}
+}
+
+func newStreamTranscriber() streamTranscriber {
+	return streamTranscriber{streams: make(chan *fakeStream, 4), whole: make(chan int, 4)}
+}
+
+func (st streamTranscriber) Transcribe(_ context.Context, pcm []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	st.whole <- len(pcm)
+	return Transcription{Text: "whole"}, nil
+}
+
+func (st streamTranscriber) TranscribeStream(ctx context.Context, _ int, _ TranscribeOptions) (TranscribeStream, error) {
+	if st.opening != nil {
+		<-st.opening
+	}
+	fs := &fakeStream{ctx: ctx, closed: make(chan struct{})}
+	st.streams <- fs
+	return fs, nil
+}
+
+// nextStream returns the next stream opened, or fails t if none is within
+// a second.
+func (st streamTranscriber) nextStream(t *testing.T) *fakeStream {
+	t.Helper()
+	select {
+	case fs := <-st.streams:
+		<-fs.closed
+		return fs
+	case <-time.After(time.Second):
+		t.Fatal("no stream opened")
+		return nil
+	}
+}
+
+// fakeStream records the length of each chunk sent, and whether the
+// utterance had been abandoned by the time it was closed.
+type fakeStream struct {
+	ctx       context.Context
+	chunks    []int
+	abandoned bool
+	closed    chan struct{}
+}
+
+func (fs *fakeStream) Send(pcm []int16) error {
+	fs.chunks = append(fs.chunks, len(pcm))
+	return nil
+}
+
+func (fs *fakeStream) Close() (Transcription, error) {
+	fs.abandoned = fs.ctx.Err() != nil
+	close(fs.closed)
+	return Transcription{Text: "streamed"}, nil
+}
+
+func newStreamSession(t *testing.T, cfg Config, transcriber streamTranscriber) (*Session, *fakeSignaling) {
+	p, err := NewPeer(cfg, Handlers{Transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newFakeSignaling()
+	p.setConn(ws)
+	return newTurnSession(t, p, newRecordingTrack()), ws
+}
+
+// A long utterance reaches a streaming transcriber in stream_chunk_ms
+// chunks as the caller talks, never buffering a whole chunk while they
+// fit the queue, and its transcript is relayed as a buffered one's is.
+func TestStreamUtterance(t *testing.T) {
+	transcriber := newStreamTranscriber()
+	s, ws := newStreamSession(t, DefaultConfig(), transcriber)
+	chunk := 500 * sampleRate / 1000
+	peak := 0
+	for range streamQueueChunks * 25 {
+		s.speakFrames(1)
+		s.stateMu.Lock()
+		peak = max(peak, len(*s.utterance))
+		s.stateMu.Unlock()
+	}
+	s.sayFrame(nil, 0) // the silence ending it
+	fs := transcriber.nextStream(t)
+
+	total := 0
+	for i, n := range fs.chunks {
+		if n != chunk && (i < len(fs.chunks)-1 || n > chunk) {
+			t.Errorf("chunk %d of %d samples, want %d", i, n, chunk)
+		}
+		total += n
+	}
+	if len(fs.chunks) < streamQueueChunks || total < streamQueueChunks*25*frameSamples {
+		t.Errorf("4s utterance streamed as chunks %v", fs.chunks)
+	}
+	if peak >= chunk {
+		t.Errorf("utterance buffer reached %d samples, want under a %d sample chunk", peak, chunk)
+	}
+	if fs.abandoned {
+		t.Error("utterance abandoned")
+	}
+	msg := ws.nextMessage(t, time.Second)
+	transcript, _ := msg.Data.(map[string]interface{})["transcript"].(map[string]interface{})
+	if transcript["text"] != "streamed" {
+		t.Errorf("sent %+v, want the streamed transcript", msg)
+	}
+	select {
+	case n := <-transcriber.whole:
+		t.Errorf("streamed utterance also transcribed whole (%d samples)", n)
+	default:
+	}
+}
+
+// Chunks a transcriber is too slow for stay buffered with the utterance,
+// rather than holding up the read loop, and reach it in the same chunks
+// once it catches up.
+func TestStreamSlowTranscriber(t *testing.T) {
+	transcriber := newStreamTranscriber()
+	transcriber.opening = make(chan struct{})
+	s, _ := newStreamSession(t, DefaultConfig(), transcriber)
+	chunk := 500 * sampleRate / 1000
+	s.speakFrames(300)
+	s.stateMu.Lock()
+	buffered := len(*s.utterance)
+	s.stateMu.Unlock()
+	if want := 300*frameSamples - streamQueueChunks*chunk; buffered != want {
+		t.Errorf("%d samples buffered past a full queue, want %d", buffered, want)
+	}
+	close(transcriber.opening)
+	s.sayFrame(nil, 0)
+	fs := transcriber.nextStream(t)
+	total := 0
+	for i, n := range fs.chunks {
+		if n != chunk && (i < len(fs.chunks)-1 || n > chunk) {
+			t.Errorf("chunk %d of %d samples, want %d", i, n, chunk)
+		}
+		total += n
+	}
+	if total < 300*frameSamples {
+		t.Errorf("%d samples streamed, want all %d spoken", total, 300*frameSamples)
+	}
+}
+
+// Utterances shorter than a chunk, and any utterance while batching or
+// with streaming off, go to Transcribe whole.
+func TestStreamWhole(t *testing.T) {
+	short := DefaultConfig()
+	batching := DefaultConfig()
+	batching.MinTranscribeMs = 100
+	off := DefaultConfig()
+	off.StreamChunkMs = 0
+	for name, tt := range map[string]struct {
+		cfg    Config
+		frames int
+	}{
+		"short":    {short, 10},
+		"batching": {batching, 100},
+		"off":      {off, 100},
+	} {
+		transcriber := newStreamTranscriber()
+		s, _ := newStreamSession(t, tt.cfg, transcriber)
+		s.say(tt.frames)
+		select {
+		case n := <-transcriber.whole:
+			if n < tt.frames*frameSamples {
+				t.Errorf("%s: %d samples transcribed, want all %d frames", name, n, tt.frames)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: nothing transcribed whole", name)
+		}
+		select {
+		case <-transcriber.streams:
+			t.Errorf("%s: utterance streamed", name)
+		default:
+		}
+	}
+}
+
+// A streamed utterance failing the checks a buffered one gets, too quiet
+// or a repeat, is abandoned: its stream's context is cancelled and nothing
+// is relayed.
+func TestStreamAbandoned(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinSpeechRMS = 20000
+	transcriber := newStreamTranscriber()
+	s, ws := newStreamSession(t, cfg, transcriber)
+	s.say(100)
+	if fs := transcriber.nextStream(t); !fs.abandoned {
+		t.Error("quiet utterance's stream not abandoned")
+	}
+
+	transcriber = newStreamTranscriber()
+	s, ws = newStreamSession(t, DefaultConfig(), transcriber)
+	s.say(100)
+	if fs := transcriber.nextStream(t); fs.abandoned {
+		t.Fatal("first utterance abandoned")
+	}
+	ws.nextMessage(t, time.Second)
+	s.say(100)
+	if fs := transcriber.nextStream(t); !fs.abandoned {
+		t.Error("repeated utterance's stream not abandoned")
+	}
+	select {
+	case msg := <-ws.out:
+		t.Errorf("abandoned utterance sent %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+// SpeechInterval is one stretch of caller speech, in milliseconds of RTP
+// media time since the call's first audio packet. It runs from the first
+// VAD window of an utterance to the end of its last speech window, so the
+// trailing silence that ended the utterance isn't counted; the gaps
+// between intervals are the silences.
+type SpeechInterval struct {
+	StartMs int64 `json:"startMs"`
+	EndMs   int64 `json:"endMs"`
+}
+
+// maxTimelineIntervals bounds a call's timeline; later speech isn't
+// recorded. It is hours of conversation at any normal turn rate.
+const maxTimelineIntervals = 10000
+
+// speechTimeline records the intervals the speech state machine spends on
+// an utterance. Every method is called with Session.stateMu held.
+type speechTimeline struct {
+	intervals []SpeechInterval
+	open      bool
+}
+
+// start opens an interval at atMs.
+func (t *speechTimeline) start(atMs int64) {
+	if t.open || len(t.intervals) >= maxTimelineIntervals {
+		return
+	}
+	t.intervals = append(t.intervals, SpeechInterval{StartMs: atMs, EndMs: atMs})
+	t.open = true
+}
+
+// speech extends the open interval to the end of a speech window ending at
+// endMs.
+func (t *speechTimeline) speech(endMs int64) {
+	if t.open {
+		t.intervals[len(t.intervals)-1].EndMs = endMs
+	}
+}
+
+// end closes the open interval, if any.
+func (t *speechTimeline) end() {
+	t.open = false
+}
+
+func (t *speechTimeline) snapshot() []SpeechInterval {
+	return append([]SpeechInterval{}, t.intervals...)
+}
+
+// rtpMs converts an RTP timestamp to milliseconds since base, on the Opus
+// 48 kHz clock. Unsigned subtraction keeps it right across wraparound for
+// calls up to a day long.
+func rtpMs(ts, base uint32) int64 {
+	return int64(ts-base) * 1000 / sampleRate
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestRTPMs(t *testing.T) {
+	tests := []struct {
+		ts, base uint32
+		want     int64
+	}{
+		{48000, 0, 1000},
+		{960, 960, 0},
+		// Across wraparound, from 20ms before it.
+		{math.MaxUint32 - 959, math.MaxUint32 - 959, 0},
+		{0, math.MaxUint32 - 959, 20},
+		{47040, math.MaxUint32 - 959, 1000},
+	}
+	for _, tt := range tests {
+		if got := rtpMs(tt.ts, tt.base); got != tt.want {
+			t.Errorf("rtpMs(%d, %d) = %d, want %d", tt.ts, tt.base, got, tt.want)
+		}
+	}
+}
+
+// Speech past maxTimelineIntervals isn't recorded, and snapshots don't
+// change as the timeline does.
+func TestSpeechTimelineCap(t *testing.T) {
+	var tl speechTimeline
+	for i := range int64(maxTimelineIntervals + 5) {
+		tl.start(i * 100)
+		tl.speech(i*100 + 40)
+		tl.end()
+	}
+	got := tl.snapshot()
+	if len(got) != maxTimelineIntervals {
+		t.Fatalf("%d intervals kept, want %d", len(got), maxTimelineIntervals)
+	}
+	if last := got[len(got)-1]; last != (SpeechInterval{StartMs: (maxTimelineIntervals - 1) * 100, EndMs: (maxTimelineIntervals-1)*100 + 40}) {
+		t.Errorf("last interval %+v, want the last before the cap", last)
+	}
+	got[0].EndMs = -1
+	if tl.snapshot()[0].EndMs != 40 {
+		t.Error("snapshot shares the timeline's intervals")
+	}
+	// Speech with no open interval extends nothing.
+	tl.speech(1 << 40)
+	if tl.snapshot()[len(got)-1].EndMs == 1<<40 {
+		t.Error("closed interval extended")
+	}
+}
+
+// The timeline follows RTP time from the first packet, across timestamp
+// wraparound; a pause shorter than silence_ms stays inside its interval,
+// and the silence that ends an utterance isn't counted.
+func TestSpeechTimeline(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SilenceMs = 100
+	cfg.VADSmoothingFrames = 1
+	p, err := NewPeer(cfg, Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newReadSession(t, p)
+	s.dec = &countingDecoder{pcm: toneFrame(frameSamples)}
+	s.smoother = newVADSmoother(1)
+	var decisions []bool
+	for _, run := range []struct {
+		frames   int
+		isSpeech bool
+	}{
+		{5, false}, {9, true}, {3, false}, {3, true}, // 100-400ms, a 60ms pause inside
+		{10, false}, {4, true}, {5, false}, // 600-680ms
+	} {
+		for range run.frames {
+			decisions = append(decisions, run.isSpeech)
+		}
+	}
+	s.vad = &listVAD{decisions: decisions}
+
+	// The timestamp wraps 200ms in.
+	timestamp := uint32(math.MaxUint32 - 10*frameSamples + 1)
+	for range decisions {
+		if !s.handleAudio([]byte{benchOpusTOC[frameSamples]}, timestamp) {
+			t.Fatal("packet rejected")
+		}
+		timestamp += frameSamples
+	}
+	want := []SpeechInterval{{100, 400}, {600, 680}}
+	if got := s.SpeechTimeline(); !slices.Equal(got, want) {
+		t.Errorf("timeline %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package pipeline
+
+import "errors"
+
+// maxOpusPacketSamples is the most one packet can decode to: 120 ms, the
+// longest duration RFC 6716 allows.
+const maxOpusPacketSamples = 120 * sampleRate / 1000
+
+// opusFrameSamples48k is the duration of one frame for each TOC
+// configuration number, in 48 kHz samples (RFC 6716 §3.1, table 2).
+var opusFrameSamples48k = [32]int{
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880, // SILK NB/MB/WB
+	480, 960, 480, 960, // Hybrid SWB/FB
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, // CELT
+}
+
+// opusPacketSamples reads an Opus packet's TOC byte and returns how many
+// samples per channel it decodes to at rate. The packet's own framing says
+// this independently of the decoder, which is what makes it a check on the
+// decoder's output.
+func opusPacketSamples(packet []byte, rate int) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("empty Opus packet")
+	}
+	toc := packet[0]
+	frames := 1
+	switch toc & 0x3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("Opus code 3 packet without frame count")
+		}
+		frames = int(packet[1] & 0x3f)
+		if frames == 0 {
+			return 0, errors.New("Opus code 3 packet with no frames")
+		}
+	}
+	return opusFrameSamples48k[toc>>3] * frames * rate / 48000, nil
+}
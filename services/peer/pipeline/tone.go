@@ -0,0 +1,31 @@
+package pipeline
+
+import (
+	"log"
+	"math"
+)
+
+// The test tone checks the outbound path end to end without a TTS backend:
+// a caller who hears a clean 1 kHz beep for a second knows encoding,
+// pacing and the track all work.
+const (
+	testToneHz        = 1000
+	testToneMs        = 1000
+	testToneAmplitude = 8000 // about -12 dBFS
+)
+
+// testTone is ms of a sine wave at hz, at sampleRate.
+func testTone(hz, ms int) []int16 {
+	pcm := make([]int16, sampleRate*ms/1000)
+	for i := range pcm {
+		pcm[i] = int16(testToneAmplitude * math.Sin(2*math.Pi*float64(hz)*float64(i)/sampleRate))
+	}
+	return pcm
+}
+
+// PlayTestTone queues the test tone for playback after anything already
+// queued.
+func (s *Session) PlayTestTone() error {
+	log.Printf("[%s] 🔔 Playing a %d Hz test tone for %d ms", s.TraceID, testToneHz, testToneMs)
+	return s.player.enqueue(testTone(testToneHz, testToneMs))
+}
@@ -0,0 +1,52 @@
+package pipeline
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// The test tone is a second of 1 kHz sine peaking at testToneAmplitude.
+func TestTestTone(t *testing.T) {
+	tone := testTone(testToneHz, testToneMs)
+	if len(tone) != sampleRate {
+		t.Fatalf("tone of %d samples, want %d", len(tone), sampleRate)
+	}
+	var crossings int
+	var peak int16
+	for i, v := range tone {
+		if i > 0 && (tone[i-1] < 0) != (v < 0) {
+			crossings++
+		}
+		peak = max(peak, v, -v)
+	}
+	// Two zero crossings a cycle.
+	if hz := float64(crossings) / 2; math.Abs(hz-testToneHz) > 1 {
+		t.Errorf("tone at %.1f Hz, want %d", hz, testToneHz)
+	}
+	if peak < testToneAmplitude-1 || peak > testToneAmplitude {
+		t.Errorf("tone peaks at %d, want %d", peak, testToneAmplitude)
+	}
+}
+
+// A test_tone control plays the tone on the caller's track, after the
+// speech already queued.
+func TestTestToneControl(t *testing.T) {
+	p, s := newControlPeer(t, nil)
+	track := newRecordingTrack()
+	s.player = newTestPlayer(t, track)
+	queueFrames(t, s.player, 1, 2)
+	if err := control(p, map[string]interface{}{"action": "test_tone"}); err != nil {
+		t.Fatal(err)
+	}
+	tone := testTone(testToneHz, testToneMs)
+	want := []int16{1, 2}
+	for i := 0; i < len(tone); i += frameSamples {
+		want = append(want, tone[i])
+	}
+	got := track.framesWithin(time.Duration(len(want)+10) * frameDuration * time.Millisecond)
+	if !slices.Equal(got, want) {
+		t.Errorf("played %d frames %v, want the 2 queued and the tone's %d", len(got), got, testToneMs/frameDuration)
+	}
+}
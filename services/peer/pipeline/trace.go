@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// Correlation IDs let operators follow one call, and one turn within it,
+// across the transcriber, agent and synthesizer. Each session gets a random
+// ID; each utterance it hands to the conversational loop is numbered
+// within it ("3f9a…c2.4"). Both ride on the context of every stage call.
+
+type traceKey int
+
+const (
+	sessionIDKey traceKey = iota
+	utteranceIDKey
+)
+
+// newTraceID returns a random 16-hex-digit session ID.
+func newTraceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func utteranceID(sessionID string, n int) string {
+	return fmt.Sprintf("%s.%d", sessionID, n)
+}
+
+// withTrace attaches correlation IDs to ctx; an empty utterance ID is left
+// off.
+func withTrace(ctx context.Context, sessionID, utteranceID string) context.Context {
+	ctx = context.WithValue(ctx, sessionIDKey, sessionID)
+	if utteranceID != "" {
+		ctx = context.WithValue(ctx, utteranceIDKey, utteranceID)
+	}
+	return ctx
+}
+
+// SessionID returns the correlation ID of the call ctx belongs to, or "".
+func SessionID(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey).(string)
+	return id
+}
+
+// UtteranceID returns the correlation ID of the turn ctx belongs to, or "".
+func UtteranceID(ctx context.Context) string {
+	id, _ := ctx.Value(utteranceIDKey).(string)
+	return id
+}
+
+// traceTag is the log prefix for ctx: its utterance ID, else its session ID.
+func traceTag(ctx context.Context) string {
+	if id := UtteranceID(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	if id := SessionID(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
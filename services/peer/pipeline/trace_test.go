@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// traceRecorder is a transcriber, agent and synthesizer that report the
+// correlation IDs each call's context carries, as "<stage> <session>
+// <utterance>".
+type traceRecorder struct{ seen chan string }
+
+func (r traceRecorder) record(ctx context.Context, stage string) {
+	r.seen <- stage + " " + SessionID(ctx) + " " + UtteranceID(ctx)
+}
+
+func (r traceRecorder) Transcribe(ctx context.Context, _ []int16, _ int, _ TranscribeOptions) (Transcription, error) {
+	r.record(ctx, "transcribe")
+	return Transcription{Text: "hello"}, nil
+}
+
+func (r traceRecorder) Respond(ctx context.Context, transcript string) (string, error) {
+	r.record(ctx, "respond")
+	return transcript, nil
+}
+
+func (r traceRecorder) Synthesize(ctx context.Context, _ string) ([]int16, int, error) {
+	r.record(ctx, "synthesize")
+	return make([]int16, frameSamples), sampleRate, nil
+}
+
+// Every stage of a turn sees the call's ID and that turn's number.
+func TestTraceIDs(t *testing.T) {
+	rec := traceRecorder{seen: make(chan string, 3)}
+	p, err := NewPeer(DefaultConfig(), Handlers{Transcriber: rec, Agent: rec, Synthesizer: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setConn(newFakeSignaling())
+	t.Cleanup(p.wg.Wait)
+	s := newTurnSession(t, p, newRecordingTrack())
+
+	for n, amplitude := range []int16{4000, 6000} {
+		s.sayFrame(squareFrame(amplitude), 10)
+		utterance := utteranceID("call", n+1)
+		for _, stage := range []string{"transcribe", "respond", "synthesize"} {
+			select {
+			case got := <-rec.seen:
+				if want := stage + " call " + utterance; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("utterance %d never reached %s", n+1, stage)
+			}
+		}
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	if id := newTraceID(); len(id) != 16 || id == newTraceID() {
+		t.Errorf("newTraceID = %q, want 16 random hex digits", id)
+	}
+	tests := []struct {
+		ctx                context.Context
+		session, utterance string
+		tag                string
+	}{
+		{context.Background(), "", "", ""},
+		{withTrace(context.Background(), "call", ""), "call", "", "[call] "},
+		{withTrace(context.Background(), "call", "call.3"), "call", "call.3", "[call.3] "},
+		// Detached from cancellation, the IDs stay.
+		{context.WithoutCancel(withTrace(context.Background(), "call", "call.3")), "call", "call.3", "[call.3] "},
+	}
+	for i, tt := range tests {
+		if s, u, tag := SessionID(tt.ctx), UtteranceID(tt.ctx), traceTag(tt.ctx); s != tt.session || u != tt.utterance || tag != tt.tag {
+			t.Errorf("%d: IDs %q, %q and tag %q; want %q, %q and %q", i, s, u, tag, tt.session, tt.utterance, tt.tag)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"context"
+	"math"
+	"strings"
+)
+
+// Synthesizer turns agent text into speech for the outbound track.
+type Synthesizer interface {
+	// Synthesize returns mono PCM and the sample rate it was produced at.
+	// The caller resamples to the pipeline rate as needed.
+	Synthesize(ctx context.Context, text string) ([]int16, int, error)
+}
+
+// stubSynthesizer stands in until a real TTS backend is wired up. It emits a
+// short beep per word, which is enough to hear that the outbound path works.
+type stubSynthesizer struct{}
+
+const (
+	stubRate   = 16000 // Hz, deliberately not sampleRate to exercise resampling
+	stubBeepMs = 120
+	stubGapMs  = 60
+)
+
+func (stubSynthesizer) Synthesize(ctx context.Context, text string) ([]int16, int, error) {
+	words := len(strings.Fields(text))
+	beep := stubRate * stubBeepMs / 1000
+	gap := stubRate * stubGapMs / 1000
+	pcm := make([]int16, 0, words*(beep+gap))
+	for w := 0; w < words; w++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		for i := 0; i < beep; i++ {
+			pcm = append(pcm, int16(4000*math.Sin(2*math.Pi*440*float64(i)/stubRate)))
+		}
+		pcm = append(pcm, make([]int16, gap)...)
+	}
+	return pcm, stubRate, nil
+}
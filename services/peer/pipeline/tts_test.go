@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResample(t *testing.T) {
+	ramp := make([]int16, 160)
+	for i := range ramp {
+		ramp[i] = int16(i * 100)
+	}
+	tests := []struct {
+		from, to int
+		wantLen  int
+	}{
+		{8000, sampleRate, 960},
+		{16000, sampleRate, 480},
+		{24000, sampleRate, 320},
+		{sampleRate, 16000, 53},
+		{16000, 16000, 160},
+	}
+	for _, tt := range tests {
+		got := resample(ramp, tt.from, tt.to)
+		if len(got) != tt.wantLen {
+			t.Errorf("%d to %d Hz: %d samples, want %d", tt.from, tt.to, len(got), tt.wantLen)
+			continue
+		}
+		// A ramp stays a ramp: each output sample is the input at the same
+		// instant, interpolated, and held at the last input past the end.
+		for i, v := range got {
+			pos := float64(i) * float64(tt.from) / float64(tt.to)
+			want := int16(min(pos, float64(len(ramp)-1)) * 100)
+			if d := int(v) - int(want); d < -1 || d > 1 {
+				t.Errorf("%d to %d Hz: sample %d = %d, want %d", tt.from, tt.to, i, v, want)
+				break
+			}
+		}
+	}
+	if got := resample(nil, 16000, sampleRate); len(got) != 0 {
+		t.Errorf("resampling nothing gave %d samples", len(got))
+	}
+}
+
+// rateSynthesizer speaks frames 20ms frames at rate, every sample of frame i
+// being i+1.
+type rateSynthesizer struct{ rate, frames int }
+
+func (r rateSynthesizer) Synthesize(context.Context, string) ([]int16, int, error) {
+	n := r.rate * frameDuration / 1000
+	pcm := make([]int16, 0, r.frames*n)
+	for i := range r.frames {
+		for range n {
+			pcm = append(pcm, int16(i+1))
+		}
+	}
+	return pcm, r.rate, nil
+}
+
+// A Synthesizer's speech at its own rate plays at the pipeline rate, frame
+// for frame.
+func TestSpeakResamples(t *testing.T) {
+	for _, rate := range []int{16000, 24000, sampleRate} {
+		p, err := NewPeer(DefaultConfig(), Handlers{Synthesizer: rateSynthesizer{rate: rate, frames: 5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		track := newRecordingTrack()
+		s := &Session{peer: p, player: newTestPlayer(t, track)}
+		if err := s.Speak(context.Background(), "hello"); err != nil {
+			t.Fatal(err)
+		}
+		got := track.framesWithin(10 * frameDuration * time.Millisecond)
+		if want := []int16{1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+			t.Errorf("%d Hz speech played as frames %v, want %v", rate, got, want)
+		}
+	}
+}
+
+func TestStubSynthesizer(t *testing.T) {
+	pcm, rate, err := stubSynthesizer{}.Synthesize(context.Background(), "one two  three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	perWord := stubRate * (stubBeepMs + stubGapMs) / 1000
+	if rate != stubRate || len(pcm) != 3*perWord {
+		t.Errorf("got %d samples at %d Hz, want %d at %d", len(pcm), rate, 3*perWord, stubRate)
+	}
+	// Each word is a beep, then silence.
+	beep := stubRate * stubBeepMs / 1000
+	if level := rms(pcm[:beep]); level < 1000 {
+		t.Errorf("beep RMS %v, want it audible", level)
+	}
+	if level := rms(pcm[beep:perWord]); level != 0 {
+		t.Errorf("gap RMS %v, want silence", level)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := (stubSynthesizer{}).Synthesize(ctx, "hello"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Synthesize = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/baabaaox/go-webrtcvad"
+)
+
+// vadWindowSizes are the window lengths, in ms, the WebRTC VAD accepts.
+var vadWindowSizes = []int{10, 20, 30}
+
+// newVoiceDetector makes a call's VAD for cfg: one WebRTC VAD judging each
+// frame, or with Config.VADWindowsMs a vote among one per window length.
+func newVoiceDetector(cfg Config) (VoiceDetector, error) {
+	if len(cfg.VADWindowsMs) == 0 {
+		return newWebRTCVAD(cfg.VADMode)
+	}
+	return newMultiWindowVAD(cfg.VADWindowsMs, func() (VoiceDetector, error) {
+		return newWebRTCVAD(cfg.VADMode)
+	})
+}
+
+func newWebRTCVAD(mode int) (VoiceDetector, error) {
+	vad, err := webrtcvad.New()
+	if err != nil {
+		return nil, fmt.Errorf("VAD init: %w", err)
+	}
+	vad.SetMode(mode) // 0=least aggressive .. 3=most aggressive
+	return vad, nil
+}
+
+// multiWindowVAD judges each frame at several window lengths and takes a
+// vote. Short windows catch the onset of speech quickly; long ones, with
+// more context, are fooled less by clicks and breaths. Each length casts
+// one vote, speech if any of its windows covering the frame heard speech,
+// and the frame is speech when most lengths say so. A tie goes to the
+// longest window.
+//
+// Windows longer than the frame reach back into the previous one, and
+// until there is that much audio their length abstains. Every length has
+// its own detector, since the WebRTC VAD carries state between calls.
+type multiWindowVAD struct {
+	windows    []vadWindow // shortest first
+	history    []int16     // the latest audio, enough for the longest window
+	sampleRate int
+}
+
+type vadWindow struct {
+	ms  int
+	vad VoiceDetector
+}
+
+func newMultiWindowVAD(windowsMs []int, newDetector func() (VoiceDetector, error)) (*multiWindowVAD, error) {
+	m := &multiWindowVAD{}
+	for _, ms := range windowsMs {
+		vad, err := newDetector()
+		if err != nil {
+			return nil, err
+		}
+		m.windows = append(m.windows, vadWindow{ms: ms, vad: vad})
+	}
+	slices.SortFunc(m.windows, func(a, b vadWindow) int { return cmp.Compare(a.ms, b.ms) })
+	return m, nil
+}
+
+func (m *multiWindowVAD) IsSpeech(pcm []int16, sampleRate int) (bool, error) {
+	if sampleRate != m.sampleRate {
+		m.history, m.sampleRate = m.history[:0], sampleRate
+	}
+	keep := max(m.windows[len(m.windows)-1].ms*sampleRate/1000, len(pcm))
+	m.history = append(m.history, pcm...)
+	if extra := len(m.history) - keep; extra > 0 {
+		m.history = m.history[:copy(m.history, m.history[extra:])]
+	}
+
+	votes, voters := 0, 0
+	longest := false
+	for _, w := range m.windows {
+		n := w.ms * sampleRate / 1000
+		if n > len(m.history) {
+			continue
+		}
+		// The windows end at the frame's end, as many as cover it, and are
+		// judged oldest first.
+		frameStart := len(m.history) - len(pcm)
+		start := len(m.history) - n
+		for start > frameStart && start-n >= 0 {
+			start -= n
+		}
+		speech := false
+		for ; start+n <= len(m.history); start += n {
+			isSpeech, err := w.vad.IsSpeech(m.history[start:start+n], sampleRate)
+			if err != nil {
+				return false, fmt.Errorf("%d ms window: %w", w.ms, err)
+			}
+			speech = speech || isSpeech
+		}
+		voters++
+		if speech {
+			votes++
+		}
+		longest = speech
+	}
+	if votes*2 == voters {
+		return longest, nil
+	}
+	return votes*2 > voters, nil
+}
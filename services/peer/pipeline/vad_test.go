@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// energyVAD hears speech in a window whose RMS is over threshold, and
+// records the length of each window it is given.
+type energyVAD struct {
+	threshold float64
+	windows   []int
+}
+
+func (e *energyVAD) IsSpeech(pcm []int16, _ int) (bool, error) {
+	e.windows = append(e.windows, len(pcm))
+	return rms(pcm) > e.threshold, nil
+}
+
+// newEnergyVADs is a multiWindowVAD over windowsMs whose detectors are
+// energyVADs, returned in the order made.
+func newEnergyVADs(t *testing.T, windowsMs ...int) (*multiWindowVAD, []*energyVAD) {
+	var made []*energyVAD
+	m, err := newMultiWindowVAD(windowsMs, func() (VoiceDetector, error) {
+		e := &energyVAD{threshold: 5000}
+		made = append(made, e)
+		return e, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, made
+}
+
+// frameOf is a 20 ms frame at value for its first ms and silent after.
+func frameOf(value int16, ms int) []int16 {
+	pcm := make([]int16, frameSamples)
+	for i := range ms * sampleRate / 1000 {
+		pcm[i] = value
+	}
+	return pcm
+}
+
+func isSpeech(t *testing.T, vad VoiceDetector, pcm []int16) bool {
+	t.Helper()
+	speech, err := vad.IsSpeech(pcm, sampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return speech
+}
+
+// A 30 ms window reaching back into speech outvotes, as the longest, the
+// 10 ms windows hearing the silence after it, where one 20 ms window reads
+// silence. A 5 ms click fools a lone 10 ms window but loses to 20 and 30.
+func TestMultiWindowVAD(t *testing.T) {
+	single, _ := newEnergyVADs(t, 20)
+	tie, _ := newEnergyVADs(t, 30, 10)
+	for _, vad := range []VoiceDetector{single, tie} {
+		if !isSpeech(t, vad, frameOf(12000, frameDuration)) {
+			t.Fatal("speech not heard")
+		}
+	}
+	if isSpeech(t, single, frameOf(0, 0)) {
+		t.Error("20 ms window heard speech in silence")
+	}
+	if !isSpeech(t, tie, frameOf(0, 0)) {
+		t.Error("[10, 30] lost the trailing edge of speech")
+	}
+
+	lone, _ := newEnergyVADs(t, 10)
+	three, _ := newEnergyVADs(t, 10, 20, 30)
+	for _, vad := range []VoiceDetector{lone, three} {
+		isSpeech(t, vad, frameOf(0, 0))
+	}
+	if !isSpeech(t, lone, frameOf(8000, 5)) {
+		t.Error("lone 10 ms window not fooled by the click")
+	}
+	if isSpeech(t, three, frameOf(8000, 5)) {
+		t.Error("[10, 20, 30] heard speech in a click")
+	}
+}
+
+// Each length judges the windows covering the frame, all its own length;
+// a window longer than the audio so far abstains.
+func TestMultiWindowVADWindows(t *testing.T) {
+	m, made := newEnergyVADs(t, 30, 10, 20)
+	if got := []int{m.windows[0].ms, m.windows[1].ms, m.windows[2].ms}; !slices.Equal(got, []int{10, 20, 30}) {
+		t.Errorf("windows %v, want shortest first", got)
+	}
+	isSpeech(t, m, frameOf(0, 0))
+	isSpeech(t, m, frameOf(0, 0))
+	want := map[int][]int{10: {480, 480, 480, 480}, 20: {960, 960}, 30: {1440}}
+	for i, ms := range []int{30, 10, 20} {
+		if got := made[i].windows; !slices.Equal(got, want[ms]) {
+			t.Errorf("%d ms detector judged windows %v, want %v", ms, got, want[ms])
+		}
+	}
+
+	// The only window is longer than the first frame: no vote, no speech.
+	long, _ := newEnergyVADs(t, 30)
+	if isSpeech(t, long, frameOf(12000, frameDuration)) {
+		t.Error("abstaining 30 ms window decided speech")
+	}
+}
+
+// failingVAD fails every window.
+type failingVAD struct{}
+
+func (failingVAD) IsSpeech([]int16, int) (bool, error) { return false, errors.New("vad broke") }
+
+// A detector's error names its window length; a detector that can't be
+// made fails the whole VAD.
+func TestMultiWindowVADErrors(t *testing.T) {
+	m, err := newMultiWindowVAD([]int{20}, func() (VoiceDetector, error) { return failingVAD{}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.IsSpeech(frameOf(0, 0), sampleRate); err == nil || !strings.Contains(err.Error(), "20 ms window: vad broke") {
+		t.Errorf("IsSpeech = %v, want the 20 ms window's error", err)
+	}
+	if _, err := newMultiWindowVAD([]int{10, 20}, func() (VoiceDetector, error) { return nil, errors.New("no vad") }); err == nil {
+		t.Error("newMultiWindowVAD ignored a detector that failed")
+	}
+}
+
+// vad_windows_ms picks the voting VAD; unset keeps a single detector.
+func TestNewVoiceDetector(t *testing.T) {
+	cfg := DefaultConfig()
+	vad, err := newVoiceDetector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vad.(*multiWindowVAD); ok {
+		t.Error("voting VAD without vad_windows_ms")
+	}
+	cfg.VADWindowsMs = []int{30, 10}
+	vad, err = newVoiceDetector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := vad.(*multiWindowVAD); !ok || len(m.windows) != 2 || m.windows[0].ms != 10 {
+		t.Errorf("vad_windows_ms [30 10] made %T %+v, want a vote over 10 and 30 ms", vad, vad)
+	}
+}
@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookTimeout    = 5 * time.Second // per attempt
+	webhookAttempts   = 3
+	webhookBackoffMin = 500 * time.Millisecond
+	// webhookDeadline bounds a delivery, every attempt and backoff
+	// included, so one in flight as the peer stops is done within
+	// ShutdownTimeout.
+	webhookDeadline = ShutdownTimeout - 2*time.Second
+)
+
+// webhookSink is a TranscriptSink that POSTs each event as JSON to a URL.
+// Network errors, 429s and 5xx responses are retried with backoff, within
+// webhookDeadline; other non-2xx responses are not, since resending won't
+// change them.
+type webhookSink struct {
+	url      string
+	client   *http.Client
+	deadline time.Duration // for a whole delivery
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: webhookTimeout}, deadline: webhookDeadline}
+}
+
+func (w *webhookSink) Publish(ctx context.Context, ev TranscriptEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.deadline)
+	defer cancel()
+	backoff := webhookBackoffMin
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying.
+func (w *webhookSink) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook %s: %s", w.url, resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
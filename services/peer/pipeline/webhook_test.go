@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer answers each POST with the next of statuses, repeating the
+// last, and hands the test every event it receives.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, chan TranscriptEvent, *atomic.Int32) {
+	events := make(chan TranscriptEvent, 8)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		var ev TranscriptEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&ev) != nil {
+			t.Errorf("webhook got %s %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		events <- ev
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, events, &calls
+}
+
+func TestWebhookSink(t *testing.T) {
+	ev := TranscriptEvent{PeerID: "iphone-1", UtteranceID: "call.1", Text: "hello", DurationMs: 800, Timestamp: time.Unix(1700000000, 0).UTC()}
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int32
+		ok       bool
+	}{
+		{"delivered", []int{http.StatusNoContent}, 1, true},
+		{"retried past a 503", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, true},
+		{"retried past a 429", []int{http.StatusTooManyRequests, http.StatusOK}, 2, true},
+		{"400 not retried", []int{http.StatusBadRequest}, 1, false},
+		{"gives up after the last attempt", []int{http.StatusBadGateway}, webhookAttempts, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, events, calls := webhookServer(t, tt.statuses...)
+			err := newWebhookSink(srv.URL).Publish(context.Background(), ev)
+			if (err == nil) != tt.ok || calls.Load() != tt.attempts {
+				t.Errorf("Publish = %v after %d attempts, want ok %v after %d", err, calls.Load(), tt.ok, tt.attempts)
+			}
+			if got := <-events; got != ev {
+				t.Errorf("webhook got %+v, want %+v", got, ev)
+			}
+		})
+	}
+}
+
+// However the endpoint fails, a delivery ends by the sink's deadline, which
+// leaves shutdown time to spare.
+func TestWebhookDeadline(t *testing.T) {
+	if worst := webhookAttempts*webhookTimeout + 3*webhookBackoffMin; worst <= webhookDeadline || webhookDeadline >= ShutdownTimeout {
+		t.Fatalf("deadline %v: retries alone can take %v, shutdown waits %v", webhookDeadline, worst, ShutdownTimeout)
+	}
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() { close(hang); srv.Close() })
+
+	w := newWebhookSink(srv.URL)
+	w.deadline = 200 * time.Millisecond
+	start := time.Now()
+	err := w.Publish(context.Background(), TranscriptEvent{Text: "hello"})
+	if elapsed := time.Since(start); !errors.Is(err, context.DeadlineExceeded) || elapsed > time.Second {
+		t.Errorf("Publish to a hung endpoint = %v after %v, want the deadline after %v", err, elapsed, w.deadline)
+	}
+
+	// Nor does a backoff outlast it.
+	srv503, _, calls := webhookServer(t, http.StatusServiceUnavailable)
+	w = newWebhookSink(srv503.URL)
+	w.deadline = 200 * time.Millisecond
+	start = time.Now()
+	err = w.Publish(context.Background(), TranscriptEvent{Text: "hello"})
+	if elapsed := time.Since(start); !errors.Is(err, context.DeadlineExceeded) || elapsed > webhookBackoffMin || calls.Load() != 1 {
+		t.Errorf("Publish = %v after %v and %d attempts, want the deadline during the first backoff", err, elapsed, calls.Load())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// writeCapture writes 50 packets of 20ms Opus as a capture file, returning
+// its path.
+func writeCapture(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "call.ogg")
+	w, err := oggwriter.New(path, 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := range uint16(50) {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+			Payload: []byte{0xf8, 0xff, 0xfe}, // CELT fullband 20ms
+		}
+		if err := w.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The sweep reports one row for every mode and silence threshold, in the
+// order given.
+func TestVADSweep(t *testing.T) {
+	capture := writeCapture(t)
+	var out strings.Builder
+	if err := runVADSweep([]string{"-modes", "0, 3", "-silence-ms", "200,800", capture, capture}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || !slices.Equal(strings.Fields(lines[0]), []string{"vad_mode", "silence_ms", "utterances", "dropped"}) {
+		t.Fatalf("got\n%s\nwant a header and four rows", out.String())
+	}
+	for i, want := range [][2]string{{"0", "200"}, {"0", "800"}, {"3", "200"}, {"3", "800"}} {
+		if fields := strings.Fields(lines[i+1]); len(fields) != 4 || fields[0] != want[0] || fields[1] != want[1] {
+			t.Errorf("row %d = %q, want vad_mode %s and silence_ms %s", i+1, lines[i+1], want[0], want[1])
+		}
+	}
+}
+
+func TestVADSweepErrors(t *testing.T) {
+	capture := writeCapture(t)
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no captures", nil, "no capture files"},
+		{"bad modes", []string{"-modes", "0,x", capture}, "-modes"},
+		{"empty silence list", []string{"-silence-ms", " , ", capture}, "-silence-ms: empty list"},
+		{"missing capture", []string{filepath.Join(t.TempDir(), "missing.ogg")}, "missing.ogg"},
+		{"invalid mode", []string{"-modes", "9", capture}, "vad_mode 9 out of range"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := runVADSweep(tt.args, &out); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: runVADSweep = %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseIntList(t *testing.T) {
+	got, err := parseIntList(" 200, 400,,800 ")
+	if err != nil || !slices.Equal(got, []int{200, 400, 800}) {
+		t.Errorf("parseIntList = %v, %v; want [200 400 800]", got, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "log"
+
+// A relayed message carrying an "id" asks for an ack: once delivery has
+// been attempted the sender gets {"type":"ack","id":...,"delivered":...}.
+// A message held for a target that hasn't joined is acked straight away
+// with "delivered":false and "held":true, and again with the real outcome
+// if it is delivered when the target joins. One that expires while held
+// gets no second ack.
+
+// ackID returns the message ID a sender wants acked, or "".
+func ackID(msg map[string]interface{}) string {
+	id, _ := msg["id"].(string)
+	return id
+}
+
+// sendAck tells c what became of its message id.
+func sendAck(c *client, id string, outcome relayOutcome) {
+	ack := map[string]interface{}{"type": "ack", "id": id, "delivered": outcome == relayDelivered}
+	if outcome == relayHeld {
+		ack["held"] = true
+	}
+	if err := c.send(ack); err != nil {
+		log.Println("Write ack to", c.id, "failed:", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayAck(t *testing.T) {
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	backend := join(t, srv, "backend-1", nil)
+
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "id": "m1"})
+	backend.expect("signal")
+	if got := caller.expect("ack"); got["id"] != "m1" || got["delivered"] != true || got["held"] != nil {
+		t.Errorf("ack for a delivered signal = %v", got)
+	}
+
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-2", "id": "m2"})
+	if got := caller.expect("ack"); got["id"] != "m2" || got["delivered"] != false {
+		t.Errorf("ack for a signal to nobody = %v", got)
+	}
+
+	// Without an id, nothing is acked.
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1"})
+	backend.expect("signal")
+	caller.expectNothing(100 * time.Millisecond)
+}
+
+func TestHeldRelayAckedTwice(t *testing.T) {
+	setting(t, &pendingTTL, time.Second)
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "id": "m1"})
+	if got := caller.expect("ack"); got["id"] != "m1" || got["delivered"] != false || got["held"] != true {
+		t.Errorf("ack for a held signal = %v", got)
+	}
+
+	join(t, srv, "backend-1", nil).expect("signal")
+	if got := caller.expect("ack"); got["id"] != "m1" || got["delivered"] != true || got["held"] != nil {
+		t.Errorf("ack once the target joined = %v", got)
+	}
+}
+
+func TestExpiredRelayNotAckedAgain(t *testing.T) {
+	setting(t, &pendingTTL, 50*time.Millisecond)
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "id": "m1"})
+	caller.expect("ack")
+	time.Sleep(2 * pendingTTL)
+	join(t, srv, "backend-1", nil)
+	caller.expectNothing(100 * time.Millisecond)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// binaryRelayType is how binary relays are counted in /stats.
+const binaryRelayType = "binary"
+
+// A binary frame carries no JSON envelope, so it is addressed by a header:
+// one byte giving the length of a peer ID, then the ID, then the payload.
+// The sender names the target; the target receives the same layout naming
+// the sender, with the payload passed through verbatim.
+
+// parseBinaryHeader splits a binary frame into the peer ID in its header
+// and the payload after it.
+func parseBinaryHeader(frame []byte) (id string, payload []byte, err error) {
+	if len(frame) == 0 {
+		return "", nil, errors.New("binary message needs a target header")
+	}
+	n := int(frame[0])
+	if n == 0 || len(frame) < 1+n {
+		return "", nil, errors.New("binary message has a truncated target header")
+	}
+	return string(frame[1 : 1+n]), frame[1+n:], nil
+}
+
+// binaryFrame builds the frame for payload with id in its header.
+func binaryFrame(id string, payload []byte) []byte {
+	frame := make([]byte, 0, 1+len(id)+len(payload))
+	frame = append(frame, byte(len(id)))
+	frame = append(frame, id...)
+	return append(frame, payload...)
+}
+
+// relayBinary forwards a binary frame from c to the peer its header names,
+// under the same policy as a signal. Binary frames are never held for a
+// target yet to join and get no ack; one that can't be delivered is
+// dropped.
+func relayBinary(c *client, frame []byte) {
+	if c.id == "" {
+		sendError(c, "binary relay requires joining first")
+		return
+	}
+	if len(c.id) > 255 {
+		sendError(c, "binary relay requires a peer id of at most 255 bytes")
+		return
+	}
+	targetID, payload, err := parseBinaryHeader(frame)
+	if err != nil {
+		sendError(c, err.Error())
+		return
+	}
+	if relayPolicy != nil && !relayPolicy(c.id, targetID) {
+		log.Println("Binary relay denied:", c.id, "->", targetID)
+		sendError(c, "relay to "+targetID+" not allowed")
+		return
+	}
+	if !roleAllows(c, targetID) {
+		log.Println("Binary relay denied by role:", c.id, "->", targetID)
+		sendError(c, "relay to "+targetID+" not allowed: clients may only signal backends")
+		return
+	}
+
+	target, ok := lookup(targetID)
+	if !ok {
+		countRelay(binaryRelayType, false)
+		c.stats.countOutcome(relayDropped)
+		return
+	}
+	err = target.write(websocket.BinaryMessage, binaryFrame(c.id, payload))
+	if err != nil {
+		log.Println("Binary write to", targetID, "failed:", err)
+	} else {
+		target.stats.received.Add(1)
+	}
+	countRelay(binaryRelayType, err == nil)
+	c.stats.countOutcome(delivered(err == nil))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseBinaryHeader(t *testing.T) {
+	id, payload, err := parseBinaryHeader(binaryFrame("backend-1", []byte{0, 1, 2}))
+	if err != nil || id != "backend-1" || !bytes.Equal(payload, []byte{0, 1, 2}) {
+		t.Errorf("round trip = %q, %v, %v", id, payload, err)
+	}
+	for _, frame := range [][]byte{nil, {0, 'a'}, {3, 'a', 'b'}} {
+		if _, _, err := parseBinaryHeader(frame); err == nil {
+			t.Errorf("%v: want an error", frame)
+		}
+	}
+}
+
+func TestBinaryRelay(t *testing.T) {
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	backend := join(t, srv, "backend-1", nil)
+
+	payload := []byte{0x00, 0xff, '{', 0x80}
+	if err := caller.ws.WriteMessage(websocket.BinaryMessage, binaryFrame("backend-1", payload)); err != nil {
+		t.Fatal(err)
+	}
+	backend.ws.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		messageType, data, err := backend.ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue // presence
+		}
+		if want := binaryFrame("iphone-1", payload); !bytes.Equal(data, want) {
+			t.Errorf("backend got %v, want %v", data, want)
+		}
+		break
+	}
+
+	if err := caller.ws.WriteMessage(websocket.BinaryMessage, []byte{9, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	if got := caller.expect("error"); got["error"] != "binary message has a truncated target header" {
+		t.Errorf("got %v", got)
+	}
+
+	anonymous := dial(t, srv)
+	if err := anonymous.ws.WriteMessage(websocket.BinaryMessage, binaryFrame("backend-1", payload)); err != nil {
+		t.Fatal(err)
+	}
+	if got := anonymous.expect("error"); got["error"] != "binary relay requires joining first" {
+		t.Errorf("got %v", got)
+	}
+
+	var totals struct {
+		Delivered map[string]int `json:"delivered"`
+	}
+	getJSON(t, srv.URL+"/stats", &totals)
+	if totals.Delivered[binaryRelayType] != 1 {
+		t.Errorf("/stats delivered = %v, want one binary relay", totals.Delivered)
+	}
+}
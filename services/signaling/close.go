@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeReason is why the server ends a connection. Every disconnect it
+// starts sends one as a close frame, so a client can tell from the code
+// what happened, and whether to reconnect, instead of seeing the socket
+// drop.
+type closeReason struct {
+	code int
+	text string
+}
+
+var (
+	closeLeft         = closeReason{websocket.CloseNormalClosure, "left"}
+	closeShutdown     = closeReason{websocket.CloseGoingAway, "server shutting down"}
+	closeBadProtocol  = closeReason{websocket.CloseProtocolError, "unsupported protocol version, server speaks " + protocolVersion}
+	closeBadMessage   = closeReason{websocket.CloseUnsupportedData, "messages must be JSON objects"}
+	closeRateExceeded = closeReason{websocket.ClosePolicyViolation, "message rate exceeded"}
+)
+
+// sendClose writes a close frame for why, when conn is a real WebSocket.
+func sendClose(conn SignalConn, why closeReason) {
+	ws, ok := conn.(interface {
+		WriteControl(messageType int, data []byte, deadline time.Time) error
+	})
+	if !ok {
+		return
+	}
+	// gorilla allows WriteControl alongside other writers.
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(why.code, why.text), time.Now().Add(time.Second))
+}
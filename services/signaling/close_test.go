@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseCodes(t *testing.T) {
+	srv := newTestServer(t)
+
+	left := join(t, srv, "iphone-1", nil)
+	left.send(map[string]interface{}{"type": "leave"})
+	if code, text := left.closeCode(); code != websocket.CloseNormalClosure || text != closeLeft.text {
+		t.Errorf("leave closed with %d %q", code, text)
+	}
+
+	garbled := dial(t, srv)
+	if err := garbled.ws.WriteMessage(websocket.TextMessage, []byte("{not json")); err != nil {
+		t.Fatal(err)
+	}
+	if code, text := garbled.closeCode(); code != websocket.CloseUnsupportedData || text != closeBadMessage.text {
+		t.Errorf("invalid JSON closed with %d %q", code, text)
+	}
+
+	future := dial(t, srv, "voice-agent.v2")
+	if code, text := future.closeCode(); code != websocket.CloseProtocolError || text != closeBadProtocol.text {
+		t.Errorf("unsupported protocol closed with %d %q", code, text)
+	}
+}
+
+func TestCloseOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestServerContext(t, ctx)
+	p := join(t, srv, "backend-1", nil)
+
+	cancel()
+	if code, text := p.closeCode(); code != websocket.CloseGoingAway || text != closeShutdown.text {
+		t.Errorf("shutdown closed with %d %q", code, text)
+	}
+}
@@ -2,4 +2,7 @@ module github.com/MaxwellKendall/voice-agent-service/services/signaling
 
 go 1.24.2
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require (
+	github.com/gorilla/websocket v1.5.3
+	go.uber.org/goleak v1.3.0
+)
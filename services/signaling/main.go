@@ -1,57 +1,330 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{}
-var peers = make(map[string]*websocket.Conn)
+// protocolVersion is the signaling subprotocol this server speaks. Clients
+// that don't request a subprotocol are still accepted.
+const protocolVersion = "voice-agent.v1"
+
+// defaultBufferSize is the upgrader's read and write buffer size unless
+// WS_READ_BUFFER_SIZE or WS_WRITE_BUFFER_SIZE say otherwise. An SDP offer
+// with its candidates is usually 3-6 KB; gorilla's default is 4 KB.
+const defaultBufferSize = 8 << 10
+
+var upgrader = websocket.Upgrader{
+	Subprotocols:    []string{protocolVersion},
+	ReadBufferSize:  defaultBufferSize,
+	WriteBufferSize: defaultBufferSize,
+}
+
+// shutdownTimeout bounds how long shutdown waits for connections to close.
+const shutdownTimeout = 5 * time.Second
+
+// connections counts the WebSocket connections being served, so shutdown
+// can wait for every one to finish.
+var connections sync.WaitGroup
+
+// relayPolicy restricts which peers may signal each other; see RELAY_ALLOW.
+var relayPolicy RelayPolicy
+
+// relayByteRate caps the bytes per second written to each peer; zero means
+// unlimited. See RELAY_MAX_BYTES_PER_SEC.
+var relayByteRate int
 
 func main() {
-	http.HandleFunc("/ws", handleWebSocket)
+	policy, err := parseRelayPolicy(os.Getenv("RELAY_ALLOW"))
+	if err != nil {
+		log.Fatal("Invalid RELAY_ALLOW:", err)
+	}
+	relayPolicy = policy
+
+	if v := os.Getenv("ENFORCE_ROLES"); v != "" {
+		enforce, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatal("Invalid ENFORCE_ROLES: ", v)
+		}
+		enforceRoles = enforce
+	}
+
+	if v := os.Getenv("RELAY_MAX_BYTES_PER_SEC"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 0 {
+			log.Fatal("Invalid RELAY_MAX_BYTES_PER_SEC: ", v)
+		}
+		relayByteRate = rate
+	}
+
+	if v := os.Getenv("MAX_MESSAGES_PER_SEC"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 0 {
+			log.Fatal("Invalid MAX_MESSAGES_PER_SEC: ", v)
+		}
+		maxMessageRate = rate
+	}
+	if v := os.Getenv("RATE_LIMIT_ACTION"); v != "" {
+		action, err := parseRateLimitAction(v)
+		if err != nil {
+			log.Fatal("Invalid RATE_LIMIT_ACTION: ", err)
+		}
+		rateLimit = action
+	}
 
+	if err := loadBufferSizes(&upgrader); err != nil {
+		log.Fatal(err)
+	}
+
+	if v := os.Getenv("RELAY_PENDING_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			log.Fatal("Invalid RELAY_PENDING_TTL: ", v)
+		}
+		pendingTTL = ttl
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	log.Println("Signaling server started on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := serve(ctx, ":8080"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// routes maps the server's endpoints to their handlers.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleWebSocket)
+	mux.HandleFunc("/peers", handlePeers)
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/", handleUI)
+	return mux
+}
+
+// serve runs the server on addr until ctx is cancelled, then shuts down:
+// it stops accepting, closes every WebSocket with 1001 (going away), and
+// waits up to shutdownTimeout for their handlers to return.
+func serve(ctx context.Context, addr string) error {
+	// Requests inherit ctx, which is how WebSocket handlers learn of the
+	// shutdown; the server doesn't track hijacked connections itself.
+	srv := &http.Server{Addr: addr, Handler: routes(), BaseContext: func(net.Listener) context.Context { return ctx }}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down signaling server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("HTTP shutdown:", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		log.Printf("Connections still open after %v; exiting anyway", shutdownTimeout)
+	}
+	return nil
+}
+
+// loadBufferSizes sets u's read and write buffer sizes from
+// WS_READ_BUFFER_SIZE and WS_WRITE_BUFFER_SIZE, leaving either as it is
+// when unset.
+func loadBufferSizes(u *websocket.Upgrader) error {
+	read, err := envBufferSize("WS_READ_BUFFER_SIZE", u.ReadBufferSize)
+	if err != nil {
+		return err
+	}
+	write, err := envBufferSize("WS_WRITE_BUFFER_SIZE", u.WriteBufferSize)
+	if err != nil {
+		return err
+	}
+	u.ReadBufferSize, u.WriteBufferSize = read, write
+	return nil
+}
+
+// envBufferSize reads a buffer size in bytes from key, returning def when
+// unset and an error when it isn't a positive integer.
+func envBufferSize(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, v)
+	}
+	return n, nil
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Counted before the upgrade, while the server still sees the request
+	// as active, so Shutdown returning means every Add has happened.
+	connections.Add(1)
+	defer connections.Done()
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket upgrade error:", err)
 		return
 	}
 	defer conn.Close()
+	defer context.AfterFunc(r.Context(), func() {
+		sendClose(conn, closeShutdown)
+		conn.Close()
+	})()
 
-	var peerID string
+	if requested := websocket.Subprotocols(r); len(requested) > 0 && conn.Subprotocol() == "" {
+		log.Println("Rejected client requesting unsupported protocols:", requested)
+		sendClose(conn, closeBadProtocol)
+		return
+	}
+
+	serveClient(newClient(conn))
+}
+
+// serveClient handles one peer's messages until its connection fails or
+// it leaves, then unregisters it.
+func serveClient(c *client) {
+	defer c.close()
+	defer func() {
+		if c.id != "" && unregister(c) {
+			log.Println("Peer disconnected:", c.id)
+		}
+	}()
 
 	for {
-		var msg map[string]interface{}
-		if err := conn.ReadJSON(&msg); err != nil {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
 			log.Println("Read error:", err)
 			break
 		}
+		lastSeen := c.stats.lastSeen.Swap(time.Now().UnixMilli())
+		if limited, disconnect := overLimit(c); disconnect {
+			return
+		} else if limited {
+			continue
+		}
+		if messageType == websocket.BinaryMessage {
+			relayBinary(c, data)
+			continue
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Println("Disconnecting", describe(c), "after an invalid message:", err)
+			sendClose(c.conn, closeBadMessage)
+			break
+		}
 
 		switch msg["type"] {
 		case "join":
-			peerID = msg["id"].(string)
-			peers[peerID] = conn
-			log.Println("Peer joined:", peerID)
+			// Once registered, a client's ID, meta, room and role are read
+			// by other goroutines without a lock: presence broadcasts,
+			// relays and the /peers listing. So they're fixed by the first
+			// join; to change them, reconnect.
+			//
+			// Joins aren't authenticated: the ID is taken on the sender's
+			// word and fields such as a token are ignored, so replaying a
+			// join is the same as sending it, and a second connection
+			// joining with an ID takes it over (see register). There are no
+			// signed tokens to carry a nonce, so no replay cache either;
+			// that comes with token verification, which belongs here.
+			if c.id != "" {
+				sendError(c, "already joined as "+c.id)
+				continue
+			}
+			id, _ := msg["id"].(string)
+			if id == "" {
+				sendError(c, "join requires an id")
+				continue
+			}
+			meta, err := parseMeta(msg["meta"])
+			if err != nil {
+				sendError(c, "invalid meta: "+err.Error())
+				continue
+			}
+			role, _ := msg["role"].(string)
+			if err := validateRole(role); err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			room, _ := msg["room"].(string)
+			c.id, c.meta, c.room, c.role = id, meta, room, role
+			c.stats.joinedAt = time.Now()
+			register(c)
+			log.Println("Peer joined:", c.id)
+
+		case "signal", "media_config", "control", "reject", "language_detected":
+			if c.id == "" {
+				sendError(c, msg["type"].(string)+" requires joining first")
+				continue
+			}
+			// Targets act on from, e.g. the peer keys calls by it, so it
+			// must be the sender's joined ID and not whatever it claims.
+			msg["from"] = c.id
+			targetID, _ := msg["to"].(string)
+			if relayPolicy != nil && !relayPolicy(c.id, targetID) {
+				log.Println("Relay denied:", c.id, "->", targetID)
+				sendError(c, "relay to "+targetID+" not allowed")
+				continue
+			}
+			if !roleAllows(c, targetID) {
+				log.Println("Relay denied by role:", c.id, "->", targetID)
+				sendError(c, "relay to "+targetID+" not allowed: clients may only signal backends")
+				continue
+			}
+			outcome := relay(c, targetID, msg)
+			c.stats.countOutcome(outcome)
+			if id := ackID(msg); id != "" {
+				sendAck(c, id, outcome)
+			}
 
-		case "signal":
-			targetID := msg["to"].(string)
-			if targetConn, ok := peers[targetID]; ok {
-				if err := targetConn.WriteJSON(msg); err != nil {
-					log.Println("Write to", targetID, "failed:", err)
-				}
+		case "broadcast":
+			if c.room == "" {
+				sendError(c, "broadcast requires joining a room")
+				continue
 			}
+			broadcast(c, msg)
+
+		case "get_stats":
+			sendStats(c, lastSeen)
 
 		case "leave":
-			delete(peers, peerID)
-			log.Println("Peer left:", peerID)
+			unregister(c)
+			log.Println("Peer left:", c.id)
+			sendClose(c.conn, closeLeft)
 			return
 		}
 	}
-}
\ No newline at end of file
+}
+
+// sendError tells a client its last message was rejected.
+func sendError(c *client, reason string) {
+	if err := c.send(map[string]interface{}{"type": "error", "error": reason}); err != nil {
+		log.Println("Write error reply failed:", err)
+	}
+}
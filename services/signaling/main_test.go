@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/goleak"
+)
+
+// TestMain fails the run if any test leaves a goroutine behind, such as a
+// connection handler that never returned.
+func TestMain(m *testing.M) {
+	// Every connection logs; keep failures readable.
+	log.SetOutput(io.Discard)
+	goleak.VerifyTestMain(m)
+}
+
+// readTimeout bounds every read a test makes, so a missing message fails
+// the test instead of hanging it.
+const readTimeout = 2 * time.Second
+
+// newTestServer serves the signaling endpoints on a loopback port. At
+// cleanup, after the test's peers have disconnected, it waits for every
+// handler to return and clears what the server keeps between connections.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return newTestServerContext(t, context.Background())
+}
+
+// newTestServerContext is newTestServer with requests inheriting ctx, as
+// serve gives them its own, so cancelling ctx starts a shutdown.
+func newTestServerContext(t *testing.T, ctx context.Context) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(routes())
+	srv.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		connections.Wait()
+		resetServerState(t)
+	})
+	return srv
+}
+
+// resetServerState clears what the server keeps between connections once
+// a test's peers have all disconnected, and checks none is still
+// registered.
+func resetServerState(t *testing.T) {
+	t.Helper()
+	pendingMu.Lock()
+	clear(pending)
+	pendingMu.Unlock()
+	relayStats.Lock()
+	clear(relayStats.delivered)
+	clear(relayStats.dropped)
+	relayStats.Unlock()
+	if n := len(connected()); n != 0 {
+		t.Errorf("%d peers still registered after every connection closed", n)
+	}
+}
+
+// setting sets one of the server's configuration variables for the rest
+// of the test.
+func setting[T any](t *testing.T, v *T, value T) {
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// testPeer is a WebSocket client of a test server.
+type testPeer struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+// dial connects to srv, requesting protocols if any.
+func dial(t *testing.T, srv *httptest.Server, protocols ...string) *testPeer {
+	t.Helper()
+	ws, _, err := dialErr(srv, protocols...)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return &testPeer{t: t, ws: ws}
+}
+
+func dialErr(srv *httptest.Server, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: readTimeout}
+	return dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+}
+
+// join connects to srv as id, with any other join fields in extra, and
+// waits for the server's confirmation.
+func join(t *testing.T, srv *httptest.Server, id string, extra map[string]interface{}) *testPeer {
+	t.Helper()
+	p := dial(t, srv)
+	msg := map[string]interface{}{"type": "join", "id": id}
+	for k, v := range extra {
+		msg[k] = v
+	}
+	p.send(msg)
+	if got := p.expect("joined"); got["id"] != id {
+		t.Fatalf("joined as %v, want %s", got["id"], id)
+	}
+	return p
+}
+
+func (p *testPeer) send(msg map[string]interface{}) {
+	p.t.Helper()
+	if err := p.ws.WriteJSON(msg); err != nil {
+		p.t.Fatal("write:", err)
+	}
+}
+
+// read returns the next message, failing the test if none arrives.
+func (p *testPeer) read() map[string]interface{} {
+	p.t.Helper()
+	msg, err := p.tryRead(readTimeout)
+	if err != nil {
+		p.t.Fatal("read:", err)
+	}
+	return msg
+}
+
+func (p *testPeer) tryRead(timeout time.Duration) (map[string]interface{}, error) {
+	p.ws.SetReadDeadline(time.Now().Add(timeout))
+	var msg map[string]interface{}
+	err := p.ws.ReadJSON(&msg)
+	return msg, err
+}
+
+// expect returns the next message that isn't a presence event, failing
+// the test unless it has type typ.
+func (p *testPeer) expect(typ string) map[string]interface{} {
+	p.t.Helper()
+	for {
+		msg := p.read()
+		if msg["type"] == "presence" && typ != "presence" {
+			continue
+		}
+		if msg["type"] != typ {
+			p.t.Fatalf("got %v, want a %s message", msg, typ)
+		}
+		return msg
+	}
+}
+
+// expectNothing fails the test if anything but a presence event arrives
+// within d. It ends with a timed-out read, after which gorilla fails every
+// read, so it must be the last read on p.
+func (p *testPeer) expectNothing(d time.Duration) {
+	p.t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		msg, err := p.tryRead(time.Until(deadline))
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return
+		}
+		if err != nil {
+			p.t.Fatal("read:", err)
+		}
+		if msg["type"] != "presence" {
+			p.t.Fatalf("got %v, want nothing", msg)
+		}
+	}
+}
+
+// closeCode reads until the server closes the connection and returns the
+// close frame's code and reason.
+func (p *testPeer) closeCode() (int, string) {
+	p.t.Helper()
+	p.ws.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		_, _, err := p.ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) {
+			p.t.Fatal("want a close frame, got", err)
+		}
+		return ce.Code, ce.Text
+	}
+}
+
+// getJSON fetches an admin endpoint into v.
+func getJSON(t *testing.T, url string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	srv := newTestServer(t)
+
+	ws, _, err := dialErr(srv, "voice-agent.v2", protocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ws.Subprotocol(); got != protocolVersion {
+		t.Errorf("negotiated %q, want %q", got, protocolVersion)
+	}
+	ws.Close()
+
+	// Clients from before versioning request nothing and are still served.
+	legacy := join(t, srv, "legacy", nil)
+	if got := legacy.ws.Subprotocol(); got != "" {
+		t.Errorf("legacy client negotiated %q", got)
+	}
+
+	future := dial(t, srv, "voice-agent.v2")
+	if code, _ := future.closeCode(); code != closeBadProtocol.code {
+		t.Errorf("unsupported protocol closed with %d, want %d", code, closeBadProtocol.code)
+	}
+}
+
+// TestConcurrentJoinRelayLeave is a stress test for -race: peers join at
+// once, signal each other concurrently and then leave or drop, half each.
+func TestConcurrentJoinRelayLeave(t *testing.T) {
+	const peerCount, signals = 100, 10
+	srv := newTestServer(t)
+	conns := make([]*websocket.Conn, peerCount)
+	id := func(i int) string { return fmt.Sprintf("peer-%03d", i%peerCount) }
+
+	// concurrently runs fn for every peer and reports the errors.
+	concurrently := func(phase string, fn func(i int, ws *websocket.Conn) error) {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, peerCount)
+		for i := range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := fn(i, conns[i]); err != nil {
+					errs <- fmt.Errorf("%s %s: %w", phase, id(i), err)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		if t.Failed() {
+			t.FailNow()
+		}
+	}
+	// readUntil reads ws until it has seen n messages of type typ.
+	readUntil := func(ws *websocket.Conn, typ string, n int) error {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for n > 0 {
+			var msg map[string]interface{}
+			if err := ws.ReadJSON(&msg); err != nil {
+				return err
+			}
+			if msg["type"] == typ {
+				n--
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		for _, ws := range conns {
+			if ws != nil {
+				ws.Close()
+			}
+		}
+	})
+
+	concurrently("join", func(i int, _ *websocket.Conn) error {
+		ws, _, err := dialErr(srv)
+		if err != nil {
+			return err
+		}
+		conns[i] = ws
+		if err := ws.WriteJSON(map[string]interface{}{"type": "join", "id": id(i)}); err != nil {
+			return err
+		}
+		return readUntil(ws, "joined", 1)
+	})
+	if got := len(connected()); got != peerCount {
+		t.Fatalf("%d peers registered, want %d", got, peerCount)
+	}
+
+	// Peer i signals the next signals peers, so each also receives that
+	// many, all while the others' presence events are still arriving.
+	concurrently("relay", func(i int, ws *websocket.Conn) error {
+		received := make(chan error, 1)
+		go func() { received <- readUntil(ws, "signal", signals) }()
+		for k := 1; k <= signals; k++ {
+			msg := map[string]interface{}{"type": "signal", "to": id(i + k), "data": k}
+			if err := ws.WriteJSON(msg); err != nil {
+				return err
+			}
+		}
+		return <-received
+	})
+	relayStats.Lock()
+	delivered := relayStats.delivered["signal"]
+	relayStats.Unlock()
+	if delivered != peerCount*signals {
+		t.Errorf("%d signals delivered, want %d", delivered, peerCount*signals)
+	}
+
+	concurrently("leave", func(i int, ws *websocket.Conn) error {
+		if i%2 == 1 {
+			return ws.Close()
+		}
+		if err := ws.WriteJSON(map[string]interface{}{"type": "leave"}); err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := ws.ReadMessage()
+			if websocket.IsCloseError(err, closeLeft.code) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	// newTestServer's cleanup checks that every handler returned and the
+	// registry is empty.
+}
+
+func TestRelayStampsFrom(t *testing.T) {
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	backend := join(t, srv, "backend-1", nil)
+
+	for _, typ := range []string{"signal", "media_config", "control"} {
+		caller.send(map[string]interface{}{"type": typ, "from": "iphone-2", "to": "backend-1"})
+		if got := backend.expect(typ); got["from"] != "iphone-1" {
+			t.Errorf("%s relayed with from %v, want the sender's joined ID", typ, got["from"])
+		}
+	}
+
+	anonymous := dial(t, srv)
+	anonymous.send(map[string]interface{}{"type": "signal", "from": "iphone-1", "to": "backend-1"})
+	if got := anonymous.expect("error"); got["error"] != "signal requires joining first" {
+		t.Errorf("got %v", got)
+	}
+	backend.expectNothing(100 * time.Millisecond)
+}
+
+// A backend's reject reaches the caller with its reason and message.
+func TestRelayReject(t *testing.T) {
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	backend := join(t, srv, "backend-1", nil)
+
+	backend.send(map[string]interface{}{"type": "reject", "to": "iphone-1", "reason": "busy", "message": "at capacity (max_sessions 2)"})
+	got := caller.expect("reject")
+	if got["from"] != "backend-1" || got["reason"] != "busy" || got["message"] != "at capacity (max_sessions 2)" {
+		t.Errorf("caller got %v, want backend-1's busy reject", got)
+	}
+}
+
+// Joins carry no verified credentials, so a join replayed from another
+// connection, token and all, is accepted and takes the ID over. Replay
+// protection needs signed tokens first.
+func TestReplayedJoinAccepted(t *testing.T) {
+	srv := newTestServer(t)
+	backend := join(t, srv, "backend-1", nil)
+	captured := map[string]interface{}{"token": "captured-token"}
+	join(t, srv, "iphone-1", captured)
+	replayer := join(t, srv, "iphone-1", captured)
+
+	backend.send(map[string]interface{}{"type": "signal", "to": "iphone-1", "data": "offer"})
+	if got := replayer.expect("signal"); got["data"] != "offer" {
+		t.Errorf("replayed join's connection got %v, want the signal for iphone-1", got)
+	}
+}
+
+// fakeConn is a channel-backed SignalConn: the test queues what the peer
+// sends on in and reads what the server writes it from out.
+type fakeConn struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{in: make(chan []byte, 16), out: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (f *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-f.in:
+		return websocket.TextMessage, data, nil
+	case <-f.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (f *fakeConn) WriteMessage(_ int, data []byte) error {
+	select {
+	case f.out <- data:
+		return nil
+	case <-f.closed:
+		return net.ErrClosed
+	}
+}
+
+func (f *fakeConn) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeConn) send(t *testing.T, msg map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.in <- data
+}
+
+// expect returns the next message the server wrote that isn't a presence
+// event, failing the test unless it has type typ.
+func (f *fakeConn) expect(t *testing.T, typ string) map[string]interface{} {
+	t.Helper()
+	for {
+		select {
+		case data := <-f.out:
+			var msg map[string]interface{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg["type"] == "presence" && typ != "presence" {
+				continue
+			}
+			if msg["type"] != typ {
+				t.Fatalf("got %v, want a %s message", msg, typ)
+			}
+			return msg
+		case <-time.After(readTimeout):
+			t.Fatalf("no %s message within %v", typ, readTimeout)
+			return nil
+		}
+	}
+}
+
+// TestServeClientOverFakeConn drives serveClient through fake connections
+// rather than WebSockets: two peers join, one signals the other, and
+// closing a connection unregisters its peer and tells the other.
+func TestServeClientOverFakeConn(t *testing.T) {
+	run := func(conn *fakeConn) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serveClient(newClient(conn))
+		}()
+		return done
+	}
+	backend, caller := newFakeConn(), newFakeConn()
+	backendDone, callerDone := run(backend), run(caller)
+
+	backend.send(t, map[string]interface{}{"type": "join", "id": "backend-1", "role": "backend"})
+	backend.expect(t, "joined")
+	caller.send(t, map[string]interface{}{"type": "join", "id": "iphone-1"})
+	caller.expect(t, "joined")
+	if got := backend.expect(t, "presence"); got["event"] != "joined" {
+		t.Errorf("backend got %v, want iphone-1 joining", got)
+	}
+
+	caller.send(t, map[string]interface{}{"type": "signal", "to": "backend-1", "data": map[string]interface{}{"sdp": "offer"}})
+	got := backend.expect(t, "signal")
+	if got["from"] != "iphone-1" || got["data"].(map[string]interface{})["sdp"] != "offer" {
+		t.Errorf("backend got %v, want iphone-1's offer", got)
+	}
+
+	caller.Close()
+	<-callerDone
+	if got := backend.expect(t, "presence"); got["event"] != "left" || got["peer"].(map[string]interface{})["id"] != "iphone-1" {
+		t.Errorf("backend got %v, want iphone-1 leaving", got)
+	}
+	if _, ok := lookup("iphone-1"); ok {
+		t.Error("iphone-1 still registered after its connection closed")
+	}
+	backend.Close()
+	<-backendDone
+	resetServerState(t)
+}
+
+func TestBufferSizes(t *testing.T) {
+	tests := []struct {
+		name        string
+		read, write string // "" leaves the variable unset
+		want        [2]int
+		err         bool
+	}{
+		{"unset", "", "", [2]int{defaultBufferSize, defaultBufferSize}, false},
+		{"both set", "16384", "2048", [2]int{16384, 2048}, false},
+		{"read only", "1024", "", [2]int{1024, defaultBufferSize}, false},
+		{"zero", "0", "", [2]int{}, true},
+		{"negative", "", "-1", [2]int{}, true},
+		{"not a number", "8k", "", [2]int{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WS_READ_BUFFER_SIZE", tt.read)
+			t.Setenv("WS_WRITE_BUFFER_SIZE", tt.write)
+			u := websocket.Upgrader{ReadBufferSize: defaultBufferSize, WriteBufferSize: defaultBufferSize}
+			err := loadBufferSizes(&u)
+			if tt.err {
+				if err == nil {
+					t.Errorf("loaded %d/%d, want an error", u.ReadBufferSize, u.WriteBufferSize)
+				}
+				if u.ReadBufferSize != defaultBufferSize || u.WriteBufferSize != defaultBufferSize {
+					t.Errorf("failed load changed the upgrader to %d/%d", u.ReadBufferSize, u.WriteBufferSize)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := [2]int{u.ReadBufferSize, u.WriteBufferSize}; got != tt.want {
+				t.Errorf("upgrader buffers %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The server's upgrader takes the sizes, and connections through it still
+// carry messages larger than its buffers.
+func TestBufferSizesReachServer(t *testing.T) {
+	t.Setenv("WS_READ_BUFFER_SIZE", "512")
+	t.Setenv("WS_WRITE_BUFFER_SIZE", "256")
+	setting(t, &upgrader, upgrader)
+	if err := loadBufferSizes(&upgrader); err != nil {
+		t.Fatal(err)
+	}
+	if upgrader.ReadBufferSize != 512 || upgrader.WriteBufferSize != 256 {
+		t.Fatalf("server upgrader buffers %d/%d, want 512/256", upgrader.ReadBufferSize, upgrader.WriteBufferSize)
+	}
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	backend := join(t, srv, "backend-1", nil)
+	sdp := strings.Repeat("a=candidate:x\r\n", 400)
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "data": map[string]interface{}{"sdp": sdp}})
+	if got := backend.expect("signal"); got["data"].(map[string]interface{})["sdp"] != sdp {
+		t.Error("offer larger than the buffers arrived altered")
+	}
+}
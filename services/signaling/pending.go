@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Relayed messages for a peer that hasn't joined yet can be held briefly
+// and delivered when it does, covering a caller that signals a moment
+// before its target connects. Holding is off unless RELAY_PENDING_TTL is
+// set, and bounded per target and in the number of targets.
+const (
+	maxPendingPerTarget = 8
+	maxPendingTargets   = 256
+)
+
+// pendingTTL is how long a held message waits for its target; zero
+// disables holding. See RELAY_PENDING_TTL.
+var pendingTTL time.Duration
+
+type pendingMsg struct {
+	msg     map[string]interface{}
+	expires time.Time
+	ackTo   *client // sender awaiting an ack on delivery, if it asked
+}
+
+var (
+	pendingMu sync.Mutex
+	pending   = make(map[string][]pendingMsg)
+)
+
+// relayOutcome is what relay did with a message.
+type relayOutcome int
+
+const (
+	relayDropped relayOutcome = iota
+	relayDelivered
+	relayHeld
+)
+
+// relay delivers msg from sender to the peer registered as targetID,
+// holding it for later if that peer hasn't joined and holding is enabled.
+func relay(sender *client, targetID string, msg map[string]interface{}) relayOutcome {
+	if target, ok := lookup(targetID); ok {
+		return delivered(sendRelayed(target, targetID, msg))
+	}
+	if pendingTTL == 0 {
+		countRelay(msgType(msg), false)
+		return relayDropped
+	}
+
+	var ackTo *client
+	if ackID(msg) != "" {
+		ackTo = sender
+	}
+	pendingMu.Lock()
+	// register publishes the target before it collects held messages, so
+	// checking again under pendingMu means nothing is held after the
+	// target has taken its backlog.
+	target, ok := lookup(targetID)
+	outcome := relayDropped
+	if !ok && hold(targetID, msg, ackTo, time.Now()) {
+		outcome = relayHeld
+	}
+	pendingMu.Unlock()
+	if ok {
+		return delivered(sendRelayed(target, targetID, msg))
+	}
+	return outcome
+}
+
+func delivered(ok bool) relayOutcome {
+	if ok {
+		return relayDelivered
+	}
+	return relayDropped
+}
+
+// hold queues msg for targetID, reporting whether there was room. Callers
+// hold pendingMu.
+func hold(targetID string, msg map[string]interface{}, ackTo *client, now time.Time) bool {
+	if _, ok := pending[targetID]; !ok && len(pending) >= maxPendingTargets {
+		expirePending(now)
+		if len(pending) >= maxPendingTargets {
+			log.Println("Pending relay buffer full, dropping message for", targetID)
+			countRelay(msgType(msg), false)
+			return false
+		}
+	}
+	queue := unexpired(pending[targetID], now)
+	if len(queue) >= maxPendingPerTarget {
+		log.Println("Too many pending messages for", targetID, "- dropping")
+		countRelay(msgType(msg), false)
+		return false
+	}
+	pending[targetID] = append(queue, pendingMsg{msg: msg, expires: now.Add(pendingTTL), ackTo: ackTo})
+	return true
+}
+
+// deliverPending sends c whatever was held for its ID before it joined.
+func deliverPending(c *client) {
+	if pendingTTL == 0 {
+		return
+	}
+	pendingMu.Lock()
+	queue := unexpired(pending[c.id], time.Now())
+	delete(pending, c.id)
+	pendingMu.Unlock()
+	for _, p := range queue {
+		ok := sendRelayed(c, c.id, p.msg)
+		if p.ackTo != nil {
+			sendAck(p.ackTo, ackID(p.msg), delivered(ok))
+		}
+	}
+}
+
+// expirePending drops every target whose held messages have all expired.
+// Callers hold pendingMu.
+func expirePending(now time.Time) {
+	for id, queue := range pending {
+		if len(unexpired(queue, now)) == 0 {
+			delete(pending, id)
+		}
+	}
+}
+
+// unexpired drops expired messages from the front of queue. Messages are
+// held in arrival order with the same TTL, so they expire front to back.
+func unexpired(queue []pendingMsg, now time.Time) []pendingMsg {
+	for len(queue) > 0 && !now.Before(queue[0].expires) {
+		queue = queue[1:]
+	}
+	return queue
+}
+
+func sendRelayed(target *client, targetID string, msg map[string]interface{}) bool {
+	err := target.send(msg)
+	if err != nil {
+		log.Println("Write to", targetID, "failed:", err)
+	}
+	countRelay(msgType(msg), err == nil)
+	if err == nil {
+		target.stats.received.Add(1)
+	}
+	return err == nil
+}
+
+func msgType(msg map[string]interface{}) string {
+	t, _ := msg["type"].(string)
+	return t
+}
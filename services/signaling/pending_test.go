@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignalBeforeTargetJoins(t *testing.T) {
+	setting(t, &pendingTTL, time.Second)
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	for k := range maxPendingPerTarget + 1 {
+		caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "seq": k})
+	}
+	// Make sure every signal was handled before the target joins.
+	caller.send(map[string]interface{}{"type": "get_stats"})
+	stats := caller.expect("stats")
+	if relayed := stats["relayed"].(map[string]interface{}); relayed["held"] != float64(maxPendingPerTarget) || relayed["dropped"] != float64(1) {
+		t.Errorf("relayed = %v, want %d held and 1 dropped", relayed, maxPendingPerTarget)
+	}
+
+	// The joined confirmation comes first, then the held signals in order.
+	backend := join(t, srv, "backend-1", nil)
+	for k := range maxPendingPerTarget {
+		if got := backend.expect("signal"); got["seq"] != float64(k) || got["from"] != "iphone-1" {
+			t.Fatalf("held signal %d delivered as %v", k, got)
+		}
+	}
+	backend.expectNothing(100 * time.Millisecond)
+}
+
+func TestHeldSignalExpires(t *testing.T) {
+	setting(t, &pendingTTL, 50*time.Millisecond)
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1"})
+	caller.send(map[string]interface{}{"type": "get_stats"})
+	caller.expect("stats")
+	time.Sleep(2 * pendingTTL)
+
+	backend := join(t, srv, "backend-1", nil)
+	backend.expectNothing(100 * time.Millisecond)
+}
+
+func TestSignalNotHeldByDefault(t *testing.T) {
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1"})
+	caller.send(map[string]interface{}{"type": "get_stats"})
+	if relayed := caller.expect("stats")["relayed"].(map[string]interface{}); relayed["dropped"] != float64(1) {
+		t.Errorf("relayed = %v, want the signal dropped", relayed)
+	}
+
+	backend := join(t, srv, "backend-1", nil)
+	backend.expectNothing(100 * time.Millisecond)
+}
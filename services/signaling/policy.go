@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// RelayPolicy reports whether peer from may send signals to peer to.
+// A nil policy allows every relay.
+type RelayPolicy func(from, to string) bool
+
+// relayRule allows any source matching From to target any destination
+// matching To. Both are path.Match patterns, e.g. "iphone-*".
+type relayRule struct {
+	From, To string
+}
+
+// parseRelayPolicy builds a policy from a comma-separated list of
+// "from>to" rules, for example "iphone-*>backend-*,web-*>backend-*".
+// A relay is allowed if any rule matches; everything else is denied.
+// An empty spec yields a nil (allow-all) policy.
+func parseRelayPolicy(spec string) (RelayPolicy, error) {
+	var rules []relayRule
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(field, ">")
+		if !ok {
+			return nil, fmt.Errorf("relay rule %q: want from>to", field)
+		}
+		rule := relayRule{From: strings.TrimSpace(from), To: strings.TrimSpace(to)}
+		for _, pattern := range []string{rule.From, rule.To} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("relay rule %q: %w", field, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return func(from, to string) bool {
+		for _, rule := range rules {
+			fromOK, _ := path.Match(rule.From, from)
+			toOK, _ := path.Match(rule.To, to)
+			if fromOK && toOK {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
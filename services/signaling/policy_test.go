@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRelayPolicy(t *testing.T) {
+	policy, err := parseRelayPolicy("iphone-*>backend-*, web-* > backend-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from, to string
+		want     bool
+	}{
+		{"iphone-1", "backend-1", true},
+		{"web-7", "backend-2", true},
+		{"iphone-1", "iphone-2", false},
+		{"backend-1", "iphone-1", false},
+		{"android-1", "backend-1", false},
+	} {
+		if got := policy(tc.from, tc.to); got != tc.want {
+			t.Errorf("%s -> %s allowed = %v, want %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+
+	if policy, err := parseRelayPolicy(" , "); err != nil || policy != nil {
+		t.Errorf("empty spec: got a policy (%v), want allow-all", err)
+	}
+	for _, spec := range []string{"iphone-*", "iphone-[>backend-*"} {
+		if _, err := parseRelayPolicy(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func TestRelayPolicyDeniesRelay(t *testing.T) {
+	policy, err := parseRelayPolicy("iphone-*>backend-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting(t, &relayPolicy, policy)
+	srv := newTestServer(t)
+	iphone := join(t, srv, "iphone-1", nil)
+	other := join(t, srv, "iphone-2", nil)
+	backend := join(t, srv, "backend-1", nil)
+
+	iphone.send(map[string]interface{}{"type": "signal", "to": "backend-1", "data": "offer"})
+	if got := backend.expect("signal"); got["data"] != "offer" {
+		t.Errorf("backend got %v", got)
+	}
+
+	iphone.send(map[string]interface{}{"type": "signal", "to": "iphone-2", "data": "offer"})
+	if got := iphone.expect("error"); got["error"] != "relay to iphone-2 not allowed" {
+		t.Errorf("sender got %v", got)
+	}
+	other.expectNothing(100 * time.Millisecond)
+}
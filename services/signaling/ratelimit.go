@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// rateLimitAction is what happens to a peer sending faster than
+// maxMessageRate; see RATE_LIMIT_ACTION.
+type rateLimitAction string
+
+const (
+	rateLimitDrop       rateLimitAction = "drop"       // discard the excess messages
+	rateLimitDisconnect rateLimitAction = "disconnect" // close the offender's connection
+)
+
+// maxMessageRate caps the messages per second read from each peer; zero
+// means unlimited. rateLimit is what happens beyond it. See
+// MAX_MESSAGES_PER_SEC and RATE_LIMIT_ACTION.
+var (
+	maxMessageRate int
+	rateLimit      = rateLimitDrop
+)
+
+func parseRateLimitAction(v string) (rateLimitAction, error) {
+	switch a := rateLimitAction(v); a {
+	case rateLimitDrop, rateLimitDisconnect:
+		return a, nil
+	}
+	return "", fmt.Errorf("%q is not drop or disconnect", v)
+}
+
+// messageBucket is a token bucket of messages refilled at rate per second,
+// holding at most one second's worth.
+type messageBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newMessageBucket(perSec int) *messageBucket {
+	return &messageBucket{rate: float64(perSec), tokens: float64(perSec), last: time.Now()}
+}
+
+// allow takes a message from the bucket, reporting false if it is empty.
+func (b *messageBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// overLimit reports whether c's latest message exceeds its message rate,
+// applying rateLimit if so. After a disconnect the caller stops serving c.
+func overLimit(c *client) (limited, disconnect bool) {
+	if c.inbound == nil || c.inbound.allow() {
+		c.limited = false
+		return false, false
+	}
+	if rateLimit == rateLimitDisconnect {
+		log.Println("Disconnecting peer over the message rate:", describe(c))
+		sendError(c, closeRateExceeded.text)
+		sendClose(c.conn, closeRateExceeded)
+		return true, true
+	}
+	// Log once per burst rather than for every dropped message.
+	if !c.limited {
+		log.Println("Dropping messages over the rate limit from", describe(c))
+		c.limited = true
+	}
+	return true, false
+}
+
+// describe names c in logs, before or after it has joined.
+func describe(c *client) string {
+	if c.id == "" {
+		return "unjoined peer"
+	}
+	return c.id
+}
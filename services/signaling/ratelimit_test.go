@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitDrop(t *testing.T) {
+	setting(t, &maxMessageRate, 5)
+	srv := newTestServer(t)
+	backend := join(t, srv, "backend-1", nil)
+	caller := join(t, srv, "iphone-1", nil)
+
+	for k := range 20 {
+		caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "seq": k})
+	}
+	// Once the bucket has refilled, the caller is served again.
+	time.Sleep(1100 * time.Millisecond)
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1", "seq": -1})
+
+	// The join took one of the five; the burst gets the rest.
+	delivered := 0
+	for {
+		got := backend.expect("signal")
+		if got["seq"] == float64(-1) {
+			break
+		}
+		delivered++
+	}
+	if delivered < maxMessageRate-2 || delivered > maxMessageRate {
+		t.Errorf("%d of a burst of 20 signals delivered at 5 messages/s", delivered)
+	}
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	setting(t, &maxMessageRate, 5)
+	setting(t, &rateLimit, rateLimitDisconnect)
+	srv := newTestServer(t)
+	caller := join(t, srv, "iphone-1", nil)
+
+	for range 20 {
+		caller.send(map[string]interface{}{"type": "get_stats"})
+	}
+	for {
+		got := caller.read()
+		if got["type"] == "error" {
+			if got["error"] != closeRateExceeded.text {
+				t.Errorf("got %v", got)
+			}
+			break
+		}
+	}
+	if code, _ := caller.closeCode(); code != closeRateExceeded.code {
+		t.Errorf("closed with %d, want %d", code, closeRateExceeded.code)
+	}
+	if _, ok := lookup("iphone-1"); ok {
+		t.Error("a peer disconnected for its rate is still registered")
+	}
+}
+
+func TestParseRateLimitAction(t *testing.T) {
+	for _, v := range []string{"drop", "disconnect"} {
+		if a, err := parseRateLimitAction(v); err != nil || string(a) != v {
+			t.Errorf("%q: got %q, %v", v, a, err)
+		}
+	}
+	if _, err := parseRateLimitAction("ban"); err == nil {
+		t.Error(`"ban": want an error`)
+	}
+}
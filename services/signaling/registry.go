@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SignalConn is the part of a WebSocket connection the relay uses, so a
+// fake can stand in for *websocket.Conn in tests.
+type SignalConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// client is one connected peer. Writes go through send because relays from
+// other peers' goroutines and this peer's own replies can overlap, and a
+// websocket allows only one concurrent writer.
+type client struct {
+	conn SignalConn
+
+	// Set on join; read by other goroutines only via the registry.
+	id   string
+	meta map[string]string
+	room string // optional; scopes broadcasts
+	role string // "backend", "client" or unset; see roles.go
+
+	// outbound caps the bytes written to this peer; nil means unlimited.
+	// With a cap, writes it holds back wait in queue for writeLoop, which
+	// runs until done is closed.
+	outbound *byteBucket
+	queue    chan throttledWrite
+	done     chan struct{}
+	// inbound caps the messages read from it, and limited notes it is
+	// over; only serveClient touches either.
+	inbound *messageBucket
+	limited bool
+
+	stats peerStats
+
+	writeMu sync.Mutex
+}
+
+func newClient(conn SignalConn) *client {
+	c := &client{conn: conn}
+	c.stats.connectedAt = time.Now()
+	if relayByteRate > 0 {
+		c.outbound = newByteBucket(relayByteRate)
+		c.queue = make(chan throttledWrite, maxThrottledWrites)
+		c.done = make(chan struct{})
+		go c.writeLoop()
+	}
+	if maxMessageRate > 0 {
+		c.inbound = newMessageBucket(maxMessageRate)
+	}
+	return c
+}
+
+// send writes v to the peer as JSON.
+func (c *client) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, data)
+}
+
+// write sends one message of messageType to the peer. When the peer has a
+// byte budget, the message is queued for writeLoop to send once the budget
+// allows, so the caller, often another peer's read loop, never waits on
+// it. It is dropped with errThrottled if that would take longer than
+// maxThrottleDelay.
+func (c *client) write(messageType int, data []byte) error {
+	if c.outbound != nil {
+		return c.enqueue(messageType, data)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// close stops the client's writer, if it has one. Queued writes are
+// dropped along with the connection.
+func (c *client) close() {
+	if c.done != nil {
+		close(c.done)
+	}
+}
+
+// peerInfo is how a peer is described in presence events and /peers.
+type peerInfo struct {
+	ID   string            `json:"id"`
+	Meta map[string]string `json:"meta,omitempty"`
+	Room string            `json:"room,omitempty"`
+	Role string            `json:"role,omitempty"`
+}
+
+func (c *client) info() peerInfo {
+	return peerInfo{ID: c.id, Meta: c.meta, Room: c.room, Role: c.role}
+}
+
+var (
+	peersMu sync.RWMutex
+	peers   = make(map[string]*client)
+)
+
+// register adds c under its ID, replacing any earlier connection that
+// joined with the same ID.
+func register(c *client) {
+	peersMu.Lock()
+	peers[c.id] = c
+	peersMu.Unlock()
+	confirmJoin(c)
+	broadcastPresence("joined", c)
+	deliverPending(c)
+}
+
+// confirmJoin tells c its join succeeded, ahead of anything relayed to it.
+// serverTime, in Unix milliseconds, lets the client estimate clock skew.
+func confirmJoin(c *client) {
+	msg := map[string]interface{}{"type": "joined", "id": c.id, "serverTime": time.Now().UnixMilli()}
+	if err := c.send(msg); err != nil {
+		log.Println("Write join confirmation to", c.id, "failed:", err)
+	}
+}
+
+// unregister removes c if it is still the connection registered under its
+// ID, and reports whether it was.
+func unregister(c *client) bool {
+	peersMu.Lock()
+	current, ok := peers[c.id]
+	if ok && current == c {
+		delete(peers, c.id)
+	}
+	peersMu.Unlock()
+	if ok && current == c {
+		broadcastPresence("left", c)
+		return true
+	}
+	return false
+}
+
+func lookup(id string) (*client, bool) {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	c, ok := peers[id]
+	return c, ok
+}
+
+// connected returns every registered peer, sorted by ID.
+func connected() []*client {
+	peersMu.RLock()
+	out := make([]*client, 0, len(peers))
+	for _, c := range peers {
+		out = append(out, c)
+	}
+	peersMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// broadcastPresence tells every other peer allowed to see c that c joined
+// or left.
+func broadcastPresence(event string, c *client) {
+	msg := map[string]interface{}{"type": "presence", "event": event, "peer": c.info()}
+	for _, other := range connected() {
+		if other == c || !seesPresenceOf(other, c) {
+			continue
+		}
+		if err := other.send(msg); err != nil {
+			log.Println("Presence to", other.id, "failed:", err)
+		}
+	}
+}
+
+// handlePeers serves the admin listing of connected peers.
+func handlePeers(w http.ResponseWriter, r *http.Request) {
+	list := []peerInfo{}
+	for _, c := range connected() {
+		list = append(list, c.info())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+const (
+	maxMetaKeys  = 16
+	maxMetaBytes = 1024
+)
+
+// parseMeta validates the optional "meta" field of a join: a flat object of
+// string values, bounded in key count and encoded size.
+func parseMeta(raw interface{}) (map[string]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("meta must be an object")
+	}
+	if len(obj) > maxMetaKeys {
+		return nil, fmt.Errorf("meta has %d keys, max %d", len(obj), maxMetaKeys)
+	}
+	meta := make(map[string]string, len(obj))
+	for k, v := range obj {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("meta %q must be a string", k)
+		}
+		meta[k] = s
+	}
+	if encoded, _ := json.Marshal(meta); len(encoded) > maxMetaBytes {
+		return nil, fmt.Errorf("meta is %d bytes, max %d", len(encoded), maxMetaBytes)
+	}
+	return meta, nil
+}
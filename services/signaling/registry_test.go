@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMeta(t *testing.T) {
+	tooMany := map[string]interface{}{}
+	for i := range maxMetaKeys + 1 {
+		tooMany[fmt.Sprint("k", i)] = "v"
+	}
+	for _, tc := range []struct {
+		name    string
+		raw     interface{}
+		want    map[string]string
+		wantErr string
+	}{
+		{"absent", nil, nil, ""},
+		{"strings", map[string]interface{}{"device": "iphone", "app": "1.2"}, map[string]string{"device": "iphone", "app": "1.2"}, ""},
+		{"not an object", "iphone", nil, "meta must be an object"},
+		{"nested", map[string]interface{}{"device": map[string]interface{}{}}, nil, `meta "device" must be a string`},
+		{"too many keys", tooMany, nil, "meta has 17 keys, max 16"},
+		{"too large", map[string]interface{}{"blob": strings.Repeat("x", maxMetaBytes)}, nil, "max 1024"},
+	} {
+		got, err := parseMeta(tc.raw)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, %v, want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestJoinMeta(t *testing.T) {
+	srv := newTestServer(t)
+	watcher := join(t, srv, "backend-1", nil)
+	join(t, srv, "iphone-1", map[string]interface{}{"meta": map[string]interface{}{"device": "iphone"}})
+
+	presence := watcher.expect("presence")
+	peer, _ := presence["peer"].(map[string]interface{})
+	if presence["event"] != "joined" || peer["id"] != "iphone-1" || !reflect.DeepEqual(peer["meta"], map[string]interface{}{"device": "iphone"}) {
+		t.Errorf("presence = %v", presence)
+	}
+
+	var list []peerInfo
+	getJSON(t, srv.URL+"/peers", &list)
+	want := []peerInfo{{ID: "backend-1"}, {ID: "iphone-1", Meta: map[string]string{"device": "iphone"}}}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("/peers = %+v, want %+v", list, want)
+	}
+
+	bad := dial(t, srv)
+	bad.send(map[string]interface{}{"type": "join", "id": "iphone-2", "meta": map[string]interface{}{"device": 7}})
+	if got := bad.expect("error"); got["error"] != `invalid meta: meta "device" must be a string` {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := lookup("iphone-2"); ok {
+		t.Error("a join with invalid meta registered the peer")
+	}
+}
+
+func TestSecondJoinRejected(t *testing.T) {
+	srv := newTestServer(t)
+	p := join(t, srv, "iphone-1", nil)
+	p.send(map[string]interface{}{"type": "join", "id": "iphone-2"})
+	if got := p.expect("error"); got["error"] != "already joined as iphone-1" {
+		t.Errorf("got %v", got)
+	}
+	var list []peerInfo
+	getJSON(t, srv.URL+"/peers", &list)
+	if len(list) != 1 || list[0].ID != "iphone-1" {
+		t.Errorf("/peers = %+v, want just iphone-1", list)
+	}
+}
+
+func TestJoinConfirmed(t *testing.T) {
+	srv := newTestServer(t)
+	p := dial(t, srv)
+	before := time.Now().UnixMilli()
+	p.send(map[string]interface{}{"type": "join", "id": "iphone-1"})
+	got := p.read()
+	after := time.Now().UnixMilli()
+	if got["type"] != "joined" || got["id"] != "iphone-1" {
+		t.Fatalf("first reply to a join = %v", got)
+	}
+	if at, _ := got["serverTime"].(float64); int64(at) < before || int64(at) > after {
+		t.Errorf("serverTime %v outside the join's round trip [%d, %d]", got["serverTime"], before, after)
+	}
+
+	rejected := dial(t, srv)
+	rejected.send(map[string]interface{}{"type": "join"})
+	if got := rejected.read(); got["type"] != "error" {
+		t.Errorf("a join with no id was answered with %v", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+// Peers may say what they are when they join: "backend" for answering
+// services, "client" for end-user devices, "observer" for monitors such as
+// the debug page. With ENFORCE_ROLES set, a client may only signal
+// backends, and only backends and observers are told about clients coming
+// and going. Observers are otherwise clients: no one may signal them and
+// they may only signal backends. A peer that gives no role counts as a
+// client there.
+const (
+	roleBackend  = "backend"
+	roleClient   = "client"
+	roleObserver = "observer"
+)
+
+// enforceRoles turns on the role rules above; see ENFORCE_ROLES.
+var enforceRoles bool
+
+func validateRole(role string) error {
+	switch role {
+	case "", roleBackend, roleClient, roleObserver:
+		return nil
+	}
+	return fmt.Errorf("role %q must be %q, %q or %q", role, roleBackend, roleClient, roleObserver)
+}
+
+func (c *client) isBackend() bool {
+	return c.role == roleBackend
+}
+
+// roleAllows reports whether the role rules let from relay to the peer
+// registered as targetID. A client's target must be a connected backend.
+func roleAllows(from *client, targetID string) bool {
+	if !enforceRoles || from.isBackend() {
+		return true
+	}
+	target, ok := lookup(targetID)
+	return ok && roleAllowsTo(from, target)
+}
+
+func roleAllowsTo(from, to *client) bool {
+	return !enforceRoles || from.isBackend() || to.isBackend()
+}
+
+// seesPresenceOf reports whether observer is told when subject joins or
+// leaves.
+func seesPresenceOf(observer, subject *client) bool {
+	return !enforceRoles || subject.isBackend() || observer.isBackend() || observer.role == roleObserver
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnforceRoles(t *testing.T) {
+	setting(t, &enforceRoles, true)
+	srv := newTestServer(t)
+	backend := join(t, srv, "backend-1", map[string]interface{}{"role": "backend"})
+	caller := join(t, srv, "iphone-1", map[string]interface{}{"role": "client"})
+	unnamed := join(t, srv, "iphone-2", nil)
+	join(t, srv, "backend-2", map[string]interface{}{"role": "backend"})
+
+	// A client sees backends come and go, but not other clients.
+	got := caller.expect("presence")
+	if peer := got["peer"].(map[string]interface{}); peer["id"] != "backend-2" {
+		t.Errorf("client saw presence of %v, want only backend-2", peer["id"])
+	}
+	for _, want := range []string{"iphone-1", "iphone-2", "backend-2"} {
+		got := backend.expect("presence")
+		if peer := got["peer"].(map[string]interface{}); peer["id"] != want {
+			t.Errorf("backend saw presence of %v, want %s", peer["id"], want)
+		}
+	}
+
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1"})
+	backend.expect("signal")
+	caller.send(map[string]interface{}{"type": "signal", "to": "iphone-2"})
+	if got := caller.expect("error"); got["error"] != "relay to iphone-2 not allowed: clients may only signal backends" {
+		t.Errorf("got %v", got)
+	}
+	backend.send(map[string]interface{}{"type": "signal", "to": "iphone-2"})
+	unnamed.expect("signal")
+
+	var list []peerInfo
+	getJSON(t, srv.URL+"/peers", &list)
+	want := []peerInfo{{ID: "backend-1", Role: "backend"}, {ID: "backend-2", Role: "backend"}, {ID: "iphone-1", Role: "client"}, {ID: "iphone-2"}}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("/peers = %+v, want %+v", list, want)
+	}
+	caller.expectNothing(100 * time.Millisecond)
+}
+
+func TestInvalidRole(t *testing.T) {
+	srv := newTestServer(t)
+	p := dial(t, srv)
+	p.send(map[string]interface{}{"type": "join", "id": "iphone-1", "role": "admin"})
+	if got := p.expect("error"); got["error"] != `role "admin" must be "backend", "client" or "observer"` {
+		t.Errorf("got %v", got)
+	}
+}
+
+// An observer, such as the debug page, sees every peer come and go but is
+// a client otherwise: it can't be signaled and may only signal backends.
+func TestObserverRole(t *testing.T) {
+	setting(t, &enforceRoles, true)
+	srv := newTestServer(t)
+	observer := join(t, srv, "debug-ui-1", map[string]interface{}{"role": "observer"})
+	caller := join(t, srv, "iphone-1", map[string]interface{}{"role": "client"})
+	join(t, srv, "backend-1", map[string]interface{}{"role": "backend"})
+
+	for _, want := range []string{"iphone-1", "backend-1"} {
+		got := observer.expect("presence")
+		if peer := got["peer"].(map[string]interface{}); peer["id"] != want {
+			t.Errorf("observer saw presence of %v, want %s", peer["id"], want)
+		}
+	}
+
+	caller.send(map[string]interface{}{"type": "signal", "to": "debug-ui-1"})
+	if got := caller.expect("error"); got["error"] != "relay to debug-ui-1 not allowed: clients may only signal backends" {
+		t.Errorf("client signaling the observer got %v", got)
+	}
+	observer.send(map[string]interface{}{"type": "signal", "to": "iphone-1"})
+	if got := observer.expect("error"); got["error"] != "relay to iphone-1 not allowed: clients may only signal backends" {
+		t.Errorf("observer signaling a client got %v", got)
+	}
+	caller.expectNothing(100 * time.Millisecond)
+}
@@ -0,0 +1,48 @@
+package main
+
+import "log"
+
+// A peer may name a room when it joins. Rooms only scope broadcasts;
+// targeted relays and presence ignore them.
+
+// roomMembers returns the registered peers in room other than except,
+// as of one pass over the registry.
+func roomMembers(room string, except *client) []*client {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	var out []*client
+	for _, c := range peers {
+		if c.room == room && c != except {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// broadcast fans msg out to everyone else in sender's room, stamped with
+// the sender's joined ID, skipping members the relay policy or role rules
+// keep it from and carrying on past failed writes. Members are collected under the
+// registry lock but written to after it is released, so a slow or
+// throttled peer can't hold up joins.
+func broadcast(sender *client, msg map[string]interface{}) {
+	out := map[string]interface{}{
+		"type": "broadcast",
+		"from": sender.id,
+		"room": sender.room,
+		"data": msg["data"],
+	}
+	for _, member := range roomMembers(sender.room, sender) {
+		if (relayPolicy != nil && !relayPolicy(sender.id, member.id)) || !roleAllowsTo(sender, member) {
+			continue
+		}
+		if err := member.send(out); err != nil {
+			log.Println("Broadcast to", member.id, "failed:", err)
+			countRelay("broadcast", false)
+			sender.stats.dropped.Add(1)
+			continue
+		}
+		countRelay("broadcast", true)
+		sender.stats.sent.Add(1)
+		member.stats.received.Add(1)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBroadcastToRoom(t *testing.T) {
+	srv := newTestServer(t)
+	sender := join(t, srv, "iphone-1", map[string]interface{}{"room": "lobby"})
+	member := join(t, srv, "iphone-2", map[string]interface{}{"room": "lobby"})
+	other := join(t, srv, "backend-1", map[string]interface{}{"room": "kitchen"})
+	noRoom := join(t, srv, "backend-2", nil)
+
+	sender.send(map[string]interface{}{"type": "broadcast", "from": "backend-1", "room": "kitchen", "data": "hello"})
+	got := member.expect("broadcast")
+	if got["from"] != "iphone-1" || got["room"] != "lobby" || got["data"] != "hello" {
+		t.Errorf("member got %v, want it from iphone-1 in lobby", got)
+	}
+
+	noRoom.send(map[string]interface{}{"type": "broadcast", "data": "hello"})
+	if got := noRoom.expect("error"); got["error"] != "broadcast requires joining a room" {
+		t.Errorf("got %v", got)
+	}
+	sender.expectNothing(100 * time.Millisecond)
+	other.expectNothing(0)
+}
+
+func TestBroadcastSkipsDeniedMembers(t *testing.T) {
+	policy, err := parseRelayPolicy("iphone-*>backend-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting(t, &relayPolicy, policy)
+	srv := newTestServer(t)
+	sender := join(t, srv, "iphone-1", map[string]interface{}{"room": "lobby"})
+	backend := join(t, srv, "backend-1", map[string]interface{}{"room": "lobby"})
+	denied := join(t, srv, "iphone-2", map[string]interface{}{"room": "lobby"})
+
+	sender.send(map[string]interface{}{"type": "broadcast", "data": "hello"})
+	backend.expect("broadcast")
+	denied.expectNothing(100 * time.Millisecond)
+}
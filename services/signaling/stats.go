@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayStats counts relayed messages by type, for the debug UI and /stats.
+var relayStats = struct {
+	sync.Mutex
+	delivered map[string]int
+	dropped   map[string]int // no target connected, or the write failed
+}{delivered: make(map[string]int), dropped: make(map[string]int)}
+
+func countRelay(msgType string, ok bool) {
+	relayStats.Lock()
+	defer relayStats.Unlock()
+	if ok {
+		relayStats.delivered[msgType]++
+	} else {
+		relayStats.dropped[msgType]++
+	}
+}
+
+// handleStats serves the relay counters as JSON.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	peerCount := len(connected())
+	relayStats.Lock()
+	body := map[string]interface{}{
+		"peers":     peerCount,
+		"delivered": relayStats.delivered,
+		"dropped":   relayStats.dropped,
+	}
+	data, err := json.Marshal(body)
+	relayStats.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// peerStats is one connection's traffic through the server, reported to it
+// on get_stats so a client can diagnose its own session.
+type peerStats struct {
+	connectedAt time.Time
+	joinedAt    time.Time    // zero until it joins; set before it is registered
+	lastSeen    atomic.Int64 // Unix ms of the last message read from it
+
+	sent     atomic.Uint64 // its relays and broadcast copies delivered
+	held     atomic.Uint64 // its relays held for a target yet to join
+	dropped  atomic.Uint64 // its relays and broadcast copies not delivered
+	received atomic.Uint64 // relays and broadcasts delivered to it
+}
+
+// countOutcome records what became of one of the peer's relays.
+func (s *peerStats) countOutcome(outcome relayOutcome) {
+	switch outcome {
+	case relayDelivered:
+		s.sent.Add(1)
+	case relayHeld:
+		s.held.Add(1)
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// sendStats answers get_stats with c's own counters. lastSeen is when the
+// server read the message before the query, or zero if there was none.
+func sendStats(c *client, lastSeen int64) {
+	msg := map[string]interface{}{
+		"type":        "stats",
+		"id":          c.id,
+		"connectedAt": c.stats.connectedAt.UnixMilli(),
+		"serverTime":  time.Now().UnixMilli(),
+		"relayed": map[string]uint64{
+			"sent":     c.stats.sent.Load(),
+			"held":     c.stats.held.Load(),
+			"dropped":  c.stats.dropped.Load(),
+			"received": c.stats.received.Load(),
+		},
+	}
+	if !c.stats.joinedAt.IsZero() {
+		msg["joinedAt"] = c.stats.joinedAt.UnixMilli()
+	}
+	if lastSeen != 0 {
+		msg["lastSeen"] = lastSeen
+	}
+	if err := c.send(msg); err != nil {
+		log.Println("Write stats to", c.id, "failed:", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetStats(t *testing.T) {
+	srv := newTestServer(t)
+	caller := dial(t, srv)
+
+	// Allowed before joining, with no joinedAt or lastSeen yet.
+	caller.send(map[string]interface{}{"type": "get_stats"})
+	got := caller.expect("stats")
+	if got["id"] != "" || got["joinedAt"] != nil || got["lastSeen"] != nil || got["connectedAt"] == nil {
+		t.Errorf("stats before joining = %v", got)
+	}
+
+	caller.send(map[string]interface{}{"type": "join", "id": "iphone-1"})
+	caller.expect("joined")
+	backend := join(t, srv, "backend-1", nil)
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-1"})
+	caller.send(map[string]interface{}{"type": "signal", "to": "backend-2"})
+	backend.expect("signal")
+	backend.send(map[string]interface{}{"type": "signal", "to": "iphone-1"})
+	caller.expect("signal")
+
+	caller.send(map[string]interface{}{"type": "get_stats"})
+	got = caller.expect("stats")
+	wantRelayed := map[string]interface{}{"sent": 1.0, "held": 0.0, "dropped": 1.0, "received": 1.0}
+	if got["id"] != "iphone-1" || !reflect.DeepEqual(got["relayed"], wantRelayed) {
+		t.Errorf("stats = %v, want relayed %v", got, wantRelayed)
+	}
+	joinedAt, _ := got["joinedAt"].(float64)
+	lastSeen, _ := got["lastSeen"].(float64)
+	if joinedAt < got["connectedAt"].(float64) || lastSeen < joinedAt || got["serverTime"].(float64) < lastSeen {
+		t.Errorf("want connectedAt <= joinedAt <= lastSeen <= serverTime, got %v", got)
+	}
+
+	var totals struct {
+		Peers     int            `json:"peers"`
+		Delivered map[string]int `json:"delivered"`
+		Dropped   map[string]int `json:"dropped"`
+	}
+	getJSON(t, srv.URL+"/stats", &totals)
+	if totals.Peers != 2 || totals.Delivered["signal"] != 2 || totals.Dropped["signal"] != 1 {
+		t.Errorf("/stats = %+v", totals)
+	}
+}
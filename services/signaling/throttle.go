@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxThrottleDelay is how long a write may be held back to stay within a
+// peer's byte budget before it is dropped instead.
+const maxThrottleDelay = 2 * time.Second
+
+// maxThrottledWrites bounds the messages waiting on a peer's byte budget,
+// however small they are.
+const maxThrottledWrites = 256
+
+var (
+	errThrottled = errors.New("outbound byte budget exceeded")
+	errClosed    = errors.New("connection closed")
+)
+
+// throttledWrite is a message waiting for its slot in a peer's byte budget.
+type throttledWrite struct {
+	messageType int
+	data        []byte
+	due         time.Time
+}
+
+// enqueue reserves the message's bytes and queues it for writeLoop.
+func (c *client) enqueue(messageType int, data []byte) error {
+	wait, ok := c.outbound.reserve(len(data), maxThrottleDelay)
+	if !ok {
+		return errThrottled
+	}
+	select {
+	case <-c.done:
+		return errClosed
+	default:
+	}
+	select {
+	case c.queue <- throttledWrite{messageType, data, time.Now().Add(wait)}:
+		return nil
+	default:
+		return errThrottled
+	}
+}
+
+// writeLoop writes a throttled peer's queued messages in order, each once
+// its slot in the budget comes round, until the client is closed.
+func (c *client) writeLoop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var w throttledWrite
+		select {
+		case <-c.done:
+			return
+		case w = <-c.queue:
+		}
+		if wait := time.Until(w.due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-c.done:
+				return
+			case <-timer.C:
+			}
+		}
+		c.writeMu.Lock()
+		err := c.conn.WriteMessage(w.messageType, w.data)
+		c.writeMu.Unlock()
+		if err != nil {
+			log.Println("Throttled write failed:", err)
+		}
+	}
+}
+
+// byteBucket is a token bucket of bytes refilled at rate per second, holding
+// at most one second's worth. A write may overdraw it, which is what lets a
+// message larger than the bucket through; later writes then wait out the
+// debt.
+type byteBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(bytesPerSec int) *byteBucket {
+	return &byteBucket{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must
+// wait before writing them. If that would exceed maxWait, nothing is taken
+// and reserve reports false.
+func (b *byteBucket) reserve(n int, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens -= float64(n)
+	return wait, true
+}
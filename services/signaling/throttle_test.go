@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteBucket(t *testing.T) {
+	b := newByteBucket(1000)
+	for _, n := range []int{600, 400, 500} {
+		if wait, ok := b.reserve(n, time.Second); !ok || wait != 0 {
+			t.Fatalf("reserve(%d) within the burst = %v, %v; want no wait", n, wait, ok)
+		}
+	}
+	// The last reserve overdrew by 500 bytes: half a second at 1000 B/s.
+	wait, ok := b.reserve(100, time.Second)
+	if !ok || wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("reserve after an overdraw = %v, %v; want about 500ms", wait, ok)
+	}
+	if _, ok := b.reserve(100, 100*time.Millisecond); ok {
+		t.Error("reserve waiting past maxWait succeeded")
+	}
+}
+
+func TestThrottledRelay(t *testing.T) {
+	setting(t, &relayByteRate, 4000)
+	srv := newTestServer(t)
+	target := join(t, srv, "iphone-1", nil)
+	sender := join(t, srv, "backend-1", nil)
+	target.expect("presence")
+
+	// Each signal is about 3 KB, so at 4000 B/s after a one-second burst
+	// the fourth waits more than a second, and the fifth would wait past
+	// maxThrottleDelay and is dropped.
+	data := strings.Repeat("x", 3000)
+	start := time.Now()
+	for k := range 5 {
+		sender.send(map[string]interface{}{"type": "signal", "to": "iphone-1", "seq": k, "data": data})
+	}
+
+	// The signals wait on the target's budget, not in the sender's read
+	// loop, so the sender is answered straight away.
+	sender.send(map[string]interface{}{"type": "get_stats"})
+	sender.expect("stats")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("sender's get_stats answered after %v, behind the target's throttled writes", elapsed)
+	}
+
+	for k := range 4 {
+		if got := target.expect("signal"); got["seq"] != float64(k) {
+			t.Fatalf("signal %d arrived as %v", k, got["seq"])
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("four 3 KB signals arrived within %v at 4000 B/s", elapsed)
+	}
+	target.expectNothing(time.Second)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// handleUI serves the debug page at / and 404s everything else the root
+// pattern would otherwise catch.
+func handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFileFS(w, r, uiFiles, "ui/index.html")
+}